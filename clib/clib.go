@@ -97,3 +97,23 @@ func bdmUploadPackage(packageName *C.char, packageFolder *C.char, serverURL, api
 
 	return 0
 }
+
+// Resolves a version number or the name of a tag like "stable" of a remote package.
+// After successful resolution the output argument version will contain the version number the tag points to.
+// Return value will be zero when successful.
+//export bdmResolveVersion
+func bdmResolveVersion(packageName, versionOrTag *C.char, serverURL, apiToken *C.char, version *C.int) C.int {
+	goPackageName := C.GoString(packageName)
+	goVersionOrTag := C.GoString(versionOrTag)
+	goServerURL := C.GoString(serverURL)
+	goAPIToken := C.GoString(apiToken)
+
+	resolvedVersion, err := client.ResolveVersion(goServerURL, goAPIToken, goPackageName, goVersionOrTag)
+	if err != nil {
+		return 1
+	}
+
+	*version = C.int(resolvedVersion)
+
+	return 0
+}
@@ -5,11 +5,17 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -29,11 +35,17 @@ const packageNameSmall = "foo"
 const packageFolderSmall = "test/example"
 const packageNameBig = "bar"
 const packageFolderBig = "test/big"
+const packageNameChunked = "chunked"
+const packageFolderChunked = "test/chunked"
 const unzipFolder = "test/unzipped"
+const packageFolderMetadata = "test/metadata"
 
 // will be set later during test setup
 var readToken string
 var writeToken string
+var adminToken string
+var testUsers server.Users
+var testStore store.Store
 
 func TestServerClient(t *testing.T) {
 	// Prepare Cleanup
@@ -101,6 +113,504 @@ func TestServerJsonHandlers(t *testing.T) {
 	getAndCompareString(t, "/manifests/foo", readToken, "application/json", "[{\"Version\":1}]")
 }
 
+func TestServerDeleteAndYank(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	// Publish a small test package
+	publishSmallTestPackage(t)
+
+	// Yanking requires write permissions
+	httpRequestStatusCode(t, "PATCH", "/manifests/foo/1/yanked", readToken, `{"Yanked":true}`, 401)
+	httpRequestStatusCode(t, "PATCH", "/manifests/foo/1/yanked", writeToken, `{"Yanked":true}`, 200)
+	getAndCompareString(t, "/manifests/foo", readToken, "application/json", "[{\"Version\":1,\"Yanked\":true}]")
+
+	// Yanked versions can still be downloaded
+	httpGetStatusCode(t, "/manifests/foo/1", readToken, 200)
+
+	// Deleting requires admin permissions
+	httpRequestStatusCode(t, "DELETE", "/manifests/foo/1", writeToken, "", 401)
+	httpRequestStatusCode(t, "DELETE", "/manifests/foo/1", adminToken, "", 200)
+	httpRequestStatusCode(t, "DELETE", "/manifests/foo/1", adminToken, "", 404)
+	httpGetStatusCode(t, "/manifests/foo/1", readToken, 404)
+	getAndCompareString(t, "/manifests", readToken, "application/json", "[]")
+}
+
+func TestServerManifestVersions(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	// New packages are published with the latest manifest version
+	publishSmallTestPackage(t)
+	manifest, err := client.DownloadManifest(serverURL, readToken, packageNameSmall, 1)
+	util.AssertNoError(t, err)
+	util.Assert(t, manifest.ManifestVersion == bdm.LatestManifestVersion)
+
+	// Clients without version header get the first version
+	status, body, header := httpGetWithHeaders(t, "/manifests/foo/1", readToken, nil)
+	util.Assert(t, status == 200)
+	util.AssertEqualString(t, fmt.Sprint(bdm.LatestManifestVersion), header.Get(bdm.ManifestVersionHeader))
+	var oldManifest bdm.Manifest
+	util.AssertNoError(t, json.Unmarshal(body, &oldManifest))
+	util.Assert(t, oldManifest.ManifestVersion == bdm.ManifestVersion1)
+	util.AssertNoError(t, bdm.ValidatePublishedManifest(&oldManifest))
+	util.AssertEqualString(t, `"`+oldManifest.Hash+`"`, header.Get("ETag"))
+
+	status, body, _ = httpGetWithHeaders(t, "/manifests/foo/1", readToken,
+		map[string]string{bdm.ManifestVersionHeader: "2"})
+	util.Assert(t, status == 200)
+	var newManifest bdm.Manifest
+	util.AssertNoError(t, json.Unmarshal(body, &newManifest))
+	util.AssertEqualString(t, manifest.Hash, newManifest.Hash)
+
+	// Older clients can still publish manifests of the first version
+	unpublished := bdm.Manifest{ManifestVersion: bdm.ManifestVersion1, PackageName: packageNameSmall, Files: manifest.Files[:1]}
+	unpublished.Hash = bdm.HashManifest(&unpublished)
+	jsonData, err := json.Marshal(unpublished)
+	util.AssertNoError(t, err)
+	req, err := http.NewRequest("POST", serverURL+"/manifests", bytes.NewReader(jsonData))
+	util.AssertNoError(t, err)
+	req.Header.Set(bdm.ApiTokenHeader, writeToken)
+	res, err := http.DefaultClient.Do(req)
+	util.AssertNoError(t, err)
+	defer res.Body.Close()
+	util.Assert(t, res.StatusCode == 200)
+	var published bdm.Manifest
+	util.AssertNoError(t, json.NewDecoder(res.Body).Decode(&published))
+	util.Assert(t, published.ManifestVersion == bdm.ManifestVersion1)
+	util.AssertNoError(t, bdm.ValidatePublishedManifest(&published))
+	manifest, err = client.DownloadManifest(serverURL, readToken, packageNameSmall, 2)
+	util.AssertNoError(t, err)
+	util.Assert(t, manifest.ManifestVersion == bdm.LatestManifestVersion)
+}
+
+func TestServerPackageMetadata(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	// Publish a package with metadata and one without
+	publishBigTestPackage(t)
+	options := bdm.ManifestOptions{Description: "Nightly build", Labels: map[string]string{"git.commit": "abc"}}
+	manifest, err := client.UploadPackageWithOptions(packageNameSmall, packageFolderSmall, serverURL, writeToken, options)
+	util.AssertNoError(t, err)
+	util.AssertEqualString(t, "Nightly build", manifest.Description)
+	util.AssertEqualString(t, "abc", manifest.Labels["git.commit"])
+
+	// The server records the user and token of the publisher
+	util.AssertEqualString(t, "admin", manifest.Publisher)
+	util.Assert(t, len(manifest.PublisherToken) > 0)
+
+	// Listings can be filtered by labels and publisher
+	getAndCompareString(t, "/manifests?label=git.commit=abc", readToken, "application/json", `[{"Name":"foo"}]`)
+	getAndCompareString(t, "/manifests?label=git.commit", readToken, "application/json", `[{"Name":"foo"}]`)
+	getAndCompareString(t, "/manifests?label=git.commit=def", readToken, "application/json", "[]")
+	getAndCompareString(t, "/manifests?publisher=admin", readToken, "application/json", `[{"Name":"bar"},{"Name":"foo"}]`)
+	getAndCompareString(t, "/manifests/foo?publisher="+manifest.PublisherToken, readToken, "application/json", `[{"Version":1}]`)
+	getAndCompareString(t, "/manifests/bar?label=git.commit", readToken, "application/json", "[]")
+	httpGetStatusCode(t, "/manifests?label==abc", readToken, http.StatusBadRequest)
+
+	// Clients cannot choose the publisher
+	unpublished := bdm.Manifest{ManifestVersion: bdm.LatestManifestVersion, PackageName: packageNameSmall,
+		Files: manifest.Files[:1], Publisher: "someone"}
+	unpublished.Hash = bdm.HashManifest(&unpublished)
+	jsonData, err := json.Marshal(unpublished)
+	util.AssertNoError(t, err)
+	httpRequestStatusCode(t, "POST", "/manifests", writeToken, string(jsonData), http.StatusBadRequest)
+}
+
+func TestServerFileMetadata(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+	defer os.RemoveAll(outputFolder)
+	defer os.RemoveAll(packageFolderMetadata)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	// Prepare package with an executable file and a fixed modification time
+	toolPath := filepath.Join(packageFolderMetadata, "bin", "tool")
+	util.AssertNoError(t, os.MkdirAll(filepath.Dir(toolPath), os.ModePerm))
+	util.AssertNoError(t, generateTestFile(toolPath, 1000, 1))
+	util.AssertNoError(t, os.Chmod(toolPath, 0750))
+	modTime := time.Unix(1700000000, 0)
+	util.AssertNoError(t, os.Chtimes(toolPath, modTime, modTime))
+
+	options := bdm.ManifestOptions{FileMetadata: true}
+	manifest, err := client.UploadPackageWithOptions(packageNameSmall, packageFolderMetadata, serverURL, writeToken, options)
+	util.AssertNoError(t, err)
+	util.Assert(t, manifest.Files[0].ModTime == modTime.Unix())
+
+	// Metadata is only restored and checked when requested
+	err = client.DownloadPackage(outputFolder, serverURL, readToken, packageNameSmall, 1, false)
+	util.AssertNoError(t, err)
+	downloadOptions := client.DownloadOptions{FileMetadata: true}
+	err = client.CheckPackageWithOptions(outputFolder, serverURL, readToken, packageNameSmall, 1, downloadOptions)
+	util.AssertError(t, err)
+	err = client.DownloadPackageWithOptions(outputFolder, serverURL, readToken, packageNameSmall, 1, downloadOptions)
+	util.AssertNoError(t, err)
+	err = client.CheckPackageWithOptions(outputFolder, serverURL, readToken, packageNameSmall, 1, downloadOptions)
+	util.AssertNoError(t, err)
+	fileInfo, err := os.Stat(filepath.Join(outputFolder, "bin", "tool"))
+	util.AssertNoError(t, err)
+	util.Assert(t, fileInfo.ModTime().Equal(modTime))
+	if runtime.GOOS != "windows" {
+		util.Assert(t, fileInfo.Mode().Perm() == 0750)
+	}
+
+	// ZIP entries contain the metadata as well
+	for _, encoding := range []string{"gzip", "zstd"} {
+		body, _, err := httpGetWithEncoding("/zip/foo/1", readToken, encoding)
+		util.AssertNoError(t, err)
+		if encoding == "zstd" {
+			reader, err := util.CreateDecompressingReader(bytes.NewReader(body))
+			util.AssertNoError(t, err)
+			body, err = io.ReadAll(reader)
+			reader.Close()
+			util.AssertNoError(t, err)
+		}
+		zipReader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		util.AssertNoError(t, err)
+		util.Assert(t, zipReader.File[0].Mode().Perm() == os.FileMode(manifest.Files[0].Mode))
+		util.Assert(t, zipReader.File[0].Modified.Equal(modTime))
+	}
+}
+
+func TestServerReadOnlyFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("read-only files cannot be replaced on Windows")
+	}
+
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+	defer os.RemoveAll(outputFolder)
+	defer os.RemoveAll(cacheFolder)
+	defer os.RemoveAll(packageFolderMetadata)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	// Publish two versions with read-only files, the second file is a copy of the first one
+	options := bdm.ManifestOptions{FileMetadata: true}
+	util.AssertNoError(t, os.MkdirAll(packageFolderMetadata, os.ModePerm))
+	for seed := 1; seed <= 2; seed++ {
+		for _, name := range []string{"data", "copy"} {
+			filePath := filepath.Join(packageFolderMetadata, name)
+			os.Remove(filePath)
+			util.AssertNoError(t, generateTestFile(filePath, 1000, seed))
+			util.AssertNoError(t, os.Chmod(filePath, 0444))
+		}
+		_, err := client.UploadPackageWithOptions(packageNameSmall, packageFolderMetadata, serverURL, writeToken, options)
+		util.AssertNoError(t, err)
+	}
+
+	// Downloading another version into the same folder replaces the read-only files,
+	// with and without restoring them from the cache
+	for _, cache := range []string{"", cacheFolder} {
+		downloadOptions := client.DownloadOptions{FileMetadata: true, CacheFolder: cache}
+		for _, version := range []uint{1, 2, 1} {
+			err := client.DownloadPackageWithOptions(outputFolder, serverURL, readToken, packageNameSmall, version, downloadOptions)
+			util.AssertNoError(t, err)
+			err = client.CheckPackageWithOptions(outputFolder, serverURL, readToken, packageNameSmall, version, downloadOptions)
+			util.AssertNoError(t, err)
+		}
+		fileInfo, err := os.Stat(filepath.Join(outputFolder, "copy"))
+		util.AssertNoError(t, err)
+		util.Assert(t, fileInfo.Mode().Perm() == 0444)
+	}
+}
+
+func TestServerSymlinksAndFolders(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires special privileges on Windows")
+	}
+
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+	defer os.RemoveAll(outputFolder)
+	defer os.RemoveAll(packageFolderMetadata)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	// Prepare package with a relative symlink and an empty folder
+	libPath := filepath.Join(packageFolderMetadata, "lib", "libfoo.so.1")
+	util.AssertNoError(t, os.MkdirAll(filepath.Dir(libPath), os.ModePerm))
+	util.AssertNoError(t, os.MkdirAll(filepath.Join(packageFolderMetadata, "logs"), os.ModePerm))
+	util.AssertNoError(t, generateTestFile(libPath, 1000, 1))
+	util.AssertNoError(t, os.Symlink("libfoo.so.1", filepath.Join(packageFolderMetadata, "lib", "libfoo.so")))
+	manifest, err := client.UploadPackage(packageNameSmall, packageFolderMetadata, serverURL, writeToken)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(manifest.Symlinks) == 1 && len(manifest.Folders) == 1)
+
+	// Download, check and clean restore the complete folder
+	err = client.DownloadPackage(outputFolder, serverURL, readToken, packageNameSmall, 1, true)
+	util.AssertNoError(t, err)
+	err = client.CheckPackage(outputFolder, serverURL, readToken, packageNameSmall, 1, true)
+	util.AssertNoError(t, err)
+	target, err := os.Readlink(filepath.Join(outputFolder, "lib", "libfoo.so"))
+	util.AssertNoError(t, err)
+	util.AssertEqualString(t, "libfoo.so.1", target)
+	util.Assert(t, util.FolderExists(filepath.Join(outputFolder, "logs")))
+
+	// Clients without support for the new manifest version cannot get the package
+	httpGetStatusCode(t, "/manifests/foo/1", readToken, http.StatusNotAcceptable)
+
+	// ZIP contains the symlink with its target as content and the empty folder
+	body, _, err := httpGet("/zip/foo/1", readToken)
+	util.AssertNoError(t, err)
+	zipReader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	util.AssertNoError(t, err)
+	entries := make(map[string]*zip.File)
+	for _, zipFile := range zipReader.File {
+		entries[zipFile.Name] = zipFile
+	}
+	util.Assert(t, entries["logs/"] != nil && entries["logs/"].Mode().IsDir())
+	link := entries["lib/libfoo.so"]
+	util.Assert(t, link != nil && link.Mode()&os.ModeSymlink != 0)
+	reader, err := link.Open()
+	util.AssertNoError(t, err)
+	linkTarget, err := io.ReadAll(reader)
+	reader.Close()
+	util.AssertNoError(t, err)
+	util.AssertEqualString(t, "libfoo.so.1", string(linkTarget))
+}
+
+func TestServerSignedManifests(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+	defer os.RemoveAll(outputFolder)
+
+	// Creation and cleanup of server store with signing key
+	serverKey, serverPrivateKey, err := ed25519.GenerateKey(nil)
+	util.AssertNoError(t, err)
+	publisherKey, publisherPrivateKey, err := ed25519.GenerateKey(nil)
+	util.AssertNoError(t, err)
+	server, stopped := startTestingServerWithOptions(t, store.Options{SigningKey: serverPrivateKey})
+	defer stopTestingServer(server, stopped)
+
+	// Unsigned uploads are signed by the server
+	publishSmallTestPackage(t)
+	options := client.DownloadOptions{TrustedKeys: []ed25519.PublicKey{serverKey}, RequireSignature: true}
+	manifest, err := client.DownloadManifestWithOptions(serverURL, readToken, packageNameSmall, 1, options)
+	util.AssertNoError(t, err)
+	util.AssertEqualString(t, hex.EncodeToString(serverKey), manifest.Signature.PublicKey)
+	util.Assert(t, manifest.Signature.Versioned)
+	err = client.DownloadPackageWithOptions(outputFolder, serverURL, readToken, packageNameSmall, 1, options)
+	util.AssertNoError(t, err)
+	err = client.CheckPackageWithOptions(outputFolder, serverURL, readToken, packageNameSmall, 1, options)
+	util.AssertNoError(t, err)
+
+	// Untrusted signatures are refused
+	untrusted := client.DownloadOptions{TrustedKeys: []ed25519.PublicKey{publisherKey}}
+	_, err = client.DownloadManifestWithOptions(serverURL, readToken, packageNameSmall, 1, untrusted)
+	util.AssertError(t, err)
+	err = client.CheckPackageWithOptions(outputFolder, serverURL, readToken, packageNameSmall, 1, untrusted)
+	util.AssertError(t, err)
+
+	// Publishers can only sign with their registered keys
+	uploadOptions := bdm.ManifestOptions{SigningKey: publisherPrivateKey}
+	_, err = client.UploadPackageWithOptions(packageNameBig, packageFolderSmall, serverURL, writeToken, uploadOptions)
+	util.AssertError(t, err)
+	err = testUsers.SetSigningKeys("admin", []string{hex.EncodeToString(publisherKey)})
+	util.AssertNoError(t, err)
+	defer os.Remove("./users.json")
+	manifest, err = client.UploadPackageWithOptions(packageNameBig, packageFolderSmall, serverURL, writeToken, uploadOptions)
+	util.AssertNoError(t, err)
+	util.AssertNoError(t, bdm.VerifyManifestSignature(manifest, []ed25519.PublicKey{publisherKey}))
+	util.Assert(t, !manifest.Signature.Versioned)
+	_, err = client.DownloadManifestWithOptions(serverURL, readToken, packageNameBig, 1, untrusted)
+	util.AssertNoError(t, err)
+}
+
+func TestServerDiff(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+	defer os.RemoveAll(packageFolderMetadata)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	// Publish two versions with a renamed, a modified and an added file
+	util.AssertNoError(t, os.MkdirAll(filepath.Join(packageFolderMetadata, "sub"), os.ModePerm))
+	util.AssertNoError(t, generateTestFile(filepath.Join(packageFolderMetadata, "a.bin"), 1000, 1))
+	util.AssertNoError(t, generateTestFile(filepath.Join(packageFolderMetadata, "b.bin"), 500, 2))
+	_, err := client.UploadPackage(packageNameSmall, packageFolderMetadata, serverURL, writeToken)
+	util.AssertNoError(t, err)
+	util.AssertNoError(t, os.Rename(filepath.Join(packageFolderMetadata, "a.bin"), filepath.Join(packageFolderMetadata, "sub", "a.bin")))
+	util.AssertNoError(t, generateTestFile(filepath.Join(packageFolderMetadata, "b.bin"), 800, 3))
+	util.AssertNoError(t, generateTestFile(filepath.Join(packageFolderMetadata, "c.bin"), 100, 4))
+	_, err = client.UploadPackage(packageNameSmall, packageFolderMetadata, serverURL, writeToken)
+	util.AssertNoError(t, err)
+
+	diff, err := client.DiffPackage(serverURL, readToken, packageNameSmall, 1, 2)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(diff.Added) == 1 && diff.Added[0].Path == "c.bin")
+	util.Assert(t, len(diff.Removed) == 0)
+	util.Assert(t, len(diff.Modified) == 1 && diff.Modified[0].SizeDelta == 300)
+	util.Assert(t, len(diff.Renamed) == 1 && diff.Renamed[0].Old.Path == "a.bin" && diff.Renamed[0].New.Path == "sub/a.bin")
+	util.Assert(t, diff.SizeDelta == 400)
+
+	// Comparing a version with itself shows no differences
+	diff, err = client.DiffPackage(serverURL, readToken, packageNameSmall, 2, 2)
+	util.AssertNoError(t, err)
+	util.Assert(t, diff.Empty())
+
+	httpGetStatusCode(t, "/diff/foo/1/3", readToken, http.StatusNotFound)
+	httpGetStatusCode(t, "/diff/foo/X/2", readToken, http.StatusBadRequest)
+	httpGetStatusCode(t, "/diff/foo/1/2", "", http.StatusUnauthorized)
+}
+
+func TestServerDependencies(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+	defer os.RemoveAll(outputFolder)
+	defer os.RemoveAll(packageFolderMetadata)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	publish := func(name string, seed int, dependencies ...bdm.Dependency) {
+		t.Helper()
+		folder := filepath.Join(packageFolderMetadata, fmt.Sprint(seed))
+		util.AssertNoError(t, os.MkdirAll(folder, os.ModePerm))
+		util.AssertNoError(t, generateTestFile(filepath.Join(folder, name+".bin"), 1000, seed))
+		options := bdm.ManifestOptions{Dependencies: dependencies}
+		_, err := client.UploadPackageWithOptions(name, folder, serverURL, writeToken, options)
+		util.AssertNoError(t, err)
+	}
+	publish("zlib", 1)
+	publish("zlib", 2)
+	publish("zlib", 3)
+	publish("engine", 4, bdm.Dependency{PackageName: "zlib", Version: ">=1", Folder: "deps/zlib"})
+	publish("game", 5,
+		bdm.Dependency{PackageName: "engine", Version: "1", Folder: "engine"},
+		bdm.Dependency{PackageName: "zlib", Version: ">=1,<3", Folder: "zlib"})
+
+	// The direct dependency of the game selects the version for the whole tree
+	tree, err := client.DownloadPackageWithDependencies(outputFolder, serverURL, readToken, "game", 1, client.DownloadOptions{Clean: true})
+	util.AssertNoError(t, err)
+	util.AssertEqualString(t, "game 1\n  engine 1 (1) in engine\n    zlib 2 (>=1) in engine/deps/zlib\n  zlib 2 (>=1,<3) in zlib\n", tree.String())
+	util.Assert(t, util.FileExists(filepath.Join(outputFolder, "game.bin")))
+	util.Assert(t, util.FileExists(filepath.Join(outputFolder, "engine", "engine.bin")))
+	util.Assert(t, util.FileExists(filepath.Join(outputFolder, "engine", "deps", "zlib", "zlib.bin")))
+	util.Assert(t, util.FileExists(filepath.Join(outputFolder, "zlib", "zlib.bin")))
+	err = client.CheckPackage(outputFolder, serverURL, readToken, "game", 1, true)
+	util.AssertNoError(t, err)
+
+	// Yanked versions are skipped unless they are requested exactly
+	httpRequestStatusCode(t, "PATCH", "/manifests/zlib/2/yanked", writeToken, `{"Yanked":true}`, 200)
+	tree, err = client.ResolveDependencies(&bdm.Manifest{PackageName: "app", Dependencies: []bdm.Dependency{
+		{PackageName: "zlib", Version: "<3", Folder: "zlib"}}}, serverURL, readToken, client.DownloadOptions{})
+	util.AssertNoError(t, err)
+	util.Assert(t, tree.Dependencies[0].PackageVersion == 1)
+	err = client.CheckPackage(outputFolder, serverURL, readToken, "game", 1, true)
+	util.AssertError(t, err)
+
+	// Conflicting constraints are detected
+	publish("engine", 6, bdm.Dependency{PackageName: "zlib", Version: ">=3", Folder: "deps/zlib"})
+	publish("game", 7,
+		bdm.Dependency{PackageName: "zlib", Version: "1", Folder: "zlib"},
+		bdm.Dependency{PackageName: "engine", Version: "2", Folder: "engine"})
+	err = client.DownloadPackage(outputFolder, serverURL, readToken, "game", 2, false)
+	util.AssertError(t, err)
+	util.Assert(t, strings.Contains(err.Error(), "conflict"))
+
+	// Cycles are detected
+	publish("cycle-a", 8, bdm.Dependency{PackageName: "cycle-b", Version: "1", Folder: "b"})
+	publish("cycle-b", 9, bdm.Dependency{PackageName: "cycle-a", Version: "1", Folder: "a"})
+	err = client.DownloadPackage(outputFolder, serverURL, readToken, "cycle-a", 1, false)
+	util.AssertError(t, err)
+	util.Assert(t, strings.Contains(err.Error(), "cycle-a -> cycle-b -> cycle-a"))
+}
+
+func TestServerTags(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+	defer os.RemoveAll(unzipFolder)
+	defer os.RemoveAll(packageFolderMetadata)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	// Publish two versions of the same package
+	util.AssertNoError(t, os.MkdirAll(packageFolderMetadata, os.ModePerm))
+	util.AssertNoError(t, generateTestFile(filepath.Join(packageFolderMetadata, "a.bin"), 1000, 1))
+	_, err := client.UploadPackage(packageNameSmall, packageFolderMetadata, serverURL, writeToken)
+	util.AssertNoError(t, err)
+	util.AssertNoError(t, generateTestFile(filepath.Join(packageFolderMetadata, "a.bin"), 1000, 2))
+	_, err = client.UploadPackage(packageNameSmall, packageFolderMetadata, serverURL, writeToken)
+	util.AssertNoError(t, err)
+
+	// Moving tags requires write permissions and an existing version
+	httpRequestStatusCode(t, "PUT", "/tags/foo/stable", readToken, `{"Version":1}`, 401)
+	httpRequestStatusCode(t, "PUT", "/tags/foo/stable", writeToken, `{"Version":3}`, 404)
+	httpRequestStatusCode(t, "PUT", "/tags/foo/42", writeToken, `{"Version":1}`, 400)
+	util.AssertNoError(t, client.SetTag(serverURL, writeToken, packageNameSmall, "stable", 1))
+	util.AssertNoError(t, client.SetTag(serverURL, writeToken, packageNameSmall, "latest", 2))
+
+	// Tags are accepted everywhere versions are accepted
+	version, err := client.ResolveVersion(serverURL, readToken, packageNameSmall, "stable")
+	util.AssertNoError(t, err)
+	util.Assert(t, version == 1)
+	version, err = client.ResolveVersion(serverURL, readToken, packageNameSmall, "2")
+	util.AssertNoError(t, err)
+	util.Assert(t, version == 2)
+	_, err = client.ResolveVersion(serverURL, readToken, packageNameSmall, "unknown")
+	util.AssertError(t, err)
+	zipData, _, err := httpGet("/zip/foo/latest", readToken)
+	util.AssertNoError(t, err)
+	unzipAndCompare(t, zipData, packageNameSmall, packageFolderMetadata)
+	httpGetStatusCode(t, "/diff/foo/stable/latest", readToken, 200)
+	httpGetStatusCode(t, "/manifests/foo/unknown", readToken, 404)
+
+	// Manifests requested by tag must be revalidated
+	status, body, header := httpGetWithHeaders(t, "/manifests/foo/latest", readToken, nil)
+	util.Assert(t, status == 200)
+	var manifest bdm.Manifest
+	util.AssertNoError(t, json.Unmarshal(body, &manifest))
+	util.Assert(t, manifest.PackageVersion == 2)
+	util.AssertEqualString(t, "no-cache", header.Get("Cache-Control"))
+	util.AssertEqualString(t, `"`+manifest.Hash+`"`, header.Get("ETag"))
+
+	// Moving and removing tags is recorded in the history
+	util.AssertNoError(t, client.SetTag(serverURL, writeToken, packageNameSmall, "stable", 2))
+	httpRequestStatusCode(t, "DELETE", "/tags/foo/latest", readToken, "", 401)
+	httpRequestStatusCode(t, "DELETE", "/tags/foo/latest", writeToken, "", 200)
+	httpRequestStatusCode(t, "DELETE", "/tags/foo/latest", writeToken, "", 404)
+	httpGetStatusCode(t, "/manifests/foo/latest", readToken, 404)
+	tags, err := client.GetTags(serverURL, readToken, packageNameSmall)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(tags) == 2)
+	util.Assert(t, tags[0].Name == "latest" && tags[0].Version == 0 && len(tags[0].History) == 2)
+	util.Assert(t, tags[1].Name == "stable" && tags[1].Version == 2 && len(tags[1].History) == 2)
+	util.Assert(t, tags[1].History[0].Version == 1 && len(tags[1].History[0].User) > 0)
+
+	// Tags pointing to deleted versions cannot be resolved
+	httpRequestStatusCode(t, "DELETE", "/manifests/foo/2", adminToken, "", 200)
+	_, err = client.ResolveVersion(serverURL, readToken, packageNameSmall, "stable")
+	util.AssertError(t, err)
+	httpGetStatusCode(t, "/zip/foo/stable", readToken, 404)
+	httpGetStatusCode(t, "/tags/foo", "", 401)
+}
+
 func TestServerFileHandler(t *testing.T) {
 	// Prepare Cleanup
 	defer os.RemoveAll(storeFolder)
@@ -138,7 +648,7 @@ func TestServerFileHandler(t *testing.T) {
 	httpGetStatusCode(t, urlPath, readToken, 404)
 
 	// Invalid package version
-	urlPath = "/files/foo/no-number/213151e5833fecb107899dfd0c8baca0fb671d4017fbd9361c8007b7b93681a6/data.bin"
+	urlPath = "/files/foo/No-Number/213151e5833fecb107899dfd0c8baca0fb671d4017fbd9361c8007b7b93681a6/data.bin"
 	httpGetStatusCode(t, urlPath, readToken, 400)
 
 	// Wrong hash
@@ -181,6 +691,126 @@ func TestServerGzipFileHandler(t *testing.T) {
 	util.Assert(t, len(decompressed) == 1024)
 }
 
+func TestServerConditionalAndRangeRequests(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+	defer os.RemoveAll(packageFolderBig)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	// Publish test package
+	publishBigTestPackage(t)
+	data, err := os.ReadFile(filepath.Join(packageFolderBig, "testfile.dat"))
+	util.AssertNoError(t, err)
+
+	// Files use their hash as ETag and can be cached forever
+	hash := "e22e4bb46ad3e963fe059dcd969c036bd556a020d1de2d8cbd393a19ee74eb8c"
+	urlPath := "/files/bar/1/" + hash + "/testfile.dat"
+	status, body, headers := httpGetWithHeaders(t, urlPath, readToken, map[string]string{"Accept-Encoding": "identity"})
+	util.Assert(t, status == http.StatusOK)
+	util.Assert(t, bytes.Equal(body, data))
+	util.AssertEqualString(t, `"`+hash+`"`, headers.Get("ETag"))
+	util.AssertEqualString(t, "bytes", headers.Get("Accept-Ranges"))
+	util.Assert(t, strings.Contains(headers.Get("Cache-Control"), "immutable"))
+
+	// Encoded responses have their own ETag
+	_, headers, err = httpGet(urlPath, readToken)
+	util.AssertNoError(t, err)
+	util.AssertEqualString(t, `"`+hash+`-gzip"`, headers.Get("ETag"))
+
+	// Known ETags of all encodings are not sent again
+	for _, etag := range []string{`"` + hash + `"`, `"` + hash + `-gzip"`, `W/"foo", "` + hash + `-zstd"`} {
+		status, body, _ = httpGetWithHeaders(t, urlPath, readToken, map[string]string{"If-None-Match": etag})
+		util.Assert(t, status == http.StatusNotModified)
+		util.Assert(t, len(body) == 0)
+	}
+	status, _, _ = httpGetWithHeaders(t, urlPath, readToken, map[string]string{"If-None-Match": `"foo"`})
+	util.Assert(t, status == http.StatusOK)
+
+	// Range requests are answered uncompressed
+	rangeHeaders := map[string]string{"Range": "bytes=100-199", "Accept-Encoding": "gzip, zstd"}
+	status, body, headers = httpGetWithHeaders(t, urlPath, readToken, rangeHeaders)
+	util.Assert(t, status == http.StatusPartialContent)
+	util.Assert(t, bytes.Equal(body, data[100:200]))
+	util.AssertEqualString(t, "bytes 100-199/1024", headers.Get("Content-Range"))
+	util.AssertEqualString(t, "", headers.Get("Content-Encoding"))
+
+	// Resuming with an outdated ETag returns the complete file
+	rangeHeaders = map[string]string{"Range": "bytes=1000-", "If-Range": `"foo"`}
+	status, body, _ = httpGetWithHeaders(t, urlPath, readToken, rangeHeaders)
+	util.Assert(t, status == http.StatusOK)
+	util.Assert(t, bytes.Equal(body, data))
+	rangeHeaders["If-Range"] = `"` + hash + `"`
+	status, body, _ = httpGetWithHeaders(t, urlPath, readToken, rangeHeaders)
+	util.Assert(t, status == http.StatusPartialContent)
+	util.Assert(t, bytes.Equal(body, data[1000:]))
+
+	status, _, _ = httpGetWithHeaders(t, urlPath, readToken, map[string]string{"Range": "bytes=2000-"})
+	util.Assert(t, status == http.StatusRequestedRangeNotSatisfiable)
+
+	// Manifests use their hash as ETag
+	manifest, err := client.DownloadManifest(serverURL, readToken, packageNameBig, 1)
+	util.AssertNoError(t, err)
+	versionHeader := fmt.Sprint(bdm.LatestManifestVersion)
+	status, body, headers = httpGetWithHeaders(t, "/manifests/bar/1", readToken,
+		map[string]string{bdm.ManifestVersionHeader: versionHeader})
+	util.Assert(t, status == http.StatusOK)
+	util.AssertEqualString(t, `"`+manifest.Hash+`"`, headers.Get("ETag"))
+	status, _, _ = httpGetWithHeaders(t, "/manifests/bar/1", readToken,
+		map[string]string{bdm.ManifestVersionHeader: versionHeader, "If-None-Match": headers.Get("ETag")})
+	util.Assert(t, status == http.StatusNotModified)
+	status, rangeBody, _ := httpGetWithHeaders(t, "/manifests/bar/1", readToken,
+		map[string]string{bdm.ManifestVersionHeader: versionHeader, "Range": "bytes=0-9"})
+	util.Assert(t, status == http.StatusPartialContent)
+	util.Assert(t, bytes.Equal(rangeBody, body[:10]))
+}
+
+func TestServerZstdFileHandler(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+	defer os.RemoveAll(packageFolderBig)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	// Publish test package
+	publishBigTestPackage(t)
+
+	// ZSTD is preferred over gzip if supported
+	hash := "e22e4bb46ad3e963fe059dcd969c036bd556a020d1de2d8cbd393a19ee74eb8c"
+	urlPath := "/files/bar/1/" + hash + "/testfile.dat"
+	body, headers, err := httpGetWithEncoding(urlPath, readToken, "gzip, deflate, br, zstd")
+	util.AssertNoError(t, err)
+	util.AssertEqualString(t, "zstd", headers["Content-Encoding"][0])
+
+	// The stored object is sent without recompression
+	stored, err := os.ReadFile(filepath.Join(storeFolder, "objects", hash[:2], hash[2:]))
+	util.AssertNoError(t, err)
+	util.Assert(t, bytes.Equal(body, stored))
+
+	reader, err := util.CreateDecompressingReader(bytes.NewReader(body))
+	util.AssertNoError(t, err)
+	defer reader.Close()
+	decompressed, err := io.ReadAll(reader)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(decompressed) == 1024)
+
+	// ZIP files contain the stored object frames as well
+	defer os.RemoveAll(unzipFolder)
+	body, _, err = httpGetWithEncoding("/zip/bar/1", readToken, "zstd")
+	util.AssertNoError(t, err)
+	util.Assert(t, bytes.Contains(body, stored))
+	zipReader, err := util.CreateDecompressingReader(bytes.NewReader(body))
+	util.AssertNoError(t, err)
+	defer zipReader.Close()
+	decompressed, err = io.ReadAll(zipReader)
+	util.AssertNoError(t, err)
+	unzipAndCompare(t, decompressed, packageNameBig, packageFolderBig)
+}
+
 func TestServerZipHandler(t *testing.T) {
 	// Prepare Cleanup
 	defer os.RemoveAll(storeFolder)
@@ -204,8 +834,27 @@ func TestServerZipHandler(t *testing.T) {
 	// Download name must be <package>.<version>.zip
 	util.AssertEqualString(t, "attachment; filename=\"foo.v1.zip\"", headers["Content-Disposition"][0])
 
-	// Open returned body as ZIP archive
-	zipReader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	// Unzip and compare with original folder
+	unzipAndCompare(t, body, packageNameSmall, packageFolderSmall)
+
+	// Request ZSTD compressed ZIP with uncompressed entries
+	os.RemoveAll(unzipFolder)
+	body, headers, err = httpGetWithEncoding(urlPath, readToken, "zstd, gzip")
+	util.AssertNoError(t, err)
+	util.AssertEqualString(t, "zstd", headers["Content-Encoding"][0])
+	reader, err := util.CreateDecompressingReader(bytes.NewReader(body))
+	util.AssertNoError(t, err)
+	defer reader.Close()
+	decompressed, err := io.ReadAll(reader)
+	util.AssertNoError(t, err)
+	unzipAndCompare(t, decompressed, packageNameSmall, packageFolderSmall)
+}
+
+func unzipAndCompare(t *testing.T, zipData []byte, packageName, packageFolder string) {
+	t.Helper()
+
+	// Open data as ZIP archive
+	zipReader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
 	util.AssertNoError(t, err)
 
 	// Read all files from ZIP
@@ -224,14 +873,184 @@ func TestServerZipHandler(t *testing.T) {
 	}
 
 	// Generate manifests for original and unzipped folder and compare
-	manifestOrg, err := bdm.GenerateManifest(packageNameSmall, packageFolderSmall)
+	manifestOrg, err := bdm.GenerateManifest(packageName, packageFolder)
 	util.AssertNoError(t, err)
-	manifestZipped, err := bdm.GenerateManifest(packageNameSmall, unzipFolder)
+	manifestZipped, err := bdm.GenerateManifest(packageName, unzipFolder)
 	util.AssertNoError(t, err)
 	util.AssertEqualString(t, manifestOrg.Hash, manifestZipped.Hash)
 }
 
+func TestServerChunkedPackage(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+	defer os.RemoveAll(outputFolder)
+	defer os.RemoveAll(packageFolderChunked)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	// Publish a package with a big random file as chunks
+	data := make([]byte, 12*1024*1024)
+	rand.New(rand.NewSource(123)).Read(data)
+	os.MkdirAll(packageFolderChunked, os.ModePerm)
+	err := os.WriteFile(filepath.Join(packageFolderChunked, "big.dat"), data, os.ModePerm)
+	util.AssertNoError(t, err)
+	options := bdm.ManifestOptions{ChunkFiles: true}
+	manifest, err := client.UploadPackageWithOptions(packageNameChunked, packageFolderChunked, serverURL, writeToken, options)
+	util.AssertNoError(t, err)
+	chunks := len(manifest.Files[0].Chunks)
+	util.Assert(t, chunks > 1)
+
+	// Only the chunks are stored on the server
+	objects, err := testStore.GetObjects()
+	util.AssertNoError(t, err)
+	util.Assert(t, len(objects) == chunks)
+
+	// Download and check the package
+	err = client.DownloadPackage(outputFolder, serverURL, readToken, packageNameChunked, 1, true)
+	util.AssertNoError(t, err)
+	err = client.CheckPackage(outputFolder, serverURL, readToken, packageNameChunked, 1, true)
+	util.AssertNoError(t, err)
+
+	// Older clients cannot download chunked files
+	httpGetStatusCode(t, "/manifests/"+packageNameChunked+"/1", readToken, http.StatusNotAcceptable)
+
+	// The complete file is available from the files handler
+	urlPath := fmt.Sprintf("/files/%s/1/%s/big.dat", packageNameChunked, manifest.Files[0].Object.Hash)
+	body, _, err := httpGet(urlPath, readToken)
+	util.AssertNoError(t, err)
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	util.AssertNoError(t, err)
+	decompressed, err := io.ReadAll(reader)
+	util.AssertNoError(t, err)
+	util.Assert(t, bytes.Equal(decompressed, data))
+
+	// Ranges can span multiple chunks
+	status, body, _ := httpGetWithHeaders(t, urlPath, readToken, map[string]string{"Range": "bytes=3000000-9999999"})
+	util.Assert(t, status == http.StatusPartialContent)
+	util.Assert(t, bytes.Equal(body, data[3000000:10000000]))
+
+	// Insert some data in the middle of the file and publish a new version
+	modified := append(append(bytes.Clone(data[:5000000]), 1, 2, 3), data[5000000:]...)
+	err = os.WriteFile(filepath.Join(packageFolderChunked, "big.dat"), modified, os.ModePerm)
+	util.AssertNoError(t, err)
+	manifest, err = client.UploadPackageWithOptions(packageNameChunked, packageFolderChunked, serverURL, writeToken, options)
+	util.AssertNoError(t, err)
+	util.Assert(t, manifest.PackageVersion == 2)
+
+	// Only the modified chunks were added
+	objects, err = testStore.GetObjects()
+	util.AssertNoError(t, err)
+	util.Assert(t, len(objects) > chunks && len(objects) <= chunks+3)
+
+	// Update the outdated output folder and check it
+	err = client.DownloadPackage(outputFolder, serverURL, readToken, packageNameChunked, 2, true)
+	util.AssertNoError(t, err)
+	err = client.CheckPackage(outputFolder, serverURL, readToken, packageNameChunked, 2, true)
+	util.AssertNoError(t, err)
+
+	// Store validation must include the chunks
+	_, err = store.ValidateStore(testStore)
+	util.AssertNoError(t, err)
+}
+
+func TestServerMirror(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+	defer os.RemoveAll(packageFolderBig)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	// Publish two test packages
+	publishSmallTestPackage(t)
+	publishBigTestPackage(t)
+
+	// Mirror only the small package
+	mirrorStore := store.NewMemory()
+	result, err := client.MirrorPackages(mirrorStore, serverURL, readToken, regexp.MustCompile("^foo$"))
+	util.AssertNoError(t, err)
+	util.Assert(t, result.Manifests == 1)
+	util.Assert(t, result.Objects > 0)
+	names, err := mirrorStore.GetNames()
+	util.AssertNoError(t, err)
+	util.Assert(t, len(names) == 1 && names[0] == packageNameSmall)
+
+	// Nothing is transferred again
+	result, err = client.MirrorPackages(mirrorStore, serverURL, readToken, regexp.MustCompile("^foo$"))
+	util.AssertNoError(t, err)
+	util.Assert(t, result.Manifests == 0 && result.Objects == 0 && result.Yanked == 0)
+
+	// Mirror everything including the yanked state
+	httpRequestStatusCode(t, "PATCH", "/manifests/foo/1/yanked", writeToken, `{"Yanked":true}`, 200)
+	result, err = client.MirrorPackages(mirrorStore, serverURL, readToken, nil)
+	util.AssertNoError(t, err)
+	util.Assert(t, result.Manifests == 1)
+	util.Assert(t, result.Yanked == 1)
+	yanked, err := mirrorStore.IsYanked(packageNameSmall, 1)
+	util.AssertNoError(t, err)
+	util.Assert(t, yanked)
+
+	// Mirrored manifests are identical and the mirror is valid
+	remoteManifest, err := client.DownloadManifest(serverURL, readToken, packageNameBig, 1)
+	util.AssertNoError(t, err)
+	localManifest, err := mirrorStore.GetManifest(packageNameBig, 1)
+	util.AssertNoError(t, err)
+	util.Assert(t, localManifest.Hash == remoteManifest.Hash)
+	util.Assert(t, localManifest.Published == remoteManifest.Published)
+	stats, err := store.ValidateStore(mirrorStore)
+	util.AssertNoError(t, err)
+	util.Assert(t, stats["packages"] == 2)
+
+	// Versions deleted in the mirror are skipped by all following runs
+	util.AssertNoError(t, mirrorStore.DeleteManifest(packageNameSmall, 1))
+	for i := 0; i < 2; i++ {
+		result, err = client.MirrorPackages(mirrorStore, serverURL, readToken, nil)
+		util.AssertNoError(t, err)
+		util.Assert(t, result.Manifests == 0 && result.Objects == 0 && result.Deleted == 1)
+	}
+	_, err = mirrorStore.GetManifest(packageNameSmall, 1)
+	util.AssertError(t, err)
+}
+
+func TestServerStats(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+
+	// Creation and cleanup of server store
+	server, stopped := startTestingServer(t)
+	defer stopTestingServer(server, stopped)
+
+	// Publish a small test package
+	publishSmallTestPackage(t)
+
+	// Stats require admin permissions
+	httpGetStatusCode(t, "/stats", writeToken, 401)
+
+	// The stats are calculated in the background and are available shortly after the first request
+	var body []byte
+	var err error
+	for i := 0; i < 50; i++ {
+		body, _, err = httpGet("/stats", adminToken)
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	util.AssertNoError(t, err)
+	var stats store.StoreStats
+	util.AssertNoError(t, json.Unmarshal(body, &stats))
+	util.Assert(t, stats.Versions == 1)
+	util.Assert(t, len(stats.Packages) == 1 && stats.Packages[0].Name == packageNameSmall)
+	util.Assert(t, stats.Objects > 0 && stats.CompressedSize > 0)
+}
+
 func TestServerStaticHandler(t *testing.T) {
+	// Prepare Cleanup
+	defer os.RemoveAll(storeFolder)
+
 	// Creation and cleanup of server store
 	server, stopped := startTestingServer(t)
 	defer stopTestingServer(server, stopped)
@@ -261,7 +1080,11 @@ func TestServerStaticHandler(t *testing.T) {
 }
 
 func startTestingServer(t *testing.T) (*http.Server, chan bool) {
-	packageStore, err := store.New(storeFolder)
+	return startTestingServerWithOptions(t, store.Options{})
+}
+
+func startTestingServerWithOptions(t *testing.T, options store.Options) (*http.Server, chan bool) {
+	packageStore, err := store.NewWithOptions(storeFolder, options)
 	util.AssertNoError(t, err)
 
 	limits := bdm.ManifestLimits{}
@@ -272,6 +1095,8 @@ func startTestingServer(t *testing.T) (*http.Server, chan bool) {
 	util.AssertNoError(t, err)
 	defer os.Remove("./tokens.json")
 	handler := server.CreateRouter(packageStore, &limits, users, tokens)
+	testUsers = users
+	testStore = packageStore
 
 	err = users.CreateUser(server.User{
 		Id: "admin",
@@ -293,10 +1118,15 @@ func startTestingServer(t *testing.T) (*http.Server, chan bool) {
 	util.AssertNoError(t, err)
 	writeToken = wt.Secret
 
+	at, err := tokens.CreateToken("admin", "Admin", expiration, &server.Roles{Admin: true, Writer: true, Reader: true})
+	util.AssertNoError(t, err)
+	adminToken = at.Secret
+
 	server := &http.Server{Addr: "127.0.0.1:2323", Handler: handler}
 	stopped := make(chan bool)
 	go func() {
 		server.ListenAndServe()
+		packageStore.Close()
 		stopped <- true
 	}()
 
@@ -355,13 +1185,17 @@ func publishBigTestPackage(t *testing.T) {
 }
 
 func httpGet(path, token string) ([]byte, http.Header, error) {
+	return httpGetWithEncoding(path, token, "gzip")
+}
+
+func httpGetWithEncoding(path, token, acceptEncoding string) ([]byte, http.Header, error) {
 	client := &http.Client{}
 	req, err := http.NewRequest("GET", "http://127.0.0.1:2323"+path, nil)
 	if err != nil {
 		return nil, nil, err
 	}
 	req.Header.Set(bdm.ApiTokenHeader, token)
-	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", acceptEncoding)
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, nil, err
@@ -377,6 +1211,23 @@ func httpGet(path, token string) ([]byte, http.Header, error) {
 	return body, resp.Header, nil
 }
 
+func httpGetWithHeaders(t *testing.T, path, token string, headers map[string]string) (int, []byte, http.Header) {
+	t.Helper()
+	client := &http.Client{}
+	req, err := http.NewRequest("GET", "http://127.0.0.1:2323"+path, nil)
+	util.AssertNoError(t, err)
+	req.Header.Set(bdm.ApiTokenHeader, token)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	util.AssertNoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	util.AssertNoError(t, err)
+	return resp.StatusCode, body, resp.Header
+}
+
 func httpGetStatusCode(t *testing.T, path, token string, statusCode int) {
 	t.Helper()
 	client := &http.Client{}
@@ -389,6 +1240,18 @@ func httpGetStatusCode(t *testing.T, path, token string, statusCode int) {
 	util.Assert(t, resp.StatusCode == statusCode)
 }
 
+func httpRequestStatusCode(t *testing.T, method, path, token, body string, statusCode int) {
+	t.Helper()
+	client := &http.Client{}
+	req, err := http.NewRequest(method, "http://127.0.0.1:2323"+path, strings.NewReader(body))
+	util.AssertNoError(t, err)
+	req.Header.Set(bdm.ApiTokenHeader, token)
+	resp, err := client.Do(req)
+	util.AssertNoError(t, err)
+	defer resp.Body.Close()
+	util.Assert(t, resp.StatusCode == statusCode)
+}
+
 func getAndCompareString(t *testing.T, path, token, expectedType, expectedStr string) {
 	t.Helper()
 	body, header, err := httpGet(path, token)
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -8,6 +10,9 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cry-inc/bdm/pkg/bdm"
 	"github.com/cry-inc/bdm/pkg/bdm/client"
@@ -24,6 +29,16 @@ func main() {
 	checkMode := flag.Bool("check", false, "Enables check mode to compare local folder against an existing package.")
 	aboutMode := flag.Bool("about", false, "Show application version and build information.")
 	validateMode := flag.Bool("validate", false, "Validates a package store to make sure all contained data is valid.")
+	gcMode := flag.Bool("gc", false, "Removes all objects from a package store that are not referenced by any package.")
+	repairMode := flag.Bool("repair", false, "Checks a package store folder for all problems, quarantines corrupt data and writes a JSON report.")
+	reindexMode := flag.Bool("reindex", false, "Rebuilds the manifest index of a package store folder from the manifest files.")
+	pruneMode := flag.Bool("prune", false, "Deletes all package versions that are not kept by the retention policy and collects the garbage.")
+	exportMode := flag.Bool("export", false, "Writes package versions from a package store into a bundle file for offline transfers.")
+	importMode := flag.Bool("import", false, "Verifies a bundle file and imports the contained package versions into a package store.")
+	mirrorMode := flag.Bool("mirror", false, "Pulls all package versions from a remote server that are missing in the local package store.")
+	keygenMode := flag.Bool("keygen", false, "Generates a new private key for signing manifests and writes it into the sign key file.")
+	diffMode := flag.Bool("diff", false, "Shows the file differences between two versions of a remote package.")
+	tagsMode := flag.Bool("tags", false, "Lists the tags of a remote package. Moves the tags given with -tag to the specified version or removes them.")
 
 	// Application Arguments
 	port := flag.Uint("port", 2323, "Port for HTTP server of the package repository in server mode.")
@@ -33,22 +48,84 @@ func main() {
 	letsEncryptDomain := flag.String("letsencrypt", "", "Domain name to enable HTTPS with automatic LE certificates. Will also start an HTTP server on port 80 that needs to be reachable from the internet.")
 	certCacheFolder := flag.String("certcache", "./certs", "Cache folder for LE certificates.")
 	storeFolder := flag.String("store", "./store", "Specifies location of the servers package repository on disk.")
+	memoryStore := flag.Bool("memory", false, "Keeps all packages in memory in server mode. Everything is lost when the server stops.")
 	guestReading := flag.Bool("guestreading", false, "Use this flag to allow everyone without an account to browse and download packages.")
 	guestWriting := flag.Bool("guestwriting", false, "Use this flag to allow everyone without an account to upload new packages. Not recommended!")
 	usersFile := flag.String("usersfile", "./users.json", "Specifies location of the servers JSON user database.")
 	tokensFile := flag.String("tokensfile", "./tokens.json", "Specifies location of the servers JSON tokens database.")
 	defaultUser := flag.String("defaultuser", "admin", "Specifies the name of the first user that will be automatically generated.")
-	packageVersion := flag.Uint("version", 0, "Package version to download or check.")
+	packageVersion := flag.String("version", "", "Package version or tag name to download, check or export. New version in diff mode and target version in tags mode.")
+	oldVersion := flag.String("oldversion", "", "Old package version or tag name in diff mode.")
+	jsonOutput := flag.Bool("json", false, "Prints the result as JSON in diff mode.")
 	packageName := flag.String("package", "", "Specifies name of the package to be uploaded, downloaded or checked.")
 	inputFolder := flag.String("input", "", "Input path to folder that contains the package data to be published or checked.")
 	outputFolder := flag.String("output", "", "Output path to folder that receives the downloaded package data.")
 	remoteServer := flag.String("remote", "", "Remote package server URL for downloading packages.")
 	cacheFolder := flag.String("cache", "", "Local cache folder to avoid re-downloading packages from a remote server.")
 	clean := flag.Bool("clean", false, "Deletes all non-package files in the output folder in download mode and ensures that there are no non-package files in check mode.")
+	description := flag.String("description", "", "Optional description of the package version in upload mode.")
+	labels := make(map[string]string)
+	flag.Func("label", "Adds a label in the form key=value to the package version in upload mode. Can be used multiple times.", func(label string) error {
+		key, value, err := bdm.ParseLabel(label)
+		if err == nil {
+			labels[key] = value
+		}
+		return err
+	})
+	var dependencies []bdm.Dependency
+	flag.Func("dependency", "Adds a dependency in the form name:version:folder to the package in upload mode, like engine:>=3,<5:deps/engine. Can be used multiple times.", func(value string) error {
+		dependency, err := bdm.ParseDependency(value)
+		if err == nil {
+			dependencies = append(dependencies, *dependency)
+		}
+		return err
+	})
+	var tags []string
+	flag.Func("tag", "Moves this tag to the published version in upload mode or to the specified version in tags mode. Can be used multiple times.", func(tag string) error {
+		if !bdm.ValidateTagName(tag) {
+			return fmt.Errorf("invalid tag name %s", tag)
+		}
+		tags = append(tags, tag)
+		return nil
+	})
+	removeTags := flag.Bool("removetags", false, "Removes the tags given with -tag instead of moving them in tags mode.")
+	var excludes, includes []string
+	flag.Func("exclude", "Ignores files matching this gitignore-style pattern in addition to the .bdmignore file in upload mode. Such files are also kept by clean and check mode. Can be used multiple times.", func(pattern string) error {
+		excludes = append(excludes, pattern)
+		return nil
+	})
+	flag.Func("include", "Adds files matching this gitignore-style pattern even if they are excluded or ignored. Can be used multiple times.", func(pattern string) error {
+		includes = append(includes, pattern)
+		return nil
+	})
+	fileMetadata := flag.Bool("filemeta", false, "Records file permissions and modification times in upload mode, restores them in download mode and verifies them in check mode.")
+	signKeyFile := flag.String("signkey", "", "Private key file for signing manifests in upload mode. In server mode all manifests not signed by their publisher are signed with it.")
+	trustFile := flag.String("trust", "", "File with trusted public keys, one per line. Download and check mode refuse manifests signed by other keys.")
+	requireSigned := flag.Bool("requiresigned", false, "Refuses unsigned manifests in download and check mode. Requires a trust file.")
+	chunkFiles := flag.Bool("chunk", false, "Splits large files into content-defined chunks in upload mode. Only changed chunks need to be uploaded and downloaded for new versions.")
 	maxPathLength := flag.Int("maxpath", 0, "Maximum length of paths inside packages. Default is 0, which means unlimited.")
 	maxFileCount := flag.Int("maxfiles", 0, "Maximum bumber of files per package. Default is 0, which means unlimited.")
 	maxPackageSize := flag.Int64("maxsize", 0, "Maximum package size (sum of file sizes) in bytes. Default is 0, which means unlimited.")
 	maxFileSize := flag.Int64("maxfilesize", 0, "Maximum file size inside packages in bytes. Default is 0, which means unlimited.")
+	s3Endpoint := flag.String("s3endpoint", "https://s3.amazonaws.com", "Endpoint URL of the S3-compatible API used for the package store.")
+	s3Region := flag.String("s3region", "us-east-1", "Region of the S3 bucket used for the package store.")
+	s3Bucket := flag.String("s3bucket", "", "Name of an S3 bucket. If supplied, the package store is kept in this bucket instead of the store folder.")
+	s3Prefix := flag.String("s3prefix", "", "Optional prefix for all keys of the package store in the S3 bucket.")
+	s3AccessKey := flag.String("s3accesskey", os.Getenv("AWS_ACCESS_KEY_ID"), "Access key for the S3 bucket. Defaults to the environment variable AWS_ACCESS_KEY_ID.")
+	s3SecretKey := flag.String("s3secretkey", os.Getenv("AWS_SECRET_ACCESS_KEY"), "Secret key for the S3 bucket. Defaults to the environment variable AWS_SECRET_ACCESS_KEY.")
+	validateWorkers := flag.Int("workers", 0, "Number of objects checked in parallel in validation mode. Default is 0, which means number of CPUs.")
+	validateCheckpoint := flag.String("checkpoint", "", "Optional checkpoint file that allows to resume an interrupted validation.")
+	validateRecheckDays := flag.Uint("recheckdays", 0, "Only validate objects that were not verified within this number of days. Requires a checkpoint file.")
+	repairReport := flag.String("repairreport", "./repair.json", "Specifies location of the JSON report written in repair mode.")
+	repairDelete := flag.Bool("repairdelete", false, "Drops broken manifests in repair mode instead of moving them into the quarantine. Their versions are marked as deleted in both cases.")
+	bundleFile := flag.String("bundle", "./bundle.tar", "Specifies location of the bundle file in export and import mode.")
+	mirrorFilter := flag.String("mirrorfilter", "", "Optional regular expression in mirror mode. Only packages with matching names are mirrored.")
+	mirrorInterval := flag.Duration("mirrorinterval", 0, "Repeats the mirroring with this interval. Default is 0, which means the mirror mode runs only once.")
+	retentionFile := flag.String("retention", "", "Optional JSON retention policy file. Enforced periodically in server mode and used by the prune mode.")
+	retentionInterval := flag.Duration("retentioninterval", 24*time.Hour, "Interval for enforcing the retention policy in server mode.")
+	dryRun := flag.Bool("dryrun", false, "Only shows the package versions that would be deleted in prune mode.")
+	gcGracePeriod := flag.Duration("gcgrace", store.DefaultGracePeriod, "Unreferenced objects added within this period are kept by the garbage collection.")
+	compression := flag.String("compression", "default", "Compression level for new objects in server, import and mirror mode. Supported levels are none, fastest, default, better and best.")
 
 	flag.Parse()
 
@@ -59,16 +136,63 @@ func main() {
 		MaxPathLength:  *maxPathLength,
 	}
 
+	s3Config := store.S3Config{
+		Endpoint:  *s3Endpoint,
+		Region:    *s3Region,
+		Bucket:    *s3Bucket,
+		Prefix:    *s3Prefix,
+		AccessKey: *s3AccessKey,
+		SecretKey: *s3SecretKey,
+	}
+
+	compressionLevel, err := util.ParseCompressionLevel(*compression)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	storeOptions := store.Options{Compression: compressionLevel}
+
 	if *serverMode {
-		startServer(*port, &limits, *storeFolder, *usersFile, *defaultUser, *tokensFile, *guestReading, *guestWriting, *httpsCert, *httpsKey, *letsEncryptDomain, *certCacheFolder)
+		startServer(*port, &limits, *storeFolder, &s3Config, storeOptions, *memoryStore, *usersFile, *defaultUser, *tokensFile, *guestReading, *guestWriting, *httpsCert, *httpsKey, *letsEncryptDomain, *certCacheFolder, *retentionFile, *signKeyFile, *retentionInterval, *gcGracePeriod)
 	} else if *validateMode {
-		validateStore(*storeFolder)
+		validateStore(*storeFolder, &s3Config, *validateWorkers, *validateCheckpoint, *validateRecheckDays)
+	} else if *gcMode {
+		collectGarbage(*storeFolder, &s3Config, *gcGracePeriod)
+	} else if *repairMode {
+		repairStore(*storeFolder, *repairReport, store.RepairOptions{MarkDeleted: *repairDelete})
+	} else if *reindexMode {
+		rebuildIndex(*storeFolder)
+	} else if *pruneMode {
+		pruneStore(*storeFolder, &s3Config, *retentionFile, *dryRun, *gcGracePeriod)
+	} else if *exportMode {
+		exportBundle(*storeFolder, &s3Config, *bundleFile, *packageName, *packageVersion)
+	} else if *importMode {
+		importBundle(*storeFolder, &s3Config, storeOptions, *bundleFile)
+	} else if *mirrorMode {
+		mirrorStore(*storeFolder, &s3Config, storeOptions, *remoteServer, *token, *mirrorFilter, *mirrorInterval)
 	} else if *uploadMode {
-		uploadPackage(*packageName, *inputFolder, *remoteServer, *token)
+		options := bdm.ManifestOptions{ChunkFiles: *chunkFiles, Description: *description, Labels: labels, FileMetadata: *fileMetadata,
+			Exclude: excludes, Include: includes, Dependencies: dependencies}
+		if len(*signKeyFile) > 0 {
+			options.SigningKey = readSigningKey(*signKeyFile)
+		}
+		uploadPackage(*packageName, *inputFolder, *remoteServer, *token, options, tags)
 	} else if *downloadMode {
-		downloadPackage(*packageName, *packageVersion, *outputFolder, *remoteServer, *token, *cacheFolder, *clean)
+		options := client.DownloadOptions{CacheFolder: *cacheFolder, Clean: *clean, FileMetadata: *fileMetadata, RequireSignature: *requireSigned,
+			Exclude: excludes, Include: includes}
+		options.TrustedKeys = readTrustedKeys(*trustFile, *requireSigned)
+		downloadPackage(*packageName, *packageVersion, *outputFolder, *remoteServer, *token, options)
 	} else if *checkMode {
-		checkPackage(*packageName, *packageVersion, *inputFolder, *cacheFolder, *remoteServer, *token, *clean)
+		options := client.DownloadOptions{CacheFolder: *cacheFolder, Clean: *clean, FileMetadata: *fileMetadata, RequireSignature: *requireSigned,
+			Exclude: excludes, Include: includes}
+		options.TrustedKeys = readTrustedKeys(*trustFile, *requireSigned)
+		checkPackage(*packageName, *packageVersion, *inputFolder, *remoteServer, *token, options)
+	} else if *diffMode {
+		diffPackage(*packageName, *oldVersion, *packageVersion, *remoteServer, *token, *jsonOutput)
+	} else if *tagsMode {
+		changeTags(*packageName, tags, *packageVersion, *removeTags, *remoteServer, *token)
+	} else if *keygenMode {
+		generateSigningKey(*signKeyFile)
 	} else if *aboutMode {
 		showAbout()
 	} else {
@@ -88,16 +212,36 @@ func showAbout() {
 	fmt.Printf("  Arch:       %s\n", runtime.GOARCH)
 }
 
-func startServer(port uint, limits *bdm.ManifestLimits, storePath, usersFile, defaultUser, tokensFile string, guestReading, guestWriting bool, certPath, keyPath, letsEncryptDomain, certCacheFolder string) {
+func startServer(port uint, limits *bdm.ManifestLimits, storePath string, s3Config *store.S3Config, storeOptions store.Options, memoryStore bool, usersFile, defaultUser, tokensFile string, guestReading, guestWriting bool, certPath, keyPath, letsEncryptDomain, certCacheFolder, retentionFile, signKeyFile string, retentionInterval, gcGracePeriod time.Duration) {
 	log.Print("BDM - Binary Data Manager")
 
 	if port == 0 || float64(port) >= math.Pow(2, 16) {
 		log.Fatal("Invalid port number")
 	}
 
-	packageStore, err := store.New(storePath)
-	if err != nil {
-		log.Fatalf("Failed to open or create package store: %v", err)
+	if len(signKeyFile) > 0 {
+		var err error
+		storeOptions.SigningKey, err = bdm.ReadPrivateKeyFile(signKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read signing key: %v", err)
+		}
+		log.Printf("Signing published manifests with public key %x\n", storeOptions.SigningKey.Public())
+	}
+
+	var packageStore store.Store
+	if memoryStore {
+		log.Print("Using in-memory package store, all packages will be lost when the server stops")
+		packageStore = store.NewMemoryWithOptions(storeOptions)
+	} else {
+		var err error
+		packageStore, err = openStore(storePath, s3Config, storeOptions)
+		if err != nil {
+			log.Fatalf("Failed to open or create package store: %v", err)
+		}
+	}
+	defer packageStore.Close()
+	if len(s3Config.Bucket) > 0 {
+		storePath = "s3://" + s3Config.Bucket + "/" + s3Config.Prefix
 	}
 
 	users, err := server.CreateJsonUsers(usersFile)
@@ -136,6 +280,18 @@ func startServer(port uint, limits *bdm.ManifestLimits, storePath, usersFile, de
 		log.Print("WARNING: Guest upload of new packages is enabled. This is not recommended!")
 	}
 
+	if len(retentionFile) > 0 {
+		policy, err := store.ReadRetentionPolicy(retentionFile)
+		if err != nil {
+			log.Fatalf("Failed to read retention policy: %v", err)
+		}
+		if retentionInterval <= 0 {
+			log.Fatal("Invalid retention interval")
+		}
+		log.Printf("Enforcing retention policy '%s' every %s\n", retentionFile, retentionInterval)
+		go enforceRetentionPolicy(packageStore, policy, retentionInterval, gcGracePeriod)
+	}
+
 	router := server.CreateRouter(packageStore, limits, users, tokens)
 
 	p := uint16(port)
@@ -153,7 +309,7 @@ func startServer(port uint, limits *bdm.ManifestLimits, storePath, usersFile, de
 	}
 }
 
-func uploadPackage(packageName, inputFolder, serverURL, apiToken string) {
+func uploadPackage(packageName, inputFolder, serverURL, apiToken string, options bdm.ManifestOptions, tags []string) {
 	validName := bdm.ValidatePackageName(packageName)
 	if !validName {
 		fmt.Println("Invalid package name. Only lower case a-z, 0-9 and the characters - _ are allowed")
@@ -176,16 +332,76 @@ func uploadPackage(packageName, inputFolder, serverURL, apiToken string) {
 		os.Exit(1)
 	}
 
-	manifest, err := client.UploadPackage(packageName, inputFolder, serverURL, apiToken)
+	manifest, err := client.UploadPackageWithOptions(packageName, inputFolder, serverURL, apiToken, options)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Package %s was successfully published in version %d\n", manifest.PackageName, manifest.PackageVersion)
+
+	for _, tag := range tags {
+		err = client.SetTag(serverURL, apiToken, manifest.PackageName, tag, manifest.PackageVersion)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Moved tag %s to version %d\n", tag, manifest.PackageVersion)
+	}
+}
+
+func readSigningKey(keyFile string) ed25519.PrivateKey {
+	key, err := bdm.ReadPrivateKeyFile(keyFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return key
+}
+
+func readTrustedKeys(trustFile string, required bool) []ed25519.PublicKey {
+	if len(trustFile) == 0 {
+		if required {
+			fmt.Println("Missing trust file for verifying signatures")
+			os.Exit(1)
+		}
+		return nil
+	}
+	keys, err := bdm.ReadTrustFile(trustFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return keys
+}
+
+func generateSigningKey(keyFile string) {
+	if len(keyFile) == 0 {
+		fmt.Println("Missing sign key file")
+		os.Exit(1)
+	}
+
+	if util.FileExists(keyFile) {
+		fmt.Println("Sign key file exists already")
+		os.Exit(1)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = bdm.WritePrivateKeyFile(keyFile, privateKey)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Package %s was successfully published in version %d", manifest.PackageName, manifest.PackageVersion)
+	fmt.Printf("Created sign key file %s with public key %x\n", keyFile, publicKey)
 }
 
-func downloadPackage(packageName string, packageVersion uint, outputFolder, serverURL, apiToken, cacheFolder string, clean bool) {
+func downloadPackage(packageName, packageVersion string, outputFolder, serverURL, apiToken string, options client.DownloadOptions) {
 	if len(packageName) == 0 {
 		fmt.Println("Missing package name")
 		os.Exit(1)
@@ -196,8 +412,27 @@ func downloadPackage(packageName string, packageVersion uint, outputFolder, serv
 		os.Exit(1)
 	}
 
-	if packageVersion == 0 {
-		fmt.Println("Missing or invalid package version")
+	err := validateServerURL(serverURL)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	version := resolveRemoteVersion(packageName, packageVersion, serverURL, apiToken)
+	tree, err := client.DownloadPackageWithDependencies(outputFolder, serverURL, apiToken, packageName, version, options)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if len(tree.Dependencies) > 0 {
+		fmt.Print("Downloaded packages:\n" + tree.String())
+	}
+}
+
+func checkPackage(packageName, packageVersion string, checkFolder, serverURL, apiToken string, options client.DownloadOptions) {
+	if len(packageName) == 0 {
+		fmt.Println("Missing package name")
 		os.Exit(1)
 	}
 
@@ -207,29 +442,84 @@ func downloadPackage(packageName string, packageVersion uint, outputFolder, serv
 		os.Exit(1)
 	}
 
-	if len(cacheFolder) > 0 {
-		err = client.DownloadCachedPackage(outputFolder, cacheFolder, serverURL, apiToken, packageName, packageVersion, clean)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-	} else {
-		err = client.DownloadPackage(outputFolder, serverURL, apiToken, packageName, packageVersion, clean)
+	version := resolveRemoteVersion(packageName, packageVersion, serverURL, apiToken)
+	err = client.CheckPackageWithOptions(checkFolder, serverURL, apiToken, packageName, version, options)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func diffPackage(packageName, oldVersionValue, newVersionValue, serverURL, apiToken string, jsonOutput bool) {
+	if len(packageName) == 0 {
+		fmt.Println("Missing package name")
+		os.Exit(1)
+	}
+
+	if len(oldVersionValue) == 0 || len(newVersionValue) == 0 {
+		fmt.Println("Missing package versions")
+		os.Exit(1)
+	}
+
+	err := validateServerURL(serverURL)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	oldVersion := resolveRemoteVersion(packageName, oldVersionValue, serverURL, apiToken)
+	newVersion := resolveRemoteVersion(packageName, newVersionValue, serverURL, apiToken)
+
+	diff, err := client.DiffPackage(serverURL, apiToken, packageName, oldVersion, newVersion)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		jsonData, err := json.MarshalIndent(diff, "", "  ")
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
+		fmt.Println(string(jsonData))
+		return
+	}
+
+	for _, file := range diff.Added {
+		fmt.Printf("Added    %s (%+d bytes)\n", file.Path, file.Object.Size)
+	}
+	for _, file := range diff.Removed {
+		fmt.Printf("Removed  %s (%+d bytes)\n", file.Path, -file.Object.Size)
+	}
+	for _, change := range diff.Modified {
+		fmt.Printf("Modified %s (%+d bytes)\n", change.New.Path, change.SizeDelta)
 	}
+	for _, change := range diff.Renamed {
+		fmt.Printf("Renamed  %s -> %s\n", change.Old.Path, change.New.Path)
+	}
+	fmt.Printf("Package %s changed from version %d to %d by %+d bytes\n", packageName, oldVersion, newVersion, diff.SizeDelta)
 }
 
-func checkPackage(packageName string, packageVersion uint, checkFolder, cacheFolder, serverURL, apiToken string, clean bool) {
-	if len(packageName) == 0 {
-		fmt.Println("Missing package name")
+// Resolves a version number or a tag name of a remote package
+func resolveRemoteVersion(packageName, value, serverURL, apiToken string) uint {
+	if len(value) == 0 {
+		fmt.Println("Missing package version")
 		os.Exit(1)
 	}
 
-	if packageVersion == 0 {
-		fmt.Println("Missing or invalid package version")
+	version, err := client.ResolveVersion(serverURL, apiToken, packageName, value)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return version
+}
+
+// Lists the tags of a remote package if no tags are specified, otherwise moves or removes the tags
+func changeTags(packageName string, tags []string, packageVersion string, remove bool, serverURL, apiToken string) {
+	if len(packageName) == 0 {
+		fmt.Println("Missing package name")
 		os.Exit(1)
 	}
 
@@ -239,34 +529,99 @@ func checkPackage(packageName string, packageVersion uint, checkFolder, cacheFol
 		os.Exit(1)
 	}
 
-	if len(cacheFolder) > 0 {
-		err = client.CheckCachedPackage(checkFolder, cacheFolder, serverURL, apiToken, packageName, packageVersion, clean)
+	if len(tags) == 0 {
+		packageTags, err := client.GetTags(serverURL, apiToken, packageName)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
-	} else {
-		err = client.CheckPackage(checkFolder, serverURL, apiToken, packageName, packageVersion, clean)
+		for _, tag := range packageTags {
+			if tag.Version == 0 {
+				fmt.Printf("%s (removed)\n", tag.Name)
+			} else {
+				fmt.Printf("%s -> %d\n", tag.Name, tag.Version)
+			}
+		}
+		return
+	}
+
+	var version uint
+	if !remove {
+		version = resolveRemoteVersion(packageName, packageVersion, serverURL, apiToken)
+	}
+	for _, tag := range tags {
+		err = client.SetTag(serverURL, apiToken, packageName, tag, version)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
+		if remove {
+			fmt.Printf("Removed tag %s\n", tag)
+		} else {
+			fmt.Printf("Moved tag %s to version %d\n", tag, version)
+		}
 	}
 }
 
-func validateStore(storeFolder string) {
-	if !util.FolderExists(storeFolder) {
+func validateStore(storeFolder string, s3Config *store.S3Config, workers int, checkpointFile string, recheckDays uint) {
+	if len(s3Config.Bucket) == 0 && !util.FolderExists(storeFolder) {
 		fmt.Println("Missing store folder")
 		os.Exit(1)
 	}
 
-	packageStore, err := store.New((storeFolder))
+	if recheckDays > 0 && len(checkpointFile) == 0 {
+		fmt.Println("Missing checkpoint file for recheck interval")
+		os.Exit(1)
+	}
+
+	packageStore, err := openStore(storeFolder, s3Config, store.Options{})
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	defer packageStore.Close()
+
+	options := store.ValidateOptions{
+		Workers:        workers,
+		CheckpointFile: checkpointFile,
+		RecheckAfter:   time.Duration(recheckDays) * 24 * time.Hour,
+		Progress: func(progress store.ValidateProgress) {
+			fmt.Printf("Checked %d/%d objects, %d/%d MB, %s elapsed, %s remaining\n",
+				progress.Objects, progress.TotalObjects,
+				progress.Bytes/1024/1024, progress.TotalBytes/1024/1024,
+				progress.Elapsed.Round(time.Second), progress.Remaining.Round(time.Second))
+		},
+	}
+	stats, err := store.ValidateStoreWithOptions(packageStore, options)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for name, value := range stats {
+		fmt.Printf("%s: %d\n", name, value)
+	}
+}
+
+func collectGarbage(storeFolder string, s3Config *store.S3Config, gracePeriod time.Duration) {
+	if len(s3Config.Bucket) == 0 && !util.FolderExists(storeFolder) {
+		fmt.Println("Missing store folder")
+		os.Exit(1)
+	}
 
-	stats, err := store.ValidateStore(packageStore)
+	if gracePeriod < 0 {
+		fmt.Println("Invalid negative grace period")
+		os.Exit(1)
+	}
+
+	packageStore, err := openStore(storeFolder, s3Config, store.Options{})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer packageStore.Close()
+
+	stats, err := store.CollectGarbage(packageStore, gracePeriod)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -277,6 +632,294 @@ func validateStore(storeFolder string) {
 	}
 }
 
+// Runs forever in the background and prunes the store periodically
+func enforceRetentionPolicy(packageStore store.Store, policy *store.RetentionPolicy, interval, gcGracePeriod time.Duration) {
+	for {
+		pruned, err := store.ApplyRetentionPolicy(packageStore, policy, false)
+		if err != nil {
+			log.Printf("Failed to apply retention policy: %v", err)
+		} else if len(pruned) > 0 {
+			log.Printf("Retention policy deleted %d package versions", len(pruned))
+			stats, err := store.CollectGarbage(packageStore, gcGracePeriod)
+			if err != nil {
+				log.Printf("Failed to collect garbage: %v", err)
+			} else {
+				log.Printf("Garbage collection removed %d objects and freed %d bytes", stats["removed"], stats["freed"])
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func pruneStore(storeFolder string, s3Config *store.S3Config, retentionFile string, dryRun bool, gcGracePeriod time.Duration) {
+	if len(s3Config.Bucket) == 0 && !util.FolderExists(storeFolder) {
+		fmt.Println("Missing store folder")
+		os.Exit(1)
+	}
+
+	if len(retentionFile) == 0 {
+		fmt.Println("Missing retention policy file")
+		os.Exit(1)
+	}
+
+	policy, err := store.ReadRetentionPolicy(retentionFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	packageStore, err := openStore(storeFolder, s3Config, store.Options{})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer packageStore.Close()
+
+	pruned, err := store.ApplyRetentionPolicy(packageStore, policy, dryRun)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, version := range pruned {
+		if dryRun {
+			fmt.Printf("Would delete package %s version %d\n", version.PackageName, version.PackageVersion)
+		} else {
+			fmt.Printf("Deleted package %s version %d\n", version.PackageName, version.PackageVersion)
+		}
+	}
+	if dryRun {
+		return
+	}
+
+	stats, err := store.CollectGarbage(packageStore, gcGracePeriod)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Garbage collection removed %d objects and freed %d bytes\n", stats["removed"], stats["freed"])
+}
+
+func repairStore(storeFolder, reportFile string, options store.RepairOptions) {
+	if !util.FolderExists(storeFolder) {
+		fmt.Println("Missing store folder")
+		os.Exit(1)
+	}
+
+	report, err := store.RepairStoreWithOptions(storeFolder, options)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	jsonData, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Println(fmt.Errorf("error marshalling report to JSON: %w", err))
+		os.Exit(1)
+	}
+	err = os.WriteFile(reportFile, jsonData, os.ModePerm)
+	if err != nil {
+		fmt.Println(fmt.Errorf("error writing report file %s: %w", reportFile, err))
+		os.Exit(1)
+	}
+
+	for _, issue := range report.Issues {
+		location := issue.Path
+		if len(issue.Package) > 0 {
+			location = fmt.Sprintf("package %s version %d", issue.Package, issue.Version)
+		}
+		fmt.Printf("%s in %s: %s (%s)\n", issue.Type, location, issue.Message, issue.Action)
+	}
+	fmt.Printf("Checked %d packages and %d objects, found %d issues\n",
+		report.Packages, report.Objects, len(report.Issues))
+	for _, version := range report.DeletedVersions {
+		fmt.Printf("Marked package %s version %d as deleted\n", version.PackageName, version.PackageVersion)
+	}
+}
+
+func rebuildIndex(storeFolder string) {
+	if !util.FolderExists(storeFolder) {
+		fmt.Println("Missing store folder")
+		os.Exit(1)
+	}
+
+	err := store.RebuildIndex(storeFolder)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Rebuilt manifest index")
+}
+
+// Exports the specified package versions, package names are separated by commas and all packages are exported if there are none
+func exportBundle(storeFolder string, s3Config *store.S3Config, bundleFile, packageNames, packageVersionValue string) {
+	if len(s3Config.Bucket) == 0 && !util.FolderExists(storeFolder) {
+		fmt.Println("Missing store folder")
+		os.Exit(1)
+	}
+
+	packageStore, err := openStore(storeFolder, s3Config, store.Options{})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer packageStore.Close()
+
+	var names []string
+	if len(packageNames) > 0 {
+		names = strings.Split(packageNames, ",")
+	} else {
+		names, err = packageStore.GetNames()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if len(packageVersionValue) > 0 && len(names) != 1 {
+		fmt.Println("A version can only be specified for a single package")
+		os.Exit(1)
+	}
+
+	// Versions can be specified as number or as tag of the local store
+	var packageVersion uint
+	if bdm.ValidateTagName(packageVersionValue) {
+		packageVersion, err = store.ResolveTag(packageStore, names[0], packageVersionValue)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if len(packageVersionValue) > 0 {
+		version, err := strconv.ParseUint(packageVersionValue, 10, 32)
+		if err != nil || version == 0 {
+			fmt.Println("Invalid package version")
+			os.Exit(1)
+		}
+		packageVersion = uint(version)
+	}
+
+	manifests := make([]*bdm.Manifest, 0)
+	for _, name := range names {
+		if !bdm.ValidatePackageName(name) {
+			fmt.Printf("Invalid package name %s\n", name)
+			os.Exit(1)
+		}
+		versions := []uint{packageVersion}
+		if packageVersion == 0 {
+			versions, err = packageStore.GetVersions(name)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			if len(versions) == 0 {
+				fmt.Printf("Package %s does not exist\n", name)
+				os.Exit(1)
+			}
+		}
+		for _, version := range versions {
+			manifest, err := packageStore.GetManifest(name, version)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			manifests = append(manifests, manifest)
+		}
+	}
+
+	fileHandle, err := os.Create(bundleFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = store.ExportBundle(packageStore, manifests, fileHandle)
+	if err == nil {
+		err = fileHandle.Close()
+	}
+	if err != nil {
+		fileHandle.Close()
+		os.Remove(bundleFile)
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Exported %d package versions to %s\n", len(manifests), bundleFile)
+}
+
+func importBundle(storeFolder string, s3Config *store.S3Config, storeOptions store.Options, bundleFile string) {
+	packageStore, err := openStore(storeFolder, s3Config, storeOptions)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer packageStore.Close()
+
+	fileHandle, err := os.Open(bundleFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer fileHandle.Close()
+
+	result, err := store.ImportBundle(packageStore, fileHandle)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Imported %d package versions and %d objects, skipped %d existing package versions, %d deleted package versions and %d existing objects\n",
+		result.Manifests, result.Objects, result.SkippedManifests, result.DeletedManifests, result.SkippedObjects)
+}
+
+func mirrorStore(storeFolder string, s3Config *store.S3Config, storeOptions store.Options, serverURL, apiToken, filter string, interval time.Duration) {
+	err := validateServerURL(serverURL)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var nameFilter *regexp.Regexp
+	if len(filter) > 0 {
+		nameFilter, err = regexp.Compile(filter)
+		if err != nil {
+			fmt.Println("Invalid mirror filter:", err)
+			os.Exit(1)
+		}
+	}
+
+	packageStore, err := openStore(storeFolder, s3Config, storeOptions)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer packageStore.Close()
+
+	for {
+		result, err := client.MirrorPackages(packageStore, serverURL, apiToken, nameFilter)
+		if result != nil {
+			fmt.Printf("Mirrored %d package versions and %d objects with %d MB, updated yanked state of %d versions, skipped %d locally deleted versions\n",
+				result.Manifests, result.Objects, result.Bytes/1024/1024, result.Yanked, result.Deleted)
+		}
+		if err != nil {
+			fmt.Println(err)
+			if interval == 0 {
+				os.Exit(1)
+			}
+		}
+		if interval == 0 {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Opens the S3 package store if a bucket is configured, otherwise the store folder
+func openStore(storeFolder string, s3Config *store.S3Config, options store.Options) (store.Store, error) {
+	if len(s3Config.Bucket) > 0 {
+		return store.NewS3WithOptions(*s3Config, options)
+	}
+	return store.NewWithOptions(storeFolder, options)
+}
+
 func validateServerURL(serverURL string) error {
 	if len(serverURL) == 0 {
 		return fmt.Errorf("missing URL for remote server")
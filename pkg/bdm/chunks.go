@@ -0,0 +1,42 @@
+package bdm
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+// ChunkFile splits a file into content-defined chunks and returns the chunk objects in order
+func ChunkFile(filePath string) ([]Object, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	chunks := make([]Object, 0)
+	err = util.SplitChunks(file, func(data []byte) error {
+		hasher := util.CreateHasher()
+		hasher.Write(data)
+		chunks = append(chunks, Object{
+			Size: int64(len(data)),
+			Hash: util.GetHashString(hasher),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error splitting file %s into chunks: %w", filePath, err)
+	}
+
+	return chunks, nil
+}
+
+// GetFileObjects returns the objects that contain the data of a file.
+// This is a list of chunks for chunked files, otherwise just the file object.
+func GetFileObjects(file *File) []Object {
+	if len(file.Chunks) > 0 {
+		return file.Chunks
+	}
+	return []Object{file.Object}
+}
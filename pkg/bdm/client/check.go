@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/cry-inc/bdm/pkg/bdm"
 	"github.com/cry-inc/bdm/pkg/bdm/util"
@@ -12,27 +11,48 @@ import (
 
 // CheckPackage will check an existing loack package folder against the manifest
 func CheckPackage(packageFolder, serverURL, apiToken, name string, version uint, clean bool) error {
-	manifest, err := DownloadManifest(serverURL, apiToken, name, version)
-	if err != nil {
-		return fmt.Errorf("error downloading manifest: %w", err)
-	}
-
-	return CheckFiles(manifest, packageFolder, clean)
+	return CheckPackageWithOptions(packageFolder, serverURL, apiToken, name, version, DownloadOptions{Clean: clean})
 }
 
 // CheckCachedPackage is like CheckPackage but with an additional local cache
 func CheckCachedPackage(packageFolder, cacheFolder, serverURL, apiToken, name string, version uint, clean bool) error {
-	manifest, err := DownloadCachedManifest(cacheFolder, serverURL, apiToken, name, version)
+	options := DownloadOptions{CacheFolder: cacheFolder, Clean: clean}
+	return CheckPackageWithOptions(packageFolder, serverURL, apiToken, name, version, options)
+}
+
+// CheckPackageWithOptions is CheckPackage with additional options.
+// Dependencies are resolved and checked in their folders as well.
+func CheckPackageWithOptions(packageFolder, serverURL, apiToken, name string, version uint, options DownloadOptions) error {
+	rootManifest, err := DownloadManifestWithOptions(serverURL, apiToken, name, version, options)
+	if err != nil {
+		return err
+	}
+
+	tree, err := ResolveDependencies(rootManifest, serverURL, apiToken, options)
+	if err != nil {
+		return fmt.Errorf("error resolving dependencies: %w", err)
+	}
+	manifest := flattenDependencies(tree)
+
+	rules, err := bdm.LoadIgnoreRules(packageFolder, options.Exclude, options.Include)
+	if err != nil {
+		return err
+	}
+	err = checkFiles(manifest, packageFolder, options.Clean, rules)
 	if err != nil {
-		return fmt.Errorf("error downloading cached manifest: %w", err)
+		return err
+	}
+
+	if options.FileMetadata {
+		return CheckFileMetadata(manifest, packageFolder)
 	}
 
-	return CheckFiles(manifest, packageFolder, clean)
+	return nil
 }
 
 func checkFile(file bdm.File, packageFolder string) error {
 	fullPath := filepath.Join(packageFolder, file.Path)
-	if !util.FileExists(fullPath) {
+	if !util.FileExists(fullPath) || isSymlink(fullPath) {
 		return fmt.Errorf("cannot find file %s", file.Path)
 	}
 	fileInfo, err := os.Stat(fullPath)
@@ -59,7 +79,16 @@ func checkFile(file bdm.File, packageFolder string) error {
 
 // CheckFiles compare a folder against a manifest and complain about missing or wrong files.
 // It will also complain about non-package files if clean is set to true.
+// Items ignored by the ignore file in the package folder are not considered as non-package files.
 func CheckFiles(manifest *bdm.Manifest, packageFolder string, clean bool) error {
+	rules, err := bdm.LoadIgnoreRules(packageFolder, nil, nil)
+	if err != nil {
+		return err
+	}
+	return checkFiles(manifest, packageFolder, clean, rules)
+}
+
+func checkFiles(manifest *bdm.Manifest, packageFolder string, clean bool, rules *bdm.IgnoreRules) error {
 	for _, file := range manifest.Files {
 		err := checkFile(file, packageFolder)
 		if err != nil {
@@ -67,51 +96,22 @@ func CheckFiles(manifest *bdm.Manifest, packageFolder string, clean bool) error
 		}
 	}
 
+	err := checkSymlinksAndFolders(manifest, packageFolder)
+	if err != nil {
+		return fmt.Errorf("found problem while checking symlinks and folders: %w", err)
+	}
+
 	if !clean {
 		// No clean checks are requested -> early out
 		return nil
 	}
 
-	return filepath.Walk(packageFolder, func(filePath string, fileInfo os.FileInfo, err error) error {
-		if err != nil {
-			return fmt.Errorf("error walking files in folder %s: %w",
-				packageFolder, err)
-		}
-		absFolder, err := filepath.Abs(packageFolder)
-		if err != nil {
-			return fmt.Errorf("error getting absolute path for package folder %s: %w",
-				packageFolder, err)
-		}
-		absFile, err := filepath.Abs(filePath)
-		if err != nil {
-			return fmt.Errorf("error getting absolute path for file %s: %w",
-				filePath, err)
-		}
-		relPath, err := filepath.Rel(absFolder, absFile)
-		if err != nil {
-			return fmt.Errorf("error getting relative path between folder %s and file %s: %w",
-				absFolder, absFile, err)
-		}
-
-		// Normalize (Windows) paths
-		relPath = filepath.ToSlash(relPath)
-		if strings.Index(relPath, ".") == 0 || strings.Contains(relPath, "..") {
-			return nil
-		}
-
-		fileMode := fileInfo.Mode()
-		if fileMode.IsDir() {
-			if !hasFolder(relPath, manifest) {
-				return fmt.Errorf("found non-package folder %s", relPath)
-			}
-		} else if fileMode.IsRegular() {
-			if !hasFile(relPath, manifest) {
-				return fmt.Errorf("found non-package file %s", relPath)
-			}
-		} else {
-			return fmt.Errorf("found unexpected item %s which is not a regular file or folder",
-				relPath)
-		}
-		return nil
-	})
+	items, err := findNonPackageItems(manifest, packageFolder, rules)
+	if err != nil {
+		return err
+	}
+	if len(items) > 0 {
+		return fmt.Errorf("found non-package %s %s", items[0].kind, items[0].relPath)
+	}
+	return nil
 }
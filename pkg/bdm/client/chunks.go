@@ -0,0 +1,209 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+// Location of chunk data in an existing local file
+type localChunk struct {
+	path   string
+	offset int64
+}
+
+// Location of a chunk in a chunked file that is being assembled
+type chunkTarget struct {
+	handle *os.File
+	offset int64
+}
+
+// A chunked file that is assembled in a temporary file next to its final location
+type chunkedFile struct {
+	file     bdm.File
+	handle   *os.File
+	tempPath string
+}
+
+// Assembles chunked files from local data and downloaded chunks
+type chunkAssembly struct {
+	files   []*chunkedFile
+	targets map[string][]chunkTarget
+}
+
+// Searches the outdated local versions of chunked files for chunks that are still required
+func findLocalChunks(files []bdm.File, outputFolder string) map[string]localChunk {
+	required := make(map[string]bool)
+	for _, file := range files {
+		for _, chunk := range file.Chunks {
+			required[chunk.Hash] = true
+		}
+	}
+
+	found := make(map[string]localChunk)
+	for _, file := range files {
+		fullPath := filepath.Join(outputFolder, file.Path)
+		fileInfo, err := os.Stat(fullPath)
+		if err != nil || !fileInfo.Mode().IsRegular() {
+			continue
+		}
+		fileHandle, err := os.Open(fullPath)
+		if err != nil {
+			continue
+		}
+
+		// Errors are ignored, the chunks found so far are still valid
+		var offset int64 = 0
+		util.SplitChunks(fileHandle, func(data []byte) error {
+			hasher := util.CreateHasher()
+			hasher.Write(data)
+			hash := util.GetHashString(hasher)
+			if _, exists := found[hash]; required[hash] && !exists {
+				found[hash] = localChunk{fullPath, offset}
+			}
+			offset += int64(len(data))
+			return nil
+		})
+		fileHandle.Close()
+	}
+
+	return found
+}
+
+// Creates temporary files for all chunked files and fills in the chunks that exist locally.
+// The missing chunks are registered as targets for the downloaded data.
+func prepareChunkAssembly(files []bdm.File, localChunks map[string]localChunk, outputFolder string) (*chunkAssembly, error) {
+	assembly := chunkAssembly{
+		files:   make([]*chunkedFile, 0),
+		targets: make(map[string][]chunkTarget),
+	}
+
+	sources := make(map[string]*os.File)
+	defer func() {
+		for _, source := range sources {
+			source.Close()
+		}
+	}()
+
+	for _, file := range files {
+		fullPath := filepath.Join(outputFolder, file.Path)
+		folder := filepath.Dir(fullPath)
+		if !util.FolderExists(folder) {
+			err := os.MkdirAll(folder, os.ModePerm)
+			if err != nil {
+				assembly.abort()
+				return nil, fmt.Errorf("error creating directory %s: %w", folder, err)
+			}
+		}
+
+		handle, err := os.CreateTemp(folder, ".bdm_chunked_*")
+		if err != nil {
+			assembly.abort()
+			return nil, fmt.Errorf("error creating temporary file for %s: %w", fullPath, err)
+		}
+		assembly.files = append(assembly.files, &chunkedFile{file, handle, handle.Name()})
+
+		var offset int64 = 0
+		for _, chunk := range file.Chunks {
+			local, found := localChunks[chunk.Hash]
+			if found {
+				source, opened := sources[local.path]
+				if !opened {
+					source, err = os.Open(local.path)
+					if err != nil {
+						assembly.abort()
+						return nil, fmt.Errorf("error opening file %s: %w", local.path, err)
+					}
+					sources[local.path] = source
+				}
+				reader := io.NewSectionReader(source, local.offset, chunk.Size)
+				_, err = io.Copy(io.NewOffsetWriter(handle, offset), reader)
+				if err != nil {
+					assembly.abort()
+					return nil, fmt.Errorf("error copying local chunk data from %s: %w", local.path, err)
+				}
+			} else {
+				assembly.targets[chunk.Hash] = append(assembly.targets[chunk.Hash], chunkTarget{handle, offset})
+			}
+			offset += chunk.Size
+		}
+	}
+
+	return &assembly, nil
+}
+
+// Returns the unique chunks that need to be downloaded
+func (assembly *chunkAssembly) getRequiredChunks() []bdm.Object {
+	chunks := make([]bdm.Object, 0)
+	added := make(map[string]bool)
+	for _, chunkedFile := range assembly.files {
+		for _, chunk := range chunkedFile.file.Chunks {
+			if _, required := assembly.targets[chunk.Hash]; required && !added[chunk.Hash] {
+				added[chunk.Hash] = true
+				chunks = append(chunks, chunk)
+			}
+		}
+	}
+	return chunks
+}
+
+func (assembly *chunkAssembly) writeChunk(hash string, data []byte) error {
+	for _, target := range assembly.targets[hash] {
+		_, err := target.handle.WriteAt(data, target.offset)
+		if err != nil {
+			return fmt.Errorf("error writing chunk %s to file %s: %w", hash, target.handle.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Verifies all assembled files and moves them to their final location
+func (assembly *chunkAssembly) finish(outputFolder string) error {
+	defer assembly.abort()
+	for _, chunkedFile := range assembly.files {
+		_, err := chunkedFile.handle.Seek(0, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("error seeking in file %s: %w", chunkedFile.tempPath, err)
+		}
+		hasher := util.CreateHasher()
+		size, err := io.Copy(hasher, chunkedFile.handle)
+		if err != nil {
+			return fmt.Errorf("error hashing file %s: %w", chunkedFile.tempPath, err)
+		}
+		if size != chunkedFile.file.Object.Size {
+			return fmt.Errorf("error assembling file %s: found %d but expected %d bytes",
+				chunkedFile.file.Path, size, chunkedFile.file.Object.Size)
+		}
+		hash := util.GetHashString(hasher)
+		if hash != chunkedFile.file.Object.Hash {
+			return fmt.Errorf("error assembling file %s: found hash %s but expected %s",
+				chunkedFile.file.Path, hash, chunkedFile.file.Object.Hash)
+		}
+
+		err = chunkedFile.handle.Close()
+		if err != nil {
+			return fmt.Errorf("error closing file %s: %w", chunkedFile.tempPath, err)
+		}
+		fullPath := filepath.Join(outputFolder, chunkedFile.file.Path)
+		err = os.Rename(chunkedFile.tempPath, fullPath)
+		if err != nil {
+			return fmt.Errorf("error moving file %s to %s: %w", chunkedFile.tempPath, fullPath, err)
+		}
+		chunkedFile.tempPath = ""
+	}
+	return nil
+}
+
+// Closes and removes all temporary files that were not moved to their final location
+func (assembly *chunkAssembly) abort() {
+	for _, chunkedFile := range assembly.files {
+		chunkedFile.handle.Close()
+		if len(chunkedFile.tempPath) > 0 {
+			os.Remove(chunkedFile.tempPath)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package client
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -24,25 +25,41 @@ func hasFolder(relPath string, manifest *bdm.Manifest) bool {
 			return true
 		}
 	}
+	for _, symlink := range manifest.Symlinks {
+		if strings.Index(symlink.Path, relPath+"/") == 0 {
+			return true
+		}
+	}
+	for _, folder := range manifest.Folders {
+		if folder == relPath || strings.Index(folder, relPath+"/") == 0 {
+			return true
+		}
+	}
 	return false
 }
 
-// CleanPackage will delete all non-package files from a packae folder
-func CleanPackage(manifest *bdm.Manifest, packageFolder string) error {
-	return filepath.Walk(packageFolder, func(filePath string, fileInfo os.FileInfo, err error) error {
-		if os.IsNotExist(err) {
-			// Ignore not existing files.
-			// Files that are not there can also not contaminate a package :)
-			// This happens when we delete whole directories inside this visitor.
-			return nil
-		}
-		if err != nil {
-			return fmt.Errorf("error while walking over folder %s: %w",
-				packageFolder, err)
-		}
-		absFolder, err := filepath.Abs(packageFolder)
+// Describes an item in a package folder that is not part of the package
+type nonPackageItem struct {
+	relPath  string
+	fullPath string
+	kind     string
+}
+
+// Finds all items in the package folder that are neither part of the package nor ignored.
+// Folders are listed before their content. Folders that contain ignored items are not listed,
+// since they cannot be removed without removing the ignored items.
+func findNonPackageItems(manifest *bdm.Manifest, packageFolder string, rules *bdm.IgnoreRules) ([]nonPackageItem, error) {
+	absFolder, err := filepath.Abs(packageFolder)
+	if err != nil {
+		return nil, fmt.Errorf("error getting absolute path for package folder %s: %w",
+			packageFolder, err)
+	}
+
+	items := make([]nonPackageItem, 0)
+	keptFolders := make(map[string]bool)
+	err = filepath.Walk(packageFolder, func(filePath string, fileInfo os.FileInfo, err error) error {
 		if err != nil {
-			return fmt.Errorf("error getting absolute path for package folder %s: %w",
+			return fmt.Errorf("error walking files in folder %s: %w",
 				packageFolder, err)
 		}
 		absFile, err := filepath.Abs(filePath)
@@ -55,30 +72,81 @@ func CleanPackage(manifest *bdm.Manifest, packageFolder string) error {
 			return fmt.Errorf("error getting relative path between folder %s and file %s: %w",
 				absFolder, absFile, err)
 		}
+
+		// Normalize (Windows) paths
 		relPath = filepath.ToSlash(relPath)
 		if strings.Index(relPath, ".") == 0 || strings.Contains(relPath, "..") {
 			return nil
 		}
+
 		fileMode := fileInfo.Mode()
-		remove := false
+		if rules.Ignored(relPath, fileMode.IsDir()) {
+			for parent := path.Dir(relPath); parent != "."; parent = path.Dir(parent) {
+				keptFolders[parent] = true
+			}
+			if fileMode.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		item := nonPackageItem{relPath: relPath, fullPath: filePath}
 		if fileMode.IsDir() {
 			if !hasFolder(relPath, manifest) {
-				remove = true
+				item.kind = "folder"
 			}
 		} else if fileMode.IsRegular() {
 			if !hasFile(relPath, manifest) {
-				remove = true
+				item.kind = "file"
+			}
+		} else if fileMode&os.ModeSymlink != 0 {
+			if !hasSymlink(relPath, manifest) {
+				item.kind = "symlink"
 			}
 		} else {
-			return fmt.Errorf("found unexpected item %s which is not a regular file or folder",
+			return fmt.Errorf("found unexpected item %s which is not a regular file, symlink or folder",
 				relPath)
 		}
-		if remove {
-			err = os.RemoveAll(filePath)
-			if err != nil {
-				return fmt.Errorf("error cleaning path %s: %w", filePath, err)
-			}
+		if len(item.kind) > 0 {
+			items = append(items, item)
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]nonPackageItem, 0, len(items))
+	for _, item := range items {
+		if item.kind != "folder" || !keptFolders[item.relPath] {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered, nil
+}
+
+// CleanPackage will delete all non-package files, symlinks and folders from a packae folder.
+// Items ignored by the ignore file in the package folder are kept.
+func CleanPackage(manifest *bdm.Manifest, packageFolder string) error {
+	rules, err := bdm.LoadIgnoreRules(packageFolder, nil, nil)
+	if err != nil {
+		return err
+	}
+	return cleanPackage(manifest, packageFolder, rules)
+}
+
+func cleanPackage(manifest *bdm.Manifest, packageFolder string, rules *bdm.IgnoreRules) error {
+	items, err := findNonPackageItems(manifest, packageFolder, rules)
+	if err != nil {
+		return err
+	}
+
+	// Remove content before the containing folders
+	for i := len(items) - 1; i >= 0; i-- {
+		err = os.RemoveAll(items[i].fullPath)
+		if err != nil {
+			return fmt.Errorf("error cleaning path %s: %w", items[i].fullPath, err)
+		}
+	}
+	return nil
 }
@@ -3,6 +3,8 @@ package client
 import (
 	"os"
 	"path"
+	"reflect"
+	"runtime"
 	"testing"
 
 	"github.com/cry-inc/bdm/pkg/bdm"
@@ -37,3 +39,73 @@ func TestCleanPackage(t *testing.T) {
 	util.Assert(t, !util.FileExists(junkFile))
 	util.Assert(t, !util.FolderExists(junkFolder))
 }
+
+func TestSymlinksAndFolders(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires special privileges on Windows")
+	}
+	const testFolder = "testPackage"
+	defer os.RemoveAll(testFolder)
+
+	util.AssertNoError(t, os.MkdirAll(path.Join(testFolder, "lib"), os.ModePerm))
+	util.AssertNoError(t, os.MkdirAll(path.Join(testFolder, "empty"), os.ModePerm))
+	util.AssertNoError(t, os.WriteFile(path.Join(testFolder, "lib", "libfoo.so.1"), []byte{1, 2, 3}, os.ModePerm))
+	util.AssertNoError(t, os.Symlink("libfoo.so.1", path.Join(testFolder, "lib", "libfoo.so")))
+
+	manifest, err := bdm.GenerateManifest("foo", testFolder)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(manifest.Files) == 1)
+	util.Assert(t, reflect.DeepEqual(manifest.Symlinks, []bdm.Symlink{{Path: "lib/libfoo.so", Target: "libfoo.so.1"}}))
+	util.Assert(t, reflect.DeepEqual(manifest.Folders, []string{"empty"}))
+	util.AssertNoError(t, CheckFiles(manifest, testFolder, true))
+
+	// Clean keeps package symlinks and folders but removes others
+	junkLink := path.Join(testFolder, "junk")
+	util.AssertNoError(t, os.Symlink("lib", junkLink))
+	util.AssertError(t, CheckFiles(manifest, testFolder, true))
+	util.AssertNoError(t, CleanPackage(manifest, testFolder))
+	util.Assert(t, !isSymlink(junkLink))
+	util.AssertNoError(t, CheckFiles(manifest, testFolder, true))
+
+	// Missing and wrong items are detected and can be restored
+	util.AssertNoError(t, os.Remove(path.Join(testFolder, "empty")))
+	util.AssertError(t, CheckFiles(manifest, testFolder, false))
+	util.AssertNoError(t, os.Remove(path.Join(testFolder, "lib", "libfoo.so")))
+	util.AssertNoError(t, os.Symlink("other", path.Join(testFolder, "lib", "libfoo.so")))
+	util.AssertError(t, CheckFiles(manifest, testFolder, false))
+	util.AssertNoError(t, createSymlinksAndFolders(manifest, testFolder))
+	util.AssertNoError(t, CheckFiles(manifest, testFolder, true))
+
+	// Symlinks replaced by real folders must not redirect the files inside of them
+	util.AssertNoError(t, os.Symlink("lib", path.Join(testFolder, "redirect")))
+	manifest.Files[0].Path = "redirect/libfoo.so.1"
+	util.AssertNoError(t, removeBlockingSymlinks(manifest, testFolder))
+	util.Assert(t, !isSymlink(path.Join(testFolder, "redirect")))
+	util.Assert(t, util.FileExists(path.Join(testFolder, "lib", "libfoo.so.1")))
+}
+
+func TestCleanWithIgnoreFile(t *testing.T) {
+	const testFolder = "testPackage"
+	defer os.RemoveAll(testFolder)
+
+	util.AssertNoError(t, os.MkdirAll(path.Join(testFolder, "bin"), os.ModePerm))
+	util.AssertNoError(t, os.WriteFile(path.Join(testFolder, "bin", "app.exe"), []byte{1, 2, 3}, os.ModePerm))
+	ignoreData := []byte("*.log\nbuild/\n")
+	util.AssertNoError(t, os.WriteFile(path.Join(testFolder, bdm.IgnoreFileName), ignoreData, os.ModePerm))
+	manifest, err := bdm.GenerateManifest("foo", testFolder)
+	util.AssertNoError(t, err)
+
+	// Ignored items survive cleaning together with their folders
+	util.AssertNoError(t, os.MkdirAll(path.Join(testFolder, "build", "obj"), os.ModePerm))
+	util.AssertNoError(t, os.MkdirAll(path.Join(testFolder, "logs"), os.ModePerm))
+	logFile := path.Join(testFolder, "logs", "run.log")
+	util.AssertNoError(t, os.WriteFile(logFile, []byte{1}, os.ModePerm))
+	junkFile := path.Join(testFolder, "logs", "junk.txt")
+	util.AssertNoError(t, os.WriteFile(junkFile, []byte{1}, os.ModePerm))
+	util.AssertError(t, CheckFiles(manifest, testFolder, true))
+	util.AssertNoError(t, CleanPackage(manifest, testFolder))
+	util.Assert(t, util.FileExists(logFile))
+	util.Assert(t, !util.FileExists(junkFile))
+	util.Assert(t, util.FolderExists(path.Join(testFolder, "build", "obj")))
+	util.AssertNoError(t, CheckFiles(manifest, testFolder, true))
+}
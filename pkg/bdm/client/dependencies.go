@@ -0,0 +1,157 @@
+package client
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+)
+
+// ResolvedPackage is a node of a resolved dependency tree
+type ResolvedPackage struct {
+	PackageName    string
+	PackageVersion uint
+	// Version constraint of the dependency, empty for the root package
+	Constraint string
+	// Slash separated folder relative to the root package folder, empty for the root package
+	Folder       string
+	Dependencies []*ResolvedPackage
+	manifest     *bdm.Manifest
+}
+
+// String formats the tree with one indented line per package
+func (node *ResolvedPackage) String() string {
+	var builder strings.Builder
+	node.format(&builder, 0)
+	return builder.String()
+}
+
+func (node *ResolvedPackage) format(builder *strings.Builder, depth int) {
+	builder.WriteString(strings.Repeat("  ", depth))
+	fmt.Fprintf(builder, "%s %d", node.PackageName, node.PackageVersion)
+	if depth > 0 {
+		fmt.Fprintf(builder, " (%s) in %s", node.Constraint, node.Folder)
+	}
+	builder.WriteString("\n")
+	for _, dependency := range node.Dependencies {
+		dependency.format(builder, depth+1)
+	}
+}
+
+// ResolveDependencies downloads the manifests of all direct and indirect dependencies of a package.
+// Each package name is resolved to a single version for the whole tree. The dependency closest to the root
+// selects the highest version that matches its constraint and is not yanked. Exact versions are used
+// even if they are yanked. All other dependencies on the same package must accept the selected version.
+// Cycles and conflicting constraints are reported as errors.
+func ResolveDependencies(manifest *bdm.Manifest, serverURL, apiToken string, options DownloadOptions) (*ResolvedPackage, error) {
+	root := &ResolvedPackage{
+		PackageName:    manifest.PackageName,
+		PackageVersion: manifest.PackageVersion,
+		manifest:       manifest,
+	}
+	selected := map[string]*bdm.Manifest{manifest.PackageName: manifest}
+	ancestors := map[*ResolvedPackage][]string{root: {manifest.PackageName}}
+
+	// Breadth-first, so that dependencies closer to the root select the versions
+	queue := []*ResolvedPackage{root}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, dependency := range parent.manifest.Dependencies {
+			chain := append(append([]string{}, ancestors[parent]...), dependency.PackageName)
+			for _, ancestor := range ancestors[parent] {
+				if ancestor == dependency.PackageName {
+					return nil, fmt.Errorf("found dependency cycle %s", strings.Join(chain, " -> "))
+				}
+			}
+
+			constraint, err := bdm.ParseVersionConstraint(dependency.Version)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing dependency of package %s: %w", parent.PackageName, err)
+			}
+			depManifest, found := selected[dependency.PackageName]
+			if found {
+				if !constraint.Matches(depManifest.PackageVersion) {
+					return nil, fmt.Errorf("found conflict for package %s: version %d was selected, but package %s requires %s",
+						dependency.PackageName, depManifest.PackageVersion, parent.PackageName, dependency.Version)
+				}
+			} else {
+				version, err := selectVersion(serverURL, apiToken, dependency.PackageName, constraint)
+				if err != nil {
+					return nil, fmt.Errorf("error resolving dependency %s %s of package %s: %w",
+						dependency.PackageName, dependency.Version, parent.PackageName, err)
+				}
+				depManifest, err = DownloadManifestWithOptions(serverURL, apiToken, dependency.PackageName, version, options)
+				if err != nil {
+					return nil, fmt.Errorf("error getting manifest of dependency %s: %w", dependency.PackageName, err)
+				}
+				selected[dependency.PackageName] = depManifest
+			}
+
+			node := &ResolvedPackage{
+				PackageName:    depManifest.PackageName,
+				PackageVersion: depManifest.PackageVersion,
+				Constraint:     dependency.Version,
+				Folder:         path.Join(parent.Folder, dependency.Folder),
+				manifest:       depManifest,
+			}
+			parent.Dependencies = append(parent.Dependencies, node)
+			ancestors[node] = chain
+			queue = append(queue, node)
+		}
+	}
+
+	return root, nil
+}
+
+// Selects the highest matching version, exact versions are used without asking the server
+func selectVersion(serverURL, apiToken, name string, constraint *bdm.VersionConstraint) (uint, error) {
+	version, exact := constraint.Exact()
+	if exact {
+		return version, nil
+	}
+	versions, err := getPackageVersions(serverURL, apiToken, name)
+	if err != nil {
+		return 0, fmt.Errorf("error getting versions from server: %w", err)
+	}
+	var highest uint
+	for _, remote := range versions {
+		if !remote.Yanked && remote.Version > highest && constraint.Matches(remote.Version) {
+			highest = remote.Version
+		}
+	}
+	if highest == 0 {
+		return 0, fmt.Errorf("found no matching version")
+	}
+	return highest, nil
+}
+
+// Combines all packages of the tree into a single manifest with paths relative to the root package folder.
+// Files of packages that are used in multiple folders share their objects, so they are downloaded only once.
+func flattenDependencies(root *ResolvedPackage) *bdm.Manifest {
+	combined := *root.manifest
+	combined.Files = make([]bdm.File, 0, len(root.manifest.Files))
+	combined.Symlinks = nil
+	combined.Folders = nil
+
+	nodes := []*ResolvedPackage{root}
+	for len(nodes) > 0 {
+		node := nodes[0]
+		nodes = append(nodes[1:], node.Dependencies...)
+		for _, file := range node.manifest.Files {
+			file.Path = path.Join(node.Folder, file.Path)
+			combined.Files = append(combined.Files, file)
+		}
+		for _, symlink := range node.manifest.Symlinks {
+			// Targets are relative to the symlink and stay valid
+			symlink.Path = path.Join(node.Folder, symlink.Path)
+			combined.Symlinks = append(combined.Symlinks, symlink)
+		}
+		for _, folder := range node.manifest.Folders {
+			combined.Folders = append(combined.Folders, path.Join(node.Folder, folder))
+		}
+	}
+
+	return &combined
+}
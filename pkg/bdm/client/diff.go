@@ -0,0 +1,18 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+)
+
+// DiffPackage asks the server for the file differences between two versions of a package
+func DiffPackage(serverURL, apiToken, name string, oldVersion, newVersion uint) (*bdm.ManifestDiff, error) {
+	url := fmt.Sprintf("%s/diff/%s/%d/%d", serverURL, name, oldVersion, newVersion)
+	var diff bdm.ManifestDiff
+	err := getJSON(url, apiToken, &diff)
+	if err != nil {
+		return nil, fmt.Errorf("error getting diff of package %s: %w", name, err)
+	}
+	return &diff, nil
+}
@@ -1,60 +1,129 @@
 package client
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/cry-inc/bdm/pkg/bdm"
 	"github.com/cry-inc/bdm/pkg/bdm/store"
 	"github.com/cry-inc/bdm/pkg/bdm/util"
 )
 
+// DownloadOptions configures downloads and checks of packages
+type DownloadOptions struct {
+	// Optional local cache folder to avoid downloading objects again
+	CacheFolder string
+	// Deletes or complains about non-package files in the package folder
+	Clean bool
+	// Restores or checks the file permissions and modification times recorded in the manifest
+	FileMetadata bool
+	// Refuses manifests that are signed by other keys
+	TrustedKeys []ed25519.PublicKey
+	// Refuses unsigned manifests as well, only signatures of trusted keys are accepted
+	RequireSignature bool
+	// Additional ignore patterns for items that are neither removed by clean nor reported by checks.
+	// They are applied after the patterns of the ignore file in the package folder.
+	Exclude []string
+	// Patterns for items that are not ignored even if they are excluded
+	Include []string
+}
+
 // DownloadPackage downloads a package from a remote server to a local folder
 func DownloadPackage(outputFolder, serverURL, apiToken, name string, version uint, clean bool) error {
-	manifest, err := DownloadManifest(serverURL, apiToken, name, version)
+	return DownloadPackageWithOptions(outputFolder, serverURL, apiToken, name, version, DownloadOptions{Clean: clean})
+}
+
+// DownloadCachedPackage is like DownloadPackage with an additional local cache
+func DownloadCachedPackage(outputFolder, cacheFolder, serverURL, apiToken, name string, version uint, clean bool) error {
+	options := DownloadOptions{CacheFolder: cacheFolder, Clean: clean}
+	return DownloadPackageWithOptions(outputFolder, serverURL, apiToken, name, version, options)
+}
+
+// DownloadPackageWithOptions is DownloadPackage with additional options
+func DownloadPackageWithOptions(outputFolder, serverURL, apiToken, name string, version uint, options DownloadOptions) error {
+	_, err := DownloadPackageWithDependencies(outputFolder, serverURL, apiToken, name, version, options)
+	return err
+}
+
+// DownloadPackageWithDependencies is DownloadPackageWithOptions that also returns the resolved dependency tree.
+// All dependencies are downloaded into their folders inside of the output folder together with the package.
+func DownloadPackageWithDependencies(outputFolder, serverURL, apiToken, name string, version uint, options DownloadOptions) (*ResolvedPackage, error) {
+	rootManifest, err := DownloadManifestWithOptions(serverURL, apiToken, name, version, options)
 	if err != nil {
-		return fmt.Errorf("error downloading manifest: %w", err)
+		return nil, err
 	}
 
-	err = DownloadFiles(serverURL, apiToken, manifest, outputFolder)
+	tree, err := ResolveDependencies(rootManifest, serverURL, apiToken, options)
 	if err != nil {
-		return fmt.Errorf("error downloading files: %w", err)
+		return nil, fmt.Errorf("error resolving dependencies: %w", err)
 	}
+	manifest := flattenDependencies(tree)
 
-	if clean {
-		err = CleanPackage(manifest, outputFolder)
+	if len(options.CacheFolder) > 0 {
+		err = DownloadCachedFiles(options.CacheFolder, serverURL, apiToken, manifest, outputFolder)
 		if err != nil {
-			return fmt.Errorf("error cleaning package output folder: %w", err)
+			return nil, fmt.Errorf("error downloading cached files: %w", err)
+		}
+	} else {
+		err = DownloadFiles(serverURL, apiToken, manifest, outputFolder)
+		if err != nil {
+			return nil, fmt.Errorf("error downloading files: %w", err)
 		}
 	}
 
-	return nil
-}
+	if options.Clean {
+		rules, err := bdm.LoadIgnoreRules(outputFolder, options.Exclude, options.Include)
+		if err != nil {
+			return nil, err
+		}
+		err = cleanPackage(manifest, outputFolder, rules)
+		if err != nil {
+			return nil, fmt.Errorf("error cleaning package output folder: %w", err)
+		}
+	}
 
-// DownloadCachedPackage is like DownloadPackage with an additional local cache
-func DownloadCachedPackage(outputFolder, cacheFolder, serverURL, apiToken, name string, version uint, clean bool) error {
-	manifest, err := DownloadCachedManifest(cacheFolder, serverURL, apiToken, name, version)
-	if err != nil {
-		return fmt.Errorf("error downloading cached manifest: %w", err)
+	if options.FileMetadata {
+		err = RestoreFileMetadata(manifest, outputFolder)
+		if err != nil {
+			return nil, fmt.Errorf("error restoring file metadata: %w", err)
+		}
 	}
 
-	err = DownloadCachedFiles(cacheFolder, serverURL, apiToken, manifest, outputFolder)
-	if err != nil {
-		return fmt.Errorf("error downloading cached files: %w", err)
+	return tree, nil
+}
+
+// DownloadManifestWithOptions is DownloadManifest with additional options.
+// It uses the cache and verifies the signature when configured in the options.
+func DownloadManifestWithOptions(serverURL, apiToken, name string, version uint, options DownloadOptions) (*bdm.Manifest, error) {
+	var manifest *bdm.Manifest
+	var err error
+	if len(options.CacheFolder) > 0 {
+		manifest, err = DownloadCachedManifest(options.CacheFolder, serverURL, apiToken, name, version)
+		if err != nil {
+			return nil, fmt.Errorf("error downloading cached manifest: %w", err)
+		}
+	} else {
+		manifest, err = DownloadManifest(serverURL, apiToken, name, version)
+		if err != nil {
+			return nil, fmt.Errorf("error downloading manifest: %w", err)
+		}
 	}
 
-	if clean {
-		err = CleanPackage(manifest, outputFolder)
+	if options.RequireSignature || (manifest.Signature != nil && len(options.TrustedKeys) > 0) {
+		err = bdm.VerifyManifestSignature(manifest, options.TrustedKeys)
 		if err != nil {
-			return fmt.Errorf("error cleaning package output folder: %w", err)
+			return nil, fmt.Errorf("error verifying manifest signature: %w", err)
 		}
 	}
 
-	return nil
+	return manifest, nil
 }
 
 // DownloadManifest fetches the specified package manifest from a server
@@ -66,6 +135,7 @@ func DownloadManifest(serverURL, apiToken, name string, version uint) (*bdm.Mani
 	}
 
 	req.Header.Add(bdm.ApiTokenHeader, apiToken)
+	req.Header.Add(bdm.ManifestVersionHeader, fmt.Sprint(bdm.LatestManifestVersion))
 	client := &http.Client{}
 	res, err := client.Do(req)
 	if err != nil {
@@ -95,6 +165,12 @@ func DownloadManifest(serverURL, apiToken, name string, version uint) (*bdm.Mani
 		return nil, fmt.Errorf("error validating received manifest: %w", err)
 	}
 
+	// Publisher signatures do not cover the version, so a server could swap it
+	if manifest.PackageName != name || manifest.PackageVersion != version {
+		return nil, fmt.Errorf("received manifest %s %d instead of requested %s %d",
+			manifest.PackageName, manifest.PackageVersion, name, version)
+	}
+
 	return &manifest, nil
 }
 
@@ -104,6 +180,7 @@ func DownloadCachedManifest(cacheFolder, serverURL, apiToken, name string, versi
 	if err != nil {
 		return nil, fmt.Errorf("failed to open cache store at location %s: %w", cacheFolder, err)
 	}
+	defer store.Close()
 
 	manifest, err := store.GetManifest(name, version)
 	if err == nil {
@@ -128,7 +205,7 @@ func getMissingFiles(manifest *bdm.Manifest, outputFolder string) []bdm.File {
 	missingFiles := make([]bdm.File, 0)
 	for _, file := range manifest.Files {
 		fullPath := filepath.Join(outputFolder, file.Path)
-		fileInfo, err := os.Stat(fullPath)
+		fileInfo, err := os.Lstat(fullPath)
 		if err == nil && !fileInfo.IsDir() && fileInfo.Mode().IsRegular() {
 			fileSize := fileInfo.Size()
 			if fileSize == file.Object.Size {
@@ -172,28 +249,28 @@ func writeObjectToFiles(reader io.Reader, files []bdm.File, outputFolder string)
 		}
 		if i == 0 {
 			// First file is special, since its streamed over the network
-			fileHandle, err := os.Create(fullPath)
-			if err != nil {
-				return fmt.Errorf("error creating file %s: %w", fullPath, err)
-			}
-			defer fileHandle.Close()
+			err := replaceFile(fullPath, func(fileHandle io.Writer) error {
+				hasher := util.CreateHasher()
+				writer := io.MultiWriter(fileHandle, hasher)
 
-			hasher := util.CreateHasher()
-			writer := io.MultiWriter(fileHandle, hasher)
+				written, err := io.CopyN(writer, reader, file.Object.Size)
+				if err != nil {
+					return fmt.Errorf("error writing object data for file %s: %w", file.Path, err)
+				}
+				if written != file.Object.Size {
+					return fmt.Errorf("error writing object data for file %s: received %d but expected %d bytes",
+						file.Path, written, file.Object.Size)
+				}
 
-			written, err := io.CopyN(writer, reader, file.Object.Size)
+				hash := util.GetHashString(hasher)
+				if hash != file.Object.Hash {
+					return fmt.Errorf("error writing object data for file %s: found hash %s but expected %s",
+						file.Path, hash, file.Object.Hash)
+				}
+				return nil
+			})
 			if err != nil {
-				return fmt.Errorf("error writing object data for file %s: %w", file.Path, err)
-			}
-			if written != file.Object.Size {
-				return fmt.Errorf("error writing object data for file %s: received %d but expected %d bytes",
-					file.Path, written, file.Object.Size)
-			}
-
-			hash := util.GetHashString(hasher)
-			if hash != file.Object.Hash {
-				return fmt.Errorf("error writing object data for file %s: found hash %s but expected %s",
-					file.Path, hash, file.Object.Hash)
+				return err
 			}
 		} else {
 			// All the other files are copied locallay since they have the same content!
@@ -215,21 +292,45 @@ func copyFile(source, target, hash string) error {
 	}
 	defer readHandle.Close()
 
-	writeHandle, err := os.Create(target)
-	if err != nil {
-		return fmt.Errorf("unable to open target file %s: %w", target, err)
-	}
-	defer writeHandle.Close()
+	return replaceFile(target, func(writeHandle io.Writer) error {
+		hasher := util.CreateHasher()
+		writer := io.MultiWriter(writeHandle, hasher)
 
-	hasher := util.CreateHasher()
-	writer := io.MultiWriter(writeHandle, hasher)
+		_, err := io.Copy(writer, readHandle)
+		if err != nil {
+			return fmt.Errorf("unable to copy file data: %w", err)
+		}
+		if util.GetHashString(hasher) != hash {
+			return fmt.Errorf("failed to verify file content: Hash mismatch")
+		}
+		return nil
+	})
+}
 
-	_, err = io.Copy(writer, readHandle)
+// Writes the file content into a temporary file next to the target and moves it into place.
+// This replaces existing files even if they are read-only and never leaves half-written files behind.
+func replaceFile(target string, write func(writer io.Writer) error) error {
+	tempPath := filepath.Join(filepath.Dir(target),
+		fmt.Sprintf(".bdm_download_%d", time.Now().UnixNano()))
+	handle, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
-		return fmt.Errorf("unable to copy file data: %w", err)
+		return fmt.Errorf("error creating temporary file for %s: %w", target, err)
 	}
-	if util.GetHashString(hasher) != hash {
-		return fmt.Errorf("failed to verify file content: Hash mismatch")
+
+	err = write(handle)
+	closeErr := handle.Close()
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("error closing file %s: %w", tempPath, closeErr)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, target)
+		if err != nil {
+			err = fmt.Errorf("error moving file %s to %s: %w", tempPath, target, err)
+		}
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
 	}
 
 	return nil
@@ -237,7 +338,29 @@ func copyFile(source, target, hash string) error {
 
 // DownloadFiles downloads all all files from a manifest to a output folder.
 // It skips all files that already exists in the folder with the correct size and hash.
+// Chunked files are assembled from chunks found in their outdated local versions
+// and only the remaining chunks are downloaded.
+// Symlinks and empty folders of the package are created afterwards.
 func DownloadFiles(serverURL, apiToken string, manifest *bdm.Manifest, outputFolder string) error {
+	err := removeBlockingSymlinks(manifest, outputFolder)
+	if err != nil {
+		return fmt.Errorf("error preparing output folder: %w", err)
+	}
+
+	err = downloadMissingFiles(serverURL, apiToken, manifest, outputFolder)
+	if err != nil {
+		return err
+	}
+
+	err = createSymlinksAndFolders(manifest, outputFolder)
+	if err != nil {
+		return fmt.Errorf("error creating symlinks and folders: %w", err)
+	}
+
+	return nil
+}
+
+func downloadMissingFiles(serverURL, apiToken string, manifest *bdm.Manifest, outputFolder string) error {
 	missingFiles := getMissingFiles(manifest, outputFolder)
 
 	if len(missingFiles) == 0 {
@@ -245,10 +368,88 @@ func DownloadFiles(serverURL, apiToken string, manifest *bdm.Manifest, outputFol
 		return nil
 	}
 
+	plainFiles := make([]bdm.File, 0)
+	chunkedFiles := make([]bdm.File, 0)
+	for _, file := range missingFiles {
+		if len(file.Chunks) > 0 {
+			chunkedFiles = append(chunkedFiles, file)
+		} else {
+			plainFiles = append(plainFiles, file)
+		}
+	}
+
+	localChunks := findLocalChunks(chunkedFiles, outputFolder)
+	assembly, err := prepareChunkAssembly(chunkedFiles, localChunks, outputFolder)
+	if err != nil {
+		return fmt.Errorf("error preparing chunked files: %w", err)
+	}
+	defer assembly.abort()
+
 	// Filter duplicate file objects to download them only once!
-	filteredFiles := filterDuplicateFileObjects(missingFiles)
+	filteredFiles := filterDuplicateFileObjects(plainFiles)
 	requiredObjects := getObjects(filteredFiles)
+	requiredObjectsMap := make(map[string]bool)
+	for _, object := range requiredObjects {
+		requiredObjectsMap[object.Hash] = true
+	}
+	for _, chunk := range assembly.getRequiredChunks() {
+		if !requiredObjectsMap[chunk.Hash] {
+			requiredObjects = append(requiredObjects, chunk)
+		}
+	}
+
+	if len(requiredObjects) > 0 {
+		err = downloadObjects(serverURL, apiToken, requiredObjects, func(object bdm.Object, reader io.Reader) error {
+			// Get list of missing files that needs this object as content
+			files := filterFilesByObject(plainFiles, object.Hash)
+
+			if _, isChunk := assembly.targets[object.Hash]; isChunk {
+				// Chunks are small enough to be kept in memory
+				if object.Size > util.ChunkMaxSize {
+					return fmt.Errorf("found invalid chunk size %d", object.Size)
+				}
+				data := make([]byte, object.Size)
+				_, err := io.ReadFull(reader, data)
+				if err != nil {
+					return fmt.Errorf("error reading chunk %s: %w", object.Hash, err)
+				}
+				hasher := util.CreateHasher()
+				hasher.Write(data)
+				hash := util.GetHashString(hasher)
+				if hash != object.Hash {
+					return fmt.Errorf("error reading chunk: found hash %s but expected %s", hash, object.Hash)
+				}
+				err = assembly.writeChunk(object.Hash, data)
+				if err != nil {
+					return err
+				}
+				reader = bytes.NewReader(data)
+			}
+
+			if len(files) > 0 {
+				// Stream objects files to the output folder and verify them
+				err := writeObjectToFiles(reader, files, outputFolder)
+				if err != nil {
+					return fmt.Errorf("error writing object to files in output folder: %w", err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = assembly.finish(outputFolder)
+	if err != nil {
+		return fmt.Errorf("error finishing chunked files: %w", err)
+	}
+
+	return nil
+}
 
+// Requests objects from the server and calls the handler for every incoming object
+func downloadObjects(serverURL, apiToken string, requiredObjects []bdm.Object, handler func(object bdm.Object, reader io.Reader) error) error {
 	r, w := io.Pipe()
 	go func() {
 		defer w.Close()
@@ -299,13 +500,9 @@ func DownloadFiles(serverURL, apiToken string, manifest *bdm.Manifest, outputFol
 	}
 
 	for _, object := range incomingObjects {
-		// Get list of missing files that needs this object as content
-		files := filterFilesByObject(missingFiles, object.Hash)
-
-		// Stream objects files to the output folder and verify them
-		err := writeObjectToFiles(reader, files, outputFolder)
+		err = handler(object, reader)
 		if err != nil {
-			return fmt.Errorf("error writing object to files in output folder: %w", err)
+			return err
 		}
 	}
 
@@ -318,6 +515,12 @@ func DownloadCachedFiles(cacheFolder, serverURL, apiToken string, manifest *bdm.
 	if err != nil {
 		return fmt.Errorf("failed to open cache store at location %s: %w", cacheFolder, err)
 	}
+	defer cache.Close()
+
+	err = removeBlockingSymlinks(manifest, outputFolder)
+	if err != nil {
+		return fmt.Errorf("error preparing output folder: %w", err)
+	}
 
 	err = restoreFilesFromCache(cache, manifest, outputFolder)
 	if err != nil {
@@ -350,35 +553,35 @@ func restoreFilesFromCache(cache store.Store, manifest *bdm.Manifest, outputFold
 					return fmt.Errorf("error creating directory %s: %w", folder, err)
 				}
 			}
-			fileHandle, err := os.Create(fullPath)
-			if err != nil {
-				return fmt.Errorf("error creating file %s: %w", fullPath, err)
-			}
-			defer fileHandle.Close()
-
 			reader, err := cache.ReadObject(object.Hash)
 			if err != nil {
 				return fmt.Errorf("error reading object %s from cache: %w", object.Hash, err)
 			}
 			defer reader.Close()
 
-			hasher := util.CreateHasher()
-			writer := io.MultiWriter(fileHandle, hasher)
+			err = replaceFile(fullPath, func(fileHandle io.Writer) error {
+				hasher := util.CreateHasher()
+				writer := io.MultiWriter(fileHandle, hasher)
 
-			written, err := io.Copy(writer, reader)
-			if err != nil {
-				return fmt.Errorf("error writing object data: %w", err)
-			}
+				written, err := io.Copy(writer, reader)
+				if err != nil {
+					return fmt.Errorf("error writing object data: %w", err)
+				}
 
-			if written != object.Size {
-				return fmt.Errorf("error writing object data for file %s: received %d but expected %d bytes",
-					file.Path, written, file.Object.Size)
-			}
+				if written != object.Size {
+					return fmt.Errorf("error writing object data for file %s: received %d but expected %d bytes",
+						file.Path, written, file.Object.Size)
+				}
 
-			hash := util.GetHashString(hasher)
-			if hash != file.Object.Hash {
-				return fmt.Errorf("error writing object data for file %s: found hash %s but expected %s",
-					file.Path, hash, file.Object.Hash)
+				hash := util.GetHashString(hasher)
+				if hash != file.Object.Hash {
+					return fmt.Errorf("error writing object data for file %s: found hash %s but expected %s",
+						file.Path, hash, file.Object.Hash)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
 			}
 		}
 	}
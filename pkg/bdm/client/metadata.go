@@ -0,0 +1,58 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+)
+
+// RestoreFileMetadata applies the permissions and modification times recorded
+// in the manifest to the files in the package folder.
+// Files without recorded metadata are not touched.
+func RestoreFileMetadata(manifest *bdm.Manifest, packageFolder string) error {
+	for _, file := range manifest.Files {
+		fullPath := filepath.Join(packageFolder, file.Path)
+		if file.Mode != 0 {
+			err := os.Chmod(fullPath, os.FileMode(file.Mode))
+			if err != nil {
+				return fmt.Errorf("error setting mode of file %s: %w", fullPath, err)
+			}
+		}
+		if file.ModTime > 0 {
+			modTime := time.Unix(file.ModTime, 0)
+			err := os.Chtimes(fullPath, modTime, modTime)
+			if err != nil {
+				return fmt.Errorf("error setting modification time of file %s: %w", fullPath, err)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckFileMetadata compares the permissions and modification times of the files
+// in the package folder against the metadata recorded in the manifest.
+// Permissions are not checked on Windows since it does not support POSIX modes.
+func CheckFileMetadata(manifest *bdm.Manifest, packageFolder string) error {
+	for _, file := range manifest.Files {
+		fullPath := filepath.Join(packageFolder, file.Path)
+		fileInfo, err := os.Stat(fullPath)
+		if err != nil {
+			return fmt.Errorf("error reading stats for file %s: %w", fullPath, err)
+		}
+		mode := uint32(fileInfo.Mode().Perm())
+		if file.Mode != 0 && runtime.GOOS != "windows" && mode != file.Mode {
+			return fmt.Errorf("file %s has the wrong mode: expected %o and found %o",
+				file.Path, file.Mode, mode)
+		}
+		modTime := fileInfo.ModTime().Unix()
+		if file.ModTime > 0 && modTime != file.ModTime {
+			return fmt.Errorf("file %s has the wrong modification time: expected %d and found %d",
+				file.Path, file.ModTime, modTime)
+		}
+	}
+	return nil
+}
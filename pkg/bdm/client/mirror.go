@@ -0,0 +1,210 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/store"
+)
+
+// MirrorResult summarizes the changes of a mirror run
+type MirrorResult struct {
+	// Package versions added to the local store
+	Manifests int
+	// Objects downloaded into the local store
+	Objects int
+	// Sum of the sizes of all downloaded objects
+	Bytes int64
+	// Package versions with a changed yanked state
+	Yanked int
+	// Package versions skipped because they were deleted in the local store
+	Deleted int
+}
+
+// Entry of the version list returned by the server
+type remoteVersion struct {
+	Version uint
+	Yanked  bool
+}
+
+// MirrorPackages pulls all package versions from a remote server that are missing in the local store.
+// Version numbers and manifest hashes are preserved. Package versions that already exist locally
+// are skipped, so running it repeatedly only transfers new data. Versions deleted in the local store
+// are skipped as well and are never restored. The yanked state of all other package
+// versions is synchronized. If the name filter is not nil, only matching packages are mirrored.
+func MirrorPackages(packageStore store.Store, serverURL, apiToken string, nameFilter *regexp.Regexp) (*MirrorResult, error) {
+	names, err := getPackageNames(serverURL, apiToken)
+	if err != nil {
+		return nil, fmt.Errorf("error getting package names from server: %w", err)
+	}
+
+	var result MirrorResult
+	for _, name := range names {
+		if nameFilter != nil && !nameFilter.MatchString(name) {
+			continue
+		}
+		err = mirrorPackage(packageStore, serverURL, apiToken, name, &result)
+		if err != nil {
+			return &result, fmt.Errorf("error mirroring package %s: %w", name, err)
+		}
+	}
+
+	return &result, nil
+}
+
+func mirrorPackage(packageStore store.Store, serverURL, apiToken, name string, result *MirrorResult) error {
+	versions, err := getPackageVersions(serverURL, apiToken, name)
+	if err != nil {
+		return fmt.Errorf("error getting versions from server: %w", err)
+	}
+
+	localVersions, err := packageStore.GetVersions(name)
+	if err != nil {
+		return fmt.Errorf("error getting local versions: %w", err)
+	}
+	existing := make(map[uint]bool)
+	for _, version := range localVersions {
+		existing[version] = true
+	}
+
+	for _, version := range versions {
+		if !existing[version.Version] {
+			deleted, err := packageStore.IsDeleted(name, version.Version)
+			if err != nil {
+				return fmt.Errorf("error getting deleted state of version %d: %w", version.Version, err)
+			}
+			if deleted {
+				result.Deleted++
+				continue
+			}
+			manifest, err := DownloadManifest(serverURL, apiToken, name, version.Version)
+			if err != nil {
+				return fmt.Errorf("error downloading manifest: %w", err)
+			}
+			err = mirrorObjects(packageStore, serverURL, apiToken, manifest, result)
+			if err != nil {
+				return fmt.Errorf("error mirroring objects of version %d: %w", version.Version, err)
+			}
+			err = packageStore.AddManifest(manifest)
+			if err != nil {
+				return fmt.Errorf("error adding manifest of version %d: %w", version.Version, err)
+			}
+			result.Manifests++
+		}
+
+		yanked, err := packageStore.IsYanked(name, version.Version)
+		if err != nil {
+			return fmt.Errorf("error getting yanked state of version %d: %w", version.Version, err)
+		}
+		if yanked != version.Yanked {
+			err = packageStore.YankManifest(name, version.Version, version.Yanked)
+			if err != nil {
+				return fmt.Errorf("error changing yanked state of version %d: %w", version.Version, err)
+			}
+			result.Yanked++
+		}
+	}
+
+	return nil
+}
+
+// Downloads all objects of a manifest that are missing in the local store
+func mirrorObjects(packageStore store.Store, serverURL, apiToken string, manifest *bdm.Manifest, result *MirrorResult) error {
+	missingObjects := make([]bdm.Object, 0)
+	added := make(map[string]bool)
+	for _, file := range manifest.Files {
+		for _, object := range bdm.GetFileObjects(&file) {
+			if added[object.Hash] {
+				continue
+			}
+			added[object.Hash] = true
+			_, err := packageStore.GetObject(object.Hash)
+			if err != nil {
+				missingObjects = append(missingObjects, object)
+			}
+		}
+	}
+
+	if len(missingObjects) == 0 {
+		return nil
+	}
+
+	return downloadObjects(serverURL, apiToken, missingObjects, func(object bdm.Object, reader io.Reader) error {
+		stored, err := packageStore.AddObject(io.LimitReader(reader, object.Size))
+		if err != nil {
+			return fmt.Errorf("error adding object %s: %w", object.Hash, err)
+		}
+		if stored.Size != object.Size || stored.Hash != object.Hash {
+			return fmt.Errorf("error adding object %s: received object %s with %d bytes but expected %d bytes",
+				object.Hash, stored.Hash, stored.Size, object.Size)
+		}
+		result.Objects++
+		result.Bytes += object.Size
+		return nil
+	})
+}
+
+func getPackageNames(serverURL, apiToken string) ([]string, error) {
+	type nameListItem struct{ Name string }
+	var nameList []nameListItem
+	err := getJSON(serverURL+"/manifests", apiToken, &nameList)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, item := range nameList {
+		if !bdm.ValidatePackageName(item.Name) {
+			return nil, fmt.Errorf("received invalid package name %s", item.Name)
+		}
+		names = append(names, item.Name)
+	}
+	return names, nil
+}
+
+func getPackageVersions(serverURL, apiToken, name string) ([]remoteVersion, error) {
+	var versions []remoteVersion
+	err := getJSON(serverURL+"/manifests/"+name, apiToken, &versions)
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// Requests JSON data from the server and unmarshals it into the target
+func getJSON(url, apiToken string, target any) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating GET request for URL %s: %w", url, err)
+	}
+
+	req.Header.Add(bdm.ApiTokenHeader, apiToken)
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error getting URL %s: %w", url, err)
+	}
+	defer res.Body.Close()
+
+	limitedReader := io.LimitReader(res.Body, maxBodySize)
+	resData, err := io.ReadAll(limitedReader)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %w", err)
+	}
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("error getting URL %s: server returned status code %d: %s",
+			url, res.StatusCode, resData)
+	}
+
+	err = json.Unmarshal(resData, target)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling JSON: %w", err)
+	}
+
+	return nil
+}
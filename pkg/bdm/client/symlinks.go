@@ -0,0 +1,134 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+)
+
+func hasSymlink(relPath string, manifest *bdm.Manifest) bool {
+	for _, symlink := range manifest.Symlinks {
+		if symlink.Path == relPath {
+			return true
+		}
+	}
+	return false
+}
+
+func isSymlink(fullPath string) bool {
+	fileInfo, err := os.Lstat(fullPath)
+	return err == nil && fileInfo.Mode()&os.ModeSymlink != 0
+}
+
+// Removes existing symlinks in the output folder that would redirect writing package files.
+// This happens when a path was a symlink in an older version of the package.
+func removeBlockingSymlinks(manifest *bdm.Manifest, outputFolder string) error {
+	checked := make(map[string]bool)
+	removeSymlink := func(relPath string) error {
+		if checked[relPath] {
+			return nil
+		}
+		checked[relPath] = true
+		fullPath := filepath.Join(outputFolder, relPath)
+		if !isSymlink(fullPath) {
+			return nil
+		}
+		err := os.Remove(fullPath)
+		if err != nil {
+			return fmt.Errorf("error removing symlink %s: %w", fullPath, err)
+		}
+		return nil
+	}
+
+	paths := make([]string, 0, len(manifest.Files)+len(manifest.Symlinks)+len(manifest.Folders))
+	for _, file := range manifest.Files {
+		paths = append(paths, file.Path)
+		err := removeSymlink(file.Path)
+		if err != nil {
+			return err
+		}
+	}
+	for _, symlink := range manifest.Symlinks {
+		paths = append(paths, symlink.Path)
+	}
+	paths = append(paths, manifest.Folders...)
+	for _, entryPath := range paths {
+		for parent := path.Dir(entryPath); parent != "."; parent = path.Dir(parent) {
+			err := removeSymlink(parent)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Creates all symlinks and empty folders of the manifest in the output folder.
+// Existing items with the wrong type or target are replaced.
+func createSymlinksAndFolders(manifest *bdm.Manifest, outputFolder string) error {
+	for _, folder := range manifest.Folders {
+		fullPath := filepath.Join(outputFolder, folder)
+		fileInfo, err := os.Lstat(fullPath)
+		if err == nil && !fileInfo.IsDir() {
+			err = os.Remove(fullPath)
+			if err != nil {
+				return fmt.Errorf("error removing file %s: %w", fullPath, err)
+			}
+		}
+		err = os.MkdirAll(fullPath, os.ModePerm)
+		if err != nil {
+			return fmt.Errorf("error creating folder %s: %w", fullPath, err)
+		}
+	}
+
+	for _, symlink := range manifest.Symlinks {
+		fullPath := filepath.Join(outputFolder, symlink.Path)
+		target, err := os.Readlink(fullPath)
+		if err == nil && filepath.ToSlash(target) == symlink.Target {
+			continue
+		}
+		err = os.RemoveAll(fullPath)
+		if err != nil {
+			return fmt.Errorf("error removing existing item %s: %w", fullPath, err)
+		}
+		folder := filepath.Dir(fullPath)
+		err = os.MkdirAll(folder, os.ModePerm)
+		if err != nil {
+			return fmt.Errorf("error creating directory %s: %w", folder, err)
+		}
+		err = os.Symlink(filepath.FromSlash(symlink.Target), fullPath)
+		if err != nil {
+			return fmt.Errorf("error creating symlink %s: %w", fullPath, err)
+		}
+	}
+
+	return nil
+}
+
+// Compares the symlinks and empty folders in the package folder against the manifest
+func checkSymlinksAndFolders(manifest *bdm.Manifest, packageFolder string) error {
+	for _, folder := range manifest.Folders {
+		fullPath := filepath.Join(packageFolder, folder)
+		fileInfo, err := os.Lstat(fullPath)
+		if err != nil || !fileInfo.IsDir() {
+			return fmt.Errorf("cannot find folder %s", folder)
+		}
+	}
+
+	for _, symlink := range manifest.Symlinks {
+		fullPath := filepath.Join(packageFolder, symlink.Path)
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return fmt.Errorf("cannot find symlink %s", symlink.Path)
+		}
+		if filepath.ToSlash(target) != symlink.Target {
+			return fmt.Errorf("symlink %s has the wrong target: expected %s and found %s",
+				symlink.Path, symlink.Target, filepath.ToSlash(target))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/store"
+)
+
+// ResolveVersion returns the version for a value that is either a version number or a tag name.
+// Tags can be moved at any time, so they are always resolved by the server and never cached.
+func ResolveVersion(serverURL, apiToken, name, value string) (uint, error) {
+	if !bdm.ValidateTagName(value) {
+		version, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || version == 0 {
+			return 0, fmt.Errorf("invalid version or tag name %s", value)
+		}
+		return uint(version), nil
+	}
+
+	var tag store.Tag
+	err := getJSON(serverURL+"/tags/"+name+"/"+value, apiToken, &tag)
+	if err != nil {
+		return 0, fmt.Errorf("error resolving tag %s of package %s: %w", value, name, err)
+	}
+	if tag.Name != value || tag.Version == 0 {
+		return 0, fmt.Errorf("received invalid tag for %s of package %s", value, name)
+	}
+	return tag.Version, nil
+}
+
+// GetTags returns all current and removed tags of a package including their history
+func GetTags(serverURL, apiToken, name string) ([]store.Tag, error) {
+	var tags []store.Tag
+	err := getJSON(serverURL+"/tags/"+name, apiToken, &tags)
+	if err != nil {
+		return nil, fmt.Errorf("error getting tags of package %s: %w", name, err)
+	}
+	return tags, nil
+}
+
+// SetTag creates a tag or moves it to another version of the package.
+// Version zero removes the tag, its history is kept by the server.
+func SetTag(serverURL, apiToken, name, tagName string, version uint) error {
+	method := "PUT"
+	var body []byte
+	if version == 0 {
+		method = "DELETE"
+	} else {
+		jsonData, err := json.Marshal(struct{ Version uint }{version})
+		if err != nil {
+			return fmt.Errorf("error marshalling tag to JSON: %w", err)
+		}
+		body = jsonData
+	}
+
+	url := serverURL + "/tags/" + name + "/" + tagName
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating %s request for URL %s: %w", method, url, err)
+	}
+	req.Header.Add(bdm.ApiTokenHeader, apiToken)
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending %s request to URL %s: %w", method, url, err)
+	}
+
+	defer res.Body.Close()
+	limitedReader := io.LimitReader(res.Body, maxBodySize)
+	resData, err := io.ReadAll(limitedReader)
+	if err != nil {
+		return fmt.Errorf("error reading %s response body: %w", method, err)
+	}
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("error changing tag %s of package %s: server returned status code %d: %s",
+			tagName, name, res.StatusCode, resData)
+	}
+
+	return nil
+}
@@ -15,7 +15,13 @@ import (
 // UploadPackage publishes the specified folder as package to a remote server.
 // This includes uploading of all files that doe not yet exists on the server.
 func UploadPackage(name, inputFolder, serverURL, apiToken string) (*bdm.Manifest, error) {
-	manifest, err := bdm.GenerateManifest(name, inputFolder)
+	return UploadPackageWithOptions(name, inputFolder, serverURL, apiToken, bdm.ManifestOptions{})
+}
+
+// UploadPackageWithOptions is UploadPackage with additional options for generating the manifest.
+// Only the chunks of chunked files that do not yet exist on the server are uploaded.
+func UploadPackageWithOptions(name, inputFolder, serverURL, apiToken string, options bdm.ManifestOptions) (*bdm.Manifest, error) {
+	manifest, err := bdm.GenerateManifestWithOptions(name, inputFolder, options)
 	if err != nil {
 		return nil, fmt.Errorf("error generating manifest for folder %s: %w",
 			inputFolder, err)
@@ -26,20 +32,31 @@ func UploadPackage(name, inputFolder, serverURL, apiToken string) (*bdm.Manifest
 		return nil, fmt.Errorf("error validating generated manifest: %w", err)
 	}
 
-	err = checkRemoteManifestLimits(manifest, serverURL, apiToken)
+	serverManifestVersion, err := checkRemoteManifestLimits(manifest, serverURL, apiToken)
 	if err != nil {
 		return nil, fmt.Errorf("manifest failed to pass check against server limits: %w", err)
 	}
 
-	missingFiles, err := findFilesToUpload(manifest, serverURL, apiToken)
+	// Older servers only accept the manifest versions they know
+	if serverManifestVersion < manifest.ManifestVersion {
+		if manifest.Signature != nil && serverManifestVersion < bdm.ManifestVersion2 {
+			return nil, fmt.Errorf("server does not support signed manifests")
+		}
+		manifest, err = bdm.ConvertManifest(manifest, serverManifestVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error converting manifest for server: %w", err)
+		}
+	}
+
+	missingObjects, err := findObjectsToUpload(manifest, serverURL, apiToken)
 	if err != nil {
-		return nil, fmt.Errorf("error finding files to upload: %w", err)
+		return nil, fmt.Errorf("error finding objects to upload: %w", err)
 	}
 
-	if len(missingFiles) > 0 {
-		err = uploadFiles(missingFiles, inputFolder, serverURL, apiToken)
+	if len(missingObjects) > 0 {
+		err = uploadObjects(missingObjects, inputFolder, serverURL, apiToken)
 		if err != nil {
-			return nil, fmt.Errorf("error uploading files: %w", err)
+			return nil, fmt.Errorf("error uploading objects: %w", err)
 		}
 	}
 
@@ -71,8 +88,36 @@ func filterDuplicateFileObjects(files []bdm.File) []bdm.File {
 	return filtered
 }
 
-func findFilesToUpload(manifest *bdm.Manifest, serverURL, apiToken string) ([]bdm.File, error) {
-	objects := getObjects(manifest.Files)
+// Describes where the data of an object is located in the input folder
+type objectSource struct {
+	object bdm.Object
+	path   string
+	offset int64
+}
+
+// Returns the sources of all unique objects of the files, including the chunks of chunked files
+func getObjectSources(files []bdm.File) []objectSource {
+	objectMap := make(map[string]bool)
+	sources := make([]objectSource, 0)
+	for i := range files {
+		var offset int64 = 0
+		for _, object := range bdm.GetFileObjects(&files[i]) {
+			if !objectMap[object.Hash] {
+				objectMap[object.Hash] = true
+				sources = append(sources, objectSource{object, files[i].Path, offset})
+			}
+			offset += object.Size
+		}
+	}
+	return sources
+}
+
+func findObjectsToUpload(manifest *bdm.Manifest, serverURL, apiToken string) ([]objectSource, error) {
+	sources := getObjectSources(manifest.Files)
+	objects := make([]bdm.Object, 0)
+	for _, source := range sources {
+		objects = append(objects, source.object)
+	}
 
 	r, w := io.Pipe()
 	go func() {
@@ -119,27 +164,21 @@ func findFilesToUpload(manifest *bdm.Manifest, serverURL, apiToken string) ([]bd
 		return nil, fmt.Errorf("error unmarshalling objects from JSON: %w", err)
 	}
 
-	filesToUpload := make([]bdm.File, 0)
-	for _, file := range manifest.Files {
-		found := false
-		for _, foundObject := range foundObjects {
-			if file.Object.Hash == foundObject.Hash {
-				found = true
-				break
-			}
-		}
-		if !found {
-			filesToUpload = append(filesToUpload, file)
+	foundMap := make(map[string]bool)
+	for _, foundObject := range foundObjects {
+		foundMap[foundObject.Hash] = true
+	}
+	objectsToUpload := make([]objectSource, 0)
+	for _, source := range sources {
+		if !foundMap[source.object.Hash] {
+			objectsToUpload = append(objectsToUpload, source)
 		}
 	}
 
-	// Remove files with duplicate file objects!
-	filesToUpload = filterDuplicateFileObjects(filesToUpload)
-
-	return filesToUpload, nil
+	return objectsToUpload, nil
 }
 
-func uploadFiles(files []bdm.File, inputFolder, serverURL, apiToken string) error {
+func uploadObjects(sources []objectSource, inputFolder, serverURL, apiToken string) error {
 	r, w := io.Pipe()
 	go func() {
 		defer w.Close()
@@ -149,27 +188,35 @@ func uploadFiles(files []bdm.File, inputFolder, serverURL, apiToken string) erro
 		}
 		defer compressedWriter.Close()
 
-		objects := getObjects(files)
+		objects := make([]bdm.Object, 0)
+		for _, source := range sources {
+			objects = append(objects, source.object)
+		}
 		err = bdm.WriteObjectsToStream(objects, compressedWriter)
 		if err != nil {
 			panic(fmt.Errorf("error writing objects to stream: %w", err))
 		}
 
-		for _, file := range files {
-			fullPath := filepath.Join(inputFolder, file.Path)
+		for _, source := range sources {
+			fullPath := filepath.Join(inputFolder, source.path)
 			fileHandle, err := os.Open(fullPath)
 			if err != nil {
 				panic(fmt.Errorf("error opening file %s: %w", fullPath, err))
 			}
 			defer fileHandle.Close()
 
-			copied, err := io.Copy(compressedWriter, fileHandle)
+			_, err = fileHandle.Seek(source.offset, io.SeekStart)
+			if err != nil {
+				panic(fmt.Errorf("error seeking in file %s: %w", fullPath, err))
+			}
+
+			copied, err := io.CopyN(compressedWriter, fileHandle, source.object.Size)
 			if err != nil {
 				panic(fmt.Errorf("error copying file %s: %w", fullPath, err))
 			}
-			if copied != file.Object.Size {
+			if copied != source.object.Size {
 				panic(fmt.Errorf("error reading file %s: expected %d but found %d bytes",
-					fullPath, file.Object.Size, copied))
+					fullPath, source.object.Size, copied))
 			}
 		}
 	}()
@@ -205,9 +252,9 @@ func uploadFiles(files []bdm.File, inputFolder, serverURL, apiToken string) erro
 	}
 
 	// More checking required?
-	if len(uploadedObjects) != len(files) {
-		return fmt.Errorf("error uploading files: uploaded %d objects but expected to upload %d",
-			len(uploadedObjects), len(files))
+	if len(uploadedObjects) != len(sources) {
+		return fmt.Errorf("error uploading objects: uploaded %d objects but expected to upload %d",
+			len(uploadedObjects), len(sources))
 	}
 
 	return nil
@@ -237,6 +284,7 @@ func publishManifest(manifest *bdm.Manifest, serverURL, apiToken string) (*bdm.M
 		return nil, fmt.Errorf("error creating POST request for URL %s: %w", url, err)
 	}
 	req.Header.Add(bdm.ApiTokenHeader, apiToken)
+	req.Header.Add(bdm.ManifestVersionHeader, fmt.Sprint(bdm.LatestManifestVersion))
 	client := &http.Client{}
 	res, err := client.Do(req)
 	if err != nil {
@@ -274,37 +322,40 @@ func publishManifest(manifest *bdm.Manifest, serverURL, apiToken string) (*bdm.M
 	return &publishedManifest, nil
 }
 
-func checkRemoteManifestLimits(manifest *bdm.Manifest, serverURL, apiToken string) error {
+// Checks the manifest against the limits of the server and
+// returns the latest manifest version supported by the server
+func checkRemoteManifestLimits(manifest *bdm.Manifest, serverURL, apiToken string) (uint, error) {
 	url := serverURL + "/limits"
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return fmt.Errorf("error creating GET request for URL %s: %w", url, err)
+		return 0, fmt.Errorf("error creating GET request for URL %s: %w", url, err)
 	}
 
 	req.Header.Add(bdm.ApiTokenHeader, apiToken)
 	client := &http.Client{}
 	res, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error getting limits from remote server at %s: %w", url, err)
+		return 0, fmt.Errorf("error getting limits from remote server at %s: %w", url, err)
 	}
 
 	defer res.Body.Close()
 	limitedReader := io.LimitReader(res.Body, maxBodySize)
 	resData, err := io.ReadAll(limitedReader)
 	if err != nil {
-		return fmt.Errorf("error reading limits response body: %w", err)
+		return 0, fmt.Errorf("error reading limits response body: %w", err)
 	}
 
 	if res.StatusCode != 200 {
-		return fmt.Errorf("error getting server limits: server returned status code %d: %s",
+		return 0, fmt.Errorf("error getting server limits: server returned status code %d: %s",
 			res.StatusCode, resData)
 	}
 
 	var limits bdm.ManifestLimits
 	err = json.Unmarshal(resData, &limits)
 	if err != nil {
-		return fmt.Errorf("error unmarshalling limits JSON: %w", err)
+		return 0, fmt.Errorf("error unmarshalling limits JSON: %w", err)
 	}
 
-	return bdm.CheckManifestLimits(manifest, &limits)
+	serverManifestVersion := bdm.ParseManifestVersion(res.Header.Get(bdm.ManifestVersionHeader))
+	return serverManifestVersion, bdm.CheckManifestLimits(manifest, &limits)
 }
@@ -0,0 +1,119 @@
+package bdm
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// MaxDependencyCount is the maximum number of direct dependencies of a package
+const MaxDependencyCount = 100
+
+// Dependency declares that a package requires another package in a subfolder
+type Dependency struct {
+	PackageName string
+	// Exact version like 3 or a constraint like >=3,<5
+	Version string
+	// Slash separated target folder relative to the package root
+	Folder string
+}
+
+// VersionConstraint is a parsed dependency version.
+// It is either a single exact version, * for any version or a comma separated
+// list of comparisons with the operators =, >, >=, < and <= that must all match.
+type VersionConstraint struct {
+	comparisons []versionComparison
+}
+
+type versionComparison struct {
+	operator string
+	version  uint
+}
+
+// ParseVersionConstraint parses the version of a dependency
+func ParseVersionConstraint(constraint string) (*VersionConstraint, error) {
+	parsed := VersionConstraint{}
+	if strings.TrimSpace(constraint) == "*" {
+		return &parsed, nil
+	}
+	for _, part := range strings.Split(constraint, ",") {
+		part = strings.TrimSpace(part)
+		comparison := versionComparison{operator: "="}
+		for _, operator := range []string{">=", "<=", ">", "<", "="} {
+			if strings.HasPrefix(part, operator) {
+				comparison.operator = operator
+				part = strings.TrimSpace(part[len(operator):])
+				break
+			}
+		}
+		version, err := strconv.ParseUint(part, 10, 32)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("invalid version constraint %s", constraint)
+		}
+		comparison.version = uint(version)
+		parsed.comparisons = append(parsed.comparisons, comparison)
+	}
+	return &parsed, nil
+}
+
+// Exact returns the version if the constraint allows only a single version
+func (constraint *VersionConstraint) Exact() (uint, bool) {
+	if len(constraint.comparisons) == 1 && constraint.comparisons[0].operator == "=" {
+		return constraint.comparisons[0].version, true
+	}
+	return 0, false
+}
+
+// Matches returns true if the version fulfills all comparisons of the constraint
+func (constraint *VersionConstraint) Matches(version uint) bool {
+	for _, comparison := range constraint.comparisons {
+		var matches bool
+		switch comparison.operator {
+		case ">=":
+			matches = version >= comparison.version
+		case "<=":
+			matches = version <= comparison.version
+		case ">":
+			matches = version > comparison.version
+		case "<":
+			matches = version < comparison.version
+		default:
+			matches = version == comparison.version
+		}
+		if !matches {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseDependency parses a dependency in the form name:version:folder, like engine:>=3:deps/engine
+func ParseDependency(value string) (*Dependency, error) {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("dependency %s is not in the form name:version:folder", value)
+	}
+	dependency := Dependency{PackageName: parts[0], Version: parts[1], Folder: parts[2]}
+	err := validateDependency(&dependency)
+	if err != nil {
+		return nil, err
+	}
+	return &dependency, nil
+}
+
+func validateDependency(dependency *Dependency) error {
+	if !ValidatePackageName(dependency.PackageName) {
+		return fmt.Errorf("invalid dependency package name %s", dependency.PackageName)
+	}
+	_, err := ParseVersionConstraint(dependency.Version)
+	if err != nil {
+		return fmt.Errorf("invalid version of dependency %s: %w", dependency.PackageName, err)
+	}
+	folder := dependency.Folder
+	if len(folder) == 0 || folder == "." || folder != path.Clean(folder) || path.IsAbs(folder) ||
+		strings.Contains(folder, "..") || strings.ContainsAny(folder, "\\:") {
+		return fmt.Errorf("invalid folder %s for dependency %s", folder, dependency.PackageName)
+	}
+	return nil
+}
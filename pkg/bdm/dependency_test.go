@@ -0,0 +1,117 @@
+package bdm
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+func TestVersionConstraint(t *testing.T) {
+	check := func(constraint string, version uint, matches bool) {
+		t.Helper()
+		parsed, err := ParseVersionConstraint(constraint)
+		util.AssertNoError(t, err)
+		util.Assert(t, parsed.Matches(version) == matches)
+	}
+	check("3", 3, true)
+	check("3", 4, false)
+	check("=3", 3, true)
+	check("*", 123, true)
+	check(">=3", 3, true)
+	check(">3", 3, false)
+	check(">=3, <5", 4, true)
+	check(">=3,<5", 5, false)
+	check("<=2", 2, true)
+	check("<2", 2, false)
+
+	exact, err := ParseVersionConstraint("7")
+	util.AssertNoError(t, err)
+	version, isExact := exact.Exact()
+	util.Assert(t, isExact && version == 7)
+	notExact, err := ParseVersionConstraint(">=7")
+	util.AssertNoError(t, err)
+	_, isExact = notExact.Exact()
+	util.Assert(t, !isExact)
+
+	for _, invalid := range []string{"", "0", "abc", ">=", "=>3", "3,", "-1"} {
+		_, err = ParseVersionConstraint(invalid)
+		util.AssertError(t, err)
+	}
+}
+
+func TestParseDependency(t *testing.T) {
+	dependency, err := ParseDependency("engine:>=3,<5:deps/engine")
+	util.AssertNoError(t, err)
+	util.AssertEqualString(t, "engine", dependency.PackageName)
+	util.AssertEqualString(t, ">=3,<5", dependency.Version)
+	util.AssertEqualString(t, "deps/engine", dependency.Folder)
+
+	for _, invalid := range []string{"engine", "engine:3", "Engine:3:deps", "engine:x:deps",
+		"engine:3:", "engine:3:.", "engine:3:../deps", "engine:3:/deps", "engine:3:deps/", "engine:3:c:/deps"} {
+		_, err = ParseDependency(invalid)
+		util.AssertError(t, err)
+	}
+}
+
+func TestManifestDependencies(t *testing.T) {
+	manifest := generateUnpublishedManifest()
+	manifest.ManifestVersion = ManifestVersion2
+	manifest.Dependencies = []Dependency{{PackageName: "engine", Version: "3", Folder: "deps/engine"}}
+	manifest.Hash = HashManifest(&manifest)
+	checkUnpublishedManifest(t, &manifest, true)
+
+	// Dependencies change the hash and require version 2
+	_, err := ConvertManifest(&manifest, ManifestVersion1)
+	util.AssertError(t, err)
+	manifest.ManifestVersion = ManifestVersion1
+	manifest.Hash = HashManifest(&manifest)
+	checkUnpublishedManifest(t, &manifest, false)
+	manifest.ManifestVersion = ManifestVersion2
+
+	check := func(dependency Dependency, valid bool) {
+		t.Helper()
+		manifest.Dependencies = []Dependency{dependency}
+		manifest.Hash = HashManifest(&manifest)
+		checkUnpublishedManifest(t, &manifest, valid)
+	}
+	check(Dependency{PackageName: "engine", Version: ">=3", Folder: "engine"}, true)
+	check(Dependency{PackageName: manifest.PackageName, Version: "1", Folder: "engine"}, false)
+	check(Dependency{PackageName: "engine", Version: "latest", Folder: "engine"}, false)
+	check(Dependency{PackageName: "engine", Version: "1", Folder: "../engine"}, false)
+	// Package entries cannot be located inside of dependency folders
+	check(Dependency{PackageName: "engine", Version: "1", Folder: "folder"}, false)
+	check(Dependency{PackageName: "engine", Version: "1", Folder: "folder/scooby.doo"}, false)
+
+	// Dependency folders cannot be nested
+	manifest.Dependencies = []Dependency{
+		{PackageName: "engine", Version: "1", Folder: "deps"},
+		{PackageName: "zlib", Version: "1", Folder: "deps/zlib"},
+	}
+	manifest.Hash = HashManifest(&manifest)
+	checkUnpublishedManifest(t, &manifest, false)
+
+	// Packages can consist only of dependencies
+	manifest.Files = nil
+	manifest.Dependencies = manifest.Dependencies[1:]
+	manifest.Hash = HashManifest(&manifest)
+	checkUnpublishedManifest(t, &manifest, true)
+}
+
+func TestGenerateManifestWithDependencies(t *testing.T) {
+	testFolder := "testPackage"
+	err := os.MkdirAll(testFolder+"/deps/engine", os.ModePerm)
+	util.AssertNoError(t, err)
+	defer os.RemoveAll(testFolder)
+	util.AssertNoError(t, os.WriteFile(testFolder+"/deps/engine/engine.dll", []byte{1}, os.ModePerm))
+	util.AssertNoError(t, os.WriteFile(testFolder+"/game.exe", []byte{2}, os.ModePerm))
+
+	// Content of dependency folders is skipped and their parents are not empty
+	options := ManifestOptions{Dependencies: []Dependency{{PackageName: "engine", Version: "1", Folder: "deps/engine"}}}
+	manifest, err := GenerateManifestWithOptions("game", testFolder, options)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(manifest.Files) == 1 && manifest.Files[0].Path == "game.exe")
+	util.Assert(t, len(manifest.Folders) == 0)
+	util.Assert(t, len(manifest.Dependencies) == 1)
+	checkUnpublishedManifest(t, manifest, true)
+}
@@ -0,0 +1,102 @@
+package bdm
+
+import "sort"
+
+// FileChange describes a file that was modified or renamed between two manifests
+type FileChange struct {
+	Old File
+	New File
+	// Size of the new file minus size of the old file
+	SizeDelta int64
+}
+
+// ManifestDiff lists the file differences between an old and a new manifest
+type ManifestDiff struct {
+	Added    []File
+	Removed  []File
+	Modified []FileChange
+	Renamed  []FileChange
+	// Size of the new package minus size of the old package
+	SizeDelta int64
+}
+
+// DiffManifests compares the files of the old manifest a with the files of the new manifest b.
+// Files with the same path are modified if their content or permissions differ.
+// A removed and an added file with the same content are reported as renamed file.
+// All lists are sorted by path. Symlinks and empty folders are not compared.
+func DiffManifests(a, b *Manifest) *ManifestDiff {
+	diff := ManifestDiff{
+		Added:    make([]File, 0),
+		Removed:  make([]File, 0),
+		Modified: make([]FileChange, 0),
+		Renamed:  make([]FileChange, 0),
+	}
+
+	oldFiles := make(map[string]File, len(a.Files))
+	for _, file := range a.Files {
+		oldFiles[file.Path] = file
+		diff.SizeDelta -= file.Object.Size
+	}
+	newPaths := make(map[string]bool, len(b.Files))
+	added := make([]File, 0)
+	for _, file := range b.Files {
+		newPaths[file.Path] = true
+		diff.SizeDelta += file.Object.Size
+		oldFile, found := oldFiles[file.Path]
+		if !found {
+			added = append(added, file)
+		} else if oldFile.Object.Hash != file.Object.Hash || oldFile.Mode != file.Mode {
+			diff.Modified = append(diff.Modified, newFileChange(oldFile, file))
+		}
+	}
+
+	// Removed files are candidates for renames, grouped by content
+	removed := make(map[string][]File)
+	for _, file := range sortFiles(a.Files) {
+		if !newPaths[file.Path] {
+			removed[file.Object.Hash] = append(removed[file.Object.Hash], file)
+		}
+	}
+	for _, file := range sortFiles(added) {
+		candidates := removed[file.Object.Hash]
+		if len(candidates) > 0 {
+			diff.Renamed = append(diff.Renamed, newFileChange(candidates[0], file))
+			removed[file.Object.Hash] = candidates[1:]
+		} else {
+			diff.Added = append(diff.Added, file)
+		}
+	}
+	for _, files := range removed {
+		diff.Removed = append(diff.Removed, files...)
+	}
+
+	diff.Removed = sortFiles(diff.Removed)
+	sort.Slice(diff.Modified, func(i, j int) bool {
+		return diff.Modified[i].New.Path < diff.Modified[j].New.Path
+	})
+	return &diff
+}
+
+// Empty returns true if there are no file differences
+func (diff *ManifestDiff) Empty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0 &&
+		len(diff.Modified) == 0 && len(diff.Renamed) == 0
+}
+
+func newFileChange(oldFile, newFile File) FileChange {
+	return FileChange{
+		Old:       oldFile,
+		New:       newFile,
+		SizeDelta: newFile.Object.Size - oldFile.Object.Size,
+	}
+}
+
+// Returns a copy of the files sorted by path
+func sortFiles(files []File) []File {
+	sorted := make([]File, len(files))
+	copy(sorted, files)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+	return sorted
+}
@@ -0,0 +1,54 @@
+package bdm
+
+import (
+	"testing"
+
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+func TestDiffManifests(t *testing.T) {
+	file := func(path, hash string, size int64) File {
+		return File{Path: path, Object: Object{Hash: hash, Size: size}}
+	}
+	a := Manifest{Files: []File{
+		file("same.txt", "h1", 10),
+		file("modified.txt", "h2", 20),
+		file("removed.txt", "h3", 30),
+		file("old/name.txt", "h4", 40),
+		file("copy1.txt", "h5", 50),
+		file("copy2.txt", "h5", 50),
+	}}
+	b := Manifest{Files: []File{
+		file("same.txt", "h1", 10),
+		file("modified.txt", "h6", 25),
+		file("added.txt", "h7", 70),
+		file("new/name.txt", "h4", 40),
+		file("copy3.txt", "h5", 50),
+	}}
+
+	diff := DiffManifests(&a, &b)
+	util.Assert(t, !diff.Empty())
+	util.Assert(t, len(diff.Added) == 1)
+	util.AssertEqualString(t, "added.txt", diff.Added[0].Path)
+	util.Assert(t, len(diff.Removed) == 2)
+	util.AssertEqualString(t, "copy2.txt", diff.Removed[0].Path)
+	util.AssertEqualString(t, "removed.txt", diff.Removed[1].Path)
+	util.Assert(t, len(diff.Modified) == 1)
+	util.AssertEqualString(t, "h6", diff.Modified[0].New.Object.Hash)
+	util.Assert(t, diff.Modified[0].SizeDelta == 5)
+	util.Assert(t, len(diff.Renamed) == 2)
+	util.AssertEqualString(t, "copy1.txt", diff.Renamed[0].Old.Path)
+	util.AssertEqualString(t, "copy3.txt", diff.Renamed[0].New.Path)
+	util.AssertEqualString(t, "old/name.txt", diff.Renamed[1].Old.Path)
+	util.AssertEqualString(t, "new/name.txt", diff.Renamed[1].New.Path)
+	util.Assert(t, diff.SizeDelta == 195-200)
+
+	// Permission changes count as modification
+	b.Files = a.Files
+	util.Assert(t, DiffManifests(&a, &b).Empty())
+	b.Files = []File{file("same.txt", "h1", 10)}
+	b.Files[0].Mode = 0755
+	a.Files = []File{file("same.txt", "h1", 10)}
+	diff = DiffManifests(&a, &b)
+	util.Assert(t, len(diff.Modified) == 1 && diff.Modified[0].SizeDelta == 0)
+}
@@ -0,0 +1,152 @@
+package bdm
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+// IgnoreFileName is the name of the optional file with ignore patterns in the root of a package folder
+const IgnoreFileName = ".bdmignore"
+
+// IgnoreRules decide which files and folders are not part of a package.
+// The patterns use the gitignore syntax: A leading ! re-includes paths, a trailing / matches only folders,
+// patterns with a / are relative to the package root and all other patterns match names on any level.
+// The wildcards * and ? do not match a /, ** matches across folders. The last matching pattern wins.
+type IgnoreRules struct {
+	rules []ignoreRule
+}
+
+type ignoreRule struct {
+	exp     *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ParseIgnoreRules creates ignore rules from a list of patterns.
+// Empty patterns and patterns starting with # are skipped.
+func ParseIgnoreRules(patterns []string) (*IgnoreRules, error) {
+	rules := IgnoreRules{}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) == 0 || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		rule := ignoreRule{}
+		if strings.HasPrefix(pattern, "!") {
+			rule.negate = true
+			pattern = pattern[1:]
+		}
+		if strings.HasSuffix(pattern, "/") {
+			rule.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		anchored := strings.Contains(pattern, "/")
+		pattern = strings.TrimPrefix(pattern, "/")
+		if len(pattern) == 0 {
+			return nil, fmt.Errorf("found empty ignore pattern")
+		}
+		expression := globToRegex(pattern)
+		if !anchored {
+			expression = "(.*/)?" + expression
+		}
+		exp, err := regexp.Compile("^" + expression + "$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %s: %w", pattern, err)
+		}
+		rule.exp = exp
+		rules.rules = append(rules.rules, rule)
+	}
+	return &rules, nil
+}
+
+// LoadIgnoreRules reads the ignore file from the package folder, if it exists.
+// The exclude and include patterns are added after the patterns of the file,
+// so they can override them. Include patterns are negated exclude patterns.
+func LoadIgnoreRules(packageFolder string, exclude, include []string) (*IgnoreRules, error) {
+	patterns := make([]string, 0)
+	ignoreFile := filepath.Join(packageFolder, IgnoreFileName)
+	if util.FileExists(ignoreFile) {
+		data, err := os.ReadFile(ignoreFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ignore file %s: %w", ignoreFile, err)
+		}
+		patterns = append(patterns, strings.Split(string(data), "\n")...)
+	}
+	patterns = append(patterns, exclude...)
+	for _, pattern := range include {
+		patterns = append(patterns, "!"+pattern)
+	}
+	rules, err := ParseIgnoreRules(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ignore rules: %w", err)
+	}
+	return rules, nil
+}
+
+// Ignored returns true if the slash separated path relative to the package folder is ignored.
+// Paths inside of ignored folders are ignored as well.
+func (rules *IgnoreRules) Ignored(relPath string, isDir bool) bool {
+	if rules == nil || len(rules.rules) == 0 {
+		return false
+	}
+	for parent := path.Dir(relPath); parent != "." && parent != "/"; parent = path.Dir(parent) {
+		if rules.matches(parent, true) {
+			return true
+		}
+	}
+	return rules.matches(relPath, isDir)
+}
+
+func (rules *IgnoreRules) matches(relPath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.exp.MatchString(relPath) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// Converts a glob pattern into a regular expression
+func globToRegex(pattern string) string {
+	var builder strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		char := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			builder.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			builder.WriteString(".*")
+			i++
+		case char == '*':
+			builder.WriteString("[^/]*")
+		case char == '?':
+			builder.WriteString("[^/]")
+		case char == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end > 1 {
+				class := pattern[i+1 : i+end]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				builder.WriteString("[" + class + "]")
+				i += end
+			} else {
+				builder.WriteString(regexp.QuoteMeta("["))
+			}
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,85 @@
+package bdm
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules, err := ParseIgnoreRules([]string{
+		"# Comment",
+		"",
+		"*.pdb",
+		"!keep.pdb",
+		"build/",
+		"/root.txt",
+		"docs/**/*.tmp",
+		"cache?",
+		"[ab].log",
+	})
+	util.AssertNoError(t, err)
+
+	check := func(relPath string, isDir, ignored bool) {
+		t.Helper()
+		util.Assert(t, rules.Ignored(relPath, isDir) == ignored)
+	}
+	check("app.pdb", false, true)
+	check("bin/app.pdb", false, true)
+	check("bin/keep.pdb", false, false)
+	check("app.exe", false, false)
+	check("build", true, true)
+	check("src/build", true, true)
+	check("build", false, false)
+	check("build/output.bin", false, true)
+	check("root.txt", false, true)
+	check("sub/root.txt", false, false)
+	check("docs/a.tmp", false, true)
+	check("docs/a/b/c.tmp", false, true)
+	check("a.tmp", false, false)
+	check("cache1", true, true)
+	check("cache12", true, false)
+	check("a.log", false, true)
+	check("c.log", false, false)
+
+	var noRules *IgnoreRules
+	util.Assert(t, !noRules.Ignored("app.pdb", false))
+	_, err = ParseIgnoreRules([]string{"/"})
+	util.AssertError(t, err)
+}
+
+func TestGenerateManifestWithIgnoreFile(t *testing.T) {
+	testFolder := "testPackage"
+	err := os.MkdirAll(testFolder+"/.git", os.ModePerm)
+	util.AssertNoError(t, err)
+	defer os.RemoveAll(testFolder)
+
+	util.AssertNoError(t, os.MkdirAll(testFolder+"/obj", os.ModePerm))
+	files := []string{".git/HEAD", "app.exe", "app.pdb", "obj/app.o", "readme.txt"}
+	for _, file := range files {
+		util.AssertNoError(t, os.WriteFile(testFolder+"/"+file, []byte(file), os.ModePerm))
+	}
+	ignoreData := []byte(".git/\n*.pdb\nobj/\n")
+	util.AssertNoError(t, os.WriteFile(testFolder+"/"+IgnoreFileName, ignoreData, os.ModePerm))
+
+	manifest, err := GenerateManifest("foo", testFolder)
+	util.AssertNoError(t, err)
+	paths := make([]string, 0)
+	for _, file := range manifest.Files {
+		paths = append(paths, file.Path)
+	}
+	util.Assert(t, len(manifest.Folders) == 0)
+	util.AssertEqualString(t, ".bdmignore app.exe readme.txt", strings.Join(paths, " "))
+
+	// Command line patterns are applied after the ignore file
+	options := ManifestOptions{Exclude: []string{"*.txt"}, Include: []string{"app.pdb"}}
+	manifest, err = GenerateManifestWithOptions("foo", testFolder, options)
+	util.AssertNoError(t, err)
+	paths = paths[:0]
+	for _, file := range manifest.Files {
+		paths = append(paths, file.Path)
+	}
+	util.AssertEqualString(t, ".bdmignore app.exe app.pdb", strings.Join(paths, " "))
+}
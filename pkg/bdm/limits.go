@@ -14,9 +14,24 @@ type ManifestLimits struct {
 // CheckManifestLimits can check if a manifest is within the given package limits.
 // It will return nil if the manifest is within the limits, otherwise an error.
 func CheckManifestLimits(manifest *Manifest, limits *ManifestLimits) error {
-	if limits.MaxFilesCount > 0 && len(manifest.Files) > limits.MaxFilesCount {
+	// Symlinks and empty folders count as files
+	filesCount := len(manifest.Files) + len(manifest.Symlinks) + len(manifest.Folders)
+	if limits.MaxFilesCount > 0 && filesCount > limits.MaxFilesCount {
 		return fmt.Errorf("number of files is %d and exceeds the limit of %d",
-			len(manifest.Files), limits.MaxFilesCount)
+			filesCount, limits.MaxFilesCount)
+	}
+
+	for _, symlink := range manifest.Symlinks {
+		if limits.MaxPathLength > 0 && len(symlink.Path) > limits.MaxPathLength {
+			return fmt.Errorf("path length of %d exceeds the limit of %d",
+				len(symlink.Path), limits.MaxPathLength)
+		}
+	}
+	for _, folder := range manifest.Folders {
+		if limits.MaxPathLength > 0 && len(folder) > limits.MaxPathLength {
+			return fmt.Errorf("path length of %d exceeds the limit of %d",
+				len(folder), limits.MaxPathLength)
+		}
 	}
 
 	var overallSize int64 = 0
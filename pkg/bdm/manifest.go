@@ -1,10 +1,15 @@
 package bdm
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/cry-inc/bdm/pkg/bdm/util"
@@ -16,12 +21,66 @@ type Object struct {
 	Hash string
 }
 
-// File represents a file that is part of a package
+// File represents a file that is part of a package.
+// Large files can be split into chunks that are stored and transferred as separate objects.
+// The object then still describes the complete file content.
 type File struct {
 	Path   string
 	Object Object
+	Chunks []Object `json:",omitempty"`
+	// Optional POSIX permission bits and modification time in Unix seconds
+	Mode    uint32 `json:",omitempty"`
+	ModTime int64  `json:",omitempty"`
 }
 
+// Symlink represents a symbolic link that is part of a package.
+// The target is relative to the folder of the link and cannot point outside of the package.
+type Symlink struct {
+	Path   string
+	Target string
+}
+
+// MaxFileMode contains all permission bits that can be recorded for a file.
+// Special bits like setuid are not supported.
+const MaxFileMode = 0777
+
+// ManifestOptions control how manifests are generated from folders
+type ManifestOptions struct {
+	// Splits files larger than util.ChunkMaxSize into content-defined chunks
+	ChunkFiles bool
+	// Optional description of the package version
+	Description string
+	// Optional key/value labels like git.commit=abc
+	Labels map[string]string
+	// Records the permission bits and modification times of all files
+	FileMetadata bool
+	// Signs the manifest with this key if set
+	SigningKey ed25519.PrivateKey
+	// Additional ignore patterns for files that are not part of the package.
+	// They are applied after the patterns of the ignore file in the input folder.
+	Exclude []string
+	// Patterns for files that are part of the package even if they are excluded
+	Include []string
+	// Other packages required by the package. Their folders are skipped in the input folder.
+	Dependencies []Dependency
+}
+
+// Versions of the manifest format
+const (
+	// ManifestVersion1 is the original format, its hash does not cover the package version
+	ManifestVersion1 uint = 1
+	// ManifestVersion2 is hashed using a canonical JSON encoding of all fields
+	ManifestVersion2 uint = 2
+	// LatestManifestVersion is used for newly generated and published manifests
+	LatestManifestVersion = ManifestVersion2
+)
+
+// ManifestVersionHeader contains the name of the HTTP header for negotiating manifest versions.
+// Clients send the latest manifest version they understand with their requests
+// and servers send the latest version they support with their responses.
+// A missing header means that only version 1 is supported.
+const ManifestVersionHeader = "bdm-manifest-version"
+
 // A Manifest is a complete description of a package
 type Manifest struct {
 	ManifestVersion uint
@@ -30,37 +89,111 @@ type Manifest struct {
 	Published       int64
 	Hash            string
 	Files           []File
+	Symlinks        []Symlink `json:",omitempty"`
+	// Empty folders, folders with content are implicitly part of the package
+	Folders []string `json:",omitempty"`
+	// Other packages that are downloaded together with this package
+	Dependencies []Dependency      `json:",omitempty"`
+	Description  string            `json:",omitempty"`
+	Labels       map[string]string `json:",omitempty"`
+	// User and token that published the package, assigned by the server
+	Publisher      string `json:",omitempty"`
+	PublisherToken string `json:",omitempty"`
+	// Optional signature of the publisher or the server
+	Signature *Signature `json:",omitempty"`
 }
 
+// Limits for the metadata of manifests
+const (
+	MaxDescriptionLength = 10000
+	MaxLabelCount        = 100
+	MaxLabelKeyLength    = 128
+	MaxLabelValueLength  = 1024
+	MaxTagNameLength     = 128
+)
+
 // GenerateManifest creates an unpublished manifest for an input folder using the given name
 func GenerateManifest(packageName, inputFolder string) (*Manifest, error) {
+	return GenerateManifestWithOptions(packageName, inputFolder, ManifestOptions{})
+}
+
+// GenerateManifestWithOptions is GenerateManifest with additional options.
+// Files and folders ignored by the ignore file in the input folder are skipped.
+func GenerateManifestWithOptions(packageName, inputFolder string, options ManifestOptions) (*Manifest, error) {
+	ignoreRules, err := LoadIgnoreRules(inputFolder, options.Exclude, options.Include)
+	if err != nil {
+		return nil, err
+	}
+
+	absInput, err := filepath.Abs(inputFolder)
+	if err != nil {
+		return nil, fmt.Errorf("error getting absolute input path for %s: %w",
+			inputFolder, err)
+	}
+
+	dependencyFolders := make(map[string]bool)
+	for _, dependency := range options.Dependencies {
+		dependencyFolders[dependency.Folder] = true
+	}
+
 	files := make([]File, 0)
-	err := filepath.WalkDir(inputFolder, func(filePath string, entry os.DirEntry, err error) error {
+	var symlinks []Symlink
+	// Folders are marked as non-empty as soon as one of their entries is part of the package
+	folders := make(map[string]bool)
+	err = filepath.WalkDir(inputFolder, func(filePath string, entry os.DirEntry, err error) error {
 		if err != nil {
 			return fmt.Errorf("error getting file info: %w", err)
 		}
 
-		fileType := entry.Type()
-		if !entry.IsDir() && fileType.IsRegular() {
-			absInput, err := filepath.Abs(inputFolder)
-			if err != nil {
-				return fmt.Errorf("error getting absolute input path for %s: %w",
-					inputFolder, err)
+		absFile, err := filepath.Abs(filePath)
+		if err != nil {
+			return fmt.Errorf("error getting absolute file path for %s: %w",
+				filePath, err)
+		}
+
+		packageFilePath, err := filepath.Rel(absInput, absFile)
+		if err != nil {
+			return fmt.Errorf("error getting relative file path between %s and %s: %w",
+				absInput, absFile, err)
+		}
+
+		packageFilePath = filepath.ToSlash(packageFilePath)
+		if packageFilePath == "." {
+			// The input folder itself is not part of the package
+			return nil
+		}
+
+		if dependencyFolders[packageFilePath] {
+			if !entry.IsDir() {
+				return fmt.Errorf("found item %s in place of a dependency folder", packageFilePath)
 			}
+			// The content is provided by the dependency, but the parent folder is not empty
+			folders[path.Dir(packageFilePath)] = true
+			return filepath.SkipDir
+		}
 
-			absFile, err := filepath.Abs(filePath)
-			if err != nil {
-				return fmt.Errorf("error getting absolute file path for %s: %w",
-					filePath, err)
+		if ignoreRules.Ignored(packageFilePath, entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
 			}
+			return nil
+		}
 
-			packageFilePath, err := filepath.Rel(absInput, absFile)
+		fileType := entry.Type()
+		if entry.IsDir() {
+			folders[packageFilePath] = false
+		} else if fileType&os.ModeSymlink != 0 {
+			target, err := os.Readlink(filePath)
 			if err != nil {
-				return fmt.Errorf("error getting relative file path between %s and %s: %w",
-					absInput, absFile, err)
+				return fmt.Errorf("error reading symlink %s: %w", filePath, err)
 			}
-
-			packageFilePath = filepath.ToSlash(packageFilePath)
+			symlink := Symlink{Path: packageFilePath, Target: path.Clean(filepath.ToSlash(target))}
+			err = validateSymlinkTarget(&symlink)
+			if err != nil {
+				return err
+			}
+			symlinks = append(symlinks, symlink)
+		} else if fileType.IsRegular() {
 			hash, err := util.HashFile(filePath)
 			if err != nil {
 				return fmt.Errorf("error hashing file %s: %w", filePath, err)
@@ -79,8 +212,22 @@ func GenerateManifest(packageName, inputFolder string) (*Manifest, error) {
 					Hash: hash,
 				},
 			}
+			if options.FileMetadata {
+				packageFile.Mode = uint32(info.Mode().Perm())
+				packageFile.ModTime = info.ModTime().Unix()
+			}
+			if options.ChunkFiles && info.Size() > util.ChunkMaxSize {
+				packageFile.Chunks, err = ChunkFile(filePath)
+				if err != nil {
+					return fmt.Errorf("error chunking file %s: %w", filePath, err)
+				}
+			}
 			files = append(files, packageFile)
+		} else {
+			// Other items like sockets or devices are not supported
+			return nil
 		}
+		folders[path.Dir(packageFilePath)] = true
 		return nil
 	})
 
@@ -89,14 +236,34 @@ func GenerateManifest(packageName, inputFolder string) (*Manifest, error) {
 			inputFolder, err)
 	}
 
+	var emptyFolders []string
+	for folder, hasEntries := range folders {
+		if !hasEntries {
+			emptyFolders = append(emptyFolders, folder)
+		}
+	}
+	sort.Strings(emptyFolders)
+
 	manifest := Manifest{
-		ManifestVersion: 1,
+		ManifestVersion: LatestManifestVersion,
 		PackageName:     packageName,
 		Files:           files,
+		Symlinks:        symlinks,
+		Folders:         emptyFolders,
+		Dependencies:    options.Dependencies,
+		Description:     options.Description,
+		Labels:          options.Labels,
 	}
 
 	manifest.Hash = HashManifest(&manifest)
 
+	if options.SigningKey != nil {
+		err = SignManifest(&manifest, options.SigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("error signing manifest: %w", err)
+		}
+	}
+
 	return &manifest, nil
 }
 
@@ -106,16 +273,114 @@ func ValidatePackageName(name string) bool {
 	return validName
 }
 
+// ValidateLabelKey will return true for valid label keys like git.commit
+func ValidateLabelKey(key string) bool {
+	validKey, _ := regexp.MatchString(`^[a-zA-Z0-9._/-]+$`, key)
+	return validKey && len(key) <= MaxLabelKeyLength
+}
+
+// ValidateTagName will return true for valid tag names like stable or release-2026.10.
+// Tag names cannot consist only of digits to keep them apart from version numbers.
+func ValidateTagName(name string) bool {
+	validName, _ := regexp.MatchString(`^[a-z0-9][a-z0-9._-]*$`, name)
+	onlyDigits, _ := regexp.MatchString(`^[0-9]+$`, name)
+	return validName && !onlyDigits && len(name) <= MaxTagNameLength
+}
+
+// ParseLabel splits a label in the form key=value.
+// The value is optional and the label key must be valid.
+func ParseLabel(label string) (string, string, error) {
+	key, value, _ := strings.Cut(label, "=")
+	if !ValidateLabelKey(key) {
+		return "", "", fmt.Errorf("invalid label key %s", key)
+	}
+	return key, value, nil
+}
+
+func validateMetadata(manifest *Manifest) error {
+	if len(manifest.Description) > MaxDescriptionLength {
+		return fmt.Errorf("description is longer than %d bytes", MaxDescriptionLength)
+	}
+	if len(manifest.Labels) > MaxLabelCount {
+		return fmt.Errorf("manifest has more than %d labels", MaxLabelCount)
+	}
+	for key, value := range manifest.Labels {
+		if !ValidateLabelKey(key) {
+			return fmt.Errorf("invalid label key %s", key)
+		}
+		if len(value) > MaxLabelValueLength {
+			return fmt.Errorf("value of label %s is longer than %d bytes", key, MaxLabelValueLength)
+		}
+	}
+	return nil
+}
+
+// Checks the path of a symlink or folder and adds it to the existing paths
+func validateEntryPath(entryPath string, paths map[string]bool) error {
+	if len(entryPath) == 0 {
+		return fmt.Errorf("found empty path")
+	}
+	if entryPath == "." || entryPath != path.Clean(entryPath) || path.IsAbs(entryPath) || strings.Contains(entryPath, "..") {
+		return fmt.Errorf("invalid path %s", entryPath)
+	}
+	lowerCasePath := strings.ToLower(entryPath)
+	if paths[lowerCasePath] {
+		return fmt.Errorf("duplicate path %s", entryPath)
+	}
+	paths[lowerCasePath] = true
+	return nil
+}
+
+// Symlink targets must be clean relative paths that stay inside of the package.
+// Since clean paths can contain parent references only at the beginning,
+// following them never passes through other symlinks before reaching the final folder.
+func validateSymlinkTarget(symlink *Symlink) error {
+	target := symlink.Target
+	if len(target) == 0 || target != path.Clean(target) || path.IsAbs(target) ||
+		strings.ContainsAny(target, "\\:") {
+		return fmt.Errorf("invalid target %s for symlink %s", target, symlink.Path)
+	}
+	resolved := path.Join(path.Dir(symlink.Path), target)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return fmt.Errorf("target %s of symlink %s points outside of the package", target, symlink.Path)
+	}
+	return nil
+}
+
 func validateBasicManifest(manifest *Manifest) error {
-	if manifest.ManifestVersion != 1 {
+	if manifest.ManifestVersion < ManifestVersion1 || manifest.ManifestVersion > LatestManifestVersion {
 		return fmt.Errorf("invalid manifest version")
 	}
 	if !ValidatePackageName(manifest.PackageName) {
 		return fmt.Errorf("invalid package name")
 	}
-	if len(manifest.Files) <= 0 {
+	if len(manifest.Files)+len(manifest.Symlinks)+len(manifest.Folders)+len(manifest.Dependencies) <= 0 {
 		return fmt.Errorf("manifest contains no files")
 	}
+	if manifest.ManifestVersion < ManifestVersion2 && (len(manifest.Symlinks) > 0 || len(manifest.Folders) > 0) {
+		return fmt.Errorf("symlinks and empty folders require manifest version %d", ManifestVersion2)
+	}
+	if manifest.ManifestVersion < ManifestVersion2 && len(manifest.Dependencies) > 0 {
+		return fmt.Errorf("dependencies require manifest version %d", ManifestVersion2)
+	}
+	// The hash of version 1 would not protect the metadata
+	if manifest.ManifestVersion < ManifestVersion2 && (len(manifest.Description) > 0 || len(manifest.Labels) > 0 ||
+		len(manifest.Publisher) > 0 || len(manifest.PublisherToken) > 0 || manifest.Signature != nil) {
+		return fmt.Errorf("metadata and signatures require manifest version %d", ManifestVersion2)
+	}
+	if len(manifest.Dependencies) > MaxDependencyCount {
+		return fmt.Errorf("manifest has more than %d dependencies", MaxDependencyCount)
+	}
+	err := validateMetadata(manifest)
+	if err != nil {
+		return err
+	}
+	if manifest.Signature != nil {
+		err = validateSignature(manifest)
+		if err != nil {
+			return err
+		}
+	}
 
 	// compile expression for hash matching outside of loop
 	exp, err := regexp.Compile(`^[a-f0-9_-]+$`)
@@ -134,10 +399,35 @@ func validateBasicManifest(manifest *Manifest) error {
 		if file.Object.Size < 0 {
 			return fmt.Errorf("invalid object size %d for file %s", file.Object.Size, file.Path)
 		}
+		if file.Mode&^MaxFileMode != 0 {
+			return fmt.Errorf("invalid mode %o for file %s", file.Mode, file.Path)
+		}
+		if file.ModTime < 0 {
+			return fmt.Errorf("invalid modification time %d for file %s", file.ModTime, file.Path)
+		}
+		if manifest.ManifestVersion < ManifestVersion2 && (file.Mode != 0 || file.ModTime != 0) {
+			return fmt.Errorf("file metadata requires manifest version %d", ManifestVersion2)
+		}
 		validHash := exp.MatchString(file.Object.Hash)
 		if !validHash {
 			return fmt.Errorf("invalid object hash %s", file.Object.Hash)
 		}
+		if len(file.Chunks) > 0 {
+			var chunksSize int64 = 0
+			for _, chunk := range file.Chunks {
+				if chunk.Size <= 0 || chunk.Size > util.ChunkMaxSize {
+					return fmt.Errorf("invalid chunk size %d for file %s", chunk.Size, file.Path)
+				}
+				if !exp.MatchString(chunk.Hash) {
+					return fmt.Errorf("invalid chunk hash %s", chunk.Hash)
+				}
+				chunksSize += chunk.Size
+			}
+			if chunksSize != file.Object.Size {
+				return fmt.Errorf("chunks size %d does not match size %d of file %s",
+					chunksSize, file.Object.Size, file.Path)
+			}
+		}
 		// duplicates are checked case-insenstitive to avoid Windows issues
 		lowerCasePath := strings.ToLower(file.Path)
 		if paths[lowerCasePath] {
@@ -146,6 +436,50 @@ func validateBasicManifest(manifest *Manifest) error {
 		paths[lowerCasePath] = true
 	}
 
+	// Symlinks, empty folders and dependency folders cannot contain other package entries
+	leafs := make(map[string]bool)
+	for _, symlink := range manifest.Symlinks {
+		err = validateEntryPath(symlink.Path, paths)
+		if err != nil {
+			return err
+		}
+		err = validateSymlinkTarget(&symlink)
+		if err != nil {
+			return err
+		}
+		leafs[strings.ToLower(symlink.Path)] = true
+	}
+	for _, folder := range manifest.Folders {
+		err = validateEntryPath(folder, paths)
+		if err != nil {
+			return err
+		}
+		leafs[strings.ToLower(folder)] = true
+	}
+	for _, dependency := range manifest.Dependencies {
+		err = validateDependency(&dependency)
+		if err != nil {
+			return err
+		}
+		if dependency.PackageName == manifest.PackageName {
+			return fmt.Errorf("package cannot depend on itself")
+		}
+		err = validateEntryPath(dependency.Folder, paths)
+		if err != nil {
+			return err
+		}
+		leafs[strings.ToLower(dependency.Folder)] = true
+	}
+	if len(leafs) > 0 {
+		for entryPath := range paths {
+			for parent := path.Dir(entryPath); parent != "."; parent = path.Dir(parent) {
+				if leafs[parent] {
+					return fmt.Errorf("path %s is located inside of symlink, empty folder or dependency folder %s", entryPath, parent)
+				}
+			}
+		}
+	}
+
 	hash := HashManifest(manifest)
 	if hash != manifest.Hash {
 		return fmt.Errorf("invalid manifest hash")
@@ -184,13 +518,33 @@ func ValidatePublishedManifest(manifest *Manifest) error {
 	return nil
 }
 
-// HashManifest calculates the verification hash for a manifest
+// HashManifest calculates the verification hash for a manifest.
+// Version 1 manifests keep their original hash, which does not cover the package version.
+// All newer versions hash a canonical JSON encoding of all fields except for the hash and the signature,
+// so metadata added in the future is covered automatically.
 func HashManifest(manifest *Manifest) string {
+	if manifest.ManifestVersion < ManifestVersion2 {
+		return hashManifestV1(manifest)
+	}
+
+	canonical := *manifest
+	canonical.Hash = ""
+	canonical.Signature = nil
+	// Encoding a manifest cannot fail, it contains only strings, numbers and slices
+	jsonData, _ := json.Marshal(canonical)
+
+	hasher := util.CreateHasher()
+	hasher.Write(jsonData)
+	return util.GetHashString(hasher)
+}
+
+func hashManifestV1(manifest *Manifest) string {
 	hasher := util.CreateHasher()
 	addString := func(s string) {
 		hasher.Write([]byte(s))
 	}
 
+	// The duplicated manifest version instead of the package version is a known mistake
 	addString(fmt.Sprint(manifest.ManifestVersion))
 	addString(manifest.PackageName)
 	addString(fmt.Sprint(manifest.ManifestVersion))
@@ -200,7 +554,62 @@ func HashManifest(manifest *Manifest) string {
 		addString(file.Path)
 		addString(file.Object.Hash)
 		addString(fmt.Sprint(file.Object.Size))
+		// Chunks are only hashed when present to keep the hashes of older manifests valid
+		for _, chunk := range file.Chunks {
+			addString(chunk.Hash)
+			addString(fmt.Sprint(chunk.Size))
+		}
 	}
 
 	return util.GetHashString(hasher)
 }
+
+// ConvertManifest returns a copy of the manifest in another format version with a new hash.
+// Use it to serve manifests to older clients. Labels are shared with the original manifest.
+// Manifests with symlinks, empty folders, dependencies or chunked files cannot be converted to version 1.
+// Signatures and all metadata not protected by the hash of version 1 are dropped when converting to it:
+// description, labels, publisher and the modes and modification times of files.
+func ConvertManifest(manifest *Manifest, version uint) (*Manifest, error) {
+	if version < ManifestVersion1 || version > LatestManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", version)
+	}
+	converted := *manifest
+	converted.ManifestVersion = version
+	if version < ManifestVersion2 {
+		// The hash of version 1 would not protect them and older clients would ignore them
+		if len(manifest.Symlinks) > 0 || len(manifest.Folders) > 0 {
+			return nil, fmt.Errorf("manifest version %d cannot contain symlinks or empty folders", version)
+		}
+		if len(manifest.Dependencies) > 0 {
+			return nil, fmt.Errorf("manifest version %d cannot contain dependencies", version)
+		}
+		// Older clients would try to download the whole file object, which is not stored
+		converted.Files = make([]File, len(manifest.Files))
+		for i, file := range manifest.Files {
+			if len(file.Chunks) > 0 {
+				return nil, fmt.Errorf("manifest version %d cannot contain chunked files", version)
+			}
+			converted.Files[i] = File{Path: file.Path, Object: file.Object}
+		}
+		converted.Description = ""
+		converted.Labels = nil
+		converted.Publisher = ""
+		converted.PublisherToken = ""
+		converted.Signature = nil
+	}
+	converted.Hash = HashManifest(&converted)
+	return &converted, nil
+}
+
+// ParseManifestVersion reads the manifest version from the value of the ManifestVersionHeader.
+// Missing or invalid values result in version 1, newer versions than the latest one are reduced.
+func ParseManifestVersion(value string) uint {
+	version, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || version < uint64(ManifestVersion1) {
+		return ManifestVersion1
+	}
+	if version > uint64(LatestManifestVersion) {
+		return LatestManifestVersion
+	}
+	return uint(version)
+}
@@ -1,7 +1,10 @@
 package bdm
 
 import (
+	"math/rand"
 	"os"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -145,3 +148,256 @@ func TestHashManifest(t *testing.T) {
 	hash = HashManifest(&publishedManifest)
 	util.AssertEqualString(t, "db910b1dba2bf0dc19247346622c3f9f14c8719eda01ea41b71cfaf13626dce2", hash)
 }
+
+func TestManifestVersion2(t *testing.T) {
+	manifest := generateUnpublishedManifest()
+	manifest.PackageVersion = 1
+	manifest.Published = 123456
+	v1Hash := HashManifest(&manifest)
+
+	// The first version does not protect the package version
+	manifest.PackageVersion = 2
+	util.AssertEqualString(t, v1Hash, HashManifest(&manifest))
+
+	manifest.ManifestVersion = ManifestVersion2
+	manifest.PackageVersion = 1
+	v2Hash := HashManifest(&manifest)
+	util.Assert(t, v2Hash != v1Hash)
+	manifest.PackageVersion = 2
+	util.Assert(t, HashManifest(&manifest) != v2Hash)
+
+	// The hash itself is not part of the hash
+	manifest.Hash = "foo"
+	hash := HashManifest(&manifest)
+	manifest.Hash = "bar"
+	util.AssertEqualString(t, hash, HashManifest(&manifest))
+	manifest.Hash = hash
+	util.AssertNoError(t, ValidatePublishedManifest(&manifest))
+
+	// Conversions work in both directions
+	converted, err := ConvertManifest(&manifest, ManifestVersion1)
+	util.AssertNoError(t, err)
+	util.Assert(t, converted.ManifestVersion == ManifestVersion1)
+	util.Assert(t, manifest.ManifestVersion == ManifestVersion2)
+	util.AssertNoError(t, ValidatePublishedManifest(converted))
+	converted, err = ConvertManifest(converted, ManifestVersion2)
+	util.AssertNoError(t, err)
+	util.AssertEqualString(t, manifest.Hash, converted.Hash)
+	_, err = ConvertManifest(&manifest, LatestManifestVersion+1)
+	util.AssertError(t, err)
+
+	// Unknown versions are rejected
+	manifest.ManifestVersion = LatestManifestVersion + 1
+	manifest.Hash = HashManifest(&manifest)
+	util.AssertError(t, ValidatePublishedManifest(&manifest))
+
+	util.Assert(t, ParseManifestVersion("") == ManifestVersion1)
+	util.Assert(t, ParseManifestVersion("foo") == ManifestVersion1)
+	util.Assert(t, ParseManifestVersion("0") == ManifestVersion1)
+	util.Assert(t, ParseManifestVersion("2") == ManifestVersion2)
+	util.Assert(t, ParseManifestVersion("99") == LatestManifestVersion)
+}
+
+func TestManifestMetadata(t *testing.T) {
+	manifest := generateUnpublishedManifest()
+	manifest.ManifestVersion = ManifestVersion2
+	manifest.Description = "Nightly build"
+	manifest.Labels = map[string]string{"git.commit": "abc", "ci/job": "42", "empty": ""}
+	manifest.Hash = HashManifest(&manifest)
+	checkUnpublishedManifest(t, &manifest, true)
+
+	// The metadata is protected by the hash
+	hash := manifest.Hash
+	manifest.Labels["git.commit"] = "def"
+	util.Assert(t, HashManifest(&manifest) != hash)
+
+	// Version 1 does not protect the metadata, so it is dropped
+	manifest.Files[0].Mode = 0755
+	manifest.Files[0].ModTime = 1700000000
+	manifest.Publisher = "admin"
+	converted, err := ConvertManifest(&manifest, ManifestVersion1)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(converted.Description) == 0 && converted.Labels == nil && len(converted.Publisher) == 0)
+	util.Assert(t, converted.Files[0].Mode == 0 && converted.Files[0].ModTime == 0)
+	util.Assert(t, manifest.Files[0].Mode == 0755 && len(manifest.Labels) == 3)
+
+	// Version 1 manifests with any of the metadata are invalid
+	invalid := []func(m *Manifest){
+		func(m *Manifest) { m.Description = "Nightly build" },
+		func(m *Manifest) { m.Labels = map[string]string{"ci/job": "42"} },
+		func(m *Manifest) { m.Publisher = "admin" },
+		func(m *Manifest) { m.PublisherToken = "token" },
+		func(m *Manifest) { m.Files[0].Mode = 0755 },
+		func(m *Manifest) { m.Files[0].ModTime = 1700000000 },
+		func(m *Manifest) { m.Symlinks = []Symlink{{Path: "link", Target: "a"}} },
+		func(m *Manifest) { m.Folders = []string{"empty"} },
+		func(m *Manifest) { m.Dependencies = []Dependency{{PackageName: "bar", Version: "1"}} },
+		func(m *Manifest) { m.Signature = &Signature{} },
+	}
+	for _, modify := range invalid {
+		old := generateUnpublishedManifest()
+		modify(&old)
+		old.Hash = HashManifest(&old)
+		checkUnpublishedManifest(t, &old, false)
+	}
+
+	manifest.Files[0].Mode = 0
+	manifest.Files[0].ModTime = 0
+	manifest.Publisher = ""
+
+	manifest.Labels["invalid key"] = "foo"
+	manifest.Hash = HashManifest(&manifest)
+	checkUnpublishedManifest(t, &manifest, false)
+	delete(manifest.Labels, "invalid key")
+	manifest.Description = strings.Repeat("a", MaxDescriptionLength+1)
+	manifest.Hash = HashManifest(&manifest)
+	checkUnpublishedManifest(t, &manifest, false)
+
+	key, value, err := ParseLabel("git.commit=abc=def")
+	util.AssertNoError(t, err)
+	util.AssertEqualString(t, "git.commit", key)
+	util.AssertEqualString(t, "abc=def", value)
+	key, value, err = ParseLabel("release")
+	util.AssertNoError(t, err)
+	util.AssertEqualString(t, "release", key)
+	util.AssertEqualString(t, "", value)
+	_, _, err = ParseLabel("=abc")
+	util.AssertError(t, err)
+}
+
+func TestChunkedManifest(t *testing.T) {
+	manifest := generateUnpublishedManifest()
+	hash := manifest.Hash
+	manifest.Files[0].Chunks = []Object{
+		{Size: 100, Hash: "abc1"},
+		{Size: 23, Hash: "abc2"},
+	}
+	manifest.Hash = HashManifest(&manifest)
+	util.Assert(t, manifest.Hash != hash)
+	checkUnpublishedManifest(t, &manifest, true)
+	util.Assert(t, len(GetFileObjects(&manifest.Files[0])) == 2)
+
+	// Version 1 clients cannot download chunked files
+	manifest.ManifestVersion = ManifestVersion2
+	_, err := ConvertManifest(&manifest, ManifestVersion1)
+	util.AssertError(t, err)
+	manifest.ManifestVersion = ManifestVersion1
+
+	// Chunk sizes must add up to the file size
+	manifest.Files[0].Chunks[1].Size = 24
+	manifest.Hash = HashManifest(&manifest)
+	checkUnpublishedManifest(t, &manifest, false)
+
+	manifest.Files[0].Chunks[1].Size = 23
+	manifest.Files[0].Chunks[1].Hash = "ztgf/)"
+	manifest.Hash = HashManifest(&manifest)
+	checkUnpublishedManifest(t, &manifest, false)
+
+	// Files without chunks have a single object
+	manifest = generateUnpublishedManifest()
+	objects := GetFileObjects(&manifest.Files[0])
+	util.Assert(t, len(objects) == 1 && objects[0] == manifest.Files[0].Object)
+}
+
+func TestGenerateChunkedManifest(t *testing.T) {
+	testFolder := "testPackage"
+	err := os.MkdirAll(testFolder, os.ModePerm)
+	util.AssertNoError(t, err)
+	defer os.RemoveAll(testFolder)
+
+	data := make([]byte, 2*util.ChunkMaxSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	err = os.WriteFile(testFolder+"/big.dat", data, os.ModePerm)
+	util.AssertNoError(t, err)
+	err = os.WriteFile(testFolder+"/small.dat", []byte{1, 2, 3}, os.ModePerm)
+	util.AssertNoError(t, err)
+
+	manifest, err := GenerateManifest("foo", testFolder)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(manifest.Files[0].Chunks) == 0)
+
+	manifest, err = GenerateManifestWithOptions("foo", testFolder, ManifestOptions{ChunkFiles: true})
+	util.AssertNoError(t, err)
+	util.Assert(t, len(manifest.Files) == 2)
+	util.Assert(t, len(manifest.Files[0].Chunks) > 1)
+	util.Assert(t, len(manifest.Files[1].Chunks) == 0)
+	err = ValidateUnpublishedManifest(manifest)
+	util.AssertNoError(t, err)
+}
+
+func TestGenerateManifestWithFileMetadata(t *testing.T) {
+	testFolder := "testPackage"
+	err := os.MkdirAll(testFolder, os.ModePerm)
+	util.AssertNoError(t, err)
+	defer os.RemoveAll(testFolder)
+
+	filePath := testFolder + "/tool.sh"
+	err = os.WriteFile(filePath, []byte{1, 2, 3}, 0755)
+	util.AssertNoError(t, err)
+	err = os.Chmod(filePath, 0750)
+	util.AssertNoError(t, err)
+	modTime := time.Unix(1700000000, 0)
+	err = os.Chtimes(filePath, modTime, modTime)
+	util.AssertNoError(t, err)
+
+	manifest, err := GenerateManifest("foo", testFolder)
+	util.AssertNoError(t, err)
+	util.Assert(t, manifest.Files[0].Mode == 0 && manifest.Files[0].ModTime == 0)
+
+	manifest, err = GenerateManifestWithOptions("foo", testFolder, ManifestOptions{FileMetadata: true})
+	util.AssertNoError(t, err)
+	util.Assert(t, manifest.Files[0].ModTime == 1700000000)
+	if runtime.GOOS != "windows" {
+		util.Assert(t, manifest.Files[0].Mode == 0750)
+	}
+	checkUnpublishedManifest(t, manifest, true)
+
+	// The metadata is protected by the hash
+	hash := manifest.Hash
+	manifest.Files[0].Mode = 0777
+	util.Assert(t, HashManifest(manifest) != hash)
+
+	// Only permission bits and positive times are allowed
+	manifest.Files[0].Mode = 04755
+	manifest.Hash = HashManifest(manifest)
+	checkUnpublishedManifest(t, manifest, false)
+	manifest.Files[0].Mode = 0755
+	manifest.Files[0].ModTime = -1
+	manifest.Hash = HashManifest(manifest)
+	checkUnpublishedManifest(t, manifest, false)
+}
+
+func TestManifestSymlinksAndFolders(t *testing.T) {
+	manifest := generateUnpublishedManifest()
+	manifest.ManifestVersion = ManifestVersion2
+	manifest.Symlinks = []Symlink{{Path: "bin/tool", Target: "../lib/tool"}}
+	manifest.Folders = []string{"cache/empty"}
+	manifest.Hash = HashManifest(&manifest)
+	checkUnpublishedManifest(t, &manifest, true)
+
+	// Version 1 cannot describe symlinks and folders
+	_, err := ConvertManifest(&manifest, ManifestVersion1)
+	util.AssertError(t, err)
+	manifest.ManifestVersion = ManifestVersion1
+	manifest.Hash = HashManifest(&manifest)
+	checkUnpublishedManifest(t, &manifest, false)
+	manifest.ManifestVersion = ManifestVersion2
+
+	// Targets must be clean, relative and stay inside of the package
+	for _, target := range []string{"", "/etc/passwd", "../../outside", "lib/../../..", "./tool", "C:\\tool"} {
+		manifest.Symlinks[0].Target = target
+		manifest.Hash = HashManifest(&manifest)
+		checkUnpublishedManifest(t, &manifest, false)
+	}
+	manifest.Symlinks[0].Target = "../lib/tool"
+
+	// Symlinks and empty folders cannot contain other entries
+	for _, folder := range []string{"bin/tool/inside", "folder", "BIN/TOOL", "."} {
+		manifest.Folders = []string{folder}
+		manifest.Hash = HashManifest(&manifest)
+		checkUnpublishedManifest(t, &manifest, false)
+	}
+	manifest.Folders = []string{"cache/empty", "cache/other"}
+	manifest.Hash = HashManifest(&manifest)
+	checkUnpublishedManifest(t, &manifest, true)
+}
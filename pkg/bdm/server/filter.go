@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/store"
+)
+
+type labelFilter struct {
+	key      string
+	value    string
+	anyValue bool
+}
+
+// Filters package versions by their metadata
+type manifestFilter struct {
+	labels    []labelFilter
+	publisher string
+}
+
+// Reads the filter from the query parameters label and publisher.
+// Labels can be specified multiple times as key=value or just as key to match any value.
+// The publisher matches the user or the token that published a version.
+// Returns nil if the query contains no filter.
+func parseManifestFilter(query url.Values) (*manifestFilter, error) {
+	if !query.Has("label") && !query.Has("publisher") {
+		return nil, nil
+	}
+
+	filter := manifestFilter{publisher: query.Get("publisher")}
+	for _, label := range query["label"] {
+		key, value, err := bdm.ParseLabel(label)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing label filter: %w", err)
+		}
+		anyValue := len(key) == len(label)
+		filter.labels = append(filter.labels, labelFilter{key, value, anyValue})
+	}
+
+	return &filter, nil
+}
+
+func (f *manifestFilter) matches(metadata *store.VersionMetadata) bool {
+	if len(f.publisher) > 0 && f.publisher != metadata.Publisher && f.publisher != metadata.PublisherToken {
+		return false
+	}
+	for _, label := range f.labels {
+		value, found := metadata.Labels[label.key]
+		if !found || (!label.anyValue && value != label.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the versions of the package that match the filter.
+// The metadata comes from the index of the store, so no manifests need to be read.
+func (f *manifestFilter) filterVersions(packageStore store.Store, name string, versions []store.VersionInfo) ([]store.VersionInfo, error) {
+	metadata, err := packageStore.GetVersionMetadata(name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting metadata of package %s: %w", name, err)
+	}
+	matching := make(map[uint]bool)
+	for i := range metadata {
+		if f.matches(&metadata[i]) {
+			matching[metadata[i].Version] = true
+		}
+	}
+
+	filtered := make([]store.VersionInfo, 0)
+	for _, version := range versions {
+		if matching[version.Version] {
+			filtered = append(filtered, version)
+		}
+	}
+	return filtered, nil
+}
+
+// Returns true if at least one version of the package matches the filter
+func (f *manifestFilter) matchesPackage(packageStore store.Store, name string) (bool, error) {
+	metadata, err := packageStore.GetVersionMetadata(name)
+	if err != nil {
+		return false, fmt.Errorf("error getting metadata of package %s: %w", name, err)
+	}
+	for i := range metadata {
+		if f.matches(&metadata[i]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
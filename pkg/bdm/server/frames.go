@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/store"
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+// Writes a ZSTD stream as a sequence of complete frames.
+// The concatenation of frames decompresses to the concatenation of their data,
+// which allows to copy the frames of stored ZSTD objects unchanged into the stream.
+// All other data is compressed by an encoder that is finished before each copied object.
+type frameWriter struct {
+	output  io.Writer
+	encoder io.WriteCloser
+}
+
+func newFrameWriter(output io.Writer) *frameWriter {
+	return &frameWriter{output: output}
+}
+
+// Write compresses the data into the current frame
+func (w *frameWriter) Write(p []byte) (int, error) {
+	if w.encoder == nil {
+		encoder, err := util.CreateCompressingWriter(w.output)
+		if err != nil {
+			return 0, fmt.Errorf("error creating compressing writer: %w", err)
+		}
+		w.encoder = encoder
+	}
+	return w.encoder.Write(p)
+}
+
+// Close finishes the current frame
+func (w *frameWriter) Close() error {
+	if w.encoder == nil {
+		return nil
+	}
+	err := w.encoder.Close()
+	w.encoder = nil
+	if err != nil {
+		return fmt.Errorf("error finishing compressed frame: %w", err)
+	}
+	return nil
+}
+
+// Writes the data of an object into the stream without recompressing stored ZSTD objects.
+// If a decoded writer is supplied, it also receives the uncompressed object data.
+func (w *frameWriter) writeObject(packageStore store.Store, object bdm.Object, decoded io.Writer) error {
+	stored, err := packageStore.ReadStoredObject(object.Hash)
+	if err != nil {
+		return fmt.Errorf("error reading object %s from store: %w", object.Hash, err)
+	}
+	defer stored.Close()
+
+	if stored.Format == store.FormatRaw {
+		output := io.Writer(w)
+		if decoded != nil {
+			output = io.MultiWriter(w, decoded)
+		}
+		written, err := io.Copy(output, stored)
+		if err != nil {
+			return fmt.Errorf("error copying object data: %w", err)
+		}
+		if written != object.Size {
+			return fmt.Errorf("error copying object data: expected to write %d but wrote %d bytes",
+				object.Size, written)
+		}
+		return nil
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	if decoded == nil {
+		written, err := io.Copy(w.output, stored)
+		if err != nil {
+			return fmt.Errorf("error copying stored object data: %w", err)
+		}
+		if written != stored.Size {
+			return fmt.Errorf("error copying stored object data: expected to write %d but wrote %d bytes",
+				stored.Size, written)
+		}
+		return nil
+	}
+
+	// Decode the frames while they are copied
+	tee := io.TeeReader(stored, w.output)
+	decompressed, err := util.CreateDecompressingReader(tee)
+	if err != nil {
+		return fmt.Errorf("error creating decompressing reader: %w", err)
+	}
+	defer decompressed.Close()
+	written, err := io.Copy(decoded, decompressed)
+	if err != nil {
+		return fmt.Errorf("error decoding object data: %w", err)
+	}
+	if written != object.Size {
+		return fmt.Errorf("error decoding object data: expected %d but got %d bytes", object.Size, written)
+	}
+	_, err = io.Copy(io.Discard, tee)
+	if err != nil {
+		return fmt.Errorf("error copying stored object data: %w", err)
+	}
+	return nil
+}
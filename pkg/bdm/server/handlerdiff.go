@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/store"
+	"github.com/go-chi/chi/v5"
+)
+
+func createDiffHandler(packageStore store.Store, users Users, tokens Tokens) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if !hasReadPermission(req, users, tokens) {
+			http.Error(writer, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		name := chi.URLParam(req, "name")
+		validName := bdm.ValidatePackageName(name)
+		if !validName {
+			http.Error(writer, "Bad package name", http.StatusBadRequest)
+			return
+		}
+
+		manifests := make([]*bdm.Manifest, 0, 2)
+		for _, param := range []string{"v1", "v2"} {
+			value := chi.URLParam(req, param)
+			version, err := resolveVersion(packageStore, name, value)
+			if errors.Is(err, errBadVersion) {
+				http.Error(writer, "Bad package version", http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(writer, fmt.Sprintf("Package version %s does not exist", value), http.StatusNotFound)
+				return
+			}
+			manifest, err := packageStore.GetManifest(name, version)
+			if err != nil {
+				http.Error(writer, fmt.Sprintf("Package version %d does not exist", version), http.StatusNotFound)
+				return
+			}
+			manifests = append(manifests, manifest)
+		}
+
+		diff := bdm.DiffManifests(manifests[0], manifests[1])
+		jsonData, err := json.Marshal(diff)
+		if err != nil {
+			log.Print(fmt.Errorf("error marshalling diff to JSON: %w", err))
+			http.Error(writer, "Failed to generate JSON data", http.StatusInternalServerError)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonData)
+	}
+}
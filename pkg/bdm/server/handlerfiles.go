@@ -7,8 +7,8 @@ import (
 	"log"
 	"net/http"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cry-inc/bdm/pkg/bdm"
 	"github.com/cry-inc/bdm/pkg/bdm/store"
@@ -29,14 +29,13 @@ func createFilesHandler(packageStore store.Store, users Users, tokens Tokens) ht
 			return
 		}
 
-		versionString := chi.URLParam(req, "version")
-		version, err := strconv.Atoi(versionString)
-		if err != nil || version <= 0 {
-			http.Error(writer, "Bad package version", http.StatusBadRequest)
+		version, err := resolveVersion(packageStore, name, chi.URLParam(req, "version"))
+		if err != nil {
+			writeVersionError(writer, err)
 			return
 		}
 
-		manifest, err := packageStore.GetManifest(name, uint(version))
+		manifest, err := packageStore.GetManifest(name, version)
 		if err != nil || manifest == nil {
 			http.Error(writer, "Package does not exist", http.StatusNotFound)
 			return
@@ -46,41 +45,63 @@ func createFilesHandler(packageStore store.Store, users Users, tokens Tokens) ht
 		// This prevents people from faking wrong file names for downloading.
 		fileHash := chi.URLParam(req, "hash")
 		fileName := chi.URLParam(req, "file")
-		fileSize := int64(0)
-		found := false
-		for _, file := range manifest.Files {
+		var foundFile *bdm.File
+		for i, file := range manifest.Files {
 			if file.Object.Hash != fileHash {
 				continue
 			}
 			if filepath.Base(file.Path) != fileName {
 				continue
 			}
-			found = true
-			fileSize = file.Object.Size
+			foundFile = &manifest.Files[i]
 			break
 		}
 
-		if !found {
+		if foundFile == nil {
 			http.Error(writer, "File not found", http.StatusNotFound)
 			return
 		}
 
-		reader, err := packageStore.ReadObject(fileHash)
-		if err != nil {
-			log.Print(fmt.Errorf("error reading object %s from store: %w", fileHash, err))
-			http.Error(writer, "Unable to read object", http.StatusInternalServerError)
+		writer.Header().Set("Vary", "Accept-Encoding")
+		if matchesETag(req, fileHash) {
+			setImmutableHeaders(writer, fileHash, "")
+			writer.WriteHeader(http.StatusNotModified)
 			return
 		}
-		defer reader.Close()
 
+		// Range requests are always answered with the uncompressed content
+		fileSize := foundFile.Object.Size
+		acceptEncoding := req.Header.Get("Accept-Encoding")
+		compress := fileSize > 1000 && len(req.Header.Get("Range")) == 0
 		writer.Header().Set("Content-Type", "application/octet-stream")
-		if fileSize > 1000 && strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		writer.Header().Set("Accept-Ranges", "bytes")
+		if compress && strings.Contains(acceptEncoding, "zstd") {
+			// Stored ZSTD objects are sent without recompression
+			setImmutableHeaders(writer, fileHash, "zstd")
+			writer.Header().Set("Content-Encoding", "zstd")
+			frames := newFrameWriter(writer)
+			for _, object := range bdm.GetFileObjects(foundFile) {
+				err = frames.writeObject(packageStore, object, nil)
+				if err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = frames.Close()
+			}
+		} else if compress && strings.Contains(acceptEncoding, "gzip") {
+			reader := store.ReadFile(packageStore, foundFile)
+			defer reader.Close()
+			setImmutableHeaders(writer, fileHash, "gzip")
 			writer.Header().Set("Content-Encoding", "gzip")
 			gzipWriter := gzip.NewWriter(writer)
 			defer gzipWriter.Close()
 			_, err = io.Copy(gzipWriter, reader)
 		} else {
-			_, err = io.Copy(writer, reader)
+			seeker := &fileSeeker{packageStore: packageStore, file: foundFile}
+			defer seeker.Close()
+			setImmutableHeaders(writer, fileHash, "")
+			http.ServeContent(writer, req, fileName, time.Time{}, seeker)
 		}
 
 		if err != nil {
@@ -89,3 +110,50 @@ func createFilesHandler(packageStore store.Store, users Users, tokens Tokens) ht
 		}
 	}
 }
+
+// Provides seekable access to a package file for http.ServeContent.
+// The file data is only read from the store when it is requested at the current position.
+type fileSeeker struct {
+	packageStore store.Store
+	file         *bdm.File
+	offset       int64
+	reader       io.ReadCloser
+}
+
+func (s *fileSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.file.Object.Size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid negative offset %d", offset)
+	}
+	if offset != s.offset {
+		s.Close()
+		s.offset = offset
+	}
+	return offset, nil
+}
+
+func (s *fileSeeker) Read(p []byte) (int, error) {
+	if s.reader == nil {
+		s.reader = store.ReadFileAt(s.packageStore, s.file, s.offset)
+	}
+	read, err := s.reader.Read(p)
+	s.offset += int64(read)
+	return read, err
+}
+
+func (s *fileSeeker) Close() error {
+	if s.reader == nil {
+		return nil
+	}
+	err := s.reader.Close()
+	s.reader = nil
+	return err
+}
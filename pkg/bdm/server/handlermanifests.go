@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/cry-inc/bdm/pkg/bdm"
 	"github.com/cry-inc/bdm/pkg/bdm/store"
@@ -29,18 +31,24 @@ func createManifestHandler(packageStore store.Store, users Users, tokens Tokens)
 		}
 
 		versionString := chi.URLParam(req, "version")
-		version, err := strconv.Atoi(versionString)
-		if err != nil || version <= 0 {
-			http.Error(writer, "Bad package version", http.StatusBadRequest)
+		version, err := resolveVersion(packageStore, name, versionString)
+		if err != nil {
+			writeVersionError(writer, err)
 			return
 		}
 
-		manifest, err := packageStore.GetManifest(name, uint(version))
+		manifest, err := packageStore.GetManifest(name, version)
 		if err != nil {
 			http.Error(writer, "Package does not exist", http.StatusNotFound)
 			return
 		}
 
+		manifest, err = negotiateManifest(req, manifest)
+		if err != nil {
+			http.Error(writer, "Package requires a newer client", http.StatusNotAcceptable)
+			return
+		}
+
 		jsonData, err := json.Marshal(*manifest)
 		if err != nil {
 			log.Print(fmt.Errorf("error marshalling manifest to JSON: %w", err))
@@ -48,8 +56,17 @@ func createManifestHandler(packageStore store.Store, users Users, tokens Tokens)
 			return
 		}
 
+		// ServeContent handles the conditional and range requests
 		writer.Header().Set("Content-Type", "application/json")
-		writer.Write(jsonData)
+		writer.Header().Add("Vary", bdm.ManifestVersionHeader)
+		if bdm.ValidateTagName(versionString) {
+			// Tags can be moved, so the response must be revalidated
+			writer.Header().Set("ETag", `"`+manifest.Hash+`"`)
+			writer.Header().Set("Cache-Control", "no-cache")
+		} else {
+			setImmutableHeaders(writer, manifest.Hash, "")
+		}
+		http.ServeContent(writer, req, "", time.Time{}, bytes.NewReader(jsonData))
 	}
 }
 
@@ -60,6 +77,12 @@ func createManifestNamesHandler(packageStore store.Store, users Users, tokens To
 			return
 		}
 
+		filter, err := parseManifestFilter(req.URL.Query())
+		if err != nil {
+			http.Error(writer, "Bad filter", http.StatusBadRequest)
+			return
+		}
+
 		names, err := packageStore.GetNames()
 		if err != nil {
 			log.Print(fmt.Errorf("error listing package names: %w", err))
@@ -67,6 +90,23 @@ func createManifestNamesHandler(packageStore store.Store, users Users, tokens To
 			return
 		}
 
+		// Only packages with at least one matching version are listed
+		if filter != nil {
+			filteredNames := make([]string, 0)
+			for _, name := range names {
+				matches, err := filter.matchesPackage(packageStore, name)
+				if err != nil {
+					log.Print(fmt.Errorf("error filtering package %s: %w", name, err))
+					http.Error(writer, "Failed to list package names", http.StatusInternalServerError)
+					return
+				}
+				if matches {
+					filteredNames = append(filteredNames, name)
+				}
+			}
+			names = filteredNames
+		}
+
 		type manifestListItem struct{ Name string }
 		manifestList := make([]manifestListItem, 0)
 		for _, name := range names {
@@ -99,7 +139,13 @@ func createManifestVersionsHandler(packageStore store.Store, users Users, tokens
 			return
 		}
 
-		versions, err := packageStore.GetVersions(name)
+		filter, err := parseManifestFilter(req.URL.Query())
+		if err != nil {
+			http.Error(writer, "Bad filter", http.StatusBadRequest)
+			return
+		}
+
+		versions, err := packageStore.GetVersionInfos(name)
 		if err != nil {
 			log.Print(fmt.Errorf("error getting version numbers for package %s: %w", name, err))
 			http.Error(writer, "Failed to list package versions", http.StatusInternalServerError)
@@ -109,14 +155,16 @@ func createManifestVersionsHandler(packageStore store.Store, users Users, tokens
 			http.Error(writer, "Package not found", http.StatusNotFound)
 			return
 		}
-
-		type versionListItem struct{ Version uint }
-		versionList := make([]versionListItem, 0)
-		for _, version := range versions {
-			versionList = append(versionList, versionListItem{Version: version})
+		if filter != nil {
+			versions, err = filter.filterVersions(packageStore, name, versions)
+			if err != nil {
+				log.Print(fmt.Errorf("error filtering versions of package %s: %w", name, err))
+				http.Error(writer, "Failed to list package versions", http.StatusInternalServerError)
+				return
+			}
 		}
 
-		jsonData, err := json.Marshal(versionList)
+		jsonData, err := json.Marshal(versions)
 		if err != nil {
 			log.Print(fmt.Errorf("error marshalling version numbers to JSON: %w", err))
 			http.Error(writer, "Failed to generate JSON data", http.StatusInternalServerError)
@@ -153,6 +201,10 @@ func createPublishManifestHandler(packageStore store.Store, limits *bdm.Manifest
 			http.Error(writer, "Bad manifest", http.StatusBadRequest)
 			return
 		}
+		if len(manifest.Publisher) > 0 || len(manifest.PublisherToken) > 0 {
+			http.Error(writer, "Publisher is assigned by the server", http.StatusBadRequest)
+			return
+		}
 
 		err = bdm.CheckManifestLimits(&manifest, limits)
 		if err != nil {
@@ -166,6 +218,19 @@ func createPublishManifestHandler(packageStore store.Store, limits *bdm.Manifest
 			return
 		}
 
+		// Changing the publisher requires a new hash before publishing.
+		// Manifests of older clients are upgraded first, since version 1 cannot contain a publisher.
+		manifest.ManifestVersion = bdm.LatestManifestVersion
+		manifest.Publisher, manifest.PublisherToken = getPublisher(req, users, tokens)
+
+		// Publishers can only sign with their own keys, all other manifests
+		// are signed by the store after assigning the version number
+		if manifest.Signature != nil && !hasSigningKey(users, manifest.Publisher, manifest.Signature.PublicKey) {
+			http.Error(writer, "Signing key is not registered for publisher", http.StatusForbidden)
+			return
+		}
+		manifest.Hash = bdm.HashManifest(&manifest)
+
 		err = packageStore.PublishManifest(&manifest)
 		var dupErr store.DuplicatePackageError
 		if errors.As(err, &dupErr) {
@@ -177,7 +242,13 @@ func createPublishManifestHandler(packageStore store.Store, limits *bdm.Manifest
 			return
 		}
 
-		jsonData, err = json.Marshal(manifest)
+		published, err := negotiateManifest(req, &manifest)
+		if err != nil {
+			http.Error(writer, "Failed to convert published manifest", http.StatusInternalServerError)
+			return
+		}
+
+		jsonData, err = json.Marshal(published)
 		if err != nil {
 			http.Error(writer, "Failed to serialize published manifest", http.StatusInternalServerError)
 			return
@@ -187,3 +258,112 @@ func createPublishManifestHandler(packageStore store.Store, limits *bdm.Manifest
 		writer.Write(jsonData)
 	})
 }
+
+func createDeleteManifestHandler(packageStore store.Store, users Users, tokens Tokens) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if !hasAdminPermission(req, users, tokens) {
+			http.Error(writer, "Admin permissions required", http.StatusUnauthorized)
+			return
+		}
+
+		name := chi.URLParam(req, "name")
+		validName := bdm.ValidatePackageName(name)
+		if !validName {
+			http.Error(writer, "Bad package name", http.StatusBadRequest)
+			return
+		}
+
+		versionString := chi.URLParam(req, "version")
+		version, err := strconv.Atoi(versionString)
+		if err != nil || version <= 0 {
+			http.Error(writer, "Bad package version", http.StatusBadRequest)
+			return
+		}
+
+		_, err = packageStore.GetManifest(name, uint(version))
+		if err != nil {
+			http.Error(writer, "Package does not exist", http.StatusNotFound)
+			return
+		}
+
+		err = packageStore.DeleteManifest(name, uint(version))
+		if err != nil {
+			log.Print(fmt.Errorf("error deleting package %s version %d: %w", name, version, err))
+			http.Error(writer, "Failed to delete package", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Deleted package %s version %d", name, version)
+		writer.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(writer, "{}")
+	}
+}
+
+type yankRequest struct {
+	Yanked bool
+}
+
+func createYankManifestHandler(packageStore store.Store, users Users, tokens Tokens) http.HandlerFunc {
+	return enforceSmallBodySize(func(writer http.ResponseWriter, req *http.Request) {
+		if !hasWritePermission(req, users, tokens) {
+			http.Error(writer, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		name := chi.URLParam(req, "name")
+		validName := bdm.ValidatePackageName(name)
+		if !validName {
+			http.Error(writer, "Bad package name", http.StatusBadRequest)
+			return
+		}
+
+		versionString := chi.URLParam(req, "version")
+		version, err := strconv.Atoi(versionString)
+		if err != nil || version <= 0 {
+			http.Error(writer, "Bad package version", http.StatusBadRequest)
+			return
+		}
+
+		jsonData, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(writer, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		var yank yankRequest
+		err = json.Unmarshal(jsonData, &yank)
+		if err != nil {
+			http.Error(writer, "Bad JSON data", http.StatusBadRequest)
+			return
+		}
+
+		_, err = packageStore.GetManifest(name, uint(version))
+		if err != nil {
+			http.Error(writer, "Package does not exist", http.StatusNotFound)
+			return
+		}
+
+		err = packageStore.YankManifest(name, uint(version), yank.Yanked)
+		if err != nil {
+			log.Print(fmt.Errorf("error changing yanked state of package %s version %d: %w", name, version, err))
+			http.Error(writer, "Failed to change yanked state", http.StatusInternalServerError)
+			return
+		}
+
+		if yank.Yanked {
+			log.Printf("Yanked package %s version %d", name, version)
+		} else {
+			log.Printf("Restored yanked package %s version %d", name, version)
+		}
+
+		jsonData, err = json.Marshal(yank)
+		if err != nil {
+			log.Print(fmt.Errorf("error marshalling yanked state to JSON: %w", err))
+			http.Error(writer, "Failed to generate JSON data", http.StatusInternalServerError)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonData)
+	})
+}
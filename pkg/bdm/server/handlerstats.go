@@ -0,0 +1,35 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+func createStatsHandler(cache *statsCache, users Users, tokens Tokens) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if !hasAdminPermission(req, users, tokens) {
+			http.Error(writer, "Admin permissions required", http.StatusUnauthorized)
+			return
+		}
+
+		stats := cache.get()
+		if stats == nil {
+			// The first calculation is still running in the background
+			writer.Header().Set("Retry-After", "5")
+			http.Error(writer, "Statistics are being calculated", http.StatusAccepted)
+			return
+		}
+
+		jsonData, err := json.Marshal(stats)
+		if err != nil {
+			log.Print(fmt.Errorf("error marshalling stats JSON: %w", err))
+			http.Error(writer, "Failed to generate JSON data", http.StatusInternalServerError)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonData)
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/store"
+	"github.com/go-chi/chi/v5"
+)
+
+type tagRequest struct {
+	Version uint
+}
+
+func createTagsHandler(packageStore store.Store, users Users, tokens Tokens) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if !hasReadPermission(req, users, tokens) {
+			http.Error(writer, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		name := chi.URLParam(req, "name")
+		validName := bdm.ValidatePackageName(name)
+		if !validName {
+			http.Error(writer, "Bad package name", http.StatusBadRequest)
+			return
+		}
+
+		tags, err := packageStore.GetTags(name)
+		if err != nil {
+			log.Print(fmt.Errorf("error getting tags of package %s: %w", name, err))
+			http.Error(writer, "Failed to list tags", http.StatusInternalServerError)
+			return
+		}
+
+		writeTagsJSON(writer, tags)
+	}
+}
+
+func createTagHandler(packageStore store.Store, users Users, tokens Tokens) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if !hasReadPermission(req, users, tokens) {
+			http.Error(writer, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		name := chi.URLParam(req, "name")
+		tagName := chi.URLParam(req, "tag")
+		if !bdm.ValidatePackageName(name) || !bdm.ValidateTagName(tagName) {
+			http.Error(writer, "Bad package or tag name", http.StatusBadRequest)
+			return
+		}
+
+		tag, err := findTag(packageStore, name, tagName)
+		if err != nil {
+			log.Print(fmt.Errorf("error getting tag %s of package %s: %w", tagName, name, err))
+			http.Error(writer, "Failed to get tag", http.StatusInternalServerError)
+			return
+		}
+		if tag == nil || tag.Version == 0 {
+			http.Error(writer, "Tag does not exist", http.StatusNotFound)
+			return
+		}
+
+		// Only tags that point to an existing version are returned
+		versions, err := packageStore.GetVersions(name)
+		if err != nil {
+			log.Print(fmt.Errorf("error getting versions of package %s: %w", name, err))
+			http.Error(writer, "Failed to get tag", http.StatusInternalServerError)
+			return
+		}
+		for _, version := range versions {
+			if version == tag.Version {
+				writeTagsJSON(writer, tag)
+				return
+			}
+		}
+
+		http.Error(writer, "Tag does not exist", http.StatusNotFound)
+	}
+}
+
+func createPutTagHandler(packageStore store.Store, users Users, tokens Tokens) http.HandlerFunc {
+	return enforceSmallBodySize(func(writer http.ResponseWriter, req *http.Request) {
+		if !hasWritePermission(req, users, tokens) {
+			http.Error(writer, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		name := chi.URLParam(req, "name")
+		tagName := chi.URLParam(req, "tag")
+		if !bdm.ValidatePackageName(name) || !bdm.ValidateTagName(tagName) {
+			http.Error(writer, "Bad package or tag name", http.StatusBadRequest)
+			return
+		}
+
+		jsonData, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(writer, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		var request tagRequest
+		err = json.Unmarshal(jsonData, &request)
+		if err != nil || request.Version == 0 {
+			http.Error(writer, "Bad JSON data", http.StatusBadRequest)
+			return
+		}
+
+		_, err = packageStore.GetManifest(name, request.Version)
+		if err != nil {
+			http.Error(writer, "Package does not exist", http.StatusNotFound)
+			return
+		}
+
+		userId, _ := getPublisher(req, users, tokens)
+		err = packageStore.SetTag(name, tagName, request.Version, userId)
+		if err != nil {
+			log.Print(fmt.Errorf("error setting tag %s of package %s: %w", tagName, name, err))
+			http.Error(writer, "Failed to set tag", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Moved tag %s of package %s to version %d", tagName, name, request.Version)
+
+		tag, err := findTag(packageStore, name, tagName)
+		if err != nil {
+			log.Print(fmt.Errorf("error getting tag %s of package %s: %w", tagName, name, err))
+			http.Error(writer, "Failed to get tag", http.StatusInternalServerError)
+			return
+		}
+
+		writeTagsJSON(writer, tag)
+	})
+}
+
+func createDeleteTagHandler(packageStore store.Store, users Users, tokens Tokens) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if !hasWritePermission(req, users, tokens) {
+			http.Error(writer, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		name := chi.URLParam(req, "name")
+		tagName := chi.URLParam(req, "tag")
+		if !bdm.ValidatePackageName(name) || !bdm.ValidateTagName(tagName) {
+			http.Error(writer, "Bad package or tag name", http.StatusBadRequest)
+			return
+		}
+
+		tag, err := findTag(packageStore, name, tagName)
+		if err != nil {
+			log.Print(fmt.Errorf("error getting tag %s of package %s: %w", tagName, name, err))
+			http.Error(writer, "Failed to get tag", http.StatusInternalServerError)
+			return
+		}
+		if tag == nil || tag.Version == 0 {
+			http.Error(writer, "Tag does not exist", http.StatusNotFound)
+			return
+		}
+
+		// Removed tags keep their history
+		userId, _ := getPublisher(req, users, tokens)
+		err = packageStore.SetTag(name, tagName, 0, userId)
+		if err != nil {
+			log.Print(fmt.Errorf("error removing tag %s of package %s: %w", tagName, name, err))
+			http.Error(writer, "Failed to remove tag", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Removed tag %s of package %s", tagName, name)
+		writer.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(writer, "{}")
+	}
+}
+
+// Returns the tag with the specified name or nil if the package has no such tag
+func findTag(packageStore store.Store, name, tagName string) (*store.Tag, error) {
+	tags, err := packageStore.GetTags(name)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tags {
+		if tags[i].Name == tagName {
+			return &tags[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func writeTagsJSON(writer http.ResponseWriter, value any) {
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		log.Print(fmt.Errorf("error marshalling tags to JSON: %w", err))
+		http.Error(writer, "Failed to generate JSON data", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsonData)
+}
@@ -199,3 +199,48 @@ func createUserPatchRolesHandler(users Users) http.HandlerFunc {
 		writer.Write(jsonData)
 	}))
 }
+
+type changeSigningKeysRequest struct {
+	SigningKeys []string
+}
+
+func createUserPatchSigningKeysHandler(users Users) http.HandlerFunc {
+	return enforceSmallBodySize(enforceAdminOrMatchUser(users, func(writer http.ResponseWriter, req *http.Request, authUser *User, paramUser *User) {
+		jsonData, err := io.ReadAll(req.Body)
+		if err != nil {
+			log.Print(fmt.Errorf("error reading user patch request: %w", err))
+			http.Error(writer, "Failed read user change request", http.StatusBadRequest)
+			return
+		}
+
+		var keysChange changeSigningKeysRequest
+		err = json.Unmarshal(jsonData, &keysChange)
+		if err != nil {
+			http.Error(writer, "Failed to parse JSON signing keys data", http.StatusBadRequest)
+			return
+		}
+
+		err = users.SetSigningKeys(paramUser.Id, keysChange.SigningKeys)
+		if err != nil {
+			http.Error(writer, "Failed to apply new signing keys", http.StatusBadRequest)
+			return
+		}
+
+		changedUser, err := users.GetUser(paramUser.Id)
+		if err != nil {
+			log.Print(fmt.Errorf("changed user no longer exists: %w", err))
+			http.Error(writer, "Changed user no longer exists", http.StatusInternalServerError)
+			return
+		}
+
+		jsonData, err = json.Marshal(changedUser)
+		if err != nil {
+			log.Print(fmt.Errorf("error marshalling JSON user data: %w", err))
+			http.Error(writer, "Failed to generate JSON user data", http.StatusInternalServerError)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonData)
+	}))
+}
@@ -2,7 +2,9 @@ package server
 
 import (
 	"encoding/json"
+	"net/http"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/cry-inc/bdm/pkg/bdm/util"
@@ -115,4 +117,20 @@ func TestUserPatchHandlers(t *testing.T) {
 	util.Assert(t, roles.Reader)
 	util.Assert(t, roles.Writer)
 	util.Assert(t, !roles.Admin)
+
+	key := strings.Repeat("ab", 32)
+	body = `{"SigningKeys": ["` + key + `"]}`
+	request = createMockedRequest("PATCH", "/users/admin/keys", &body, &authUser)
+	response = createMockedResponse()
+	router.ServeHTTP(response, request)
+	util.Assert(t, response.status == 0)
+	user, err := users.GetUser("admin")
+	util.AssertNoError(t, err)
+	util.Assert(t, len(user.SigningKeys) == 1 && user.SigningKeys[0] == key)
+
+	body = `{"SigningKeys": ["abc"]}`
+	request = createMockedRequest("PATCH", "/users/admin/keys", &body, &authUser)
+	response = createMockedResponse()
+	router.ServeHTTP(response, request)
+	util.Assert(t, response.status == http.StatusBadRequest)
 }
@@ -6,14 +6,16 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"strconv"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/cry-inc/bdm/pkg/bdm"
 	"github.com/cry-inc/bdm/pkg/bdm/store"
 	"github.com/go-chi/chi/v5"
 )
 
-func createZipHandler(store store.Store, users Users, tokens Tokens) http.HandlerFunc {
+func createZipHandler(packageStore store.Store, users Users, tokens Tokens) http.HandlerFunc {
 	return func(writer http.ResponseWriter, req *http.Request) {
 		if !hasReadPermission(req, users, tokens) {
 			http.Error(writer, "Invalid token", http.StatusUnauthorized)
@@ -27,17 +29,28 @@ func createZipHandler(store store.Store, users Users, tokens Tokens) http.Handle
 			return
 		}
 
-		versionString := chi.URLParam(req, "version")
-		version, err := strconv.Atoi(versionString)
-		if err != nil || version <= 0 {
-			http.Error(writer, "Bad package version", http.StatusBadRequest)
+		version, err := resolveVersion(packageStore, name, chi.URLParam(req, "version"))
+		if err != nil {
+			writeVersionError(writer, err)
+			return
+		}
+
+		manifest, err := packageStore.GetManifest(name, version)
+		if err != nil || manifest == nil {
+			http.Error(writer, "Package does not exist", http.StatusNotFound)
 			return
 		}
 
 		writer.Header().Set("Content-Type", "application/zip")
 		writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.v%d.zip\"", name, version))
+		writer.Header().Set("Vary", "Accept-Encoding")
 
-		err = streamPackageZip(name, uint(version), store, writer)
+		if strings.Contains(req.Header.Get("Accept-Encoding"), "zstd") {
+			writer.Header().Set("Content-Encoding", "zstd")
+			err = streamPackageZipFrames(manifest, packageStore, writer)
+		} else {
+			err = streamPackageZip(manifest, packageStore, writer)
+		}
 		if err != nil {
 			log.Print(fmt.Errorf("error streaming zip package: %w", err))
 			http.Error(writer, "Failed to stream ZIP data", http.StatusInternalServerError)
@@ -46,23 +59,53 @@ func createZipHandler(store store.Store, users Users, tokens Tokens) http.Handle
 	}
 }
 
-func streamPackageZip(name string, version uint, store store.Store, output io.Writer) error {
-	manifest, err := store.GetManifest(name, version)
-	if err != nil {
-		return fmt.Errorf("error getting manifest %s in version %d: %w", name, version, err)
+// Creates the ZIP entry header for a package file including the optional mode and modification time
+func createZipHeader(file *bdm.File, method uint16) *zip.FileHeader {
+	header := &zip.FileHeader{Name: file.Path, Method: method}
+	if file.ModTime > 0 {
+		header.Modified = time.Unix(file.ModTime, 0)
+	}
+	if file.Mode != 0 {
+		header.SetMode(os.FileMode(file.Mode))
+	}
+	return header
+}
+
+// Adds the symlinks and empty folders of the package to the ZIP.
+// Symlinks are stored with their target as content, like most unix ZIP tools do.
+func addZipSymlinksAndFolders(manifest *bdm.Manifest, zipWriter *zip.Writer, method uint16) error {
+	for _, symlink := range manifest.Symlinks {
+		header := &zip.FileHeader{Name: symlink.Path, Method: method}
+		header.SetMode(os.ModeSymlink | 0777)
+		zipFile, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("error creating symlink %s in ZIP: %w", symlink.Path, err)
+		}
+		_, err = io.WriteString(zipFile, symlink.Target)
+		if err != nil {
+			return fmt.Errorf("error writing symlink %s into ZIP: %w", symlink.Path, err)
+		}
+	}
+	for _, folder := range manifest.Folders {
+		header := &zip.FileHeader{Name: folder + "/"}
+		header.SetMode(os.ModeDir | 0755)
+		_, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("error creating folder %s in ZIP: %w", folder, err)
+		}
 	}
+	return nil
+}
 
+func streamPackageZip(manifest *bdm.Manifest, packageStore store.Store, output io.Writer) error {
 	zipWriter := zip.NewWriter(output)
 	defer zipWriter.Close()
 
 	for _, file := range manifest.Files {
-		objectReader, err := store.ReadObject(file.Object.Hash)
-		if err != nil {
-			return fmt.Errorf("error reading object %s: %w", file.Object.Hash, err)
-		}
+		objectReader := store.ReadFile(packageStore, &file)
 		defer objectReader.Close()
 
-		zipFile, err := zipWriter.Create(file.Path)
+		zipFile, err := zipWriter.CreateHeader(createZipHeader(&file, zip.Deflate))
 		if err != nil {
 			return fmt.Errorf("error creating file %s in ZIP: %w", file.Path, err)
 		}
@@ -77,5 +120,61 @@ func streamPackageZip(name string, version uint, store store.Store, output io.Wr
 		}
 	}
 
-	return nil
+	return addZipSymlinksAndFolders(manifest, zipWriter, zip.Deflate)
+}
+
+// Receives the output of the ZIP writer and drops the file data that was already sent as stored frames
+type zipFrameOutput struct {
+	frames  *frameWriter
+	discard bool
+}
+
+func (o *zipFrameOutput) Write(p []byte) (int, error) {
+	if o.discard {
+		return len(p), nil
+	}
+	return o.frames.Write(p)
+}
+
+// Streams a ZSTD compressed ZIP file with uncompressed entries.
+// The file data in the ZIP is sent as stored ZSTD frames, so no object needs to be compressed again.
+// The ZIP writer still gets the decoded data to calculate checksums and offsets.
+func streamPackageZipFrames(manifest *bdm.Manifest, packageStore store.Store, output io.Writer) error {
+	frames := newFrameWriter(output)
+	zipOutput := &zipFrameOutput{frames: frames}
+	zipWriter := zip.NewWriter(zipOutput)
+
+	for _, file := range manifest.Files {
+		zipFile, err := zipWriter.CreateHeader(createZipHeader(&file, zip.Store))
+		if err != nil {
+			return fmt.Errorf("error creating file %s in ZIP: %w", file.Path, err)
+		}
+		err = zipWriter.Flush()
+		if err != nil {
+			return fmt.Errorf("error writing file header %s of ZIP: %w", file.Path, err)
+		}
+
+		zipOutput.discard = true
+		for _, object := range bdm.GetFileObjects(&file) {
+			err = frames.writeObject(packageStore, object, zipFile)
+			if err != nil {
+				return fmt.Errorf("error copying file %s into ZIP: %w", file.Path, err)
+			}
+		}
+		err = zipWriter.Flush()
+		if err != nil {
+			return fmt.Errorf("error copying file %s into ZIP: %w", file.Path, err)
+		}
+		zipOutput.discard = false
+	}
+
+	err := addZipSymlinksAndFolders(manifest, zipWriter, zip.Store)
+	if err != nil {
+		return err
+	}
+	err = zipWriter.Close()
+	if err != nil {
+		return fmt.Errorf("error finishing ZIP: %w", err)
+	}
+	return frames.Close()
 }
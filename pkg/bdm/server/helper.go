@@ -1,10 +1,14 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/store"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -52,6 +56,18 @@ func hasWritePermission(request *http.Request, users Users, tokens Tokens) bool
 	return err == nil && user.Writer
 }
 
+// Checks if a request contains permissions for administration.
+// Checks for an BDM API token (typically used by the CLI client) with admin permissions
+// or for auth tokens (used by the Web UI logins) of users with admin permissions.
+func hasAdminPermission(request *http.Request, users Users, tokens Tokens) bool {
+	apiToken := request.Header.Get(bdm.ApiTokenHeader)
+	if tokens.IsAdmin(apiToken) {
+		return true
+	}
+	user, err := getCurrentUser(request, users)
+	return err == nil && user.Admin
+}
+
 // Extracts the logged in Web UI user identified by an auth token from an incoming request
 func getCurrentUser(request *http.Request, users Users) (*User, error) {
 	cookie, err := request.Cookie("login")
@@ -69,6 +85,40 @@ func getCurrentUser(request *http.Request, users Users) (*User, error) {
 	return user, nil
 }
 
+// Identifies the user and the API token used for a request.
+// Both IDs are empty for guests and the token ID is empty for Web UI logins.
+func getPublisher(request *http.Request, users Users, tokens Tokens) (string, string) {
+	apiToken := request.Header.Get(bdm.ApiTokenHeader)
+	if len(apiToken) > 0 && tokens.CanWrite(apiToken) {
+		token, userId, err := tokens.FindToken(apiToken)
+		if err == nil {
+			return userId, token.Id
+		}
+	}
+	user, err := getCurrentUser(request, users)
+	if err == nil {
+		return user.Id, ""
+	}
+	return "", ""
+}
+
+// Checks if the public key is registered for the user
+func hasSigningKey(users Users, userId, publicKey string) bool {
+	if len(userId) == 0 {
+		return false
+	}
+	user, err := users.GetUser(userId)
+	if err != nil {
+		return false
+	}
+	for _, key := range user.SigningKeys {
+		if strings.EqualFold(key, publicKey) {
+			return true
+		}
+	}
+	return false
+}
+
 type userHandlerFunc func(writer http.ResponseWriter, req *http.Request, authUser *User, paramUser *User)
 
 // Wrapper for http.HandlerFunc that enforces and looks up a logged in user.
@@ -122,3 +172,70 @@ func enforceAdminOrMatchUser(users Users, handler userHandlerFunc) http.HandlerF
 		handler(writer, req, authUser, paramUser)
 	})
 }
+
+// Manifests and files never change, so browsers can keep them forever
+const immutableCacheControl = "private, max-age=31536000, immutable"
+
+// Sets the caching headers for immutable content identified by a hash.
+// Encoded responses get a different strong ETag than the raw content.
+func setImmutableHeaders(writer http.ResponseWriter, hash, encoding string) {
+	etag := hash
+	if len(encoding) > 0 {
+		etag += "-" + encoding
+	}
+	writer.Header().Set("ETag", `"`+etag+`"`)
+	writer.Header().Set("Cache-Control", immutableCacheControl)
+}
+
+var errBadVersion = errors.New("bad package version")
+
+// Resolves a version URL parameter that is either a version number or the name of a tag.
+// Returns errBadVersion if the value is neither a valid version nor a valid tag name.
+func resolveVersion(packageStore store.Store, name, value string) (uint, error) {
+	if bdm.ValidateTagName(value) {
+		return store.ResolveTag(packageStore, name, value)
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version <= 0 {
+		return 0, errBadVersion
+	}
+	return uint(version), nil
+}
+
+// Writes the error response for a version parameter that could not be resolved
+func writeVersionError(writer http.ResponseWriter, err error) {
+	if errors.Is(err, errBadVersion) {
+		http.Error(writer, "Bad package version", http.StatusBadRequest)
+	} else {
+		http.Error(writer, "Package does not exist", http.StatusNotFound)
+	}
+}
+
+// Checks if the If-None-Match header of the request contains an ETag for the hash.
+// The different encodings of the same content are considered as equal.
+func matchesETag(req *http.Request, hash string) bool {
+	for _, tag := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == `"`+hash+`"` || strings.HasPrefix(tag, `"`+hash+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// Announces the latest manifest version supported by the server in all responses
+func announceManifestVersion(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Header().Set(bdm.ManifestVersionHeader, fmt.Sprint(bdm.LatestManifestVersion))
+		handler.ServeHTTP(writer, req)
+	})
+}
+
+// Converts the manifest into the latest version understood by the client if required
+func negotiateManifest(req *http.Request, manifest *bdm.Manifest) (*bdm.Manifest, error) {
+	version := bdm.ParseManifestVersion(req.Header.Get(bdm.ManifestVersionHeader))
+	if manifest.ManifestVersion <= version {
+		return manifest, nil
+	}
+	return bdm.ConvertManifest(manifest, version)
+}
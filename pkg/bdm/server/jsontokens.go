@@ -178,6 +178,20 @@ func (tokens *jsonTokens) DeleteToken(tokenId string) error {
 	return nil
 }
 
+// FindToken returns a copy of the token with the secret and the ID of its user
+func (tokens *jsonTokens) FindToken(secret string) (*Token, string, error) {
+	tokens.mutex.Lock()
+	defer tokens.mutex.Unlock()
+
+	token, found := tokens.tokensBySecret[secret]
+	if !found {
+		return nil, "", fmt.Errorf("token not found")
+	}
+
+	copy := token.Token
+	return &copy, token.UserId, nil
+}
+
 const readerRole = "READER"
 const writerRole = "WRITER"
 const adminRole = "ADMIN"
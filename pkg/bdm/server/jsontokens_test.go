@@ -231,4 +231,12 @@ func TestTokenExpiration(t *testing.T) {
 	validToken, err := tokens.CreateToken("user", "token", expiration, &Roles{Reader: true})
 	util.AssertNoError(t, err)
 	util.Assert(t, tokens.CanRead(validToken.Secret))
+
+	// Tokens can be found with their secret
+	found, userId, err := tokens.FindToken(validToken.Secret)
+	util.AssertNoError(t, err)
+	util.AssertEqualString(t, "user", userId)
+	util.AssertEqualString(t, validToken.Id, found.Id)
+	_, _, err = tokens.FindToken("invalid")
+	util.AssertError(t, err)
 }
@@ -9,6 +9,7 @@ import (
 	"regexp"
 	"sync"
 
+	"github.com/cry-inc/bdm/pkg/bdm"
 	"github.com/cry-inc/bdm/pkg/bdm/util"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -214,6 +215,32 @@ func (users *jsonUsers) GetRoles(userId string) (*Roles, error) {
 	return &roles, nil
 }
 
+func (users *jsonUsers) SetSigningKeys(userId string, keys []string) error {
+	for _, key := range keys {
+		_, err := bdm.ParsePublicKey(key)
+		if err != nil {
+			return fmt.Errorf("invalid signing key: %w", err)
+		}
+	}
+
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+
+	if _, found := users.users[userId]; !found {
+		return fmt.Errorf("user with ID %s does not exist in database", userId)
+	}
+
+	user := users.users[userId]
+	user.SigningKeys = keys
+	users.users[userId] = user
+	err := users.saveUsers()
+	if err != nil {
+		return fmt.Errorf("unable to save JSON user database: %w", err)
+	}
+
+	return nil
+}
+
 func (users *jsonUsers) Authenticate(userId, password string) bool {
 	users.mutex.Lock()
 	defer users.mutex.Unlock()
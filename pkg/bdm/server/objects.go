@@ -80,33 +80,23 @@ func streamObjectsFromStore(input io.Reader, store store.Store, output io.Writer
 		}
 	}
 
-	compressedOutput, err := util.CreateCompressingWriter(output)
-	if err != nil {
-		return fmt.Errorf("error creating compressing writer: %w", err)
-	}
-	defer compressedOutput.Close()
+	// Stored ZSTD objects are sent without decompressing and compressing them again
+	frames := newFrameWriter(output)
+	defer frames.Close()
 
-	err = bdm.WriteObjectsToStream(foundObjects, compressedOutput)
+	err = bdm.WriteObjectsToStream(foundObjects, frames)
 	if err != nil {
 		return fmt.Errorf("error writing objects to stream: %w", err)
 	}
 
 	for _, object := range foundObjects {
-		reader, err := store.ReadObject(object.Hash)
-		if err != nil {
-			return fmt.Errorf("error reading object %s from store: %w", object.Hash, err)
-		}
-		written, err := io.Copy(compressedOutput, reader)
+		err = frames.writeObject(store, object, nil)
 		if err != nil {
-			return fmt.Errorf("error copying object data: %w", err)
-		}
-		if written != object.Size {
-			return fmt.Errorf("error copying object data: expected to write %d but wrote %d bytes",
-				object.Size, written)
+			return err
 		}
 	}
 
-	return nil
+	return frames.Close()
 }
 
 func checkStoreForObjects(input io.Reader, store store.Store) ([]bdm.Object, error) {
@@ -127,7 +117,13 @@ func checkStoreForObjects(input io.Reader, store store.Store) ([]bdm.Object, err
 		if err == nil &&
 			foundObject.Size == object.Size &&
 			foundObject.Hash == object.Hash {
-			foundObjects = append(foundObjects, *foundObject)
+			// Found objects are not uploaded again, so they need to be
+			// protected from the garbage collection until they are published.
+			// Objects that cannot be refreshed are reported as missing.
+			err = store.RefreshObject(object.Hash)
+			if err == nil {
+				foundObjects = append(foundObjects, *foundObject)
+			}
 		}
 	}
 
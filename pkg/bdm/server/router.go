@@ -11,6 +11,7 @@ import (
 // CreateRouter creates a new HTTP handler that handles all server routes
 func CreateRouter(packageStore store.Store, limits *bdm.ManifestLimits, users Users, tokens Tokens) http.Handler {
 	router := chi.NewRouter()
+	router.Use(announceManifestVersion)
 
 	// Static assets for HTML UI
 	router.Get("/*", createStaticHandler())
@@ -33,6 +34,27 @@ func CreateRouter(packageStore store.Store, limits *bdm.ManifestLimits, users Us
 	// Get manifest for specific package & version
 	router.Get("/manifests/{name}/{version}", createManifestHandler(packageStore, users, tokens))
 
+	// Delete specific package version (admin only)
+	router.Delete("/manifests/{name}/{version}", createDeleteManifestHandler(packageStore, users, tokens))
+
+	// Yank or restore specific package version
+	router.Patch("/manifests/{name}/{version}/yanked", createYankManifestHandler(packageStore, users, tokens))
+
+	// Get all tags of a package including removed tags and their history
+	router.Get("/tags/{name}", createTagsHandler(packageStore, users, tokens))
+
+	// Get a single tag if it points to an existing version
+	router.Get("/tags/{name}/{tag}", createTagHandler(packageStore, users, tokens))
+
+	// Create or move a tag to a version
+	router.Put("/tags/{name}/{tag}", createPutTagHandler(packageStore, users, tokens))
+
+	// Remove a tag
+	router.Delete("/tags/{name}/{tag}", createDeleteTagHandler(packageStore, users, tokens))
+
+	// Compare the files of two versions of a package
+	router.Get("/diff/{name}/{v1}/{v2}", createDiffHandler(packageStore, users, tokens))
+
 	// Upload one or more objects. The compressed request body contains:
 	// - 8 bytes uint for JSON data length
 	// - JSON data with bdm.Object array
@@ -58,6 +80,9 @@ func CreateRouter(packageStore store.Store, limits *bdm.ManifestLimits, users Us
 	// Downloads a single file from a package
 	router.Get("/files/{name}/{version}/{hash}/{file}", createFilesHandler(packageStore, users, tokens))
 
+	// Get store statistics (admin only), they are calculated in the background
+	router.Get("/stats", createStatsHandler(newStatsCache(packageStore), users, tokens))
+
 	// Login
 	router.Post("/login", createLoginPostHandler(users))
 	// Logout
@@ -77,6 +102,8 @@ func CreateRouter(packageStore store.Store, limits *bdm.ManifestLimits, users Us
 	router.Patch("/users/{user}/password", createUserPatchPasswordHandler(users))
 	// Change user roles
 	router.Patch("/users/{user}/roles", createUserPatchRolesHandler(users))
+	// Change the public keys the user can sign manifests with
+	router.Patch("/users/{user}/keys", createUserPatchSigningKeysHandler(users))
 
 	// List all tokens for a user
 	router.Get("/users/{user}/tokens", createTokensGetHandler(users, tokens))
@@ -5,6 +5,7 @@ import Compare from './components/compare.js'
 import Users from './components/users.js'
 import User from './components/user.js'
 import Tokens from './components/tokens.js'
+import Stats from './components/stats.js'
 import Login from './components/login.js'
 import Breadcrumbs from './components/breadcrumbs.js'
 import UserMenu from './components/user-menu.js'
@@ -21,6 +22,7 @@ const router = VueRouter.createRouter({
 		{path: '/users/:userId', name: 'user', component: User, props: true},
 		{path: '/users/:userId/tokens', name: 'tokens', component: Tokens, props: true},
 		{path: '/login', name: 'login', component: Login},
+		{path: '/stats', name: 'stats', component: Stats},
 	]
 });
 
@@ -49,6 +49,12 @@ export default {
 					Route: '/users/' + route.params.userId + '/tokens'
 				});
 			}
+			if (route.name === 'stats') {
+				this.breadcrumbs.push({
+					Name: 'Statistics',
+					Route: '/stats'
+				});
+			}
 			if (route.name === 'login') {
 				this.breadcrumbs.push({
 					Name: 'Login',
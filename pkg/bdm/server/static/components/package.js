@@ -7,24 +7,98 @@ export default {
 			loaded: false,
 			manifest: null,
 			size: null,
-			published: null
+			published: null,
+			yanked: false,
+			tags: [],
+			newTag: '',
+			user: null
 		};
 	},
 	async created() {
-		const response = await fetch('manifests/' + this.package + '/' + this.version);
+		const response = await Helper.fetchManifest(this.package, this.version);
 		if (response.ok) {
 			this.manifest = await response.json();
 			this.size = Helper.getPackageSize(this.manifest);
 			Helper.addFileNames(this.manifest);
+			await this.queryYanked();
+			await this.queryTags();
 		}
+		const userResponse = await fetch('login');
+		this.user = userResponse.ok ? await userResponse.json() : null;
 		this.loaded = true;
 	},
+	methods: {
+		async queryYanked() {
+			const response = await fetch('manifests/' + this.package);
+			const versions = response.ok ? await response.json() : [];
+			const version = versions.find(v => v.Version === this.manifest.PackageVersion);
+			this.yanked = version && version.Yanked ? true : false;
+		},
+		async changeYanked() {
+			const yanked = !this.yanked;
+			if (yanked && !confirm('Really yank version ' + this.version + ' of package ' + this.package + '?')) {
+				return;
+			}
+			const response = await fetch('manifests/' + this.package + '/' + this.manifest.PackageVersion + '/yanked', {
+				method: 'PATCH',
+				headers: {'Content-Type': 'application/json'},
+				body: JSON.stringify({Yanked: yanked})
+			});
+			if (!response.ok) {
+				alert('Failed to change yanked state!');
+			}
+			await this.queryYanked();
+		},
+		async queryTags() {
+			// Only the tags currently pointing at this version are shown
+			const response = await fetch('tags/' + this.package);
+			const tags = response.ok ? await response.json() : [];
+			this.tags = tags.filter(t => t.Version === this.manifest.PackageVersion);
+		},
+		async moveTag() {
+			const response = await fetch('tags/' + this.package + '/' + this.newTag, {
+				method: 'PUT',
+				headers: {'Content-Type': 'application/json'},
+				body: JSON.stringify({Version: this.manifest.PackageVersion})
+			});
+			if (!response.ok) {
+				alert('Failed to move tag!');
+				return;
+			}
+			this.newTag = '';
+			await this.queryTags();
+		},
+		async removeTag(tag) {
+			if (!confirm('Really remove tag ' + tag + ' of package ' + this.package + '?')) {
+				return;
+			}
+			const response = await fetch('tags/' + this.package + '/' + tag, {method: 'DELETE'});
+			if (!response.ok) {
+				alert('Failed to remove tag!');
+			}
+			await this.queryTags();
+		},
+		async deleteVersion() {
+			if (!confirm('Really delete version ' + this.version + ' of package ' + this.package + '? This cannot be undone!')) {
+				return;
+			}
+			const response = await fetch('manifests/' + this.package + '/' + this.manifest.PackageVersion, {method: 'DELETE'});
+			if (!response.ok) {
+				alert('Failed to delete package version!');
+				return;
+			}
+			await this.$router.push('/' + this.package);
+		}
+	},
 	template: `
 		<div v-if="loaded">
 			<h1>{{package}} Version {{version}}</h1>
 			<div class="alert alert-danger" role="alert" v-if="!manifest">
 				The package {{package}} in version {{version}} does not exist!
 			</div>
+			<div class="alert alert-warning" role="alert" v-if="yanked">
+				This version was yanked and should no longer be used!
+			</div>
 			<div v-if="manifest">
 				<table class="table table-sm">
 					<tbody>	
@@ -36,10 +110,27 @@ export default {
 							<th>Version</th>
 							<td>{{manifest.PackageVersion}}</td>
 						</tr>
+						<tr v-if="tags.length > 0">
+							<th>Tags</th>
+							<td>
+								<span class="badge bg-info text-dark me-1" v-for="tag in tags">
+									{{tag.Name}}
+									<a href="#" class="text-dark ms-1" title="Remove Tag" v-if="user && user.Writer" @click.prevent="removeTag(tag.Name)">&times;</a>
+								</span>
+							</td>
+						</tr>
 						<tr>
 							<th>Files</th>
 							<td>{{manifest.Files ? manifest.Files.length : 0}}</td>
 						</tr>
+						<tr v-if="manifest.Symlinks">
+							<th>Symlinks</th>
+							<td>{{manifest.Symlinks.length}}</td>
+						</tr>
+						<tr v-if="manifest.Folders">
+							<th>Empty Folders</th>
+							<td>{{manifest.Folders.length}}</td>
+						</tr>
 						<tr>
 							<th>Size</th>
 							<td>{{$filters.size(size)}}</td>
@@ -48,19 +139,62 @@ export default {
 							<th>Published</th>
 							<td>{{$filters.date(manifest.Published)}}</td>
 						</tr>
+						<tr v-if="manifest.Publisher">
+							<th>Publisher</th>
+							<td>
+								{{manifest.Publisher}}
+								<span class="text-muted" v-if="manifest.PublisherToken">(Token {{manifest.PublisherToken}})</span>
+							</td>
+						</tr>
+						<tr v-if="manifest.Description">
+							<th>Description</th>
+							<td style="white-space: pre-wrap">{{manifest.Description}}</td>
+						</tr>
+						<tr v-if="manifest.Labels">
+							<th>Labels</th>
+							<td>
+								<router-link v-for="(value, key) in manifest.Labels" class="badge bg-secondary me-1"
+									v-bind:to="{path: '/' + package, query: {label: key + '=' + value}}">{{key}}={{value}}</router-link>
+							</td>
+						</tr>
 						<tr>
 							<th>Hash</th>
 							<td>{{manifest.Hash}}</td>
 						</tr>
+						<tr v-if="manifest.Dependencies">
+							<th>Dependencies</th>
+							<td>
+								<div v-for="dependency in manifest.Dependencies">
+									<router-link v-bind:to="'/' + dependency.PackageName">{{dependency.PackageName}}</router-link>
+									{{dependency.Version}} in {{dependency.Folder}}/
+								</div>
+							</td>
+						</tr>
+						<tr v-if="manifest.Signature">
+							<th>Signed By</th>
+							<td>{{manifest.Signature.PublicKey}}</td>
+						</tr>
 					</tbody>
 				</table>
 				<p>
 					<a v-bind:href="'zip/' + package + '/' + version">Download Package as ZIP</a><br>
 					<a target="_blank" rel="noopener" v-bind:href="'manifests/' + package + '/' + version">Package Manifest JSON</a><br>
-					<router-link v-if="version > 1" v-bind:to="'/' + package + '/' + version + '/compare/' + (version - 1)">
+					<router-link v-if="manifest.PackageVersion > 1" v-bind:to="'/' + package + '/' + manifest.PackageVersion + '/compare/' + (manifest.PackageVersion - 1)">
 						Compare with Previous Version
 					</router-link>
 				</p>
+				<p v-if="user && (user.Writer || user.Admin)">
+					<button class="btn btn-sm btn-warning" v-if="user.Writer" @click="changeYanked">{{yanked ? 'Restore Yanked Version' : 'Yank Version'}}</button>
+					<button class="btn btn-sm btn-danger ms-2" v-if="user.Admin" @click="deleteVersion">Delete Version</button>
+				</p>
+				<form class="row g-2 mb-3" v-if="user && user.Writer" @submit.prevent="moveTag">
+					<div class="col-auto">
+						<input type="text" class="form-control form-control-sm" placeholder="Tag like stable" v-model="newTag">
+					</div>
+					<div class="col-auto">
+						<button type="submit" class="btn btn-sm btn-primary" v-bind:disabled="newTag.length === 0">Move Tag to this Version</button>
+					</div>
+				</form>
 				<table class="table table-striped table-sm">
 					<thead>	
 						<tr>
@@ -75,6 +209,16 @@ export default {
 							<td>{{$filters.size(file.Object.Size)}}</td>
 							<td>{{file.Object.Hash}}</td>
 						</tr>
+						<tr v-for="symlink in manifest.Symlinks">
+							<td>{{symlink.Path}} &rarr; {{symlink.Target}}</td>
+							<td></td>
+							<td class="text-muted">Symlink</td>
+						</tr>
+						<tr v-for="folder in manifest.Folders">
+							<td>{{folder}}/</td>
+							<td></td>
+							<td class="text-muted">Empty Folder</td>
+						</tr>
 					</tbody>
 				</table>
 			</div>
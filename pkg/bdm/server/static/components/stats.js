@@ -0,0 +1,72 @@
+export default {
+	data() {
+		return {
+			stats: null,
+			loaded: false,
+			calculating: false,
+			timer: null
+		};
+	},
+	async created() {
+		await this.query();
+	},
+	unmounted() {
+		clearTimeout(this.timer);
+	},
+	methods: {
+		async query() {
+			const response = await fetch('stats');
+			// The server answers with 202 while the first calculation is still running
+			this.calculating = response.status === 202;
+			this.stats = response.status === 200 ? await response.json() : null;
+			this.loaded = true;
+			if (this.calculating) {
+				this.timer = setTimeout(this.query, 5000);
+			}
+		}
+	},
+	template: `
+		<div v-if="loaded">
+			<h1>Store Statistics</h1>
+			<div class="alert alert-info" role="alert" v-if="calculating">
+				The statistics are being calculated, please wait...
+			</div>
+			<div class="alert alert-warning" role="alert" v-if="!calculating && !stats">
+				Unable to get store statistics!
+			</div>
+			<div v-if="stats">
+				<table class="table table-sm table-striped">
+					<tbody>
+						<tr><td>Calculated</td><td>{{$filters.date(stats.Created)}}</td></tr>
+						<tr><td>Packages</td><td>{{stats.Packages.length}}</td></tr>
+						<tr><td>Package Versions</td><td>{{stats.Versions}}</td></tr>
+						<tr><td>Objects</td><td>{{stats.Objects}}</td></tr>
+						<tr><td>Size of all Package Versions</td><td>{{$filters.size(stats.LogicalSize)}}</td></tr>
+						<tr><td>Uncompressed Object Size</td><td>{{$filters.size(stats.ObjectsSize)}}</td></tr>
+						<tr><td>Compressed Object Size on Disk</td><td>{{$filters.size(stats.CompressedSize)}}</td></tr>
+						<tr><td>Uncompressed Objects</td><td>{{stats.RawObjects}}</td></tr>
+						<tr><td>Deduplication Ratio</td><td>{{stats.DedupRatio.toFixed(2)}}</td></tr>
+					</tbody>
+				</table>
+				<h2 class="mt-4">Packages</h2>
+				<table class="table table-sm table-striped" v-if="stats.Packages.length > 0">
+					<thead>
+						<tr>
+							<th>Package</th>
+							<th>Versions</th>
+							<th>Size of all Versions</th>
+							<th>Unique Object Size</th>
+						</tr>
+					</thead>
+					<tbody>
+						<tr v-for="package in stats.Packages">
+							<td><router-link v-bind:to="'/' + package.Name">{{package.Name}}</router-link></td>
+							<td>{{package.Versions}}</td>
+							<td>{{$filters.size(package.LogicalSize)}}</td>
+							<td>{{$filters.size(package.UniqueSize)}}</td>
+						</tr>
+					</tbody>
+				</table>
+			</div>
+		</div>`
+}
@@ -3,24 +3,79 @@ export default {
 	data() {
 		return {
 			versions: [],
+			tags: [],
+			filter: '',
 			loaded: false
 		};
 	},
 	async created() {
-		const response = await fetch('manifests/' + this.package);
-		this.versions = response.ok ? await response.json() : [];
+		const query = this.$route.query;
+		const labels = query.label ? [].concat(query.label) : [];
+		this.filter = labels.join(' ');
+		await this.queryVersions();
+		const response = await fetch('tags/' + this.package);
+		this.tags = response.ok ? await response.json() : [];
 		this.loaded = true;
 	},
+	methods: {
+		async queryVersions() {
+			// The filter contains labels like key=value separated by spaces
+			const params = new URLSearchParams();
+			this.filter.split(' ').filter(l => l.length > 0).forEach(l => params.append('label', l));
+			const query = params.toString();
+			const response = await fetch('manifests/' + this.package + (query ? '?' + query : ''));
+			this.versions = response.ok ? await response.json() : [];
+		},
+		versionTags(version) {
+			return this.tags.filter(t => t.Version === version);
+		}
+	},
 	template: `
 		<div v-if="loaded">
 			<h1>{{package}} Versions</h1>
+			<form class="row g-2 mb-3" @submit.prevent="queryVersions">
+				<div class="col-auto">
+					<input type="text" class="form-control form-control-sm" placeholder="Labels like git.commit=abc" v-model="filter">
+				</div>
+				<div class="col-auto">
+					<button type="submit" class="btn btn-sm btn-primary">Filter</button>
+				</div>
+			</form>
 			<div class="alert alert-warning" role="alert" v-if="versions.length === 0">
 				No versions for package {{package}} found!
 			</div>
 			<ul>
 				<li v-for="version in versions">
 					<router-link v-bind:to="'/' + package + '/' + version.Version">Version {{version.Version}}</router-link>
+					<span class="badge bg-warning text-dark ms-2" v-if="version.Yanked">Yanked</span>
+					<span class="badge bg-info text-dark ms-2" v-for="tag in versionTags(version.Version)">{{tag.Name}}</span>
 				</li>
 			</ul>
+			<div v-if="tags.length > 0">
+				<h2>Tag History</h2>
+				<table class="table table-sm table-striped">
+					<thead>
+						<tr>
+							<th>Tag</th>
+							<th>Changed</th>
+							<th>Version</th>
+							<th>User</th>
+						</tr>
+					</thead>
+					<tbody>
+						<template v-for="tag in tags">
+							<tr v-for="change in tag.History.slice().reverse()">
+								<td>{{tag.Name}}</td>
+								<td>{{$filters.date(change.Time)}}</td>
+								<td>
+									<router-link v-if="change.Version > 0" v-bind:to="'/' + package + '/' + change.Version">Version {{change.Version}}</router-link>
+									<span class="text-muted" v-else>Removed</span>
+								</td>
+								<td>{{change.User}}</td>
+							</tr>
+						</template>
+					</tbody>
+				</table>
+			</div>
 		</div>`
 }
@@ -15,6 +15,11 @@ function addFileNames(manifest) {
 	});
 }
 
+// Requests the latest manifest version, older versions cannot describe all packages
+function fetchManifest(name, version) {
+	return fetch('manifests/' + name + '/' + version, {headers: {'bdm-manifest-version': '2'}});
+}
+
 function getSizeString(bytes) {
 	if (bytes < 1024) {
 		return bytes + " byte";
@@ -27,4 +32,4 @@ function getSizeString(bytes) {
 	}
 }
 
-export default {getPackageSize, addFileNames, getSizeString};
+export default {getPackageSize, addFileNames, fetchManifest, getSizeString};
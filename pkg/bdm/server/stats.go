@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cry-inc/bdm/pkg/bdm/store"
+)
+
+// Stats older than this are recalculated in the background when requested
+const statsMaxAge = 10 * time.Minute
+
+// Caches the expensive store statistics and calculates them in the background.
+// The calculation only reads from the store, so publishing is never blocked by it.
+type statsCache struct {
+	packageStore store.Store
+	mutex        sync.Mutex
+	stats        *store.StoreStats
+	updated      time.Time
+	running      bool
+}
+
+func newStatsCache(packageStore store.Store) *statsCache {
+	return &statsCache{packageStore: packageStore}
+}
+
+// Returns the latest stats or nil if there are none yet.
+// Starts a background calculation if the stats are missing or outdated.
+func (cache *statsCache) get() *store.StoreStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if !cache.running && time.Since(cache.updated) > statsMaxAge {
+		cache.running = true
+		go cache.update()
+	}
+	return cache.stats
+}
+
+func (cache *statsCache) update() {
+	stats, err := store.GetStoreStats(cache.packageStore)
+	if err != nil {
+		log.Print(fmt.Errorf("error calculating store stats: %w", err))
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.running = false
+	cache.updated = time.Now()
+	if err == nil {
+		cache.stats = stats
+	}
+}
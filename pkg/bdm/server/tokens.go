@@ -16,6 +16,7 @@ type Tokens interface {
 	CanRead(secret string) bool
 	CanWrite(secret string) bool
 	IsAdmin(secret string) bool
+	FindToken(secret string) (*Token, string, error)
 
 	GetTokens(userId string) ([]Token, error)
 	CreateToken(userId, name string, expiration time.Time, roles *Roles) (*Token, error)
@@ -4,6 +4,8 @@ package server
 type User struct {
 	Id string
 	Roles
+	// Hex encoded ed25519 public keys the user can sign manifests with
+	SigningKeys []string `json:",omitempty"`
 }
 
 // The Users interface is used by the server as abstraction for user management
@@ -18,4 +20,6 @@ type Users interface {
 
 	SetRoles(userId string, roles *Roles) error
 	GetRoles(userId string) (*Roles, error)
+
+	SetSigningKeys(userId string, keys []string) error
 }
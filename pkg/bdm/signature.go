@@ -0,0 +1,189 @@
+package bdm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+// Signature proves that a manifest was signed by the owner of a private key.
+// Publisher signatures cover the name, files and metadata of a package, but not the fields assigned
+// by the server during publishing. This allows publishers to sign their manifests before uploading them,
+// but such a signed manifest could also be presented as another version of the same package.
+// Signatures created by the server after publishing also cover the version number and publishing date.
+type Signature struct {
+	// Hex encoded ed25519 public key of the signer
+	PublicKey string
+	// Hex encoded ed25519 signature of the signed content hash
+	Value string
+	// True if the signature also covers the version number and the publishing date
+	Versioned bool `json:",omitempty"`
+}
+
+// Calculates the hash that is signed by manifest signatures
+func hashSignedContent(manifest *Manifest, versioned bool) string {
+	content := *manifest
+	if !versioned {
+		content.PackageVersion = 0
+		content.Published = 0
+	}
+	content.Hash = ""
+	content.Publisher = ""
+	content.PublisherToken = ""
+	content.Signature = nil
+	// Encoding a manifest cannot fail, it contains only strings, numbers and slices
+	jsonData, _ := json.Marshal(content)
+
+	hasher := util.CreateHasher()
+	hasher.Write(jsonData)
+	return util.GetHashString(hasher)
+}
+
+// SignManifest adds a signature created with the private key to the manifest.
+// Only manifests of version 2 or newer can be signed. The manifest hash is not changed.
+func SignManifest(manifest *Manifest, key ed25519.PrivateKey) error {
+	if manifest.ManifestVersion < ManifestVersion2 {
+		return fmt.Errorf("manifest version %d cannot be signed", manifest.ManifestVersion)
+	}
+	publicKey := key.Public().(ed25519.PublicKey)
+	signature := ed25519.Sign(key, []byte(hashSignedContent(manifest, false)))
+	manifest.Signature = &Signature{
+		PublicKey: hex.EncodeToString(publicKey),
+		Value:     hex.EncodeToString(signature),
+	}
+	return nil
+}
+
+// SignPublishedManifest adds a signature that also covers the version number and publishing date.
+// This prevents presenting the manifest as another version of the package.
+func SignPublishedManifest(manifest *Manifest, key ed25519.PrivateKey) error {
+	if manifest.ManifestVersion < ManifestVersion2 {
+		return fmt.Errorf("manifest version %d cannot be signed", manifest.ManifestVersion)
+	}
+	if manifest.PackageVersion == 0 || manifest.Published == 0 {
+		return fmt.Errorf("manifest is not published")
+	}
+	publicKey := key.Public().(ed25519.PublicKey)
+	signature := ed25519.Sign(key, []byte(hashSignedContent(manifest, true)))
+	manifest.Signature = &Signature{
+		PublicKey: hex.EncodeToString(publicKey),
+		Value:     hex.EncodeToString(signature),
+		Versioned: true,
+	}
+	return nil
+}
+
+// Checks that the signature of the manifest matches the contained public key
+func validateSignature(manifest *Manifest) error {
+	if manifest.ManifestVersion < ManifestVersion2 {
+		return fmt.Errorf("signatures require manifest version %d", ManifestVersion2)
+	}
+	publicKey, err := ParsePublicKey(manifest.Signature.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid signature key: %w", err)
+	}
+	signature, err := hex.DecodeString(manifest.Signature.Value)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid signature value")
+	}
+	if !ed25519.Verify(publicKey, []byte(hashSignedContent(manifest, manifest.Signature.Versioned)), signature) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// VerifyManifestSignature checks that the manifest was signed by one of the trusted keys
+func VerifyManifestSignature(manifest *Manifest, trustedKeys []ed25519.PublicKey) error {
+	if manifest.Signature == nil {
+		return fmt.Errorf("manifest is not signed")
+	}
+	err := validateSignature(manifest)
+	if err != nil {
+		return err
+	}
+	publicKey, _ := ParsePublicKey(manifest.Signature.PublicKey)
+	for _, trustedKey := range trustedKeys {
+		if bytes.Equal(publicKey, trustedKey) {
+			return nil
+		}
+	}
+	return fmt.Errorf("manifest is signed by untrusted key %s", manifest.Signature.PublicKey)
+}
+
+// ParsePublicKey decodes a hex encoded ed25519 public key
+func ParsePublicKey(value string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding public key %s: %w", value, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key %s has invalid size %d", value, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// ReadPrivateKeyFile reads a PEM encoded PKCS #8 ed25519 private key.
+// Such keys are written by WritePrivateKeyFile or `openssl genpkey -algorithm ed25519`.
+func ReadPrivateKeyFile(keyFile string) (ed25519.PrivateKey, error) {
+	pemData, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file %s: %w", keyFile, err)
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("key file %s contains no PEM encoded private key", keyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key from %s: %w", keyFile, err)
+	}
+	privateKey, valid := key.(ed25519.PrivateKey)
+	if !valid {
+		return nil, fmt.Errorf("key file %s does not contain an ed25519 key", keyFile)
+	}
+	return privateKey, nil
+}
+
+// WritePrivateKeyFile writes a PEM encoded PKCS #8 private key that only the current user can read
+func WritePrivateKeyFile(keyFile string, key ed25519.PrivateKey) error {
+	keyData, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("error encoding private key: %w", err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyData})
+	err = os.WriteFile(keyFile, pemData, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing key file %s: %w", keyFile, err)
+	}
+	return nil
+}
+
+// ReadTrustFile reads a list of trusted hex encoded public keys with one key per line.
+// Empty lines and lines starting with # are ignored.
+func ReadTrustFile(trustFile string) ([]ed25519.PublicKey, error) {
+	data, err := os.ReadFile(trustFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading trust file %s: %w", trustFile, err)
+	}
+	keys := make([]ed25519.PublicKey, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := ParsePublicKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing trust file %s: %w", trustFile, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
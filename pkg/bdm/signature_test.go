@@ -0,0 +1,106 @@
+package bdm
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+func TestSignManifest(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	util.AssertNoError(t, err)
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	util.AssertNoError(t, err)
+
+	// Version 1 manifests cannot be signed
+	manifest := generateUnpublishedManifest()
+	util.AssertError(t, SignManifest(&manifest, privateKey))
+
+	manifest.ManifestVersion = ManifestVersion2
+	manifest.Hash = HashManifest(&manifest)
+	hash := manifest.Hash
+	util.AssertNoError(t, SignManifest(&manifest, privateKey))
+	util.AssertEqualString(t, hash, HashManifest(&manifest))
+	util.AssertEqualString(t, hex.EncodeToString(publicKey), manifest.Signature.PublicKey)
+	checkUnpublishedManifest(t, &manifest, true)
+	util.AssertNoError(t, VerifyManifestSignature(&manifest, []ed25519.PublicKey{otherKey, publicKey}))
+	util.AssertError(t, VerifyManifestSignature(&manifest, []ed25519.PublicKey{otherKey}))
+
+	// Fields assigned by the server during publishing are not signed
+	manifest.PackageVersion = 3
+	manifest.Published = 123
+	manifest.Publisher = "admin"
+	manifest.Hash = HashManifest(&manifest)
+	checkPublishedManifest(t, &manifest, true)
+	util.AssertNoError(t, VerifyManifestSignature(&manifest, []ed25519.PublicKey{publicKey}))
+
+	// Modified content invalidates the signature, even with a new hash
+	manifest.Files[0].Object.Size = 1
+	manifest.Hash = HashManifest(&manifest)
+	checkPublishedManifest(t, &manifest, false)
+	util.AssertError(t, VerifyManifestSignature(&manifest, []ed25519.PublicKey{publicKey}))
+
+	// Signatures are dropped when converting to version 1
+	converted, err := ConvertManifest(&manifest, ManifestVersion1)
+	util.AssertNoError(t, err)
+	util.Assert(t, converted.Signature == nil)
+	manifest.Signature = nil
+	util.AssertError(t, VerifyManifestSignature(&manifest, []ed25519.PublicKey{publicKey}))
+}
+
+func TestSignPublishedManifest(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	util.AssertNoError(t, err)
+
+	// Unpublished manifests cannot be signed with the version
+	manifest := generateUnpublishedManifest()
+	manifest.ManifestVersion = ManifestVersion2
+	util.AssertError(t, SignPublishedManifest(&manifest, privateKey))
+
+	manifest.PackageVersion = 3
+	manifest.Published = 123
+	util.AssertNoError(t, SignPublishedManifest(&manifest, privateKey))
+	util.Assert(t, manifest.Signature.Versioned)
+	manifest.Hash = HashManifest(&manifest)
+	util.AssertNoError(t, VerifyManifestSignature(&manifest, []ed25519.PublicKey{publicKey}))
+
+	// Changing the version invalidates the signature
+	manifest.PackageVersion = 2
+	manifest.Hash = HashManifest(&manifest)
+	util.AssertError(t, VerifyManifestSignature(&manifest, []ed25519.PublicKey{publicKey}))
+
+	// Removing the flag does not help either
+	manifest.PackageVersion = 3
+	manifest.Signature.Versioned = false
+	manifest.Hash = HashManifest(&manifest)
+	util.AssertError(t, VerifyManifestSignature(&manifest, []ed25519.PublicKey{publicKey}))
+}
+
+func TestSigningKeyFiles(t *testing.T) {
+	const keyFile = "test.pem"
+	const trustFile = "trust.txt"
+	defer os.Remove(keyFile)
+	defer os.Remove(trustFile)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	util.AssertNoError(t, err)
+	util.AssertNoError(t, WritePrivateKeyFile(keyFile, privateKey))
+	readKey, err := ReadPrivateKeyFile(keyFile)
+	util.AssertNoError(t, err)
+	util.Assert(t, privateKey.Equal(readKey))
+
+	trustData := "# Build server\n" + hex.EncodeToString(publicKey) + "\n\n"
+	util.AssertNoError(t, os.WriteFile(trustFile, []byte(trustData), os.ModePerm))
+	keys, err := ReadTrustFile(trustFile)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(keys) == 1 && publicKey.Equal(keys[0]))
+
+	util.AssertNoError(t, os.WriteFile(trustFile, []byte("abc\n"), os.ModePerm))
+	_, err = ReadTrustFile(trustFile)
+	util.AssertError(t, err)
+	_, err = ReadPrivateKeyFile(trustFile)
+	util.AssertError(t, err)
+}
@@ -0,0 +1,344 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+)
+
+const bundleFormat = 1
+const bundleIndexName = "index.json"
+const bundleManifestsFolder = "manifests/"
+const bundleObjectsFolder = "objects/"
+
+// Name of the PAX record with the format of stored objects, entries without it are ZSTD objects
+const bundleFormatRecord = "BDM.format"
+
+// The first entry of every bundle, lists the complete content of the bundle
+type bundleIndex struct {
+	Format    int
+	Created   int64
+	Manifests []bundleManifest
+	Objects   []bdm.Object
+}
+
+type bundleManifest struct {
+	PackageName    string
+	PackageVersion uint
+	Hash           string
+	Yanked         bool `json:",omitempty"`
+}
+
+// ImportResult summarizes the changes of a bundle import
+type ImportResult struct {
+	// Package versions added to the store
+	Manifests int
+	// Package versions that already existed in the store
+	SkippedManifests int
+	// Package versions skipped because they were deleted in the store
+	DeletedManifests int
+	// Objects added to the store
+	Objects int
+	// Objects that already existed in the store
+	SkippedObjects int
+}
+
+func getBundleManifestName(name string, version uint) string {
+	return bundleManifestsFolder + name + "/" + strconv.FormatUint(uint64(version), 10) + ".json"
+}
+
+func writeBundleEntry(writer *tar.Writer, name string, size int64, records map[string]string, reader io.Reader) error {
+	header := tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Size:       size,
+		Mode:       0644,
+		ModTime:    time.Now(),
+		PAXRecords: records,
+	}
+	err := writer.WriteHeader(&header)
+	if err != nil {
+		return fmt.Errorf("error writing bundle header for %s: %w", name, err)
+	}
+	written, err := io.Copy(writer, reader)
+	if err != nil {
+		return fmt.Errorf("error writing bundle data for %s: %w", name, err)
+	}
+	if written != size {
+		return fmt.Errorf("error writing bundle data for %s: wrote %d but expected %d bytes", name, written, size)
+	}
+	return nil
+}
+
+// ExportBundle writes the specified package versions as tar bundle.
+// The bundle contains an index, the manifests and all their objects exactly once.
+// The objects are copied as they are stored, without decompressing them.
+func ExportBundle(packageStore Store, manifests []*bdm.Manifest, writer io.Writer) error {
+	index := bundleIndex{
+		Format:    bundleFormat,
+		Created:   time.Now().Unix(),
+		Manifests: make([]bundleManifest, 0),
+		Objects:   make([]bdm.Object, 0),
+	}
+	added := make(map[string]bool)
+	for _, manifest := range manifests {
+		yanked, err := packageStore.IsYanked(manifest.PackageName, manifest.PackageVersion)
+		if err != nil {
+			return fmt.Errorf("error getting yanked state of package %s version %d: %w",
+				manifest.PackageName, manifest.PackageVersion, err)
+		}
+		index.Manifests = append(index.Manifests, bundleManifest{
+			PackageName:    manifest.PackageName,
+			PackageVersion: manifest.PackageVersion,
+			Hash:           manifest.Hash,
+			Yanked:         yanked,
+		})
+		for _, file := range manifest.Files {
+			for _, object := range bdm.GetFileObjects(&file) {
+				if !added[object.Hash] {
+					added[object.Hash] = true
+					index.Objects = append(index.Objects, object)
+				}
+			}
+		}
+	}
+
+	tarWriter := tar.NewWriter(writer)
+	jsonData, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("error marshalling bundle index to JSON: %w", err)
+	}
+	err = writeBundleEntry(tarWriter, bundleIndexName, int64(len(jsonData)), nil, bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+
+	for _, manifest := range manifests {
+		jsonData, err := json.Marshal(manifest)
+		if err != nil {
+			return fmt.Errorf("error marshalling manifest to JSON: %w", err)
+		}
+		name := getBundleManifestName(manifest.PackageName, manifest.PackageVersion)
+		err = writeBundleEntry(tarWriter, name, int64(len(jsonData)), nil, bytes.NewReader(jsonData))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, object := range index.Objects {
+		stored, err := packageStore.ReadStoredObject(object.Hash)
+		if err != nil {
+			return fmt.Errorf("error reading object %s: %w", object.Hash, err)
+		}
+		records := map[string]string{bundleFormatRecord: strconv.Itoa(int(stored.Format))}
+		err = writeBundleEntry(tarWriter, bundleObjectsFolder+object.Hash, stored.Size, records, stored)
+		stored.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return fmt.Errorf("error finishing bundle: %w", err)
+	}
+
+	return nil
+}
+
+// ImportBundle reads a tar bundle created by ExportBundle into a store.
+// Objects already existing in the store are skipped, all other objects are verified.
+// The manifests are only added after all of their objects were found.
+// Versions that already exist or were deleted in the store are skipped.
+func ImportBundle(packageStore Store, reader io.Reader) (*ImportResult, error) {
+	tarReader := tar.NewReader(reader)
+	header, err := tarReader.Next()
+	if err != nil {
+		return nil, fmt.Errorf("error reading bundle index: %w", err)
+	}
+	if header.Name != bundleIndexName {
+		return nil, fmt.Errorf("found %s instead of the bundle index", header.Name)
+	}
+	jsonData, err := io.ReadAll(io.LimitReader(tarReader, bdm.JsonSizeLimit))
+	if err != nil {
+		return nil, fmt.Errorf("error reading bundle index: %w", err)
+	}
+	var index bundleIndex
+	err = json.Unmarshal(jsonData, &index)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling bundle index JSON: %w", err)
+	}
+	if index.Format != bundleFormat {
+		return nil, fmt.Errorf("found unsupported bundle format %d", index.Format)
+	}
+
+	expectedManifests := make(map[string]bundleManifest)
+	for _, entry := range index.Manifests {
+		expectedManifests[getBundleManifestName(entry.PackageName, entry.PackageVersion)] = entry
+	}
+	expectedObjects := make(map[string]bdm.Object)
+	for _, object := range index.Objects {
+		expectedObjects[object.Hash] = object
+	}
+
+	var result ImportResult
+	manifests := make([]*bdm.Manifest, 0)
+	found := make(map[string]bool)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading bundle: %w", err)
+		}
+		if found[header.Name] {
+			return nil, fmt.Errorf("found duplicate bundle entry %s", header.Name)
+		}
+		found[header.Name] = true
+
+		if entry, ok := expectedManifests[header.Name]; ok {
+			manifest, err := readBundleManifest(tarReader, entry)
+			if err != nil {
+				return nil, fmt.Errorf("error reading bundle entry %s: %w", header.Name, err)
+			}
+			manifests = append(manifests, manifest)
+		} else if object, ok := expectedObjects[path.Base(header.Name)]; ok && header.Name == bundleObjectsFolder+object.Hash {
+			format := FormatZstd
+			if value, found := header.PAXRecords[bundleFormatRecord]; found {
+				parsed, err := strconv.ParseUint(value, 10, 8)
+				if err != nil || (ObjectFormat(parsed) != FormatZstd && ObjectFormat(parsed) != FormatRaw) {
+					return nil, fmt.Errorf("found invalid format %s for bundle entry %s", value, header.Name)
+				}
+				format = ObjectFormat(parsed)
+			}
+			imported, err := importBundleObject(packageStore, tarReader, object, format)
+			if err != nil {
+				return nil, fmt.Errorf("error importing bundle entry %s: %w", header.Name, err)
+			}
+			if imported {
+				result.Objects++
+			} else {
+				result.SkippedObjects++
+			}
+		} else {
+			return nil, fmt.Errorf("found unexpected bundle entry %s", header.Name)
+		}
+	}
+
+	// The bundle must be complete before any manifest is added
+	if len(manifests) != len(index.Manifests) {
+		return nil, fmt.Errorf("found %d manifests in bundle but expected %d", len(manifests), len(index.Manifests))
+	}
+	for _, object := range index.Objects {
+		if !found[bundleObjectsFolder+object.Hash] {
+			return nil, fmt.Errorf("unable to find object %s in bundle", object.Hash)
+		}
+	}
+	for _, manifest := range manifests {
+		for _, file := range manifest.Files {
+			for _, object := range bdm.GetFileObjects(&file) {
+				if _, ok := expectedObjects[object.Hash]; !ok {
+					return nil, fmt.Errorf("unable to find object %s of package %s version %d in bundle index",
+						object.Hash, manifest.PackageName, manifest.PackageVersion)
+				}
+			}
+		}
+	}
+
+	for _, manifest := range manifests {
+		existing, err := packageStore.GetManifest(manifest.PackageName, manifest.PackageVersion)
+		if err == nil {
+			if existing.Hash != manifest.Hash {
+				return nil, fmt.Errorf("found different package %s version %d in store",
+					manifest.PackageName, manifest.PackageVersion)
+			}
+			result.SkippedManifests++
+			continue
+		}
+		// Deleted versions are never restored, their numbers cannot be reused
+		deleted, err := packageStore.IsDeleted(manifest.PackageName, manifest.PackageVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error checking deleted state of package %s version %d: %w",
+				manifest.PackageName, manifest.PackageVersion, err)
+		}
+		if deleted {
+			result.DeletedManifests++
+			continue
+		}
+		err = packageStore.AddManifest(manifest)
+		if err != nil {
+			return nil, fmt.Errorf("error adding package %s version %d: %w",
+				manifest.PackageName, manifest.PackageVersion, err)
+		}
+		entry := expectedManifests[getBundleManifestName(manifest.PackageName, manifest.PackageVersion)]
+		if entry.Yanked {
+			err = packageStore.YankManifest(manifest.PackageName, manifest.PackageVersion, true)
+			if err != nil {
+				return nil, fmt.Errorf("error yanking package %s version %d: %w",
+					manifest.PackageName, manifest.PackageVersion, err)
+			}
+		}
+		result.Manifests++
+	}
+
+	return &result, nil
+}
+
+func readBundleManifest(reader io.Reader, entry bundleManifest) (*bdm.Manifest, error) {
+	jsonData, err := io.ReadAll(io.LimitReader(reader, bdm.JsonSizeLimit))
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	var manifest bdm.Manifest
+	err = json.Unmarshal(jsonData, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling manifest JSON: %w", err)
+	}
+	err = bdm.ValidatePublishedManifest(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error validating manifest: %w", err)
+	}
+	if manifest.PackageName != entry.PackageName ||
+		manifest.PackageVersion != entry.PackageVersion ||
+		manifest.Hash != entry.Hash {
+		return nil, fmt.Errorf("found manifest that does not match the bundle index")
+	}
+	return &manifest, nil
+}
+
+// Adds the object to the store if it does not exist yet and returns true if it was added
+func importBundleObject(packageStore Store, reader io.Reader, object bdm.Object, format ObjectFormat) (bool, error) {
+	// Existing objects need to be protected from a concurrently running garbage collection.
+	// Objects that cannot be refreshed are imported again.
+	existing, err := packageStore.GetObject(object.Hash)
+	if err == nil && existing.Size == object.Size && packageStore.RefreshObject(object.Hash) == nil {
+		return false, nil
+	}
+
+	decompressed, err := decodeObjectData(io.NopCloser(reader), format)
+	if err != nil {
+		return false, err
+	}
+	defer decompressed.Close()
+
+	// Read one byte more than expected to detect objects that are too large
+	added, err := packageStore.AddObject(io.LimitReader(decompressed, object.Size+1))
+	if err != nil {
+		return false, fmt.Errorf("error adding object: %w", err)
+	}
+	if added.Hash != object.Hash || added.Size != object.Size {
+		return false, fmt.Errorf("found object %s with %d bytes but expected %s with %d bytes",
+			added.Hash, added.Size, object.Hash, object.Size)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,285 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+func TestFileStoreConformance(t *testing.T) {
+	defer os.RemoveAll(storeFolder)
+	store, err := New(storeFolder)
+	util.AssertNoError(t, err)
+	defer store.Close()
+	testStoreConformance(t, store)
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	testStoreConformance(t, NewMemory())
+}
+
+func TestS3StoreConformance(t *testing.T) {
+	store, _, stop := createFakeS3Store(t)
+	defer stop()
+	testStoreConformance(t, store)
+}
+
+// Checks the behavior all store implementations must share, the store must be empty
+func testStoreConformance(t *testing.T, store Store) {
+	t.Helper()
+
+	// Empty store
+	names, err := store.GetNames()
+	util.AssertNoError(t, err)
+	util.Assert(t, len(names) == 0)
+	versions, err := store.GetVersions("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, len(versions) == 0)
+	_, err = store.GetManifest("foo", 1)
+	util.AssertError(t, err)
+	_, err = store.IsYanked("foo", 1)
+	util.AssertError(t, err)
+	objects, err := store.GetObjects()
+	util.AssertNoError(t, err)
+	util.Assert(t, len(objects) == 0)
+
+	// Objects of all formats can be read completely and from an offset
+	small := []byte{1, 2, 3, 4, 5}
+	big := bytes.Repeat([]byte("conformance"), objectFrameSize/5)
+	for _, data := range [][]byte{small, big, {}} {
+		object, err := store.AddObject(bytes.NewReader(data))
+		util.AssertNoError(t, err)
+		util.Assert(t, object.Size == int64(len(data)))
+		hash, err := util.HashStream(bytes.NewReader(data))
+		util.AssertNoError(t, err)
+		util.Assert(t, object.Hash == hash)
+
+		found, err := store.GetObject(object.Hash)
+		util.AssertNoError(t, err)
+		util.Assert(t, reflect.DeepEqual(found, object))
+
+		reader, err := store.ReadObject(object.Hash)
+		util.AssertNoError(t, err)
+		readData, err := io.ReadAll(reader)
+		reader.Close()
+		util.AssertNoError(t, err)
+		util.Assert(t, bytes.Equal(readData, data))
+
+		offset := int64(len(data)) * 2 / 3
+		reader, err = store.ReadObjectAt(object.Hash, offset)
+		util.AssertNoError(t, err)
+		readData, err = io.ReadAll(reader)
+		reader.Close()
+		util.AssertNoError(t, err)
+		util.Assert(t, bytes.Equal(readData, data[offset:]))
+
+		stored, err := store.ReadStoredObject(object.Hash)
+		util.AssertNoError(t, err)
+		storedData, err := io.ReadAll(stored)
+		stored.Close()
+		util.AssertNoError(t, err)
+		util.Assert(t, int64(len(storedData)) == stored.Size)
+		info, err := store.GetStoredObjectInfo(object.Hash)
+		util.AssertNoError(t, err)
+		util.Assert(t, info.Size == stored.Size && info.Format == stored.Format)
+		decoded, err := decodeObjectData(io.NopCloser(bytes.NewReader(storedData)), stored.Format)
+		util.AssertNoError(t, err)
+		readData, err = io.ReadAll(decoded)
+		decoded.Close()
+		util.AssertNoError(t, err)
+		util.Assert(t, bytes.Equal(readData, data))
+	}
+	_, err = store.GetObject("abcdef")
+	util.AssertError(t, err)
+	_, err = store.ReadObject("abcdef")
+	util.AssertError(t, err)
+	objects, err = store.GetObjects()
+	util.AssertNoError(t, err)
+	util.Assert(t, len(objects) == 3)
+
+	// Adding an existing object again returns the same object
+	object, err := store.AddObject(bytes.NewReader(small))
+	util.AssertNoError(t, err)
+	objects, err = store.GetObjects()
+	util.AssertNoError(t, err)
+	util.Assert(t, len(objects) == 3)
+
+	// Unpublished manifests get the next free version number
+	publish := func(name string, files ...bdm.File) (*bdm.Manifest, error) {
+		manifest := bdm.Manifest{ManifestVersion: 1, PackageName: name, Files: files}
+		manifest.Hash = bdm.HashManifest(&manifest)
+		return &manifest, store.PublishManifest(&manifest)
+	}
+	fileA := bdm.File{Path: "a", Object: *object}
+	fileB := bdm.File{Path: "b", Object: *object}
+	manifest1, err := publish("foo", fileA)
+	util.AssertNoError(t, err)
+	util.Assert(t, manifest1.PackageVersion == 1 && manifest1.Published > 0)
+	manifest2, err := publish("foo", fileA, fileB)
+	util.AssertNoError(t, err)
+	util.Assert(t, manifest2.PackageVersion == 2)
+	_, err = publish("bar", fileB)
+	util.AssertNoError(t, err)
+	names, err = store.GetNames()
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(names, []string{"bar", "foo"}))
+	versions, err = store.GetVersions("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(versions, []uint{1, 2}))
+	found, err := store.GetManifest("foo", 2)
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(found, manifest2))
+
+	// Returned manifests are copies
+	found.Files[0].Path = "modified"
+	found, err = store.GetManifest("foo", 2)
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(found, manifest2))
+
+	// Identical content is rejected independent of the file order
+	_, err = publish("foo", fileB, fileA)
+	util.Assert(t, errors.As(err, &DuplicatePackageError{}))
+	_, err = publish("bar", fileA)
+	util.AssertNoError(t, err)
+
+	// Invalid manifests are rejected
+	_, err = publish("Invalid Name", fileA)
+	util.AssertError(t, err)
+	util.AssertError(t, store.PublishManifest(manifest1))
+	util.AssertError(t, store.AddManifest(manifest1))
+
+	// Published manifests keep their version
+	added := bdm.Manifest{ManifestVersion: 1, PackageName: "baz", PackageVersion: 5, Published: time.Now().Unix(), Files: []bdm.File{fileA}}
+	added.Hash = bdm.HashManifest(&added)
+	util.AssertNoError(t, store.AddManifest(&added))
+	versions, err = store.GetVersions("baz")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(versions, []uint{5}))
+
+	// The metadata for filtering is available for all versions
+	labeled := bdm.Manifest{ManifestVersion: 2, PackageName: "baz", PackageVersion: 6, Published: time.Now().Unix(),
+		Files: []bdm.File{fileB}, Labels: map[string]string{"ci.job": "42"}, Publisher: "admin", PublisherToken: "abc"}
+	labeled.Hash = bdm.HashManifest(&labeled)
+	util.AssertNoError(t, store.AddManifest(&labeled))
+	metadata, err := store.GetVersionMetadata("baz")
+	util.AssertNoError(t, err)
+	util.Assert(t, len(metadata) == 2 && metadata[0].Version == 5 && metadata[0].Labels == nil)
+	util.Assert(t, reflect.DeepEqual(metadata[1], VersionMetadata{6, labeled.Labels, "admin", "abc"}))
+	metadata, err = store.GetVersionMetadata("unknown")
+	util.AssertNoError(t, err)
+	util.Assert(t, len(metadata) == 0)
+
+	// Yanked versions stay readable
+	util.AssertNoError(t, store.YankManifest("foo", 1, true))
+	yanked, err := store.IsYanked("foo", 1)
+	util.AssertNoError(t, err)
+	util.Assert(t, yanked)
+	infos, err := store.GetVersionInfos("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(infos, []VersionInfo{{Version: 1, Yanked: true}, {Version: 2}}))
+	_, err = store.GetManifest("foo", 1)
+	util.AssertNoError(t, err)
+	util.AssertNoError(t, store.YankManifest("foo", 1, false))
+	yanked, err = store.IsYanked("foo", 1)
+	util.AssertNoError(t, err)
+	util.Assert(t, !yanked)
+	util.AssertError(t, store.YankManifest("foo", 3, true))
+
+	// Tags can be moved between versions and keep their history
+	tags, err := store.GetTags("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, len(tags) == 0)
+	util.AssertNoError(t, store.SetTag("foo", "stable", 1, "admin"))
+	util.AssertNoError(t, store.SetTag("foo", "latest", 2, "admin"))
+	util.AssertNoError(t, store.SetTag("foo", "stable", 2, "writer"))
+	tags, err = store.GetTags("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, len(tags) == 2 && tags[0].Name == "latest" && tags[1].Name == "stable")
+	util.Assert(t, tags[1].Version == 2 && len(tags[1].History) == 2)
+	util.Assert(t, tags[1].History[0].Version == 1 && tags[1].History[1].User == "writer")
+	version, err := ResolveTag(store, "foo", "stable")
+	util.AssertNoError(t, err)
+	util.Assert(t, version == 2)
+	util.AssertError(t, store.SetTag("foo", "stable", 3, "admin"))
+	util.AssertError(t, store.SetTag("foo", "123", 1, "admin"))
+	util.AssertError(t, store.SetTag("foo", "Stable", 1, "admin"))
+	_, err = ResolveTag(store, "foo", "unknown")
+	util.AssertError(t, err)
+
+	// Removed tags cannot be resolved, but keep their history
+	util.AssertNoError(t, store.SetTag("foo", "latest", 0, "admin"))
+	util.AssertError(t, store.SetTag("foo", "latest", 0, "admin"))
+	util.AssertError(t, store.SetTag("foo", "unknown", 0, "admin"))
+	_, err = ResolveTag(store, "foo", "latest")
+	util.AssertError(t, err)
+	tags, err = store.GetTags("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, tags[0].Version == 0 && len(tags[0].History) == 2)
+
+	// Deleted versions disappear and their numbers are never reused
+	deleted, err := store.IsDeleted("foo", 2)
+	util.AssertNoError(t, err)
+	util.Assert(t, !deleted)
+	util.AssertNoError(t, store.DeleteManifest("foo", 2))
+	deleted, err = store.IsDeleted("foo", 2)
+	util.AssertNoError(t, err)
+	util.Assert(t, deleted)
+	deleted, err = store.IsDeleted("foo", 42)
+	util.AssertNoError(t, err)
+	util.Assert(t, !deleted)
+	_, err = store.GetManifest("foo", 2)
+	util.AssertError(t, err)
+	_, err = store.IsYanked("foo", 2)
+	util.AssertError(t, err)
+	util.AssertError(t, store.DeleteManifest("foo", 2))
+	util.AssertError(t, store.YankManifest("foo", 2, true))
+	util.AssertError(t, store.AddManifest(manifest2))
+	versions, err = store.GetVersions("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(versions, []uint{1}))
+	infos, err = store.GetVersionInfos("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(infos, []VersionInfo{{Version: 1}}))
+	_, err = ResolveTag(store, "foo", "stable")
+	util.AssertError(t, err)
+
+	// The content of deleted versions can be published again
+	republished, err := publish("foo", fileA, fileB)
+	util.AssertNoError(t, err)
+	util.Assert(t, republished.PackageVersion == 3)
+
+	// Packages without remaining versions are not listed
+	util.AssertNoError(t, store.DeleteManifest("baz", 5))
+	util.AssertNoError(t, store.DeleteManifest("baz", 6))
+	names, err = store.GetNames()
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(names, []string{"bar", "foo"}))
+
+	// Refreshing keeps the object unchanged
+	util.AssertNoError(t, store.RefreshObject(object.Hash))
+	refreshed, err := store.GetObject(object.Hash)
+	util.AssertNoError(t, err)
+	util.Assert(t, refreshed.Size == object.Size)
+	util.AssertError(t, store.RefreshObject("0000000000000000000000000000000000000000000000000000000000000000"))
+	_, err = store.GetStoredObjectInfo("0000000000000000000000000000000000000000000000000000000000000000")
+	util.AssertError(t, err)
+
+	// Objects are only removed if they were added before the given time
+	removed, err := store.RemoveObject(object.Hash, time.Now().Add(-time.Hour))
+	util.AssertNoError(t, err)
+	util.Assert(t, !removed)
+	removed, err = store.RemoveObject(object.Hash, time.Now().Add(time.Hour))
+	util.AssertNoError(t, err)
+	util.Assert(t, removed)
+	_, err = store.GetObject(object.Hash)
+	util.AssertError(t, err)
+	_, err = store.RemoveObject(object.Hash, time.Now().Add(time.Hour))
+	util.AssertError(t, err)
+}
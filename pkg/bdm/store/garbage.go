@@ -0,0 +1,67 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+)
+
+// DefaultGracePeriod protects recently added objects from the garbage collection.
+// Objects uploaded for a publish that is still in progress are not yet referenced
+// by any manifest and would be deleted without this grace period.
+const DefaultGracePeriod = 24 * time.Hour
+
+// CollectGarbage removes all objects from the store that are not referenced by any manifest.
+// Objects that were added or re-added within the grace period are kept.
+// It returns a map with some simple statistics about the collection.
+func CollectGarbage(store Store, gracePeriod time.Duration) (map[string]int64, error) {
+	// Determine the cutoff before listing anything,
+	// objects added after this point in time are always kept.
+	addedBefore := time.Now().Add(-gracePeriod)
+
+	objects, err := store.GetObjects()
+	if err != nil {
+		return nil, fmt.Errorf("error getting objects list from store: %w", err)
+	}
+
+	// Mark all objects referenced by any manifest
+	manifests, err := getAllManifests(store)
+	if err != nil {
+		return nil, fmt.Errorf("error listing all manifests: %w", err)
+	}
+	referenced := make(map[string]bool)
+	for _, manifest := range manifests {
+		for _, file := range manifest.Files {
+			for _, object := range bdm.GetFileObjects(&file) {
+				referenced[object.Hash] = true
+			}
+		}
+	}
+
+	// Sweep all unreferenced objects outside of the grace period
+	var removedObjects, removedSize, keptObjects int64
+	for _, object := range objects {
+		if referenced[object.Hash] {
+			continue
+		}
+		removed, err := store.RemoveObject(object.Hash, addedBefore)
+		if err != nil {
+			return nil, fmt.Errorf("error removing object %s: %w", object.Hash, err)
+		}
+		if removed {
+			removedObjects++
+			removedSize += object.Size
+		} else {
+			keptObjects++
+		}
+	}
+
+	stats := make(map[string]int64)
+	stats["objects"] = int64(len(objects))
+	stats["removed"] = removedObjects
+	stats["freed"] = removedSize
+	stats["recent"] = keptObjects
+
+	return stats, nil
+}
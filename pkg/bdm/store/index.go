@@ -0,0 +1,583 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+	"go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+)
+
+const indexFileName = "index.db"
+
+// Locks are only held for single operations, so waiting for other processes is short
+const indexLockTimeout = 30 * time.Second
+
+// Increase this number when the index layout changes to trigger a rebuild
+const indexFormat = "2"
+
+var indexMetaBucket = []byte("meta")
+var indexPackagesBucket = []byte("packages")
+var indexVersionsBucket = []byte("versions")
+var indexFingerprintsBucket = []byte("fingerprints")
+var indexFormatKey = []byte("format")
+
+// indexEntry describes a single package version in the index
+type indexEntry struct {
+	Published   int64
+	Size        int64
+	Files       int
+	Fingerprint string
+	Deleted     bool
+	Yanked      bool
+	// Metadata used for filtering version lists
+	Labels         map[string]string `json:",omitempty"`
+	Publisher      string            `json:",omitempty"`
+	PublisherToken string            `json:",omitempty"`
+}
+
+// The manifest index is an embedded key/value database in the store folder.
+// It avoids scanning directories and reading JSON files for listing packages
+// and searching duplicates. It can always be rebuilt from the JSON files.
+// The database is only opened for the duration of a single operation.
+// This keeps the file lock short and allows other processes like the
+// garbage collection to work with the same store while the server is running.
+type manifestIndex struct {
+	indexPath       string
+	manifestsFolder string
+	mutex           sync.Mutex
+}
+
+// Calculates a fingerprint of the package content that does not depend on the file order
+func getFingerprint(manifest *bdm.Manifest) string {
+	files := make([]bdm.File, len(manifest.Files))
+	copy(files, manifest.Files)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	hasher := util.CreateHasher()
+	for _, file := range files {
+		fmt.Fprintf(hasher, "%s\x00%s\x00%d", file.Path, file.Object.Hash, file.Object.Size)
+		// Modes are only added when present to keep the fingerprints of older manifests valid
+		if file.Mode != 0 {
+			fmt.Fprintf(hasher, "\x00%o", file.Mode)
+		}
+		fmt.Fprint(hasher, "\n")
+	}
+	// Symlinks and folders are only added when present to keep the fingerprints of older manifests valid
+	symlinks := make([]bdm.Symlink, len(manifest.Symlinks))
+	copy(symlinks, manifest.Symlinks)
+	sort.Slice(symlinks, func(i, j int) bool {
+		return symlinks[i].Path < symlinks[j].Path
+	})
+	for _, symlink := range symlinks {
+		fmt.Fprintf(hasher, "%s\x00->%s\n", symlink.Path, symlink.Target)
+	}
+	folders := make([]string, len(manifest.Folders))
+	copy(folders, manifest.Folders)
+	sort.Strings(folders)
+	for _, folder := range folders {
+		fmt.Fprintf(hasher, "%s/\n", folder)
+	}
+	// Dependencies are only added when present for the same reason
+	dependencies := make([]bdm.Dependency, len(manifest.Dependencies))
+	copy(dependencies, manifest.Dependencies)
+	sort.Slice(dependencies, func(i, j int) bool {
+		return dependencies[i].Folder < dependencies[j].Folder
+	})
+	for _, dependency := range dependencies {
+		fmt.Fprintf(hasher, "%s/\x00%s\x00%s\n", dependency.Folder, dependency.PackageName, dependency.Version)
+	}
+	return util.GetHashString(hasher)
+}
+
+func createIndexEntry(manifest *bdm.Manifest) indexEntry {
+	var size int64 = 0
+	for _, file := range manifest.Files {
+		size += file.Object.Size
+	}
+	return indexEntry{
+		Published:      manifest.Published,
+		Size:           size,
+		Files:          len(manifest.Files),
+		Fingerprint:    getFingerprint(manifest),
+		Labels:         manifest.Labels,
+		Publisher:      manifest.Publisher,
+		PublisherToken: manifest.PublisherToken,
+	}
+}
+
+func versionToKey(version uint) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(version))
+	return key
+}
+
+func keyToVersion(key []byte) uint {
+	return uint(binary.BigEndian.Uint64(key))
+}
+
+// Opens the index database and rebuilds it from the manifests folder if required.
+// Read-only opens share the file lock with other readers, also in other processes.
+func (index *manifestIndex) open(readOnly bool) (*bbolt.DB, error) {
+	if readOnly && util.FileExists(index.indexPath) {
+		db, err := openIndexDatabase(index.indexPath, true)
+		if err != nil {
+			return nil, err
+		}
+		if readIndexFormat(db) == indexFormat {
+			return db, nil
+		}
+		// Rebuilding requires write access
+		db.Close()
+	}
+
+	db, err := openIndexDatabase(index.indexPath, false)
+	if err != nil {
+		return nil, err
+	}
+	if readIndexFormat(db) != indexFormat {
+		err = db.Update(func(tx *bbolt.Tx) error {
+			return rebuildIndex(tx, index.manifestsFolder)
+		})
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error rebuilding index database %s: %w", index.indexPath, err)
+		}
+	}
+
+	return db, nil
+}
+
+func openIndexDatabase(indexPath string, readOnly bool) (*bbolt.DB, error) {
+	options := bbolt.Options{Timeout: indexLockTimeout, ReadOnly: readOnly}
+	db, err := bbolt.Open(indexPath, 0666, &options)
+	if errors.Is(err, berrors.ErrTimeout) {
+		return nil, fmt.Errorf("error opening index database %s: store is in use by another process", indexPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening index database %s: %w", indexPath, err)
+	}
+	return db, nil
+}
+
+func readIndexFormat(db *bbolt.DB) string {
+	format := ""
+	db.View(func(tx *bbolt.Tx) error {
+		if meta := tx.Bucket(indexMetaBucket); meta != nil {
+			format = string(meta.Get(indexFormatKey))
+		}
+		return nil
+	})
+	return format
+}
+
+func (index *manifestIndex) view(fn func(tx *bbolt.Tx) error) error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	db, err := index.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(fn)
+}
+
+func (index *manifestIndex) update(fn func(tx *bbolt.Tx) error) error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	db, err := index.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(fn)
+}
+
+// Discards the current index content and rebuilds it from the JSON files
+func (index *manifestIndex) rebuild() error {
+	return index.update(func(tx *bbolt.Tx) error {
+		return rebuildIndex(tx, index.manifestsFolder)
+	})
+}
+
+// Replaces the complete index content with the data from the manifest JSON files
+func rebuildIndex(tx *bbolt.Tx, manifestsFolder string) error {
+	for _, name := range [][]byte{indexMetaBucket, indexPackagesBucket} {
+		if tx.Bucket(name) != nil {
+			err := tx.DeleteBucket(name)
+			if err != nil {
+				return fmt.Errorf("error deleting bucket %s: %w", name, err)
+			}
+		}
+	}
+
+	packagesBucket, err := tx.CreateBucket(indexPackagesBucket)
+	if err != nil {
+		return fmt.Errorf("error creating packages bucket: %w", err)
+	}
+
+	packages, err := os.ReadDir(manifestsFolder)
+	if err != nil {
+		return fmt.Errorf("error reading manifest store directory: %w", err)
+	}
+	for _, item := range packages {
+		if !item.IsDir() {
+			continue
+		}
+		packageFolder := path.Join(manifestsFolder, item.Name())
+		versions, err := os.ReadDir(packageFolder)
+		if err != nil {
+			return fmt.Errorf("error reading package directory %s: %w", packageFolder, err)
+		}
+		for _, versionItem := range versions {
+			if !versionItem.IsDir() || strings.HasPrefix(versionItem.Name(), tempPrefix) {
+				continue
+			}
+			version, err := strconv.Atoi(versionItem.Name())
+			if err != nil {
+				return fmt.Errorf("error parsing version number from folder name %s: %w",
+					versionItem.Name(), err)
+			}
+			versionFolder := path.Join(packageFolder, versionItem.Name())
+			entry, err := readIndexEntry(versionFolder)
+			if err != nil {
+				return fmt.Errorf("error reading package %s version %d: %w",
+					item.Name(), version, err)
+			}
+			err = putIndexEntry(packagesBucket, item.Name(), uint(version), entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	metaBucket, err := tx.CreateBucket(indexMetaBucket)
+	if err != nil {
+		return fmt.Errorf("error creating meta bucket: %w", err)
+	}
+	return metaBucket.Put(indexFormatKey, []byte(indexFormat))
+}
+
+// Creates the index entry for a version folder from the files inside it
+func readIndexEntry(versionFolder string) (*indexEntry, error) {
+	if util.FileExists(path.Join(versionFolder, deletedFileName)) {
+		return &indexEntry{Deleted: true}, nil
+	}
+
+	jsonData, err := os.ReadFile(path.Join(versionFolder, manifestFileName))
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest file: %w", err)
+	}
+	var manifest bdm.Manifest
+	err = json.Unmarshal(jsonData, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling manifest JSON: %w", err)
+	}
+
+	entry := createIndexEntry(&manifest)
+	entry.Yanked = util.FileExists(path.Join(versionFolder, yankedFileName))
+	return &entry, nil
+}
+
+func putIndexEntry(packagesBucket *bbolt.Bucket, packageName string, version uint, entry *indexEntry) error {
+	packageBucket, err := packagesBucket.CreateBucketIfNotExists([]byte(packageName))
+	if err != nil {
+		return fmt.Errorf("error creating bucket for package %s: %w", packageName, err)
+	}
+	versionsBucket, err := packageBucket.CreateBucketIfNotExists(indexVersionsBucket)
+	if err != nil {
+		return fmt.Errorf("error creating versions bucket for package %s: %w", packageName, err)
+	}
+	fingerprintsBucket, err := packageBucket.CreateBucketIfNotExists(indexFingerprintsBucket)
+	if err != nil {
+		return fmt.Errorf("error creating fingerprints bucket for package %s: %w", packageName, err)
+	}
+
+	key := versionToKey(version)
+	jsonData, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshalling index entry to JSON: %w", err)
+	}
+	err = versionsBucket.Put(key, jsonData)
+	if err != nil {
+		return fmt.Errorf("error writing index entry: %w", err)
+	}
+
+	if !entry.Deleted && len(entry.Fingerprint) > 0 {
+		err = fingerprintsBucket.Put([]byte(entry.Fingerprint), key)
+		if err != nil {
+			return fmt.Errorf("error writing fingerprint: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (index *manifestIndex) addManifest(manifest *bdm.Manifest) error {
+	entry := createIndexEntry(manifest)
+	return index.update(func(tx *bbolt.Tx) error {
+		packagesBucket, err := tx.CreateBucketIfNotExists(indexPackagesBucket)
+		if err != nil {
+			return fmt.Errorf("error creating packages bucket: %w", err)
+		}
+		return putIndexEntry(packagesBucket, manifest.PackageName, manifest.PackageVersion, &entry)
+	})
+}
+
+// Returns the versions bucket of a package or nil if the package does not exist
+func getVersionsBucket(tx *bbolt.Tx, packageName string) *bbolt.Bucket {
+	packagesBucket := tx.Bucket(indexPackagesBucket)
+	if packagesBucket == nil {
+		return nil
+	}
+	packageBucket := packagesBucket.Bucket([]byte(packageName))
+	if packageBucket == nil {
+		return nil
+	}
+	return packageBucket.Bucket(indexVersionsBucket)
+}
+
+func (index *manifestIndex) getEntry(packageName string, version uint) (*indexEntry, error) {
+	var entry *indexEntry
+	err := index.view(func(tx *bbolt.Tx) error {
+		versionsBucket := getVersionsBucket(tx, packageName)
+		if versionsBucket == nil {
+			return nil
+		}
+		jsonData := versionsBucket.Get(versionToKey(version))
+		if jsonData == nil {
+			return nil
+		}
+		entry = &indexEntry{}
+		return json.Unmarshal(jsonData, entry)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading index entry: %w", err)
+	}
+	return entry, nil
+}
+
+// Modifies an existing entry. The fingerprint is removed for deleted versions.
+func (index *manifestIndex) modifyEntry(packageName string, version uint, modify func(entry *indexEntry)) error {
+	return index.update(func(tx *bbolt.Tx) error {
+		versionsBucket := getVersionsBucket(tx, packageName)
+		if versionsBucket == nil {
+			return fmt.Errorf("package %s does not exist in index", packageName)
+		}
+		key := versionToKey(version)
+		jsonData := versionsBucket.Get(key)
+		if jsonData == nil {
+			return fmt.Errorf("package %s in version %d does not exist in index", packageName, version)
+		}
+		var entry indexEntry
+		err := json.Unmarshal(jsonData, &entry)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling index entry: %w", err)
+		}
+
+		modify(&entry)
+
+		jsonData, err = json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("error marshalling index entry to JSON: %w", err)
+		}
+		err = versionsBucket.Put(key, jsonData)
+		if err != nil {
+			return fmt.Errorf("error writing index entry: %w", err)
+		}
+
+		if entry.Deleted {
+			fingerprintsBucket := tx.Bucket(indexPackagesBucket).Bucket([]byte(packageName)).Bucket(indexFingerprintsBucket)
+			if string(fingerprintsBucket.Get([]byte(entry.Fingerprint))) == string(key) {
+				return replaceFingerprint(versionsBucket, fingerprintsBucket, entry.Fingerprint)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Points the fingerprint to another version with the same content or removes it if there is none.
+// Manifests added with AddManifest can have the same content as an existing version.
+func replaceFingerprint(versionsBucket, fingerprintsBucket *bbolt.Bucket, fingerprint string) error {
+	cursor := versionsBucket.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		var entry indexEntry
+		err := json.Unmarshal(value, &entry)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling index entry: %w", err)
+		}
+		if !entry.Deleted && entry.Fingerprint == fingerprint {
+			return fingerprintsBucket.Put([]byte(fingerprint), key)
+		}
+	}
+
+	err := fingerprintsBucket.Delete([]byte(fingerprint))
+	if err != nil {
+		return fmt.Errorf("error deleting fingerprint: %w", err)
+	}
+	return nil
+}
+
+// Returns the sorted versions of a package that were not deleted together with their yanked state
+func (index *manifestIndex) getVersionInfos(packageName string) ([]VersionInfo, error) {
+	infos := make([]VersionInfo, 0)
+	err := index.view(func(tx *bbolt.Tx) error {
+		versionsBucket := getVersionsBucket(tx, packageName)
+		if versionsBucket == nil {
+			return nil
+		}
+		return versionsBucket.ForEach(func(key, value []byte) error {
+			var entry indexEntry
+			err := json.Unmarshal(value, &entry)
+			if err != nil {
+				return fmt.Errorf("error unmarshalling index entry: %w", err)
+			}
+			if !entry.Deleted {
+				infos = append(infos, VersionInfo{Version: keyToVersion(key), Yanked: entry.Yanked})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading versions from index: %w", err)
+	}
+	return infos, nil
+}
+
+// Returns the metadata of all versions of a package that were not deleted
+func (index *manifestIndex) getVersionMetadata(packageName string) ([]VersionMetadata, error) {
+	metadata := make([]VersionMetadata, 0)
+	err := index.view(func(tx *bbolt.Tx) error {
+		versionsBucket := getVersionsBucket(tx, packageName)
+		if versionsBucket == nil {
+			return nil
+		}
+		return versionsBucket.ForEach(func(key, value []byte) error {
+			var entry indexEntry
+			err := json.Unmarshal(value, &entry)
+			if err != nil {
+				return fmt.Errorf("error unmarshalling index entry: %w", err)
+			}
+			if !entry.Deleted {
+				metadata = append(metadata, VersionMetadata{
+					Version:        keyToVersion(key),
+					Labels:         entry.Labels,
+					Publisher:      entry.Publisher,
+					PublisherToken: entry.PublisherToken,
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading version metadata from index: %w", err)
+	}
+	return metadata, nil
+}
+
+// Returns the sorted versions of a package, optionally including the deleted versions
+func (index *manifestIndex) getVersions(packageName string, includeDeleted bool) ([]uint, error) {
+	versions := make([]uint, 0)
+	err := index.view(func(tx *bbolt.Tx) error {
+		versionsBucket := getVersionsBucket(tx, packageName)
+		if versionsBucket == nil {
+			return nil
+		}
+		return versionsBucket.ForEach(func(key, value []byte) error {
+			var entry indexEntry
+			err := json.Unmarshal(value, &entry)
+			if err != nil {
+				return fmt.Errorf("error unmarshalling index entry: %w", err)
+			}
+			if includeDeleted || !entry.Deleted {
+				versions = append(versions, keyToVersion(key))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading versions from index: %w", err)
+	}
+	return versions, nil
+}
+
+// Returns the names of all packages with at least one version that was not deleted
+func (index *manifestIndex) getNames() ([]string, error) {
+	names := make([]string, 0)
+	err := index.view(func(tx *bbolt.Tx) error {
+		packagesBucket := tx.Bucket(indexPackagesBucket)
+		if packagesBucket == nil {
+			return nil
+		}
+		return packagesBucket.ForEachBucket(func(name []byte) error {
+			// Only packages with versions that were not deleted have fingerprints
+			fingerprints := packagesBucket.Bucket(name).Bucket(indexFingerprintsBucket)
+			if key, _ := fingerprints.Cursor().First(); key != nil {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading package names from index: %w", err)
+	}
+	return names, nil
+}
+
+// Returns the version of a package with the specified fingerprint or zero if there is none
+func (index *manifestIndex) findFingerprint(packageName, fingerprint string) (uint, error) {
+	var version uint = 0
+	err := index.view(func(tx *bbolt.Tx) error {
+		packagesBucket := tx.Bucket(indexPackagesBucket)
+		if packagesBucket == nil {
+			return nil
+		}
+		packageBucket := packagesBucket.Bucket([]byte(packageName))
+		if packageBucket == nil {
+			return nil
+		}
+		key := packageBucket.Bucket(indexFingerprintsBucket).Get([]byte(fingerprint))
+		if key != nil {
+			version = keyToVersion(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error searching fingerprint in index: %w", err)
+	}
+	return version, nil
+}
+
+// RebuildIndex recreates the manifest index of a filesystem-based store from the JSON files.
+// Use it after modifying the manifests folder manually.
+func RebuildIndex(storeFolder string) error {
+	store, err := New(storeFolder)
+	if err != nil {
+		return fmt.Errorf("error opening store: %w", err)
+	}
+	defer store.Close()
+	packageStore := store.(*packageStore)
+
+	packageStore.manifestsMutex.Lock()
+	defer packageStore.manifestsMutex.Unlock()
+
+	return packageStore.index.rebuild()
+}
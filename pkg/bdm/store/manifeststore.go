@@ -13,6 +13,13 @@ import (
 )
 
 const manifestFileName = "manifest.json"
+const deletedFileName = "deleted.json"
+const yankedFileName = "yanked.json"
+
+// Records when a package version was deleted or yanked
+type versionRecord struct {
+	Time int64
+}
 
 // Call this method only if you have already locked the manifestsMutex exclusively!
 func (s *packageStore) addManifestLocked(manifest *bdm.Manifest) error {
@@ -32,70 +39,41 @@ func (s *packageStore) addManifestLocked(manifest *bdm.Manifest) error {
 			manifest.PackageName, manifest.PackageVersion)
 	}
 
-	err = os.MkdirAll(versionFolder, os.ModePerm)
-	if err != nil {
-		return fmt.Errorf("error creating manifest folder: %w", err)
-	}
-
 	jsonData, err := json.Marshal(manifest)
 	if err != nil {
 		return fmt.Errorf("error marshalling manifest to JSON: %w", err)
 	}
 
-	manifestPath := path.Join(versionFolder, manifestFileName)
-	fileHandle, err := os.Create(manifestPath)
+	// The version folder is prepared under a temporary name and renamed when it is complete.
+	// This makes sure there are never version folders without a manifest, even after a crash.
+	err = os.MkdirAll(packageFolder, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("error opening manifest file %s: %w", manifestPath, err)
+		return fmt.Errorf("error creating package folder: %w", err)
 	}
-	defer fileHandle.Close()
-
-	_, err = fileHandle.Write(jsonData)
+	tempFolder := path.Join(packageFolder, fmt.Sprintf("%s%d_%d",
+		tempPrefix, manifest.PackageVersion, time.Now().UnixNano()))
+	err = os.Mkdir(tempFolder, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("error writing manifest data: %w", err)
+		return fmt.Errorf("error creating temporary manifest folder: %w", err)
 	}
-
-	return nil
-}
-
-func (s *packageStore) searchDuplicate(manifest *bdm.Manifest) error {
-	existingVersions, err := s.GetVersions(manifest.PackageName)
+	err = util.WriteFileAtomic(path.Join(tempFolder, manifestFileName), tempFolder, jsonData)
 	if err != nil {
-		return fmt.Errorf("error getting versions for package %s: %w",
-			manifest.PackageName, err)
+		os.RemoveAll(tempFolder)
+		return fmt.Errorf("error writing manifest file: %w", err)
+	}
+	err = os.Rename(tempFolder, versionFolder)
+	if err != nil {
+		os.RemoveAll(tempFolder)
+		return fmt.Errorf("error renaming manifest folder: %w", err)
+	}
+	err = util.SyncFolder(packageFolder)
+	if err != nil {
+		return err
 	}
-	for _, version := range existingVersions {
-		existingManifest, err := s.GetManifest(manifest.PackageName, version)
-		if err != nil {
-			return fmt.Errorf("error getting manifest for package %s version %d: %w",
-				manifest.PackageName, version, err)
-		}
-		if len(existingManifest.Files) != len(manifest.Files) {
-			// Different number of files -> no duplicate
-			continue
-		}
-
-		allFilesFoundAndIdentical := true
-		for _, existingFile := range existingManifest.Files {
-			found := false
-			for _, file := range manifest.Files {
-				if existingFile.Path == file.Path &&
-					existingFile.Object.Hash == file.Object.Hash &&
-					existingFile.Object.Size == file.Object.Size {
-					found = true
-					break
-				}
-			}
-			if !found {
-				allFilesFoundAndIdentical = false
-				break
-			}
-		}
 
-		if allFilesFoundAndIdentical {
-			err := fmt.Errorf("found identical older version %d for package %s",
-				version, manifest.PackageName)
-			return DuplicatePackageError{err}
-		}
+	err = s.index.addManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("error adding manifest to index: %w", err)
 	}
 
 	return nil
@@ -114,28 +92,33 @@ func (s *packageStore) PublishManifest(manifest *bdm.Manifest) error {
 		return fmt.Errorf("error validating unpublished manifest: %w", err)
 	}
 
-	err = s.searchDuplicate(manifest)
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	duplicate, err := s.index.findFingerprint(manifest.PackageName, getFingerprint(manifest))
 	if err != nil {
 		return fmt.Errorf("error searching for duplicate package: %w", err)
 	}
+	if duplicate > 0 {
+		err := fmt.Errorf("found identical older version %d for package %s",
+			duplicate, manifest.PackageName)
+		return DuplicatePackageError{err}
+	}
 
-	s.manifestsMutex.Lock()
-	defer s.manifestsMutex.Unlock()
-
+	// Deleted versions must be included to never reuse their version numbers
 	var newVersion uint = 1
-	existingVersions, err := s.GetVersions(manifest.PackageName)
+	existingVersions, err := s.index.getVersions(manifest.PackageName, true)
 	if err != nil {
 		return fmt.Errorf("error getting existing versions for package %s: %w",
 			manifest.PackageName, err)
 	}
-	for _, version := range existingVersions {
-		if version >= newVersion {
-			newVersion = version + 1
-		}
+	if len(existingVersions) > 0 {
+		newVersion = existingVersions[len(existingVersions)-1] + 1
+	}
+	err = assignVersion(manifest, newVersion, s.options.SigningKey)
+	if err != nil {
+		return err
 	}
-	manifest.PackageVersion = newVersion
-	manifest.Published = time.Now().Unix()
-	manifest.Hash = bdm.HashManifest(manifest)
 
 	err = bdm.ValidatePublishedManifest(manifest)
 	if err != nil {
@@ -162,6 +145,9 @@ func (s *packageStore) GetManifest(packageName string, version uint) (*bdm.Manif
 	if !util.FolderExists(versionFolder) {
 		return nil, fmt.Errorf("package %s in version %d does not exist", packageName, version)
 	}
+	if util.FileExists(path.Join(versionFolder, deletedFileName)) {
+		return nil, fmt.Errorf("package %s in version %d was deleted", packageName, version)
+	}
 
 	manifestPath := path.Join(versionFolder, manifestFileName)
 	jsonData, err := os.ReadFile(manifestPath)
@@ -184,49 +170,230 @@ func (s *packageStore) GetNames() ([]string, error) {
 		return nil, fmt.Errorf("manifest store folder does not exist")
 	}
 
-	items, err := os.ReadDir(s.manifestsFolder)
-	if err != nil {
-		return nil, fmt.Errorf("error reading manifest store directory: %w", err)
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	return s.index.getNames()
+}
+
+func (s *packageStore) GetVersions(packageName string) ([]uint, error) {
+	if !util.FolderExists(s.manifestsFolder) {
+		return nil, fmt.Errorf("manifest store folder does not exist")
 	}
 
-	names := make([]string, 0)
-	for _, item := range items {
-		if item.IsDir() {
-			name := item.Name()
-			names = append(names, name)
-		}
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	return s.index.getVersions(packageName, false)
+}
+
+func (s *packageStore) GetVersionInfos(packageName string) ([]VersionInfo, error) {
+	if !util.FolderExists(s.manifestsFolder) {
+		return nil, fmt.Errorf("manifest store folder does not exist")
 	}
 
-	return names, nil
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	return s.index.getVersionInfos(packageName)
 }
 
-func (s *packageStore) GetVersions(packageName string) ([]uint, error) {
+// The metadata is read from the index without opening any manifest files
+func (s *packageStore) GetVersionMetadata(packageName string) ([]VersionMetadata, error) {
 	if !util.FolderExists(s.manifestsFolder) {
 		return nil, fmt.Errorf("manifest store folder does not exist")
 	}
 
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	return s.index.getVersionMetadata(packageName)
+}
+
+func (s *packageStore) getVersionFolder(packageName string, version uint) string {
 	packageFolder := path.Join(s.manifestsFolder, packageName)
-	if !util.FolderExists(packageFolder) {
-		return []uint{}, nil
+	return path.Join(packageFolder, strconv.FormatUint(uint64(version), 10))
+}
+
+func writeVersionRecord(recordPath string) error {
+	record := versionRecord{Time: time.Now().Unix()}
+	jsonData, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error marshalling record to JSON: %w", err)
+	}
+	err = util.WriteFileAtomic(recordPath, path.Dir(recordPath), jsonData)
+	if err != nil {
+		return fmt.Errorf("error writing record file %s: %w", recordPath, err)
+	}
+	return nil
+}
+
+// Removes the manifest and yanked files of a version folder that has a deletion record
+func removeVersionFiles(versionFolder string) error {
+	for _, name := range []string{manifestFileName, yankedFileName} {
+		filePath := path.Join(versionFolder, name)
+		err := os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing file %s: %w", filePath, err)
+		}
+	}
+	return util.SyncFolder(versionFolder)
+}
+
+func (s *packageStore) DeleteManifest(packageName string, version uint) error {
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	versionFolder := s.getVersionFolder(packageName, version)
+	manifestPath := path.Join(versionFolder, manifestFileName)
+	if !util.FileExists(manifestPath) {
+		return fmt.Errorf("package %s in version %d does not exist", packageName, version)
+	}
+
+	// The empty version folder stays with a record of the deletion
+	// to make sure the version number is never reused.
+	err := writeVersionRecord(path.Join(versionFolder, deletedFileName))
+	if err != nil {
+		return fmt.Errorf("error recording deletion: %w", err)
 	}
 
-	files, err := os.ReadDir(packageFolder)
+	// A crash from here on is completed by the repair mode or by deleting the version again
+	err = removeVersionFiles(versionFolder)
 	if err != nil {
-		return nil, fmt.Errorf("error reading manifest store directory: %w", err)
+		return err
 	}
 
-	versions := make([]uint, 0)
-	for _, file := range files {
-		if file.IsDir() {
-			name := file.Name()
-			i, err := strconv.Atoi(name)
-			if err != nil {
-				return nil, fmt.Errorf("error parsing version number from folder name %s: %w", name, err)
-			}
-			u := uint(i)
-			versions = append(versions, u)
+	err = s.index.modifyEntry(packageName, version, func(entry *indexEntry) {
+		entry.Deleted = true
+		entry.Yanked = false
+	})
+	if err != nil {
+		return fmt.Errorf("error updating index: %w", err)
+	}
+
+	return nil
+}
+
+func (s *packageStore) YankManifest(packageName string, version uint, yanked bool) error {
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	versionFolder := s.getVersionFolder(packageName, version)
+	if !util.FileExists(path.Join(versionFolder, manifestFileName)) {
+		return fmt.Errorf("package %s in version %d does not exist", packageName, version)
+	}
+
+	yankedPath := path.Join(versionFolder, yankedFileName)
+	isYanked := util.FileExists(yankedPath)
+	if yanked && !isYanked {
+		err := writeVersionRecord(yankedPath)
+		if err != nil {
+			return fmt.Errorf("error recording yank: %w", err)
+		}
+	} else if !yanked && isYanked {
+		err := os.Remove(yankedPath)
+		if err != nil {
+			return fmt.Errorf("error removing yanked file %s: %w", yankedPath, err)
+		}
+		err = util.SyncFolder(versionFolder)
+		if err != nil {
+			return err
 		}
 	}
 
-	return versions, nil
+	err := s.index.modifyEntry(packageName, version, func(entry *indexEntry) {
+		entry.Yanked = yanked
+	})
+	if err != nil {
+		return fmt.Errorf("error updating index: %w", err)
+	}
+
+	return nil
+}
+
+func (s *packageStore) IsYanked(packageName string, version uint) (bool, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	entry, err := s.index.getEntry(packageName, version)
+	if err != nil {
+		return false, fmt.Errorf("error reading index: %w", err)
+	}
+	if entry == nil || entry.Deleted {
+		return false, fmt.Errorf("package %s in version %d does not exist", packageName, version)
+	}
+
+	return entry.Yanked, nil
+}
+
+// Versions that never existed are not deleted
+func (s *packageStore) IsDeleted(packageName string, version uint) (bool, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	entry, err := s.index.getEntry(packageName, version)
+	if err != nil {
+		return false, fmt.Errorf("error reading index: %w", err)
+	}
+
+	return entry != nil && entry.Deleted, nil
+}
+
+func (s *packageStore) getTagsPath(packageName string) string {
+	return path.Join(s.manifestsFolder, packageName, tagsFileName)
+}
+
+// Call this method only if you have already locked the manifestsMutex!
+func (s *packageStore) getTagsLocked(packageName string) ([]Tag, error) {
+	tagsPath := s.getTagsPath(packageName)
+	if !util.FileExists(tagsPath) {
+		return unmarshalTags(nil)
+	}
+	jsonData, err := os.ReadFile(tagsPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tags file %s: %w", tagsPath, err)
+	}
+	return unmarshalTags(jsonData)
+}
+
+func (s *packageStore) SetTag(packageName, tagName string, version uint, user string) error {
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	if version > 0 {
+		entry, err := s.index.getEntry(packageName, version)
+		if err != nil {
+			return fmt.Errorf("error reading index: %w", err)
+		}
+		if entry == nil || entry.Deleted {
+			return fmt.Errorf("package %s in version %d does not exist", packageName, version)
+		}
+	}
+
+	tags, err := s.getTagsLocked(packageName)
+	if err != nil {
+		return err
+	}
+	tags, err = changeTag(tags, tagName, version, user)
+	if err != nil {
+		return err
+	}
+	jsonData, err := json.Marshal(tags)
+	if err != nil {
+		return fmt.Errorf("error marshalling tags to JSON: %w", err)
+	}
+	tagsPath := s.getTagsPath(packageName)
+	err = util.WriteFileAtomic(tagsPath, path.Dir(tagsPath), jsonData)
+	if err != nil {
+		return fmt.Errorf("error writing tags file %s: %w", tagsPath, err)
+	}
+
+	return nil
+}
+
+func (s *packageStore) GetTags(packageName string) ([]Tag, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	return s.getTagsLocked(packageName)
 }
@@ -0,0 +1,450 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+)
+
+type memoryObject struct {
+	data   []byte
+	size   int64
+	format ObjectFormat
+	added  time.Time
+}
+
+type memoryVersion struct {
+	// Manifests are kept as JSON to make sure callers cannot modify them
+	manifest    []byte
+	fingerprint string
+	deleted     bool
+	yanked      bool
+}
+
+type memoryStore struct {
+	options        Options
+	objects        map[string]*memoryObject
+	packages       map[string]map[uint]*memoryVersion
+	objectsMutex   sync.RWMutex
+	manifestsMutex sync.RWMutex
+	// Tags are kept as JSON for the same reason as manifests
+	tags map[string][]byte
+}
+
+// NewMemory creates a package store that keeps all data in memory.
+// It is meant for tests and ephemeral servers, all data is lost when the process ends.
+func NewMemory() Store {
+	return NewMemoryWithOptions(Options{})
+}
+
+// NewMemoryWithOptions creates a new in-memory package store with specific options
+func NewMemoryWithOptions(options Options) Store {
+	return &memoryStore{
+		options:  options,
+		objects:  make(map[string]*memoryObject),
+		packages: make(map[string]map[uint]*memoryVersion),
+		tags:     make(map[string][]byte),
+	}
+}
+
+// Memory stores keep no open resources
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// Call this method only if you have already locked the manifestsMutex exclusively!
+func (s *memoryStore) addManifestLocked(manifest *bdm.Manifest) error {
+	err := bdm.ValidatePublishedManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("error validating published manifest: %w", err)
+	}
+
+	versions := s.packages[manifest.PackageName]
+	if _, found := versions[manifest.PackageVersion]; found {
+		return fmt.Errorf("manifest with package name %s and version %d already exists",
+			manifest.PackageName, manifest.PackageVersion)
+	}
+
+	jsonData, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("error marshalling manifest to JSON: %w", err)
+	}
+
+	if versions == nil {
+		versions = make(map[uint]*memoryVersion)
+		s.packages[manifest.PackageName] = versions
+	}
+	versions[manifest.PackageVersion] = &memoryVersion{
+		manifest:    jsonData,
+		fingerprint: getFingerprint(manifest),
+	}
+
+	return nil
+}
+
+func (s *memoryStore) AddManifest(manifest *bdm.Manifest) error {
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	return s.addManifestLocked(manifest)
+}
+
+func (s *memoryStore) PublishManifest(manifest *bdm.Manifest) error {
+	err := bdm.ValidateUnpublishedManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("error validating unpublished manifest: %w", err)
+	}
+
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	// Deleted versions must be included to never reuse their version numbers
+	var newVersion uint = 1
+	fingerprint := getFingerprint(manifest)
+	for version, entry := range s.packages[manifest.PackageName] {
+		if !entry.deleted && entry.fingerprint == fingerprint {
+			err := fmt.Errorf("found identical older version %d for package %s",
+				version, manifest.PackageName)
+			return DuplicatePackageError{err}
+		}
+		if version >= newVersion {
+			newVersion = version + 1
+		}
+	}
+	err = assignVersion(manifest, newVersion, s.options.SigningKey)
+	if err != nil {
+		return err
+	}
+
+	err = bdm.ValidatePublishedManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("error validating published manifest: %w", err)
+	}
+
+	return s.addManifestLocked(manifest)
+}
+
+// Call this method only if you have already locked the manifestsMutex!
+func (s *memoryStore) getVersionLocked(packageName string, version uint) (*memoryVersion, error) {
+	entry := s.packages[packageName][version]
+	if entry == nil {
+		return nil, fmt.Errorf("package %s in version %d does not exist", packageName, version)
+	}
+	if entry.deleted {
+		return nil, fmt.Errorf("package %s in version %d was deleted", packageName, version)
+	}
+	return entry, nil
+}
+
+func (s *memoryStore) GetManifest(packageName string, version uint) (*bdm.Manifest, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	entry, err := s.getVersionLocked(packageName, version)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest bdm.Manifest
+	err = json.Unmarshal(entry.manifest, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling manifest JSON: %w", err)
+	}
+
+	return &manifest, nil
+}
+
+// Call this method only if you have already locked the manifestsMutex!
+func (s *memoryStore) getVersionsLocked(packageName string) []uint {
+	versions := make([]uint, 0)
+	for version, entry := range s.packages[packageName] {
+		if !entry.deleted {
+			versions = append(versions, version)
+		}
+	}
+	sortVersions(versions)
+	return versions
+}
+
+func (s *memoryStore) GetNames() ([]string, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	names := make([]string, 0)
+	for name := range s.packages {
+		if len(s.getVersionsLocked(name)) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (s *memoryStore) GetVersions(packageName string) ([]uint, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	return s.getVersionsLocked(packageName), nil
+}
+
+func (s *memoryStore) GetVersionInfos(packageName string) ([]VersionInfo, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	infos := make([]VersionInfo, 0)
+	for _, version := range s.getVersionsLocked(packageName) {
+		infos = append(infos, VersionInfo{Version: version, Yanked: s.packages[packageName][version].yanked})
+	}
+	return infos, nil
+}
+
+func (s *memoryStore) GetVersionMetadata(packageName string) ([]VersionMetadata, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	metadata := make([]VersionMetadata, 0)
+	for _, version := range s.getVersionsLocked(packageName) {
+		var manifest bdm.Manifest
+		err := json.Unmarshal(s.packages[packageName][version].manifest, &manifest)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling manifest JSON: %w", err)
+		}
+		metadata = append(metadata, VersionMetadata{
+			Version:        version,
+			Labels:         manifest.Labels,
+			Publisher:      manifest.Publisher,
+			PublisherToken: manifest.PublisherToken,
+		})
+	}
+	return metadata, nil
+}
+
+func (s *memoryStore) DeleteManifest(packageName string, version uint) error {
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	entry, err := s.getVersionLocked(packageName, version)
+	if err != nil {
+		return fmt.Errorf("package %s in version %d does not exist", packageName, version)
+	}
+
+	// The entry stays to make sure the version number is never reused
+	entry.manifest = nil
+	entry.deleted = true
+	entry.yanked = false
+
+	return nil
+}
+
+func (s *memoryStore) YankManifest(packageName string, version uint, yanked bool) error {
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	entry, err := s.getVersionLocked(packageName, version)
+	if err != nil {
+		return fmt.Errorf("package %s in version %d does not exist", packageName, version)
+	}
+	entry.yanked = yanked
+
+	return nil
+}
+
+func (s *memoryStore) IsYanked(packageName string, version uint) (bool, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	entry, err := s.getVersionLocked(packageName, version)
+	if err != nil {
+		return false, fmt.Errorf("package %s in version %d does not exist", packageName, version)
+	}
+
+	return entry.yanked, nil
+}
+
+func (s *memoryStore) IsDeleted(packageName string, version uint) (bool, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	entry := s.packages[packageName][version]
+	return entry != nil && entry.deleted, nil
+}
+
+func (s *memoryStore) SetTag(packageName, tagName string, version uint, user string) error {
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	if version > 0 {
+		_, err := s.getVersionLocked(packageName, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	tags, err := unmarshalTags(s.tags[packageName])
+	if err != nil {
+		return err
+	}
+	tags, err = changeTag(tags, tagName, version, user)
+	if err != nil {
+		return err
+	}
+	jsonData, err := json.Marshal(tags)
+	if err != nil {
+		return fmt.Errorf("error marshalling tags to JSON: %w", err)
+	}
+	s.tags[packageName] = jsonData
+
+	return nil
+}
+
+func (s *memoryStore) GetTags(packageName string) ([]Tag, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	return unmarshalTags(s.tags[packageName])
+}
+
+func (s *memoryStore) getObject(hash string) (*memoryObject, error) {
+	s.objectsMutex.RLock()
+	defer s.objectsMutex.RUnlock()
+
+	object := s.objects[hash]
+	if object == nil {
+		return nil, fmt.Errorf("unable to find object %s", hash)
+	}
+	return object, nil
+}
+
+func (s *memoryStore) GetObject(hash string) (*bdm.Object, error) {
+	object, err := s.getObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bdm.Object{
+		Hash: hash,
+		Size: object.size,
+	}, nil
+}
+
+func (s *memoryStore) AddObject(reader io.Reader) (*bdm.Object, error) {
+	var buffer bytes.Buffer
+	size, hash, format, err := writeObjectData(reader, &buffer, s.options.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	s.objectsMutex.Lock()
+	defer s.objectsMutex.Unlock()
+
+	if existing := s.objects[hash]; existing != nil {
+		// Protect the existing object from a concurrently running garbage collection
+		existing.added = time.Now()
+	} else {
+		s.objects[hash] = &memoryObject{
+			data:   buffer.Bytes(),
+			size:   size,
+			format: format,
+			added:  time.Now(),
+		}
+	}
+
+	return &bdm.Object{
+		Hash: hash,
+		Size: size,
+	}, nil
+}
+
+func (s *memoryStore) ReadObject(hash string) (io.ReadCloser, error) {
+	stored, err := s.ReadStoredObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	return decodeObjectData(stored, stored.Format)
+}
+
+func (s *memoryStore) ReadObjectAt(hash string, offset int64) (io.ReadCloser, error) {
+	object, err := s.getObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	storedSize := int64(len(object.data))
+	return readObjectDataAt(object.format, storedSize, offset, func(offset, length int64) (io.ReadCloser, error) {
+		if length < 0 {
+			length = storedSize - offset
+		}
+		return io.NopCloser(bytes.NewReader(object.data[offset : offset+length])), nil
+	})
+}
+
+func (s *memoryStore) ReadStoredObject(hash string) (*StoredObject, error) {
+	object, err := s.getObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := io.NopCloser(bytes.NewReader(object.data))
+	return &StoredObject{reader, int64(len(object.data)), object.format}, nil
+}
+
+func (s *memoryStore) GetStoredObjectInfo(hash string) (*StoredObjectInfo, error) {
+	object, err := s.getObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StoredObjectInfo{int64(len(object.data)), object.format}, nil
+}
+
+func (s *memoryStore) GetObjects() ([]*bdm.Object, error) {
+	s.objectsMutex.RLock()
+	defer s.objectsMutex.RUnlock()
+
+	objects := make([]*bdm.Object, 0, len(s.objects))
+	for hash, object := range s.objects {
+		objects = append(objects, &bdm.Object{Hash: hash, Size: object.size})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Hash < objects[j].Hash
+	})
+
+	return objects, nil
+}
+
+func (s *memoryStore) RefreshObject(hash string) error {
+	s.objectsMutex.Lock()
+	defer s.objectsMutex.Unlock()
+
+	object := s.objects[hash]
+	if object == nil {
+		return fmt.Errorf("unable to find object %s", hash)
+	}
+	object.added = time.Now()
+
+	return nil
+}
+
+func (s *memoryStore) RemoveObject(hash string, addedBefore time.Time) (bool, error) {
+	s.objectsMutex.Lock()
+	defer s.objectsMutex.Unlock()
+
+	object := s.objects[hash]
+	if object == nil {
+		return false, fmt.Errorf("unable to find object %s", hash)
+	}
+	if !object.added.Before(addedBefore) {
+		// Object is too young and might be needed by an upload in progress
+		return false, nil
+	}
+
+	delete(s.objects, hash)
+	return true, nil
+}
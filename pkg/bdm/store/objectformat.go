@@ -0,0 +1,317 @@
+package store
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+// ObjectFormat describes how the data of an object is stored
+type ObjectFormat byte
+
+const (
+	// FormatZstd objects are stored as ZSTD compressed data
+	FormatZstd ObjectFormat = 0
+	// FormatRaw objects are stored uncompressed, since compression would not reduce their size
+	FormatRaw ObjectFormat = 1
+)
+
+// Options configure how a store keeps new objects and publishes manifests
+type Options struct {
+	// Compression level for new objects, CompressionNone stores all objects raw
+	Compression util.CompressionLevel
+	// Signs all published manifests that were not signed by their publisher
+	SigningKey ed25519.PrivateKey
+}
+
+// StoredObject provides the object data as it is stored
+type StoredObject struct {
+	io.ReadCloser
+	// Size of the stored data, which is the compressed size for ZSTD objects
+	Size   int64
+	Format ObjectFormat
+}
+
+// StoredObjectInfo describes how an object is stored without reading its data
+type StoredObjectInfo struct {
+	// Size of the stored data, which is the compressed size for ZSTD objects
+	Size   int64
+	Format ObjectFormat
+}
+
+// ZSTD objects consist of independent frames with this amount of uncompressed data.
+// The first block is also the sample that decides about the format of the object.
+const objectFrameSize = 1024 * 1024
+
+// Objects are stored raw if compressing the sample saves less than this fraction
+const minCompressionSavings = 0.05
+
+// ZSTD objects end with a seek table as defined by the seekable format of the ZSTD project.
+// The table is a skippable frame that is ignored by decoders and lists the sizes of all frames.
+const (
+	seekTableSkippableMagic = 0x184D2A5E
+	seekTableFooterMagic    = 0x8F92EAB1
+	seekTableFooterSize     = 9
+	seekTableChecksumFlag   = 0x80
+)
+
+type seekTableEntry struct {
+	compressed   uint32
+	decompressed uint32
+}
+
+func encodeSeekTable(entries []seekTableEntry) []byte {
+	size := len(entries)*8 + seekTableFooterSize
+	table := make([]byte, 0, 8+size)
+	table = binary.LittleEndian.AppendUint32(table, seekTableSkippableMagic)
+	table = binary.LittleEndian.AppendUint32(table, uint32(size))
+	for _, entry := range entries {
+		table = binary.LittleEndian.AppendUint32(table, entry.compressed)
+		table = binary.LittleEndian.AppendUint32(table, entry.decompressed)
+	}
+	table = binary.LittleEndian.AppendUint32(table, uint32(len(entries)))
+	table = append(table, 0) // No checksums
+	return binary.LittleEndian.AppendUint32(table, seekTableFooterMagic)
+}
+
+func readObjectBlock(reader io.Reader, block []byte) (int, error) {
+	size, err := io.ReadFull(reader, block)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, fmt.Errorf("error reading object data: %w", err)
+	}
+	return size, nil
+}
+
+// Writes the data from the reader in the format selected by compressing a sample.
+// Returns size and hash of the uncompressed data together with the selected format.
+func writeObjectData(reader io.Reader, writer io.Writer, level util.CompressionLevel) (int64, string, ObjectFormat, error) {
+	block := make([]byte, objectFrameSize)
+	blockSize, err := readObjectBlock(reader, block)
+	if err != nil {
+		return 0, "", FormatZstd, err
+	}
+	hasher := util.CreateHasher()
+	hasher.Write(block[:blockSize])
+
+	format := FormatRaw
+	var encoder *util.FrameEncoder
+	var frame []byte
+	if level != util.CompressionNone {
+		encoder, err = util.CreateFrameEncoder(level)
+		if err != nil {
+			return 0, "", FormatZstd, err
+		}
+		defer encoder.Close()
+		frame = encoder.EncodeFrame(block[:blockSize], nil)
+		if float64(len(frame)) < float64(blockSize)*(1-minCompressionSavings) {
+			format = FormatZstd
+		}
+	}
+
+	if format == FormatRaw {
+		_, err = writer.Write(block[:blockSize])
+		if err != nil {
+			return 0, "", format, fmt.Errorf("error writing object data: %w", err)
+		}
+		size := int64(blockSize)
+		if blockSize == objectFrameSize {
+			remaining, err := io.Copy(io.MultiWriter(writer, hasher), reader)
+			if err != nil {
+				return 0, "", format, fmt.Errorf("error writing object data: %w", err)
+			}
+			size += remaining
+		}
+		return size, util.GetHashString(hasher), format, nil
+	}
+
+	size := int64(0)
+	entries := make([]seekTableEntry, 0)
+	for {
+		_, err = writer.Write(frame)
+		if err != nil {
+			return 0, "", format, fmt.Errorf("error writing compressed object data: %w", err)
+		}
+		entries = append(entries, seekTableEntry{uint32(len(frame)), uint32(blockSize)})
+		size += int64(blockSize)
+		if blockSize < objectFrameSize {
+			break
+		}
+		blockSize, err = readObjectBlock(reader, block)
+		if err != nil {
+			return 0, "", format, err
+		}
+		if blockSize == 0 {
+			break
+		}
+		hasher.Write(block[:blockSize])
+		frame = encoder.EncodeFrame(block[:blockSize], frame[:0])
+	}
+
+	_, err = writer.Write(encodeSeekTable(entries))
+	if err != nil {
+		return 0, "", format, fmt.Errorf("error writing seek table: %w", err)
+	}
+
+	return size, util.GetHashString(hasher), format, nil
+}
+
+// Reads a range of the stored object data, a negative length reads until the end
+type storedRangeReader func(offset, length int64) (io.ReadCloser, error)
+
+func readStoredBytes(readRange storedRangeReader, offset, length int64) ([]byte, error) {
+	reader, err := readRange(offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data := make([]byte, length)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading stored object data: %w", err)
+	}
+	return data, nil
+}
+
+// Returns the stored offset of the frame that contains the uncompressed offset
+// and the number of uncompressed bytes to skip in this frame.
+// Objects without seek table are decoded from their start.
+func findObjectFrame(storedSize, offset int64, readRange storedRangeReader) (int64, int64, error) {
+	if offset == 0 || storedSize < seekTableFooterSize {
+		return 0, offset, nil
+	}
+	footer, err := readStoredBytes(readRange, storedSize-seekTableFooterSize, seekTableFooterSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	descriptor := footer[4]
+	if binary.LittleEndian.Uint32(footer[5:]) != seekTableFooterMagic || descriptor&^seekTableChecksumFlag != 0 {
+		return 0, offset, nil
+	}
+	entrySize := int64(8)
+	if descriptor&seekTableChecksumFlag != 0 {
+		entrySize = 12
+	}
+	frames := int64(binary.LittleEndian.Uint32(footer))
+	tableStart := storedSize - seekTableFooterSize - frames*entrySize
+	if tableStart < 8 {
+		return 0, offset, nil
+	}
+	table, err := readStoredBytes(readRange, tableStart, frames*entrySize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	compressedStart, decompressedStart := int64(0), int64(0)
+	for i := int64(0); i < frames; i++ {
+		entry := table[i*entrySize:]
+		decompressedEnd := decompressedStart + int64(binary.LittleEndian.Uint32(entry[4:]))
+		if offset < decompressedEnd {
+			break
+		}
+		compressedStart += int64(binary.LittleEndian.Uint32(entry))
+		decompressedStart = decompressedEnd
+	}
+	return compressedStart, offset - decompressedStart, nil
+}
+
+// Returns a reader for the uncompressed object data starting at the offset.
+// For ZSTD objects only the frame containing the offset and all following frames are decoded.
+func readObjectDataAt(format ObjectFormat, storedSize, offset int64, readRange storedRangeReader) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid negative offset %d", offset)
+	}
+	if format == FormatRaw {
+		if offset >= storedSize {
+			return io.NopCloser(bytes.NewReader(nil)), nil
+		}
+		return readRange(offset, -1)
+	}
+
+	frameStart, skip, err := findObjectFrame(storedSize, offset, readRange)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := readRange(frameStart, -1)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := decodeObjectData(stored, FormatZstd)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(io.Discard, decoded, skip)
+	if err != nil {
+		decoded.Close()
+		return nil, fmt.Errorf("error skipping %d bytes of object data: %w", skip, err)
+	}
+	return decoded, nil
+}
+
+// Returns a reader for the uncompressed data of a stored object and closes the stored data with it
+func decodeObjectData(stored io.ReadCloser, format ObjectFormat) (io.ReadCloser, error) {
+	if format == FormatRaw {
+		return stored, nil
+	}
+	decompressed, err := util.CreateDecompressingReader(stored)
+	if err != nil {
+		stored.Close()
+		return nil, fmt.Errorf("error creating decompressing reader: %w", err)
+	}
+	return &decodedObjectReader{stored, decompressed}, nil
+}
+
+type decodedObjectReader struct {
+	stored       io.ReadCloser
+	decompressed io.ReadCloser
+}
+
+func (r *decodedObjectReader) Read(p []byte) (int, error) {
+	return r.decompressed.Read(p)
+}
+
+func (r *decodedObjectReader) Close() error {
+	r.decompressed.Close()
+	return r.stored.Close()
+}
+
+// The info file next to each object contains the 8 byte size and an optional format byte.
+// Files without the format byte were written before raw objects existed and are ZSTD objects.
+func readObjectInfo(infoPath string) (int64, ObjectFormat, error) {
+	infoBytes, err := os.ReadFile(infoPath)
+	if err != nil {
+		return 0, FormatZstd, fmt.Errorf("failed to read object size file %s: %w", infoPath, err)
+	}
+	format := FormatZstd
+	if len(infoBytes) == 9 {
+		format = ObjectFormat(infoBytes[8])
+		infoBytes = infoBytes[:8]
+	}
+	if format != FormatZstd && format != FormatRaw {
+		return 0, FormatZstd, fmt.Errorf("found unknown object format %d", format)
+	}
+	size, err := util.Int64FromBytes(infoBytes)
+	if err != nil {
+		return 0, FormatZstd, fmt.Errorf("error parsing object size: %w", err)
+	}
+	return size, format, nil
+}
+
+// ZSTD objects keep the old info file format, so older versions can still read them.
+// The file is written atomically using a temporary file in the temp folder.
+func writeObjectInfo(infoPath, tempFolder string, size int64, format ObjectFormat) error {
+	infoBytes := util.Int64ToBytes(size)
+	if format != FormatZstd {
+		infoBytes = append(infoBytes, byte(format))
+	}
+	err := util.WriteFileAtomic(infoPath, tempFolder, infoBytes)
+	if err != nil {
+		return fmt.Errorf("error writing object size file %s: %w", infoPath, err)
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/cry-inc/bdm/pkg/bdm"
 	"github.com/cry-inc/bdm/pkg/bdm/util"
@@ -30,16 +31,9 @@ func (s *packageStore) GetObject(hash string) (*bdm.Object, error) {
 		return nil, fmt.Errorf("unable to find object file %s", filePath)
 	}
 
-	sizePath := filePath + sizeSuffix
-	sizeBytes, err := os.ReadFile(sizePath)
+	size, _, err := readObjectInfo(filePath + sizeSuffix)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read object size file %s: %w",
-			sizePath, err)
-	}
-
-	size, err := util.Int64FromBytes(sizeBytes)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing object size: %w", err)
+		return nil, err
 	}
 
 	return &bdm.Object{
@@ -49,30 +43,26 @@ func (s *packageStore) GetObject(hash string) (*bdm.Object, error) {
 }
 
 func (s *packageStore) AddObject(reader io.Reader) (*bdm.Object, error) {
-	tempFile, err := os.CreateTemp(s.objectsFolder, "tmp_*")
+	tempFile, err := os.CreateTemp(s.objectsFolder, tempPrefix+"*")
 	if err != nil {
 		return nil, fmt.Errorf("error opening temporary object file: %w", err)
 	}
 	defer tempFile.Close()
 
-	compressedHandle, err := util.CreateCompressingWriter(tempFile)
-	if err != nil {
-		return nil, fmt.Errorf("error creating compressing writer: %w", err)
+	tempFileName := tempFile.Name()
+	fileSize, hash, format, err := writeObjectData(reader, tempFile, s.options.Compression)
+	if err == nil {
+		err = tempFile.Sync()
+		if err != nil {
+			err = fmt.Errorf("error flushing temporary object file: %w", err)
+		}
 	}
-	defer compressedHandle.Close()
-
-	hasher := util.CreateHasher()
-	writer := io.MultiWriter(compressedHandle, hasher)
-
-	fileSize, err := io.Copy(writer, reader)
 	if err != nil {
-		return nil, fmt.Errorf("error writing compressed object data: %w", err)
+		tempFile.Close()
+		os.Remove(tempFileName)
+		return nil, err
 	}
 
-	hash := util.GetHashString(hasher)
-	tempFileName := tempFile.Name()
-
-	compressedHandle.Close()
 	tempFile.Close()
 
 	{
@@ -82,7 +72,11 @@ func (s *packageStore) AddObject(reader io.Reader) (*bdm.Object, error) {
 		object, _ := s.GetObject(hash)
 		if object != nil {
 			// Object exists already in store, no file moving required!
+			// Refresh the modification time to protect the object
+			// from a concurrently running garbage collection.
 			os.Remove(tempFileName)
+			now := time.Now()
+			os.Chtimes(path.Join(s.objectsFolder, getObjectPath(hash)), now, now)
 		} else {
 			objectPath := getObjectPath(hash)
 			finalPath := path.Join(s.objectsFolder, objectPath)
@@ -95,17 +89,23 @@ func (s *packageStore) AddObject(reader io.Reader) (*bdm.Object, error) {
 				}
 			}
 
+			// The size file is written first, objects without size file cannot be read.
+			// Size files without object are ignored and removed by the repair mode.
+			err = writeObjectInfo(finalPath+sizeSuffix, s.objectsFolder, fileSize, format)
+			if err != nil {
+				os.Remove(tempFileName)
+				return nil, err
+			}
+
 			err := os.Rename(tempFileName, finalPath)
 			if err != nil {
+				os.Remove(tempFileName)
 				return nil, fmt.Errorf("error finalizing object file name: %w", err)
 			}
 
-			sizeBytes := util.Int64ToBytes(fileSize)
-			sizePath := finalPath + sizeSuffix
-			err = os.WriteFile(sizePath, sizeBytes, os.ModePerm)
+			err = util.SyncFolder(finalFolder)
 			if err != nil {
-				return nil, fmt.Errorf("error writing object size file %s: %w",
-					sizePath, err)
+				return nil, err
 			}
 		}
 	}
@@ -119,32 +119,102 @@ func (s *packageStore) AddObject(reader io.Reader) (*bdm.Object, error) {
 }
 
 func (s *packageStore) ReadObject(hash string) (io.ReadCloser, error) {
-	objectPath := getObjectPath(hash)
-	filePath := path.Join(s.objectsFolder, objectPath)
-	fileHandle, err := os.Open(filePath)
+	stored, err := s.ReadStoredObject(hash)
 	if err != nil {
-		return nil, fmt.Errorf("error opening object file: %w", err)
+		return nil, err
+	}
+	if stored.Format == FormatRaw {
+		return stored, nil
 	}
 
-	decompressedHandle, err := util.CreateDecompressingReader(fileHandle)
+	filePath := path.Join(s.objectsFolder, getObjectPath(hash))
+	decompressedHandle, err := util.CreateDecompressingReader(stored)
 	if err != nil {
+		stored.Close()
 		return nil, fmt.Errorf("error creating decompressing reader: %w", err)
 	}
 
 	reader, writer := io.Pipe()
 	go func() {
-		defer fileHandle.Close()
+		defer stored.Close()
 		defer decompressedHandle.Close()
-		defer writer.Close()
 		_, err := io.Copy(writer, decompressedHandle)
 		if err != nil {
-			panic(fmt.Errorf("error reading compressed object data from file %s: %w", filePath, err))
+			// Pass the error to the reader instead of crashing, corrupt objects must not stop a server
+			writer.CloseWithError(fmt.Errorf("error reading compressed object data from file %s: %w", filePath, err))
+			return
 		}
+		writer.Close()
 	}()
 
 	return reader, nil
 }
 
+func (s *packageStore) ReadObjectAt(hash string, offset int64) (io.ReadCloser, error) {
+	fileHandle, size, format, err := s.openObjectFile(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := readObjectDataAt(format, size, offset, func(offset, length int64) (io.ReadCloser, error) {
+		if length < 0 {
+			length = size - offset
+		}
+		return io.NopCloser(io.NewSectionReader(fileHandle, offset, length)), nil
+	})
+	if err != nil {
+		fileHandle.Close()
+		return nil, err
+	}
+
+	return &decodedObjectReader{fileHandle, reader}, nil
+}
+
+func (s *packageStore) ReadStoredObject(hash string) (*StoredObject, error) {
+	fileHandle, size, format, err := s.openObjectFile(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &StoredObject{fileHandle, size, format}, nil
+}
+
+func (s *packageStore) GetStoredObjectInfo(hash string) (*StoredObjectInfo, error) {
+	filePath := path.Join(s.objectsFolder, getObjectPath(hash))
+	_, format, err := readObjectInfo(filePath + sizeSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error getting size of object file %s: %w", filePath, err)
+	}
+
+	return &StoredObjectInfo{fileInfo.Size(), format}, nil
+}
+
+// Opens the object file and returns it together with its size and format
+func (s *packageStore) openObjectFile(hash string) (*os.File, int64, ObjectFormat, error) {
+	filePath := path.Join(s.objectsFolder, getObjectPath(hash))
+	_, format, err := readObjectInfo(filePath + sizeSuffix)
+	if err != nil {
+		return nil, 0, format, err
+	}
+
+	fileHandle, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, format, fmt.Errorf("error opening object file: %w", err)
+	}
+
+	fileInfo, err := fileHandle.Stat()
+	if err != nil {
+		fileHandle.Close()
+		return nil, 0, format, fmt.Errorf("error getting size of object file %s: %w", filePath, err)
+	}
+
+	return fileHandle, fileInfo.Size(), format, nil
+}
+
 func (s *packageStore) GetObjects() ([]*bdm.Object, error) {
 	if !util.FolderExists(s.objectsFolder) {
 		return nil, fmt.Errorf("objects store folder %s does not exist",
@@ -184,5 +254,56 @@ func (s *packageStore) GetObjects() ([]*bdm.Object, error) {
 	}
 
 	return objects, nil
+}
+
+// Refreshes the modification time of an existing object to protect
+// it from the garbage collection until it is referenced by a manifest.
+func (s *packageStore) RefreshObject(hash string) error {
+	s.objectsMutex.Lock()
+	defer s.objectsMutex.Unlock()
+
+	filePath := path.Join(s.objectsFolder, getObjectPath(hash))
+	now := time.Now()
+	err := os.Chtimes(filePath, now, now)
+	if err != nil {
+		return fmt.Errorf("error refreshing object file %s: %w", filePath, err)
+	}
+
+	return nil
+}
+
+func (s *packageStore) RemoveObject(hash string, addedBefore time.Time) (bool, error) {
+	s.objectsMutex.Lock()
+	defer s.objectsMutex.Unlock()
+
+	objectPath := getObjectPath(hash)
+	filePath := path.Join(s.objectsFolder, objectPath)
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return false, fmt.Errorf("unable to find object file %s: %w", filePath, err)
+	}
+	if !stat.ModTime().Before(addedBefore) {
+		// Object is too young and might be needed by an upload in progress
+		return false, nil
+	}
+
+	err = os.Remove(filePath)
+	if err != nil {
+		return false, fmt.Errorf("error removing object file %s: %w", filePath, err)
+	}
+
+	sizePath := filePath + sizeSuffix
+	err = os.Remove(sizePath)
+	if err != nil && !os.IsNotExist(err) {
+		return true, fmt.Errorf("error removing object size file %s: %w", sizePath, err)
+	}
+
+	// Remove the object sub folder if it became empty
+	folder := path.Dir(filePath)
+	items, err := os.ReadDir(folder)
+	if err == nil && len(items) == 0 {
+		os.Remove(folder)
+	}
 
+	return true, nil
 }
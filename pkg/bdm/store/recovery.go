@@ -0,0 +1,77 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Prefix for temporary files and folders inside the store
+const tempPrefix = "tmp_"
+
+// Removes temporary items left behind by writes that were interrupted by a crash.
+// Temporary items are only removed after the default grace period,
+// since they might belong to another process working with the same store.
+// Everything else, like incomplete versions or objects without size file,
+// is left for the repair mode to avoid walking the whole store on every start.
+func (s *packageStore) recoverWrites() error {
+	err := removeOldTempItems(s.objectsFolder)
+	if err != nil {
+		return fmt.Errorf("error recovering objects: %w", err)
+	}
+
+	packages, err := os.ReadDir(s.manifestsFolder)
+	if err != nil {
+		return fmt.Errorf("error reading manifest store directory: %w", err)
+	}
+	for _, packageItem := range packages {
+		if !packageItem.IsDir() {
+			continue
+		}
+		err = removeOldTempItems(path.Join(s.manifestsFolder, packageItem.Name()))
+		if err != nil {
+			return fmt.Errorf("error recovering manifests: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Removes all temporary items directly inside the folder that are older than the grace period
+func removeOldTempItems(folder string) error {
+	items, err := os.ReadDir(folder)
+	if err != nil {
+		return fmt.Errorf("error reading directory %s: %w", folder, err)
+	}
+	for _, item := range items {
+		if strings.HasPrefix(item.Name(), tempPrefix) {
+			err = removeOldTempItem(path.Join(folder, item.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Removes the item if it was not modified within the grace period
+func removeOldTempItem(itemPath string) error {
+	info, err := os.Stat(itemPath)
+	if os.IsNotExist(err) {
+		// Already removed by another process
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting file info for %s: %w", itemPath, err)
+	}
+	if time.Since(info.ModTime()) < DefaultGracePeriod {
+		return nil
+	}
+	err = os.RemoveAll(itemPath)
+	if err != nil {
+		return fmt.Errorf("error removing temporary item %s: %w", itemPath, err)
+	}
+	return nil
+}
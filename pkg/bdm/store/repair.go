@@ -0,0 +1,512 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+const quarantineSubFolder = "quarantine"
+
+// Types of issues found by RepairStore
+const (
+	IssueTempFile           = "temp_file"
+	IssueOrphanedSize       = "orphaned_size"
+	IssueMissingSize        = "missing_size"
+	IssueSizeMismatch       = "size_mismatch"
+	IssueHashMismatch       = "hash_mismatch"
+	IssueCorruptObject      = "corrupt_object"
+	IssueInvalidFolder      = "invalid_folder"
+	IssueInvalidManifest    = "invalid_manifest"
+	IssueIncompleteVersion  = "incomplete_version"
+	IssueIncompleteDeletion = "incomplete_deletion"
+	IssueMissingObject      = "missing_object"
+)
+
+// Actions taken by RepairStore for the issues
+const (
+	ActionNone            = "none"
+	ActionRemoved         = "removed"
+	ActionRestored        = "restored"
+	ActionQuarantined     = "quarantined"
+	ActionMarkedAsDeleted = "marked_as_deleted"
+)
+
+// RepairIssue describes a single problem found in a store and how it was handled
+type RepairIssue struct {
+	Type    string
+	Action  string
+	Message string
+	Path    string `json:",omitempty"`
+	Package string `json:",omitempty"`
+	Version uint   `json:",omitempty"`
+	Object  string `json:",omitempty"`
+}
+
+// RepairReport is the machine-readable result of RepairStore
+type RepairReport struct {
+	Started  int64
+	Finished int64
+	Packages int
+	Objects  int
+	Issues   []RepairIssue
+	// Package versions with broken or incomplete manifests that were marked as deleted
+	DeletedVersions []PrunedVersion `json:",omitempty"`
+}
+
+// RepairOptions control how RepairStore handles broken package versions
+type RepairOptions struct {
+	// Versions with broken manifests are always marked as deleted to never reuse their version numbers.
+	// Their manifests are moved into the quarantine by default, this option drops them instead.
+	MarkDeleted bool
+}
+
+type storeRepair struct {
+	report           RepairReport
+	options          RepairOptions
+	manifestsFolder  string
+	objectsFolder    string
+	quarantineFolder string
+	objects          map[string]bool
+}
+
+// RepairStore checks every manifest and object of a filesystem-based store and reports all issues.
+// Corrupt objects and broken manifests are moved into a quarantine folder inside the store.
+// Package versions with broken manifests are marked as deleted.
+// Missing size files are restored and leftover temporary files older than the grace period are removed.
+// The server should not run while the store is repaired.
+func RepairStore(storeFolder string) (*RepairReport, error) {
+	return RepairStoreWithOptions(storeFolder, RepairOptions{})
+}
+
+// RepairStoreWithOptions is RepairStore with additional options
+func RepairStoreWithOptions(storeFolder string, options RepairOptions) (*RepairReport, error) {
+	if !util.FolderExists(storeFolder) {
+		return nil, fmt.Errorf("store folder %s does not exist", storeFolder)
+	}
+
+	repair := storeRepair{
+		report: RepairReport{
+			Started: time.Now().Unix(),
+			Issues:  make([]RepairIssue, 0),
+		},
+		options:          options,
+		manifestsFolder:  path.Join(storeFolder, manifestsSubFolder),
+		objectsFolder:    path.Join(storeFolder, objectsSubFolder),
+		quarantineFolder: path.Join(storeFolder, quarantineSubFolder),
+		objects:          make(map[string]bool),
+	}
+
+	// Objects first, the manifests need to know which objects are still available
+	err := repair.checkObjects()
+	if err != nil {
+		return nil, fmt.Errorf("error checking objects: %w", err)
+	}
+
+	err = repair.checkManifests()
+	if err != nil {
+		return nil, fmt.Errorf("error checking manifests: %w", err)
+	}
+
+	// The index must reflect the manifests that were marked as deleted
+	err = RebuildIndex(storeFolder)
+	if err != nil {
+		return nil, fmt.Errorf("error rebuilding index: %w", err)
+	}
+
+	repair.report.Finished = time.Now().Unix()
+	return &repair.report, nil
+}
+
+func (r *storeRepair) addIssue(issue RepairIssue) {
+	r.report.Issues = append(r.report.Issues, issue)
+}
+
+// Moves a file or folder into the quarantine folder while keeping its relative path
+func (r *storeRepair) quarantine(itemPath, relativePath string) error {
+	target := path.Join(r.quarantineFolder, relativePath)
+	if util.FileExists(target) || util.FolderExists(target) {
+		target += "_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	err := os.MkdirAll(path.Dir(target), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("error creating quarantine folder: %w", err)
+	}
+	err = os.Rename(itemPath, target)
+	if err != nil {
+		return fmt.Errorf("error moving %s to quarantine: %w", itemPath, err)
+	}
+	return nil
+}
+
+func (r *storeRepair) checkObjects() error {
+	if !util.FolderExists(r.objectsFolder) {
+		return fmt.Errorf("objects folder %s does not exist", r.objectsFolder)
+	}
+
+	items, err := os.ReadDir(r.objectsFolder)
+	if err != nil {
+		return fmt.Errorf("error reading object store directory: %w", err)
+	}
+
+	for _, item := range items {
+		itemPath := path.Join(r.objectsFolder, item.Name())
+		if !item.IsDir() {
+			if strings.HasPrefix(item.Name(), tempPrefix) {
+				err = r.checkTempFile(itemPath)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		files, err := os.ReadDir(itemPath)
+		if err != nil {
+			return fmt.Errorf("error reading object store subdirectory %s: %w", itemPath, err)
+		}
+		for _, file := range files {
+			if !file.Type().IsRegular() {
+				continue
+			}
+			filePath := path.Join(itemPath, file.Name())
+			if !util.FileExists(filePath) {
+				// Size file was already moved into quarantine together with its object
+				continue
+			}
+			if strings.HasSuffix(file.Name(), sizeSuffix) {
+				if !util.FileExists(strings.TrimSuffix(filePath, sizeSuffix)) {
+					err = os.Remove(filePath)
+					if err != nil {
+						return fmt.Errorf("error removing size file %s: %w", filePath, err)
+					}
+					r.addIssue(RepairIssue{
+						Type:    IssueOrphanedSize,
+						Action:  ActionRemoved,
+						Message: "found size file without object",
+						Path:    filePath,
+					})
+				}
+				continue
+			}
+			err = r.checkObject(item.Name()+file.Name(), filePath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *storeRepair) checkTempFile(filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return fmt.Errorf("error getting file info for %s: %w", filePath, err)
+	}
+
+	// Recent temporary files might belong to an upload that is still in progress
+	if time.Since(info.ModTime()) < DefaultGracePeriod {
+		r.addIssue(RepairIssue{
+			Type:    IssueTempFile,
+			Action:  ActionNone,
+			Message: "found recent temporary file",
+			Path:    filePath,
+		})
+		return nil
+	}
+
+	err = os.RemoveAll(filePath)
+	if err != nil {
+		return fmt.Errorf("error removing temporary file %s: %w", filePath, err)
+	}
+	r.addIssue(RepairIssue{
+		Type:    IssueTempFile,
+		Action:  ActionRemoved,
+		Message: "found leftover temporary file",
+		Path:    filePath,
+	})
+	return nil
+}
+
+// Decodes and hashes the object data in the specified format
+func hashObjectFile(filePath string, format ObjectFormat) (string, int64, error) {
+	fileHandle, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, fmt.Errorf("error opening object file: %w", err)
+	}
+
+	reader, err := decodeObjectData(fileHandle, format)
+	if err != nil {
+		return "", 0, err
+	}
+	defer reader.Close()
+
+	hasher := util.CreateHasher()
+	size, err := io.Copy(hasher, reader)
+	if err != nil {
+		return "", 0, fmt.Errorf("error decompressing object data: %w", err)
+	}
+
+	return util.GetHashString(hasher), size, nil
+}
+
+func (r *storeRepair) checkObject(hash, filePath string) error {
+	r.report.Objects++
+
+	quarantineObject := func(issueType, message string) error {
+		relativePath := path.Join(objectsSubFolder, getObjectPath(hash))
+		err := r.quarantine(filePath, relativePath)
+		if err != nil {
+			return err
+		}
+		if util.FileExists(filePath + sizeSuffix) {
+			err = r.quarantine(filePath+sizeSuffix, relativePath+sizeSuffix)
+			if err != nil {
+				return err
+			}
+		}
+		r.addIssue(RepairIssue{
+			Type:    issueType,
+			Action:  ActionQuarantined,
+			Message: message,
+			Path:    filePath,
+			Object:  hash,
+		})
+		return nil
+	}
+
+	// The size file might be damaged, so the other format is tried if the recorded one does not work.
+	// Problems are reported for the recorded format, which is ZSTD if the size file is invalid.
+	sizePath := filePath + sizeSuffix
+	size, recordedFormat, infoErr := readObjectInfo(sizePath)
+	otherFormat := FormatRaw
+	if recordedFormat == FormatRaw {
+		otherFormat = FormatZstd
+	}
+	format := recordedFormat
+	actualHash, actualSize, err := hashObjectFile(filePath, format)
+	if err != nil || actualHash != hash {
+		otherHash, otherSize, otherErr := hashObjectFile(filePath, otherFormat)
+		if otherErr == nil && otherHash == hash {
+			format, actualHash, actualSize, err = otherFormat, otherHash, otherSize, nil
+		}
+	}
+	if err != nil {
+		return quarantineObject(IssueCorruptObject, err.Error())
+	}
+	if actualHash != hash {
+		return quarantineObject(IssueHashMismatch,
+			fmt.Sprintf("found hash %s but expected %s", actualHash, hash))
+	}
+
+	// The object data is valid, restore the size file if required
+	issue := RepairIssue{Action: ActionRestored, Path: sizePath, Object: hash}
+	if !util.FileExists(sizePath) {
+		issue.Type = IssueMissingSize
+		issue.Message = "found object without size file"
+	} else if infoErr != nil || size != actualSize || format != recordedFormat {
+		issue.Type = IssueSizeMismatch
+		issue.Message = fmt.Sprintf("found invalid size file for object with %d bytes", actualSize)
+	}
+	if len(issue.Type) > 0 {
+		err = writeObjectInfo(sizePath, r.objectsFolder, actualSize, format)
+		if err != nil {
+			return err
+		}
+		r.addIssue(issue)
+	}
+
+	r.objects[hash] = true
+	return nil
+}
+
+func (r *storeRepair) checkManifests() error {
+	if !util.FolderExists(r.manifestsFolder) {
+		return fmt.Errorf("manifests folder %s does not exist", r.manifestsFolder)
+	}
+
+	packages, err := os.ReadDir(r.manifestsFolder)
+	if err != nil {
+		return fmt.Errorf("error reading manifest store directory: %w", err)
+	}
+
+	for _, packageItem := range packages {
+		if !packageItem.IsDir() {
+			continue
+		}
+		packageFolder := path.Join(r.manifestsFolder, packageItem.Name())
+		versions, err := os.ReadDir(packageFolder)
+		if err != nil {
+			return fmt.Errorf("error reading package directory %s: %w", packageFolder, err)
+		}
+		for _, versionItem := range versions {
+			if strings.HasPrefix(versionItem.Name(), tempPrefix) {
+				err = r.checkTempFile(path.Join(packageFolder, versionItem.Name()))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if !versionItem.IsDir() {
+				continue
+			}
+			err = r.checkVersionFolder(packageItem.Name(), versionItem.Name())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *storeRepair) checkVersionFolder(packageName, folderName string) error {
+	versionFolder := path.Join(r.manifestsFolder, packageName, folderName)
+	relativePath := path.Join(manifestsSubFolder, packageName, folderName)
+
+	version, err := strconv.Atoi(folderName)
+	if err != nil || version <= 0 {
+		err = r.quarantine(versionFolder, relativePath)
+		if err != nil {
+			return err
+		}
+		r.addIssue(RepairIssue{
+			Type:    IssueInvalidFolder,
+			Action:  ActionQuarantined,
+			Message: "found version folder name that is not a valid version number",
+			Path:    versionFolder,
+			Package: packageName,
+		})
+		return nil
+	}
+
+	items, err := os.ReadDir(versionFolder)
+	if err != nil {
+		return fmt.Errorf("error reading version directory %s: %w", versionFolder, err)
+	}
+	for _, item := range items {
+		if strings.HasPrefix(item.Name(), tempPrefix) {
+			err = r.checkTempFile(path.Join(versionFolder, item.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	manifestPath := path.Join(versionFolder, manifestFileName)
+	if util.FileExists(path.Join(versionFolder, deletedFileName)) {
+		// The deletion was interrupted before all files were removed
+		if util.FileExists(manifestPath) || util.FileExists(path.Join(versionFolder, yankedFileName)) {
+			err = removeVersionFiles(versionFolder)
+			if err != nil {
+				return err
+			}
+			r.addIssue(RepairIssue{
+				Type:    IssueIncompleteDeletion,
+				Action:  ActionRemoved,
+				Message: "found files of a deleted version",
+				Path:    versionFolder,
+				Package: packageName,
+				Version: uint(version),
+			})
+		}
+		return nil
+	}
+
+	// Interrupted writes of older versions might have left the manifest missing or empty.
+	// Such versions are always marked as deleted to never reuse their version numbers.
+	issueType := IssueInvalidManifest
+	info, err := os.Stat(manifestPath)
+	if err != nil || info.Size() == 0 {
+		issueType = IssueIncompleteVersion
+	}
+
+	manifest, err := readManifestFile(manifestPath)
+	if err == nil && (manifest.PackageName != packageName || manifest.PackageVersion != uint(version)) {
+		err = fmt.Errorf("manifest for package %s version %d is in the wrong folder",
+			manifest.PackageName, manifest.PackageVersion)
+	}
+	if err != nil {
+		message := err.Error()
+
+		// Keep the version folder with a deletion record to never reuse the version number.
+		// The broken manifest stays available in the quarantine unless it should be dropped.
+		if util.FileExists(manifestPath) && r.options.MarkDeleted {
+			err := os.Remove(manifestPath)
+			if err != nil {
+				return fmt.Errorf("error removing broken manifest %s: %w", manifestPath, err)
+			}
+		} else if util.FileExists(manifestPath) {
+			err := r.quarantine(manifestPath, path.Join(relativePath, manifestFileName))
+			if err != nil {
+				return err
+			}
+		}
+		yankedPath := path.Join(versionFolder, yankedFileName)
+		if util.FileExists(yankedPath) {
+			os.Remove(yankedPath)
+		}
+		err := writeVersionRecord(path.Join(versionFolder, deletedFileName))
+		if err != nil {
+			return fmt.Errorf("error marking version as deleted: %w", err)
+		}
+		r.addIssue(RepairIssue{
+			Type:    issueType,
+			Action:  ActionMarkedAsDeleted,
+			Message: message,
+			Path:    versionFolder,
+			Package: packageName,
+			Version: uint(version),
+		})
+		r.report.DeletedVersions = append(r.report.DeletedVersions, PrunedVersion{packageName, uint(version)})
+		return nil
+	}
+
+	r.report.Packages++
+	for _, file := range manifest.Files {
+		for _, object := range bdm.GetFileObjects(&file) {
+			if !r.objects[object.Hash] {
+				r.addIssue(RepairIssue{
+					Type:    IssueMissingObject,
+					Action:  ActionNone,
+					Message: fmt.Sprintf("object for file %s is missing", file.Path),
+					Package: packageName,
+					Version: uint(version),
+					Object:  object.Hash,
+				})
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reads and validates a published manifest from a JSON file
+func readManifestFile(manifestPath string) (*bdm.Manifest, error) {
+	jsonData, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest file: %w", err)
+	}
+
+	var manifest bdm.Manifest
+	err = json.Unmarshal(jsonData, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling manifest JSON: %w", err)
+	}
+
+	err = bdm.ValidatePublishedManifest(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error validating manifest: %w", err)
+	}
+
+	return &manifest, nil
+}
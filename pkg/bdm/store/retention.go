@@ -0,0 +1,143 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// RetentionRule decides which versions of the matching packages are kept.
+// A version is kept if it fulfills at least one of the conditions.
+type RetentionRule struct {
+	// Glob pattern for package names, like "ci-*"
+	Pattern string
+	// Keep this number of the newest versions
+	KeepLast uint `json:",omitempty"`
+	// Keep versions published within this number of days
+	KeepDays uint `json:",omitempty"`
+	// Always keep these versions
+	KeepVersions []uint `json:",omitempty"`
+}
+
+// RetentionPolicy is a list of rules, only the first rule matching a package name is used.
+// Packages without a matching rule are never pruned.
+type RetentionPolicy struct {
+	Rules []RetentionRule
+}
+
+// PrunedVersion identifies a package version that was removed by the retention policy
+type PrunedVersion struct {
+	PackageName    string
+	PackageVersion uint
+}
+
+// ReadRetentionPolicy reads and validates a JSON retention policy file
+func ReadRetentionPolicy(policyFile string) (*RetentionPolicy, error) {
+	jsonData, err := os.ReadFile(policyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading retention policy file %s: %w", policyFile, err)
+	}
+
+	var policy RetentionPolicy
+	err = json.Unmarshal(jsonData, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling retention policy JSON: %w", err)
+	}
+
+	err = policy.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+// Validate checks that all rules have a valid pattern and keep at least some versions
+func (policy *RetentionPolicy) Validate() error {
+	for i, rule := range policy.Rules {
+		_, err := path.Match(rule.Pattern, "")
+		if len(rule.Pattern) == 0 || err != nil {
+			return fmt.Errorf("found invalid pattern '%s' in retention rule %d", rule.Pattern, i+1)
+		}
+		if rule.KeepLast == 0 && rule.KeepDays == 0 {
+			return fmt.Errorf("retention rule %d for pattern '%s' needs KeepLast or KeepDays",
+				i+1, rule.Pattern)
+		}
+	}
+	return nil
+}
+
+func (policy *RetentionPolicy) findRule(packageName string) *RetentionRule {
+	for i, rule := range policy.Rules {
+		if matched, _ := path.Match(rule.Pattern, packageName); matched {
+			return &policy.Rules[i]
+		}
+	}
+	return nil
+}
+
+// ApplyRetentionPolicy deletes all package versions that are not kept by the policy.
+// In dry run mode, nothing is deleted and only the versions that would be pruned are returned.
+// The objects of pruned versions are only removed by the next garbage collection.
+func ApplyRetentionPolicy(store Store, policy *RetentionPolicy, dryRun bool) ([]PrunedVersion, error) {
+	names, err := store.GetNames()
+	if err != nil {
+		return nil, fmt.Errorf("error getting package names: %w", err)
+	}
+
+	pruned := make([]PrunedVersion, 0)
+	for _, name := range names {
+		rule := policy.findRule(name)
+		if rule == nil {
+			continue
+		}
+
+		versions, err := store.GetVersions(name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting versions of package %s: %w", name, err)
+		}
+
+		keepVersions := make(map[uint]bool)
+		for _, version := range rule.KeepVersions {
+			keepVersions[version] = true
+		}
+		// Versions referenced by current tags are always kept, removed tags do not count
+		tags, err := store.GetTags(name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting tags of package %s: %w", name, err)
+		}
+		for _, tag := range tags {
+			if tag.Version != 0 {
+				keepVersions[tag.Version] = true
+			}
+		}
+		publishedAfter := time.Now().AddDate(0, 0, -int(rule.KeepDays)).Unix()
+
+		// Versions are sorted in ascending order
+		for i, version := range versions {
+			if keepVersions[version] || uint(len(versions)-i) <= rule.KeepLast {
+				continue
+			}
+			if rule.KeepDays > 0 {
+				manifest, err := store.GetManifest(name, version)
+				if err != nil {
+					return nil, fmt.Errorf("error getting package %s version %d: %w", name, version, err)
+				}
+				if manifest.Published >= publishedAfter {
+					continue
+				}
+			}
+			if !dryRun {
+				err = store.DeleteManifest(name, version)
+				if err != nil {
+					return nil, fmt.Errorf("error deleting package %s version %d: %w", name, version, err)
+				}
+			}
+			pruned = append(pruned, PrunedVersion{name, version})
+		}
+	}
+
+	return pruned, nil
+}
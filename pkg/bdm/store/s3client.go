@@ -0,0 +1,315 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Payload hash value used for all requests to avoid hashing large object uploads twice
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Returned by the S3 client when a key does not exist in the bucket
+var errS3NotFound = errors.New("key not found in bucket")
+
+// Minimal client for S3-compatible APIs that signs requests with AWS signature version 4
+// and uses path-style addressing for the bucket.
+type s3Client struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	http      *http.Client
+}
+
+type s3ListResult struct {
+	Keys           []string
+	CommonPrefixes []string
+}
+
+// Returns the URI-encoded path for a key, slashes are kept as separators
+func (c *s3Client) getPath(key string) string {
+	path := "/" + s3Encode(c.bucket, false)
+	if len(key) > 0 {
+		path += "/" + s3Encode(key, true)
+	}
+	return path
+}
+
+func (c *s3Client) newRequest(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	rawURL := c.endpoint + c.getPath(key)
+	if len(query) > 0 {
+		rawURL += "?" + s3CanonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s request for URL %s: %w", method, rawURL, err)
+	}
+	return req, nil
+}
+
+// Adds the AWS signature version 4 headers to a request
+func (c *s3Client) sign(req *http.Request, key string, query url.Values) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", s3UnsignedPayload)
+
+	// Collect all headers that need to be signed
+	signed := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		c.getPath(key),
+		s3CanonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	scope := shortDate + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	signingKey := s3HMAC([]byte("AWS4"+c.secretKey), shortDate)
+	signingKey = s3HMAC(signingKey, c.region)
+	signingKey = s3HMAC(signingKey, "s3")
+	signingKey = s3HMAC(signingKey, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func (c *s3Client) do(method, key string, query url.Values, body io.Reader, size int64, headers http.Header) (*http.Response, error) {
+	req, err := c.newRequest(method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for name, values := range headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	c.sign(req, key, query)
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending %s request for key %s: %w", method, key, err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, fmt.Errorf("error sending %s request for key %s: %w", method, key, errS3NotFound)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, fmt.Errorf("error sending %s request for key %s: server returned status code %d: %s",
+			method, key, res.StatusCode, message)
+	}
+
+	return res, nil
+}
+
+func (c *s3Client) putObject(key string, body io.Reader, size int64, metadata map[string]string) error {
+	headers := make(http.Header)
+	for name, value := range metadata {
+		headers.Set("x-amz-meta-"+name, value)
+	}
+	res, err := c.do("PUT", key, nil, body, size, headers)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Copies an object onto itself to refresh its modification time
+func (c *s3Client) touchObject(key string, metadata map[string]string) error {
+	headers := make(http.Header)
+	headers.Set("x-amz-copy-source", c.getPath(key))
+	headers.Set("x-amz-metadata-directive", "REPLACE")
+	for name, value := range metadata {
+		headers.Set("x-amz-meta-"+name, value)
+	}
+	res, err := c.do("PUT", key, nil, nil, 0, headers)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Returns the response with the object data as body, the caller must close it
+func (c *s3Client) getObject(key string) (*http.Response, error) {
+	return c.do("GET", key, nil, nil, 0, nil)
+}
+
+// Returns the response with a range of the object data as body, a negative length reads until the end
+func (c *s3Client) getObjectRange(key string, offset, length int64) (io.ReadCloser, error) {
+	headers := make(http.Header)
+	if length < 0 {
+		headers.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else {
+		headers.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+	res, err := c.do("GET", key, nil, nil, 0, headers)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, fmt.Errorf("error reading range of key %s: server returned status code %d", key, res.StatusCode)
+	}
+	return res.Body, nil
+}
+
+func (c *s3Client) headObject(key string) (http.Header, error) {
+	res, err := c.do("HEAD", key, nil, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res.Header, nil
+}
+
+func (c *s3Client) deleteObject(key string) error {
+	res, err := c.do("DELETE", key, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Lists all keys with the specified prefix.
+// Keys are grouped into common prefixes if the delimiter is not empty.
+func (c *s3Client) listObjects(prefix, delimiter string) (*s3ListResult, error) {
+	type listBucketResult struct {
+		IsTruncated           bool
+		NextContinuationToken string
+		Contents              []struct{ Key string }
+		CommonPrefixes        []struct{ Prefix string }
+	}
+
+	result := s3ListResult{
+		Keys:           make([]string, 0),
+		CommonPrefixes: make([]string, 0),
+	}
+
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if len(delimiter) > 0 {
+			query.Set("delimiter", delimiter)
+		}
+		if len(continuationToken) > 0 {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		res, err := c.do("GET", "", query, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		xmlData, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading list response: %w", err)
+		}
+
+		var page listBucketResult
+		err = xml.Unmarshal(xmlData, &page)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling list response XML: %w", err)
+		}
+		for _, content := range page.Contents {
+			result.Keys = append(result.Keys, content.Key)
+		}
+		for _, commonPrefix := range page.CommonPrefixes {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix.Prefix)
+		}
+
+		if !page.IsTruncated || len(page.NextContinuationToken) == 0 {
+			break
+		}
+		continuationToken = page.NextContinuationToken
+	}
+
+	return &result, nil
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// URI-encodes a string as required by AWS signature version 4
+func s3Encode(value string, keepSlash bool) string {
+	var builder strings.Builder
+	for _, b := range []byte(value) {
+		unreserved := (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~'
+		if unreserved || (keepSlash && b == '/') {
+			builder.WriteByte(b)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0)
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3Encode(name, false)+"="+s3Encode(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
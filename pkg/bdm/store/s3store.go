@@ -0,0 +1,731 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+// S3Config describes the location and credentials of an S3-compatible bucket
+type S3Config struct {
+	// Endpoint URL of the S3 API without trailing slash, like https://s3.eu-central-1.amazonaws.com
+	Endpoint string
+	// Region of the bucket, like eu-central-1
+	Region string
+	// Name of the bucket
+	Bucket string
+	// Optional prefix for all keys, allows sharing a bucket
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Folder for temporary files while adding objects, system default if empty
+	TempFolder string
+}
+
+// Name of the object metadata field that holds the uncompressed object size
+const s3SizeMetadata = "size"
+
+// Name of the object metadata field that holds the object format, objects without it are ZSTD objects
+const s3FormatMetadata = "format"
+
+type s3Store struct {
+	client         s3Client
+	prefix         string
+	tempFolder     string
+	options        Options
+	objectsMutex   sync.Mutex
+	manifestsMutex sync.RWMutex
+}
+
+// NewS3 creates a new package store that keeps all data in an S3-compatible bucket
+func NewS3(config S3Config) (Store, error) {
+	return NewS3WithOptions(config, Options{})
+}
+
+// NewS3WithOptions creates a new S3 package store with specific options
+func NewS3WithOptions(config S3Config, options Options) (Store, error) {
+	if len(config.Endpoint) == 0 || len(config.Bucket) == 0 {
+		return nil, fmt.Errorf("S3 endpoint and bucket are required")
+	}
+	if len(config.Region) == 0 {
+		config.Region = "us-east-1"
+	}
+	if len(config.Prefix) > 0 && !strings.HasSuffix(config.Prefix, "/") {
+		config.Prefix += "/"
+	}
+	if len(config.TempFolder) > 0 && !util.FolderExists(config.TempFolder) {
+		return nil, fmt.Errorf("temporary folder %s does not exist", config.TempFolder)
+	}
+
+	store := s3Store{
+		client: s3Client{
+			endpoint:  strings.TrimSuffix(config.Endpoint, "/"),
+			region:    config.Region,
+			bucket:    config.Bucket,
+			accessKey: config.AccessKey,
+			secretKey: config.SecretKey,
+			http:      &http.Client{},
+		},
+		prefix:     config.Prefix,
+		tempFolder: config.TempFolder,
+		options:    options,
+	}
+
+	// Check bucket access early to report configuration issues on startup
+	_, err := store.client.listObjects(store.prefix+manifestsSubFolder+"/", "/")
+	if err != nil {
+		return nil, fmt.Errorf("error accessing bucket %s: %w", config.Bucket, err)
+	}
+
+	return &store, nil
+}
+
+// S3 stores keep no open resources
+func (s *s3Store) Close() error {
+	return nil
+}
+
+func (s *s3Store) getObjectKey(hash string) string {
+	return s.prefix + objectsSubFolder + "/" + getObjectPath(hash)
+}
+
+func (s *s3Store) getVersionPrefix(packageName string, version uint) string {
+	return s.prefix + manifestsSubFolder + "/" + packageName + "/" + strconv.FormatUint(uint64(version), 10) + "/"
+}
+
+// Returns the uncompressed size and the format of an object from its metadata headers
+func parseObjectInfo(headers http.Header) (int64, ObjectFormat, error) {
+	size, err := strconv.ParseInt(headers.Get("x-amz-meta-"+s3SizeMetadata), 10, 64)
+	if err != nil {
+		return 0, FormatZstd, fmt.Errorf("error parsing object size: %w", err)
+	}
+
+	format := FormatZstd
+	if formatString := headers.Get("x-amz-meta-" + s3FormatMetadata); len(formatString) > 0 {
+		value, err := strconv.ParseUint(formatString, 10, 8)
+		if err != nil || (ObjectFormat(value) != FormatZstd && ObjectFormat(value) != FormatRaw) {
+			return 0, FormatZstd, fmt.Errorf("found invalid object format %s", formatString)
+		}
+		format = ObjectFormat(value)
+	}
+
+	return size, format, nil
+}
+
+func (s *s3Store) GetObject(hash string) (*bdm.Object, error) {
+	key := s.getObjectKey(hash)
+	headers, err := s.client.headObject(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find object %s: %w", key, err)
+	}
+
+	size, _, err := parseObjectInfo(headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bdm.Object{
+		Hash: hash,
+		Size: size,
+	}, nil
+}
+
+// Creates the metadata headers with the uncompressed size and the format of an object
+func createObjectMetadata(size int64, format ObjectFormat) map[string]string {
+	metadata := map[string]string{s3SizeMetadata: strconv.FormatInt(size, 10)}
+	if format != FormatZstd {
+		metadata[s3FormatMetadata] = strconv.Itoa(int(format))
+	}
+	return metadata
+}
+
+func (s *s3Store) AddObject(reader io.Reader) (*bdm.Object, error) {
+	// Objects are compressed into a temporary file first,
+	// since hash and compressed size are only known at the end.
+	tempFile, err := os.CreateTemp(s.tempFolder, "bdm_s3_*")
+	if err != nil {
+		return nil, fmt.Errorf("error opening temporary object file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	fileSize, hash, format, err := writeObjectData(reader, tempFile, s.options.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	key := s.getObjectKey(hash)
+	metadata := createObjectMetadata(fileSize, format)
+
+	s.objectsMutex.Lock()
+	defer s.objectsMutex.Unlock()
+
+	object, _ := s.GetObject(hash)
+	if object != nil {
+		// Object exists already in bucket, no upload required!
+		// Refresh the modification time to protect the object
+		// from a concurrently running garbage collection.
+		err = s.client.touchObject(key, metadata)
+		if err != nil {
+			return nil, fmt.Errorf("error refreshing existing object %s: %w", key, err)
+		}
+	} else {
+		compressedSize, err := tempFile.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, fmt.Errorf("error getting compressed object size: %w", err)
+		}
+		_, err = tempFile.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, fmt.Errorf("error rewinding temporary object file: %w", err)
+		}
+		err = s.client.putObject(key, tempFile, compressedSize, metadata)
+		if err != nil {
+			return nil, fmt.Errorf("error uploading object %s: %w", key, err)
+		}
+	}
+
+	return &bdm.Object{
+		Hash: hash,
+		Size: fileSize,
+	}, nil
+}
+
+func (s *s3Store) ReadObject(hash string) (io.ReadCloser, error) {
+	stored, err := s.ReadStoredObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	return decodeObjectData(stored, stored.Format)
+}
+
+func (s *s3Store) ReadObjectAt(hash string, offset int64) (io.ReadCloser, error) {
+	key := s.getObjectKey(hash)
+	headers, err := s.client.headObject(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find object %s: %w", key, err)
+	}
+	_, format, err := parseObjectInfo(headers)
+	if err != nil {
+		return nil, err
+	}
+	storedSize, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing stored size of object %s: %w", key, err)
+	}
+
+	return readObjectDataAt(format, storedSize, offset, func(offset, length int64) (io.ReadCloser, error) {
+		return s.client.getObjectRange(key, offset, length)
+	})
+}
+
+func (s *s3Store) ReadStoredObject(hash string) (*StoredObject, error) {
+	res, err := s.client.getObject(s.getObjectKey(hash))
+	if err != nil {
+		return nil, fmt.Errorf("error reading object: %w", err)
+	}
+	_, format, err := parseObjectInfo(res.Header)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	if res.ContentLength < 0 {
+		res.Body.Close()
+		return nil, fmt.Errorf("error reading object %s: unknown size", hash)
+	}
+	return &StoredObject{res.Body, res.ContentLength, format}, nil
+}
+
+// Uses only the headers of the object, the data is not downloaded
+func (s *s3Store) GetStoredObjectInfo(hash string) (*StoredObjectInfo, error) {
+	key := s.getObjectKey(hash)
+	headers, err := s.client.headObject(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find object %s: %w", key, err)
+	}
+	_, format, err := parseObjectInfo(headers)
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error reading object %s: unknown size", hash)
+	}
+	return &StoredObjectInfo{size, format}, nil
+}
+
+func (s *s3Store) GetObjects() ([]*bdm.Object, error) {
+	list, err := s.client.listObjects(s.prefix+objectsSubFolder+"/", "")
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects in bucket: %w", err)
+	}
+
+	objects := make([]*bdm.Object, 0)
+	for _, key := range list.Keys {
+		objectPath := strings.TrimPrefix(key, s.prefix+objectsSubFolder+"/")
+		hash := strings.ReplaceAll(objectPath, "/", "")
+		object, err := s.GetObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("error getting object %s: %w", hash, err)
+		}
+		objects = append(objects, object)
+	}
+
+	return objects, nil
+}
+
+func (s *s3Store) RefreshObject(hash string) error {
+	s.objectsMutex.Lock()
+	defer s.objectsMutex.Unlock()
+
+	key := s.getObjectKey(hash)
+	headers, err := s.client.headObject(key)
+	if err != nil {
+		return fmt.Errorf("unable to find object %s: %w", key, err)
+	}
+	size, format, err := parseObjectInfo(headers)
+	if err != nil {
+		return err
+	}
+
+	// Copying the object onto itself updates the modification time
+	err = s.client.touchObject(key, createObjectMetadata(size, format))
+	if err != nil {
+		return fmt.Errorf("error refreshing object %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (s *s3Store) RemoveObject(hash string, addedBefore time.Time) (bool, error) {
+	s.objectsMutex.Lock()
+	defer s.objectsMutex.Unlock()
+
+	key := s.getObjectKey(hash)
+	headers, err := s.client.headObject(key)
+	if err != nil {
+		return false, fmt.Errorf("unable to find object %s: %w", key, err)
+	}
+
+	modified, err := http.ParseTime(headers.Get("Last-Modified"))
+	if err != nil {
+		return false, fmt.Errorf("error parsing modification time of object %s: %w", key, err)
+	}
+	if !modified.Before(addedBefore) {
+		// Object is too young and might be needed by an upload in progress
+		return false, nil
+	}
+
+	err = s.client.deleteObject(key)
+	if err != nil {
+		return false, fmt.Errorf("error deleting object %s: %w", key, err)
+	}
+
+	return true, nil
+}
+
+// Call this method only if you have already locked the manifestsMutex exclusively!
+func (s *s3Store) addManifestLocked(manifest *bdm.Manifest) error {
+	err := bdm.ValidatePublishedManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("error validating published manifest: %w", err)
+	}
+
+	versions, err := s.getAllVersions(manifest.PackageName)
+	if err != nil {
+		return fmt.Errorf("error getting existing versions for package %s: %w",
+			manifest.PackageName, err)
+	}
+	if _, found := versions[manifest.PackageVersion]; found {
+		return fmt.Errorf("manifest with package name %s and version %d already exists",
+			manifest.PackageName, manifest.PackageVersion)
+	}
+
+	jsonData, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("error marshalling manifest to JSON: %w", err)
+	}
+
+	key := s.getVersionPrefix(manifest.PackageName, manifest.PackageVersion) + manifestFileName
+	err = s.client.putObject(key, strings.NewReader(string(jsonData)), int64(len(jsonData)), nil)
+	if err != nil {
+		return fmt.Errorf("error uploading manifest %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (s *s3Store) AddManifest(manifest *bdm.Manifest) error {
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	return s.addManifestLocked(manifest)
+}
+
+func (s *s3Store) PublishManifest(manifest *bdm.Manifest) error {
+	err := bdm.ValidateUnpublishedManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("error validating unpublished manifest: %w", err)
+	}
+
+	err = searchDuplicate(s, manifest)
+	if err != nil {
+		return fmt.Errorf("error searching for duplicate package: %w", err)
+	}
+
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	// Deleted versions must be included to never reuse their version numbers
+	var newVersion uint = 1
+	existingVersions, err := s.getAllVersions(manifest.PackageName)
+	if err != nil {
+		return fmt.Errorf("error getting existing versions for package %s: %w",
+			manifest.PackageName, err)
+	}
+	for version := range existingVersions {
+		if version >= newVersion {
+			newVersion = version + 1
+		}
+	}
+	err = assignVersion(manifest, newVersion, s.options.SigningKey)
+	if err != nil {
+		return err
+	}
+
+	err = bdm.ValidatePublishedManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("error validating published manifest: %w", err)
+	}
+
+	return s.addManifestLocked(manifest)
+}
+
+func (s *s3Store) GetManifest(packageName string, version uint) (*bdm.Manifest, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	key := s.getVersionPrefix(packageName, version) + manifestFileName
+	res, err := s.client.getObject(key)
+	if errors.Is(err, errS3NotFound) {
+		return nil, fmt.Errorf("package %s in version %d does not exist", packageName, version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest for package %s in version %d: %w",
+			packageName, version, err)
+	}
+	defer res.Body.Close()
+
+	jsonData, err := io.ReadAll(io.LimitReader(res.Body, bdm.JsonSizeLimit))
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest for package %s in version %d: %w",
+			packageName, version, err)
+	}
+
+	var manifest bdm.Manifest
+	err = json.Unmarshal(jsonData, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling manifest JSON: %w", err)
+	}
+
+	return &manifest, nil
+}
+
+func (s *s3Store) GetNames() ([]string, error) {
+	packagesPrefix := s.prefix + manifestsSubFolder + "/"
+	list, err := s.client.listObjects(packagesPrefix, "/")
+	if err != nil {
+		return nil, fmt.Errorf("error listing manifests in bucket: %w", err)
+	}
+
+	names := make([]string, 0)
+	for _, commonPrefix := range list.CommonPrefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(commonPrefix, packagesPrefix), "/")
+		versions, err := s.GetVersions(name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting versions of package %s: %w", name, err)
+		}
+		if len(versions) == 0 {
+			// All versions of this package were deleted
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// State of a single package version derived from the keys in the bucket
+type s3VersionState struct {
+	manifest bool
+	deleted  bool
+	yanked   bool
+}
+
+// Returns the state of all versions of a package, including the deleted versions
+func (s *s3Store) getAllVersions(packageName string) (map[uint]*s3VersionState, error) {
+	packagePrefix := s.prefix + manifestsSubFolder + "/" + packageName + "/"
+	list, err := s.client.listObjects(packagePrefix, "")
+	if err != nil {
+		return nil, fmt.Errorf("error listing manifests of package %s: %w", packageName, err)
+	}
+
+	versions := make(map[uint]*s3VersionState)
+	for _, key := range list.Keys {
+		parts := strings.Split(strings.TrimPrefix(key, packagePrefix), "/")
+		if len(parts) != 2 {
+			continue
+		}
+		number, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing version number from key %s: %w", key, err)
+		}
+		version := uint(number)
+		if versions[version] == nil {
+			versions[version] = &s3VersionState{}
+		}
+		switch parts[1] {
+		case manifestFileName:
+			versions[version].manifest = true
+		case deletedFileName:
+			versions[version].deleted = true
+		case yankedFileName:
+			versions[version].yanked = true
+		}
+	}
+
+	return versions, nil
+}
+
+func (s *s3Store) GetVersions(packageName string) ([]uint, error) {
+	allVersions, err := s.getAllVersions(packageName)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]uint, 0)
+	for version, state := range allVersions {
+		if state.manifest && !state.deleted {
+			versions = append(versions, version)
+		}
+	}
+	sortVersions(versions)
+
+	return versions, nil
+}
+
+func (s *s3Store) GetVersionInfos(packageName string) ([]VersionInfo, error) {
+	allVersions, err := s.getAllVersions(packageName)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]VersionInfo, 0)
+	for version, state := range allVersions {
+		if state.manifest && !state.deleted {
+			infos = append(infos, VersionInfo{Version: version, Yanked: state.yanked})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Version < infos[j].Version
+	})
+
+	return infos, nil
+}
+
+// S3 stores have no index, so all manifests of the package are read
+func (s *s3Store) GetVersionMetadata(packageName string) ([]VersionMetadata, error) {
+	versions, err := s.GetVersions(packageName)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make([]VersionMetadata, 0)
+	for _, version := range versions {
+		manifest, err := s.GetManifest(packageName, version)
+		if err != nil {
+			return nil, fmt.Errorf("error getting manifest for package %s version %d: %w", packageName, version, err)
+		}
+		metadata = append(metadata, VersionMetadata{
+			Version:        version,
+			Labels:         manifest.Labels,
+			Publisher:      manifest.Publisher,
+			PublisherToken: manifest.PublisherToken,
+		})
+	}
+	return metadata, nil
+}
+
+func (s *s3Store) putVersionRecord(key string) error {
+	record := versionRecord{Time: time.Now().Unix()}
+	jsonData, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error marshalling record to JSON: %w", err)
+	}
+	return s.client.putObject(key, strings.NewReader(string(jsonData)), int64(len(jsonData)), nil)
+}
+
+func (s *s3Store) getVersionState(packageName string, version uint) (*s3VersionState, error) {
+	versions, err := s.getAllVersions(packageName)
+	if err != nil {
+		return nil, err
+	}
+	state := versions[version]
+	if state == nil || !state.manifest || state.deleted {
+		return nil, fmt.Errorf("package %s in version %d does not exist", packageName, version)
+	}
+	return state, nil
+}
+
+func (s *s3Store) DeleteManifest(packageName string, version uint) error {
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	state, err := s.getVersionState(packageName, version)
+	if err != nil {
+		return err
+	}
+
+	// The record of the deletion stays to make sure the version number is never reused
+	versionPrefix := s.getVersionPrefix(packageName, version)
+	err = s.putVersionRecord(versionPrefix + deletedFileName)
+	if err != nil {
+		return fmt.Errorf("error recording deletion: %w", err)
+	}
+
+	err = s.client.deleteObject(versionPrefix + manifestFileName)
+	if err != nil {
+		return fmt.Errorf("error deleting manifest: %w", err)
+	}
+
+	if state.yanked {
+		err = s.client.deleteObject(versionPrefix + yankedFileName)
+		if err != nil {
+			return fmt.Errorf("error deleting yanked record: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *s3Store) YankManifest(packageName string, version uint, yanked bool) error {
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	state, err := s.getVersionState(packageName, version)
+	if err != nil {
+		return err
+	}
+
+	key := s.getVersionPrefix(packageName, version) + yankedFileName
+	if yanked && !state.yanked {
+		err = s.putVersionRecord(key)
+		if err != nil {
+			return fmt.Errorf("error recording yank: %w", err)
+		}
+	} else if !yanked && state.yanked {
+		err = s.client.deleteObject(key)
+		if err != nil {
+			return fmt.Errorf("error deleting yanked record: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *s3Store) IsYanked(packageName string, version uint) (bool, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	state, err := s.getVersionState(packageName, version)
+	if err != nil {
+		return false, err
+	}
+
+	return state.yanked, nil
+}
+
+func (s *s3Store) IsDeleted(packageName string, version uint) (bool, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	versions, err := s.getAllVersions(packageName)
+	if err != nil {
+		return false, err
+	}
+	state := versions[version]
+
+	return state != nil && state.deleted, nil
+}
+
+func (s *s3Store) getTagsKey(packageName string) string {
+	return s.prefix + manifestsSubFolder + "/" + packageName + "/" + tagsFileName
+}
+
+// Call this method only if you have already locked the manifestsMutex!
+func (s *s3Store) getTagsLocked(packageName string) ([]Tag, error) {
+	key := s.getTagsKey(packageName)
+	res, err := s.client.getObject(key)
+	if errors.Is(err, errS3NotFound) {
+		return unmarshalTags(nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading tags %s: %w", key, err)
+	}
+	defer res.Body.Close()
+
+	jsonData, err := io.ReadAll(io.LimitReader(res.Body, bdm.JsonSizeLimit))
+	if err != nil {
+		return nil, fmt.Errorf("error reading tags %s: %w", key, err)
+	}
+	return unmarshalTags(jsonData)
+}
+
+func (s *s3Store) SetTag(packageName, tagName string, version uint, user string) error {
+	s.manifestsMutex.Lock()
+	defer s.manifestsMutex.Unlock()
+
+	if version > 0 {
+		_, err := s.getVersionState(packageName, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	tags, err := s.getTagsLocked(packageName)
+	if err != nil {
+		return err
+	}
+	tags, err = changeTag(tags, tagName, version, user)
+	if err != nil {
+		return err
+	}
+	jsonData, err := json.Marshal(tags)
+	if err != nil {
+		return fmt.Errorf("error marshalling tags to JSON: %w", err)
+	}
+	key := s.getTagsKey(packageName)
+	err = s.client.putObject(key, strings.NewReader(string(jsonData)), int64(len(jsonData)), nil)
+	if err != nil {
+		return fmt.Errorf("error uploading tags %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (s *s3Store) GetTags(packageName string) ([]Tag, error) {
+	s.manifestsMutex.RLock()
+	defer s.manifestsMutex.RUnlock()
+
+	return s.getTagsLocked(packageName)
+}
@@ -0,0 +1,287 @@
+package store
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+type fakeS3Object struct {
+	data     []byte
+	metadata http.Header
+	modified time.Time
+}
+
+// Minimal in-process fake of the S3 API for a single bucket
+type fakeS3 struct {
+	bucket   string
+	objects  map[string]*fakeS3Object
+	mutex    sync.Mutex
+	pageSize int
+}
+
+func (f *fakeS3) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") ||
+		len(req.Header.Get("x-amz-date")) == 0 {
+		http.Error(writer, "Missing signature", http.StatusForbidden)
+		return
+	}
+
+	bucketPath := "/" + f.bucket
+	if req.URL.Path == bucketPath && req.Method == "GET" {
+		f.list(writer, req)
+		return
+	}
+
+	key := strings.TrimPrefix(req.URL.Path, bucketPath+"/")
+	switch req.Method {
+	case "PUT":
+		object := &fakeS3Object{metadata: make(http.Header), modified: time.Now()}
+		if source := req.Header.Get("x-amz-copy-source"); len(source) > 0 {
+			existing := f.objects[strings.TrimPrefix(source, bucketPath+"/")]
+			if existing == nil {
+				http.Error(writer, "Source not found", http.StatusNotFound)
+				return
+			}
+			object.data = existing.data
+		} else {
+			object.data, _ = io.ReadAll(req.Body)
+		}
+		for name, values := range req.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+				object.metadata[name] = values
+			}
+		}
+		f.objects[key] = object
+	case "GET", "HEAD":
+		object := f.objects[key]
+		if object == nil {
+			http.Error(writer, "Not found", http.StatusNotFound)
+			return
+		}
+		for name, values := range object.metadata {
+			writer.Header()[name] = values
+		}
+		if req.Method == "GET" {
+			// Handles range requests as well
+			http.ServeContent(writer, req, "", object.modified, bytes.NewReader(object.data))
+			return
+		}
+		writer.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+		writer.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+	case "DELETE":
+		delete(f.objects, key)
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(writer, "Bad method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(writer http.ResponseWriter, req *http.Request) {
+	type content struct{ Key string }
+	type commonPrefix struct{ Prefix string }
+	type listBucketResult struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		IsTruncated           bool
+		NextContinuationToken string
+		Contents              []content
+		CommonPrefixes        []commonPrefix
+	}
+
+	query := req.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+
+	// Collect sorted keys and common prefixes
+	entries := make([]string, 0)
+	seenPrefixes := make(map[string]bool)
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, prefix)
+		if index := strings.Index(rest, delimiter); len(delimiter) > 0 && index >= 0 {
+			commonPrefix := prefix + rest[:index+1]
+			if !seenPrefixes[commonPrefix] {
+				seenPrefixes[commonPrefix] = true
+				entries = append(entries, commonPrefix)
+			}
+		} else {
+			entries = append(entries, key)
+		}
+	}
+	sort.Strings(entries)
+
+	var result listBucketResult
+	end := start + f.pageSize
+	if end < len(entries) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	} else {
+		end = len(entries)
+	}
+	for _, entry := range entries[start:end] {
+		if seenPrefixes[entry] {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: entry})
+		} else {
+			result.Contents = append(result.Contents, content{Key: entry})
+		}
+	}
+
+	xmlData, _ := xml.Marshal(result)
+	writer.Header().Set("Content-Type", "application/xml")
+	writer.Write(xmlData)
+}
+
+func createFakeS3Store(t *testing.T) (Store, *fakeS3, func()) {
+	fake := &fakeS3{
+		bucket:   "bucket",
+		objects:  make(map[string]*fakeS3Object),
+		pageSize: 3,
+	}
+	server := httptest.NewServer(fake)
+	store, err := NewS3(S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "bucket",
+		Prefix:    "bdm",
+		AccessKey: "key",
+		SecretKey: "secret",
+	})
+	util.AssertNoError(t, err)
+	return store, fake, server.Close
+}
+
+func TestS3Store(t *testing.T) {
+	store, fake, stop := createFakeS3Store(t)
+	defer stop()
+
+	// Empty bucket
+	names, err := store.GetNames()
+	util.AssertNoError(t, err)
+	util.Assert(t, len(names) == 0)
+
+	// Add objects and check that they are stored compressed with the prefix
+	objectData := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 100)
+	object, err := store.AddObject(bytes.NewReader(objectData))
+	util.AssertNoError(t, err)
+	util.Assert(t, object.Size == int64(len(objectData)))
+	stored := fake.objects["bdm/objects/"+getObjectPath(object.Hash)]
+	util.Assert(t, stored != nil)
+	util.Assert(t, !bytes.Equal(stored.data, objectData))
+
+	// Adding the same object again works
+	again, err := store.AddObject(bytes.NewReader(objectData))
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(object, again))
+
+	found, err := store.GetObject(object.Hash)
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(object, found))
+	_, err = store.GetObject("abcdef")
+	util.AssertError(t, err)
+
+	reader, err := store.ReadObject(object.Hash)
+	util.AssertNoError(t, err)
+	readData, err := io.ReadAll(reader)
+	util.AssertNoError(t, err)
+	reader.Close()
+	util.Assert(t, bytes.Equal(readData, objectData))
+
+	// Stored data is returned as it is
+	storedObject, err := store.ReadStoredObject(object.Hash)
+	util.AssertNoError(t, err)
+	storedData, err := io.ReadAll(storedObject)
+	util.AssertNoError(t, err)
+	storedObject.Close()
+	util.Assert(t, storedObject.Size == int64(len(stored.data)))
+	util.Assert(t, bytes.Equal(storedData, stored.data))
+	info, err := store.GetStoredObjectInfo(object.Hash)
+	util.AssertNoError(t, err)
+	util.Assert(t, info.Size == int64(len(stored.data)) && info.Format == FormatZstd)
+
+	// Reading at an offset only requests the required range of the stored frames
+	bigData := bytes.Repeat([]byte("frames"), objectFrameSize/2)
+	bigObject, err := store.AddObject(bytes.NewReader(bigData))
+	util.AssertNoError(t, err)
+	reader, err = store.ReadObjectAt(bigObject.Hash, objectFrameSize+3)
+	util.AssertNoError(t, err)
+	readData, err = io.ReadAll(reader)
+	util.AssertNoError(t, err)
+	reader.Close()
+	util.Assert(t, bytes.Equal(readData, bigData[objectFrameSize+3:]))
+
+	// Publish enough versions to require multiple list pages
+	for i := 0; i < 4; i++ {
+		fileObject, err := store.AddObject(bytes.NewReader([]byte{byte(i)}))
+		util.AssertNoError(t, err)
+		manifest := bdm.Manifest{
+			ManifestVersion: 1,
+			PackageName:     "foo",
+			Files:           []bdm.File{{Path: "file", Object: *fileObject}},
+		}
+		manifest.Hash = bdm.HashManifest(&manifest)
+		err = store.PublishManifest(&manifest)
+		util.AssertNoError(t, err)
+		util.Assert(t, manifest.PackageVersion == uint(i+1))
+
+		readManifest, err := store.GetManifest("foo", manifest.PackageVersion)
+		util.AssertNoError(t, err)
+		util.Assert(t, reflect.DeepEqual(*readManifest, manifest))
+
+		// Publishing the same content again is rejected
+		duplicate := manifest
+		duplicate.PackageVersion = 0
+		duplicate.Published = 0
+		duplicate.Hash = bdm.HashManifest(&duplicate)
+		err = store.PublishManifest(&duplicate)
+		util.AssertError(t, err)
+	}
+
+	names, err = store.GetNames()
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(names, []string{"foo"}))
+	versions, err := store.GetVersions("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(versions, []uint{1, 2, 3, 4}))
+
+	// Yank and delete versions
+	util.AssertNoError(t, store.YankManifest("foo", 2, true))
+	yanked, err := store.IsYanked("foo", 2)
+	util.AssertNoError(t, err)
+	util.Assert(t, yanked)
+	util.AssertNoError(t, store.DeleteManifest("foo", 4))
+	_, err = store.GetManifest("foo", 4)
+	util.AssertError(t, err)
+	versions, err = store.GetVersions("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(versions, []uint{1, 2, 3}))
+
+	// Store validation must succeed
+	stats, err := ValidateStore(store)
+	util.AssertNoError(t, err)
+	util.Assert(t, stats["packages"] == 3)
+	util.Assert(t, stats["objects"] == 6)
+
+	// Garbage collection removes the unreferenced objects
+	stats, err = CollectGarbage(store, -time.Hour)
+	util.AssertNoError(t, err)
+	util.Assert(t, stats["removed"] == 3)
+	_, err = store.GetObject(object.Hash)
+	util.AssertError(t, err)
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+)
+
+// PackageStats contains the size figures of a single package
+type PackageStats struct {
+	Name     string
+	Versions int
+	// Sum of the file sizes of all versions
+	LogicalSize int64
+	// Size of all objects that are only referenced by this package
+	UniqueSize int64
+}
+
+// StoreStats contains size and deduplication figures of the whole store
+type StoreStats struct {
+	// Unix time of the calculation
+	Created  int64
+	Packages []PackageStats
+	Versions int
+	Objects  int
+	// Sum of the file sizes of all versions of all packages
+	LogicalSize int64
+	// Sum of the uncompressed sizes of all objects
+	ObjectsSize int64
+	// Sum of the sizes of all objects as they are stored
+	CompressedSize int64
+	// Number of objects stored without compression
+	RawObjects int
+	// Logical size divided by the objects size, zero for empty stores
+	DedupRatio float64
+}
+
+// GetStoreStats calculates statistics for all packages and objects in the store.
+// It reads all manifests and the stored size of each object, which can take a while for big stores.
+func GetStoreStats(store Store) (*StoreStats, error) {
+	stats := StoreStats{
+		Created:  time.Now().Unix(),
+		Packages: make([]PackageStats, 0),
+	}
+
+	manifests, err := getAllManifests(store)
+	if err != nil {
+		return nil, fmt.Errorf("error listing all manifests: %w", err)
+	}
+
+	// Collect the packages referencing each object
+	packages := make(map[string]*PackageStats)
+	objectPackages := make(map[string]map[string]bool)
+	objectSizes := make(map[string]int64)
+	for _, manifest := range manifests {
+		packageStats, found := packages[manifest.PackageName]
+		if !found {
+			packageStats = &PackageStats{Name: manifest.PackageName}
+			packages[manifest.PackageName] = packageStats
+		}
+		packageStats.Versions++
+		stats.Versions++
+		for _, file := range manifest.Files {
+			packageStats.LogicalSize += file.Object.Size
+			for _, object := range bdm.GetFileObjects(&file) {
+				if objectPackages[object.Hash] == nil {
+					objectPackages[object.Hash] = make(map[string]bool)
+				}
+				objectPackages[object.Hash][manifest.PackageName] = true
+				objectSizes[object.Hash] = object.Size
+			}
+		}
+	}
+	for hash, names := range objectPackages {
+		if len(names) == 1 {
+			for name := range names {
+				packages[name].UniqueSize += objectSizes[hash]
+			}
+		}
+	}
+	for _, packageStats := range packages {
+		stats.LogicalSize += packageStats.LogicalSize
+		stats.Packages = append(stats.Packages, *packageStats)
+	}
+	sort.Slice(stats.Packages, func(i, j int) bool {
+		return stats.Packages[i].Name < stats.Packages[j].Name
+	})
+
+	// Include objects that are not referenced by any package, since they also occupy space
+	objects, err := store.GetObjects()
+	if err != nil {
+		return nil, fmt.Errorf("error getting objects list from store: %w", err)
+	}
+	var remaining map[string]bool
+	for _, object := range objects {
+		stored, err := store.GetStoredObjectInfo(object.Hash)
+		if err != nil {
+			// Objects might have been removed by a concurrent garbage collection
+			if remaining == nil {
+				var listErr error
+				remaining, listErr = getObjectHashes(store)
+				if listErr != nil {
+					return nil, listErr
+				}
+			}
+			if !remaining[object.Hash] {
+				continue
+			}
+			return nil, fmt.Errorf("error getting stored size of object %s: %w", object.Hash, err)
+		}
+		stats.Objects++
+		stats.ObjectsSize += object.Size
+		stats.CompressedSize += stored.Size
+		if stored.Format == FormatRaw {
+			stats.RawObjects++
+		}
+	}
+
+	if stats.ObjectsSize > 0 {
+		stats.DedupRatio = float64(stats.LogicalSize) / float64(stats.ObjectsSize)
+	}
+
+	return &stats, nil
+}
+
+// Returns the hashes of all objects that currently exist in the store
+func getObjectHashes(store Store) (map[string]bool, error) {
+	objects, err := store.GetObjects()
+	if err != nil {
+		return nil, fmt.Errorf("error getting objects list from store: %w", err)
+	}
+	hashes := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		hashes[object.Hash] = true
+	}
+	return hashes, nil
+}
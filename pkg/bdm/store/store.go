@@ -1,11 +1,15 @@
 package store
 
 import (
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/cry-inc/bdm/pkg/bdm"
 	"github.com/cry-inc/bdm/pkg/bdm/util"
@@ -15,18 +19,47 @@ import (
 // with content already existing in an earlier version of the same package.
 type DuplicatePackageError struct{ error }
 
+// VersionInfo describes a package version that was not deleted
+type VersionInfo struct {
+	Version uint
+	Yanked  bool `json:",omitempty"`
+}
+
+// VersionMetadata contains the metadata of a package version that can be used for filtering
+type VersionMetadata struct {
+	Version        uint
+	Labels         map[string]string
+	Publisher      string
+	PublisherToken string
+}
+
 // Store represents a persitent store for package data
 type Store interface {
 	PublishManifest(manifest *bdm.Manifest) error
 	AddManifest(manifest *bdm.Manifest) error
 	GetNames() ([]string, error)
 	GetVersions(packageName string) ([]uint, error)
+	GetVersionInfos(packageName string) ([]VersionInfo, error)
+	GetVersionMetadata(packageName string) ([]VersionMetadata, error)
 	GetManifest(packageName string, version uint) (*bdm.Manifest, error)
+	DeleteManifest(packageName string, version uint) error
+	YankManifest(packageName string, version uint, yanked bool) error
+	IsYanked(packageName string, version uint) (bool, error)
+	IsDeleted(packageName string, version uint) (bool, error)
+	SetTag(packageName, tagName string, version uint, user string) error
+	GetTags(packageName string) ([]Tag, error)
 
 	GetObject(hash string) (*bdm.Object, error)
 	AddObject(reader io.Reader) (*bdm.Object, error)
+	RefreshObject(hash string) error
 	ReadObject(hash string) (io.ReadCloser, error)
+	ReadObjectAt(hash string, offset int64) (io.ReadCloser, error)
+	ReadStoredObject(hash string) (*StoredObject, error)
+	GetStoredObjectInfo(hash string) (*StoredObjectInfo, error)
 	GetObjects() ([]*bdm.Object, error)
+	RemoveObject(hash string, addedBefore time.Time) (bool, error)
+
+	Close() error
 }
 
 type packageStore struct {
@@ -34,6 +67,8 @@ type packageStore struct {
 	objectsFolder   string
 	objectsMutex    sync.Mutex
 	manifestsMutex  sync.RWMutex
+	index           manifestIndex
+	options         Options
 }
 
 const manifestsSubFolder = "manifests"
@@ -41,6 +76,11 @@ const objectsSubFolder = "objects"
 
 // New creates a new persistent filesystem-based package store
 func New(storeFolder string) (Store, error) {
+	return NewWithOptions(storeFolder, Options{})
+}
+
+// NewWithOptions creates a new persistent filesystem-based package store with specific options
+func NewWithOptions(storeFolder string, options Options) (Store, error) {
 	if !util.FolderExists(storeFolder) {
 		err := os.MkdirAll(storeFolder, os.ModePerm)
 		if err != nil {
@@ -49,7 +89,7 @@ func New(storeFolder string) (Store, error) {
 		}
 	}
 
-	var store packageStore
+	store := packageStore{options: options}
 	store.manifestsFolder = path.Join(storeFolder, manifestsSubFolder)
 	if !util.FolderExists(store.manifestsFolder) {
 		err := os.Mkdir(store.manifestsFolder, os.ModePerm)
@@ -58,6 +98,8 @@ func New(storeFolder string) (Store, error) {
 				store.manifestsFolder, err)
 		}
 	}
+	store.index.indexPath = path.Join(storeFolder, indexFileName)
+	store.index.manifestsFolder = store.manifestsFolder
 	store.objectsFolder = path.Join(storeFolder, objectsSubFolder)
 	if !util.FolderExists(store.objectsFolder) {
 		err := os.Mkdir(store.objectsFolder, os.ModePerm)
@@ -67,20 +109,120 @@ func New(storeFolder string) (Store, error) {
 		}
 	}
 
+	err := store.recoverWrites()
+	if err != nil {
+		return nil, fmt.Errorf("error recovering interrupted writes in store %s: %w", storeFolder, err)
+	}
+
 	return &store, nil
 }
 
+// The index database is only opened for single operations, so there is nothing to release
+func (s *packageStore) Close() error {
+	return nil
+}
+
 // AllObjectsExist can verify that all objects from the manifest exist in the store
 func AllObjectsExist(manifest *bdm.Manifest, store Store) bool {
 	for _, f := range manifest.Files {
-		_, err := store.GetObject(f.Object.Hash)
-		if err != nil {
-			return false
+		for _, object := range bdm.GetFileObjects(&f) {
+			_, err := store.GetObject(object.Hash)
+			if err != nil {
+				return false
+			}
 		}
 	}
 	return true
 }
 
+// Reads the objects of a file one after another
+type fileReader struct {
+	store   Store
+	objects []bdm.Object
+	current io.ReadCloser
+	offset  int64
+}
+
+func (r *fileReader) Read(data []byte) (int, error) {
+	for {
+		if r.current == nil {
+			// Skip all chunks before the offset
+			for len(r.objects) > 0 && r.offset >= r.objects[0].Size && r.offset > 0 {
+				r.offset -= r.objects[0].Size
+				r.objects = r.objects[1:]
+			}
+			if len(r.objects) == 0 {
+				return 0, io.EOF
+			}
+			var reader io.ReadCloser
+			var err error
+			if r.offset > 0 {
+				reader, err = r.store.ReadObjectAt(r.objects[0].Hash, r.offset)
+				r.offset = 0
+			} else {
+				reader, err = r.store.ReadObject(r.objects[0].Hash)
+			}
+			if err != nil {
+				return 0, fmt.Errorf("error reading object %s: %w", r.objects[0].Hash, err)
+			}
+			r.current = reader
+			r.objects = r.objects[1:]
+		}
+		read, err := r.current.Read(data)
+		if errors.Is(err, io.EOF) {
+			r.current.Close()
+			r.current = nil
+			if read == 0 {
+				continue
+			}
+			err = nil
+		}
+		return read, err
+	}
+}
+
+func (r *fileReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// ReadFile returns a reader for the complete content of a package file.
+// The data of chunked files is combined from all of their chunk objects.
+func ReadFile(store Store, file *bdm.File) io.ReadCloser {
+	return &fileReader{store: store, objects: bdm.GetFileObjects(file)}
+}
+
+// ReadFileAt returns a reader for the content of a package file starting at the offset.
+// Only the chunk containing the offset and the following chunks are read.
+func ReadFileAt(store Store, file *bdm.File, offset int64) io.ReadCloser {
+	return &fileReader{store: store, objects: bdm.GetFileObjects(file), offset: offset}
+}
+
+// Assigns the version number and the publishing date to a manifest.
+// Manifests without publisher signature are signed afterwards if there is a signing key.
+func assignVersion(manifest *bdm.Manifest, version uint, signingKey ed25519.PrivateKey) error {
+	// Manifests uploaded by older clients are upgraded
+	manifest.ManifestVersion = bdm.LatestManifestVersion
+	manifest.PackageVersion = version
+	manifest.Published = time.Now().Unix()
+	if manifest.Signature == nil && signingKey != nil {
+		err := bdm.SignPublishedManifest(manifest, signingKey)
+		if err != nil {
+			return fmt.Errorf("error signing manifest: %w", err)
+		}
+	}
+	manifest.Hash = bdm.HashManifest(manifest)
+	return nil
+}
+
+func sortVersions(versions []uint) {
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] < versions[j]
+	})
+}
+
 func getAllManifests(store Store) ([]*bdm.Manifest, error) {
 	manifests := make([]*bdm.Manifest, 0)
 	names, err := store.GetNames()
@@ -95,6 +237,11 @@ func getAllManifests(store Store) ([]*bdm.Manifest, error) {
 		for _, version := range versions {
 			manifest, err := store.GetManifest(name, version)
 			if err != nil {
+				// Skip versions that were deleted by another request in the meantime
+				deleted, deletedErr := store.IsDeleted(name, version)
+				if deletedErr == nil && deleted {
+					continue
+				}
 				return nil, fmt.Errorf("error getting manifest %s version %d: %w",
 					name, version, err)
 			}
@@ -104,89 +251,26 @@ func getAllManifests(store Store) ([]*bdm.Manifest, error) {
 	return manifests, nil
 }
 
-func checkObject(store Store, object *bdm.Object) error {
-	reader, err := store.ReadObject(object.Hash)
-	if err != nil {
-		return fmt.Errorf("error reading object %s: %w", object.Hash, err)
-	}
-	defer reader.Close()
-
-	hasher := util.CreateHasher()
-	read, err := io.Copy(hasher, reader)
-	if err != nil {
-		return fmt.Errorf("error hashing object %s: %w", object.Hash, err)
-	}
-	if read != object.Size {
-		return fmt.Errorf("found size mismatch for object %s: expected %d but read %d bytes",
-			object.Hash, object.Size, read)
-	}
-
-	hash := util.GetHashString(hasher)
-	if hash != object.Hash {
-		return fmt.Errorf("found hash mismatch for object %s: expected %s but found %s",
-			object.Hash, object.Hash, hash)
-	}
-
-	return nil
-}
-
-// ValidateStore validates the whole package store.
-// It will validate all manifests,
-// check that all the objects of all manifests exist and
-// check that all objects are valid and produce the correct hash.
-// It also returns a map with some simple store statistics.
-func ValidateStore(store Store) (map[string]int64, error) {
-	manifests, err := getAllManifests(store)
+func searchDuplicate(store Store, manifest *bdm.Manifest) error {
+	existingVersions, err := store.GetVersions(manifest.PackageName)
 	if err != nil {
-		return nil, fmt.Errorf("error listing all manifests: %w", err)
+		return fmt.Errorf("error getting versions for package %s: %w",
+			manifest.PackageName, err)
 	}
-
-	// Validate all manifests
-	for _, manifest := range manifests {
-		err = bdm.ValidatePublishedManifest(manifest)
+	fingerprint := getFingerprint(manifest)
+	for _, version := range existingVersions {
+		existingManifest, err := store.GetManifest(manifest.PackageName, version)
 		if err != nil {
-			return nil, fmt.Errorf("error validating published manifest %s version %d: %w",
-				manifest.PackageName, manifest.PackageVersion, err)
-		}
-	}
-
-	// Get all object metadata
-	objects, err := store.GetObjects()
-	if err != nil {
-		return nil, fmt.Errorf("error getting objects list from store: %w", err)
-	}
-
-	// Build map[hash]object for fast lookup
-	// and use the loop to also sum up overall size
-	objectsMap := make(map[string]*bdm.Object)
-	var objectsSize int64 = 0
-	for _, object := range objects {
-		objectsMap[object.Hash] = object
-		objectsSize += object.Size
-	}
-
-	// Check if all objects for all manifests exist
-	for _, manifest := range manifests {
-		for _, file := range manifest.Files {
-			if _, ok := objectsMap[file.Object.Hash]; !ok {
-				return nil, fmt.Errorf("unable to find object %s from package %s version %d",
-					file.Object.Hash, manifest.PackageName, manifest.PackageVersion)
-			}
+			return fmt.Errorf("error getting manifest for package %s version %d: %w",
+				manifest.PackageName, version, err)
 		}
-	}
-
-	// Check all object data for consistency
-	for _, object := range objects {
-		err = checkObject(store, object)
-		if err != nil {
-			return nil, fmt.Errorf("found problem while checking object: %w", err)
+		// Fingerprints cover the content independent of the file order
+		if getFingerprint(existingManifest) == fingerprint {
+			err := fmt.Errorf("found identical older version %d for package %s",
+				version, manifest.PackageName)
+			return DuplicatePackageError{err}
 		}
 	}
 
-	stats := make(map[string]int64)
-	stats["packages"] = int64(len(manifests))
-	stats["objects"] = int64(len(objects))
-	stats["size"] = objectsSize
-
-	return stats, nil
+	return nil
 }
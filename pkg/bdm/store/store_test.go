@@ -3,10 +3,14 @@ package store
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"math/rand"
 	"os"
+	"path"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/cry-inc/bdm/pkg/bdm"
 	"github.com/cry-inc/bdm/pkg/bdm/util"
@@ -18,6 +22,7 @@ func TestStore(t *testing.T) {
 	defer os.RemoveAll(storeFolder)
 	store, err := New(storeFolder)
 	util.AssertNoError(t, err)
+	defer store.Close()
 
 	// Get package names from empty store
 	names, err := store.GetNames()
@@ -158,6 +163,7 @@ func TestCacheStore(t *testing.T) {
 	defer os.RemoveAll(storeFolder)
 	store, err := New(storeFolder)
 	util.AssertNoError(t, err)
+	defer store.Close()
 
 	// Fake a published manifest
 	manifest := bdm.Manifest{
@@ -185,3 +191,811 @@ func TestCacheStore(t *testing.T) {
 	err = store.AddManifest(&manifest)
 	util.AssertNoError(t, err)
 }
+
+func TestCollectGarbage(t *testing.T) {
+	defer os.RemoveAll(storeFolder)
+	store, err := New(storeFolder)
+	util.AssertNoError(t, err)
+	defer store.Close()
+
+	// Add a referenced and an unreferenced object
+	referenced, err := store.AddObject(bytes.NewReader([]byte{1, 2, 3}))
+	util.AssertNoError(t, err)
+	orphan, err := store.AddObject(bytes.NewReader([]byte{4, 5, 6, 7}))
+	util.AssertNoError(t, err)
+
+	manifest := bdm.Manifest{
+		ManifestVersion: 1,
+		PackageName:     "foo",
+		Files:           []bdm.File{{Path: "file", Object: *referenced}},
+	}
+	manifest.Hash = bdm.HashManifest(&manifest)
+	err = store.PublishManifest(&manifest)
+	util.AssertNoError(t, err)
+
+	// The orphan is still within the grace period and must survive
+	stats, err := CollectGarbage(store, time.Hour)
+	util.AssertNoError(t, err)
+	util.Assert(t, stats["objects"] == 2)
+	util.Assert(t, stats["removed"] == 0)
+	util.Assert(t, stats["recent"] == 1)
+	_, err = store.GetObject(orphan.Hash)
+	util.AssertNoError(t, err)
+
+	// Refreshed objects get a new grace period, like objects found by upload checks
+	old := time.Now().Add(-2 * time.Hour)
+	orphanPath := path.Join(storeFolder, objectsSubFolder, getObjectPath(orphan.Hash))
+	util.AssertNoError(t, os.Chtimes(orphanPath, old, old))
+	util.AssertNoError(t, store.RefreshObject(orphan.Hash))
+	stats, err = CollectGarbage(store, time.Hour)
+	util.AssertNoError(t, err)
+	util.Assert(t, stats["removed"] == 0)
+
+	// Without grace period only the orphan is removed
+	stats, err = CollectGarbage(store, -time.Hour)
+	util.AssertNoError(t, err)
+	util.Assert(t, stats["removed"] == 1)
+	util.Assert(t, stats["freed"] == 4)
+	_, err = store.GetObject(orphan.Hash)
+	util.AssertError(t, err)
+	_, err = store.GetObject(referenced.Hash)
+	util.AssertNoError(t, err)
+
+	// Store must still be valid
+	_, err = ValidateStore(store)
+	util.AssertNoError(t, err)
+}
+
+func TestDeleteAndYank(t *testing.T) {
+	defer os.RemoveAll(storeFolder)
+	store, err := New(storeFolder)
+	util.AssertNoError(t, err)
+	defer store.Close()
+
+	// Publish two versions of the same package
+	publish := func(data []byte) *bdm.Manifest {
+		object, err := store.AddObject(bytes.NewReader(data))
+		util.AssertNoError(t, err)
+		manifest := bdm.Manifest{
+			ManifestVersion: 1,
+			PackageName:     "foo",
+			Files:           []bdm.File{{Path: "file", Object: *object}},
+		}
+		manifest.Hash = bdm.HashManifest(&manifest)
+		err = store.PublishManifest(&manifest)
+		util.AssertNoError(t, err)
+		return &manifest
+	}
+	publish([]byte{1})
+	publish([]byte{2})
+
+	// Yank version 1, it must stay readable
+	err = store.YankManifest("foo", 1, true)
+	util.AssertNoError(t, err)
+	yanked, err := store.IsYanked("foo", 1)
+	util.AssertNoError(t, err)
+	util.Assert(t, yanked)
+	_, err = store.GetManifest("foo", 1)
+	util.AssertNoError(t, err)
+
+	// Restore version 1
+	err = store.YankManifest("foo", 1, false)
+	util.AssertNoError(t, err)
+	yanked, err = store.IsYanked("foo", 1)
+	util.AssertNoError(t, err)
+	util.Assert(t, !yanked)
+
+	// Delete version 2, it must disappear
+	err = store.DeleteManifest("foo", 2)
+	util.AssertNoError(t, err)
+	_, err = store.GetManifest("foo", 2)
+	util.AssertError(t, err)
+	versions, err := store.GetVersions("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(versions, []uint{1}))
+
+	// Deleted versions cannot be deleted or yanked again
+	util.AssertError(t, store.DeleteManifest("foo", 2))
+	util.AssertError(t, store.YankManifest("foo", 2, true))
+
+	// The number of a deleted version is never reused
+	manifest := publish([]byte{3})
+	util.Assert(t, manifest.PackageVersion == 3)
+
+	// Deleting all versions removes the package from the list
+	util.AssertNoError(t, store.DeleteManifest("foo", 1))
+	util.AssertNoError(t, store.DeleteManifest("foo", 3))
+	names, err := store.GetNames()
+	util.AssertNoError(t, err)
+	util.Assert(t, len(names) == 0)
+	manifest = publish([]byte{4})
+	util.Assert(t, manifest.PackageVersion == 4)
+}
+
+func TestManifestIndex(t *testing.T) {
+	defer os.RemoveAll(storeFolder)
+	store, err := New(storeFolder)
+	util.AssertNoError(t, err)
+	defer store.Close()
+
+	publish := func(name string, data []byte) (*bdm.Manifest, error) {
+		object, err := store.AddObject(bytes.NewReader(data))
+		util.AssertNoError(t, err)
+		manifest := bdm.Manifest{
+			ManifestVersion: 1,
+			PackageName:     name,
+			Files:           []bdm.File{{Path: "file", Object: *object}},
+		}
+		manifest.Hash = bdm.HashManifest(&manifest)
+		return &manifest, store.PublishManifest(&manifest)
+	}
+	for i := 1; i <= 3; i++ {
+		_, err = publish("foo", []byte{byte(i)})
+		util.AssertNoError(t, err)
+	}
+	_, err = publish("bar", []byte{1})
+	util.AssertNoError(t, err)
+	util.AssertNoError(t, store.YankManifest("foo", 2, true))
+	util.AssertNoError(t, store.DeleteManifest("foo", 3))
+
+	// The index is rebuilt from the JSON files when it is missing
+	util.Assert(t, util.FileExists(storeFolder+"/"+indexFileName))
+	util.AssertNoError(t, store.Close())
+	util.AssertNoError(t, os.Remove(storeFolder+"/"+indexFileName))
+	store, err = New(storeFolder)
+	util.AssertNoError(t, err)
+	defer store.Close()
+	names, err := store.GetNames()
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(names, []string{"bar", "foo"}))
+	versions, err := store.GetVersions("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(versions, []uint{1, 2}))
+	yanked, err := store.IsYanked("foo", 2)
+	util.AssertNoError(t, err)
+	util.Assert(t, yanked)
+	_, err = store.IsYanked("foo", 3)
+	util.AssertError(t, err)
+
+	// Duplicates are found with the rebuilt index
+	_, err = publish("foo", []byte{2})
+	util.Assert(t, errors.As(err, &DuplicatePackageError{}))
+
+	// The content of a deleted version can be published again
+	manifest, err := publish("foo", []byte{3})
+	util.AssertNoError(t, err)
+	util.Assert(t, manifest.PackageVersion == 4)
+
+	// Identical content added with AddManifest keeps duplicate detection
+	// working after deleting one of the two versions
+	copied := *manifest
+	copied.PackageVersion = 5
+	copied.Hash = bdm.HashManifest(&copied)
+	util.AssertNoError(t, store.AddManifest(&copied))
+	util.AssertNoError(t, store.DeleteManifest("foo", 4))
+	_, err = publish("foo", []byte{3})
+	util.Assert(t, errors.As(err, &DuplicatePackageError{}))
+
+	// A second store instance can use the same folder while the first one is open
+	other, err := New(storeFolder)
+	util.AssertNoError(t, err)
+	names, err = other.GetNames()
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(names, []string{"bar", "foo"}))
+	util.AssertNoError(t, other.DeleteManifest("foo", 5))
+	versions, err = store.GetVersions("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(versions, []uint{1, 2}))
+	util.AssertNoError(t, other.Close())
+
+	// Manual changes in the manifests folder require an explicit rebuild
+	util.AssertNoError(t, os.RemoveAll(storeFolder+"/manifests/bar"))
+	names, err = store.GetNames()
+	util.AssertNoError(t, err)
+	util.Assert(t, len(names) == 2)
+	util.AssertNoError(t, store.Close())
+	util.AssertNoError(t, RebuildIndex(storeFolder))
+	names, err = store.GetNames()
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(names, []string{"foo"}))
+}
+
+func TestRepairStore(t *testing.T) {
+	defer os.RemoveAll(storeFolder)
+	store, err := New(storeFolder)
+	util.AssertNoError(t, err)
+	defer store.Close()
+
+	publish := func(name string, data []byte) *bdm.Object {
+		object, err := store.AddObject(bytes.NewReader(data))
+		util.AssertNoError(t, err)
+		manifest := bdm.Manifest{
+			ManifestVersion: 1,
+			PackageName:     name,
+			Files:           []bdm.File{{Path: "file", Object: *object}},
+		}
+		manifest.Hash = bdm.HashManifest(&manifest)
+		util.AssertNoError(t, store.PublishManifest(&manifest))
+		return object
+	}
+	objectA := publish("foo", bytes.Repeat([]byte{1}, 1000))
+	objectB := publish("foo", bytes.Repeat([]byte{2}, 1000))
+	objectC := publish("bar", bytes.Repeat([]byte{3}, 1000))
+	publish("baz", []byte{4})
+	objectPath := func(object *bdm.Object) string {
+		return storeFolder + "/objects/" + getObjectPath(object.Hash)
+	}
+
+	// Damage the store in all possible ways
+	util.AssertNoError(t, os.WriteFile(objectPath(objectA)+sizeSuffix, util.Int64ToBytes(666), os.ModePerm))
+	util.AssertNoError(t, os.WriteFile(objectPath(objectB), []byte{1, 2, 3}, os.ModePerm))
+	util.AssertNoError(t, os.Remove(objectPath(objectC)+sizeSuffix))
+	util.AssertNoError(t, os.MkdirAll(storeFolder+"/objects/ff", os.ModePerm))
+	util.AssertNoError(t, os.WriteFile(storeFolder+"/objects/ff/ff"+sizeSuffix, []byte{}, os.ModePerm))
+	util.AssertNoError(t, os.WriteFile(storeFolder+"/objects/tmp_old", []byte{}, os.ModePerm))
+	old := time.Now().Add(-2 * DefaultGracePeriod)
+	util.AssertNoError(t, os.Chtimes(storeFolder+"/objects/tmp_old", old, old))
+	util.AssertNoError(t, os.WriteFile(storeFolder+"/objects/tmp_new", []byte{}, os.ModePerm))
+	util.AssertNoError(t, os.MkdirAll(storeFolder+"/manifests/foo/abc", os.ModePerm))
+	util.AssertNoError(t, os.WriteFile(storeFolder+"/manifests/baz/1/manifest.json", []byte("{"), os.ModePerm))
+
+	util.AssertNoError(t, store.Close())
+	report, err := RepairStore(storeFolder)
+	util.AssertNoError(t, err)
+	util.Assert(t, report.Objects == 4)
+	util.Assert(t, report.Packages == 3)
+
+	issues := make(map[string]RepairIssue)
+	for _, issue := range report.Issues {
+		key := issue.Type + "/" + issue.Action
+		_, exists := issues[key]
+		util.Assert(t, !exists)
+		issues[key] = issue
+	}
+	util.Assert(t, len(issues) == 9)
+	util.Assert(t, issues[IssueSizeMismatch+"/"+ActionRestored].Object == objectA.Hash)
+	util.Assert(t, issues[IssueCorruptObject+"/"+ActionQuarantined].Object == objectB.Hash)
+	util.Assert(t, issues[IssueMissingObject+"/"+ActionNone].Object == objectB.Hash)
+	util.Assert(t, issues[IssueMissingObject+"/"+ActionNone].Version == 2)
+	util.Assert(t, issues[IssueMissingSize+"/"+ActionRestored].Object == objectC.Hash)
+	util.Assert(t, len(issues[IssueOrphanedSize+"/"+ActionRemoved].Path) > 0)
+	util.Assert(t, len(issues[IssueTempFile+"/"+ActionRemoved].Path) > 0)
+	util.Assert(t, len(issues[IssueTempFile+"/"+ActionNone].Path) > 0)
+	util.Assert(t, issues[IssueInvalidFolder+"/"+ActionQuarantined].Package == "foo")
+	util.Assert(t, issues[IssueInvalidManifest+"/"+ActionMarkedAsDeleted].Package == "baz")
+	util.Assert(t, reflect.DeepEqual(report.DeletedVersions, []PrunedVersion{{"baz", 1}}))
+
+	// Repaired objects are usable again and corrupt data is in quarantine
+	object, err := store.GetObject(objectA.Hash)
+	util.AssertNoError(t, err)
+	util.Assert(t, object.Size == 1000)
+	_, err = store.GetObject(objectC.Hash)
+	util.AssertNoError(t, err)
+	_, err = store.GetObject(objectB.Hash)
+	util.AssertError(t, err)
+	util.Assert(t, util.FileExists(storeFolder+"/quarantine/objects/"+getObjectPath(objectB.Hash)))
+	util.Assert(t, util.FolderExists(storeFolder+"/quarantine/manifests/foo/abc"))
+	util.Assert(t, util.FileExists(storeFolder+"/quarantine/manifests/baz/1/manifest.json"))
+
+	// The broken version is marked as deleted and its number is never reused
+	names, err := store.GetNames()
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(names, []string{"bar", "foo"}))
+	deleted, err := store.IsDeleted("baz", 1)
+	util.AssertNoError(t, err)
+	util.Assert(t, deleted)
+	publish("baz", []byte{4})
+	versions, err := store.GetVersions("baz")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(versions, []uint{2}))
+
+	// Broken manifests can be dropped instead of keeping them in the quarantine
+	util.AssertNoError(t, os.WriteFile(storeFolder+"/manifests/baz/2/manifest.json", []byte("{"), os.ModePerm))
+	util.AssertNoError(t, store.Close())
+	report, err = RepairStoreWithOptions(storeFolder, RepairOptions{MarkDeleted: true})
+	util.AssertNoError(t, err)
+	util.Assert(t, len(report.Issues) == 3)
+	util.Assert(t, reflect.DeepEqual(report.DeletedVersions, []PrunedVersion{{"baz", 2}}))
+	util.Assert(t, !util.FileExists(storeFolder+"/quarantine/manifests/baz/2/manifest.json"))
+	publish("baz", []byte{4})
+	versions, err = store.GetVersions("baz")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(versions, []uint{3}))
+
+	// A second run finds only the remaining problems
+	util.AssertNoError(t, store.Close())
+	report, err = RepairStore(storeFolder)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(report.Issues) == 2)
+}
+
+func TestRecoverInterruptedWrites(t *testing.T) {
+	defer os.RemoveAll(storeFolder)
+	store, err := New(storeFolder)
+	util.AssertNoError(t, err)
+	defer store.Close()
+
+	object, err := store.AddObject(bytes.NewReader(bytes.Repeat([]byte{1, 2, 3}, 1000)))
+	util.AssertNoError(t, err)
+	for i := 0; i < 2; i++ {
+		manifest := bdm.Manifest{ManifestVersion: 1, PackageName: "foo", Files: []bdm.File{
+			{Path: fmt.Sprintf("file%d", i), Object: *object},
+		}}
+		manifest.Hash = bdm.HashManifest(&manifest)
+		util.AssertNoError(t, store.PublishManifest(&manifest))
+	}
+
+	// Simulate crashes in the middle of different writes
+	objectPath := storeFolder + "/objects/" + getObjectPath(object.Hash)
+	util.AssertNoError(t, os.Remove(objectPath+sizeSuffix))
+	old := time.Now().Add(-2 * DefaultGracePeriod)
+	orphanedSize := storeFolder + "/objects/" + getObjectPath("abcdef") + sizeSuffix
+	util.AssertNoError(t, os.MkdirAll(storeFolder+"/objects/ab", os.ModePerm))
+	util.AssertNoError(t, os.WriteFile(orphanedSize, util.Int64ToBytes(1), os.ModePerm))
+	util.AssertNoError(t, os.Chtimes(orphanedSize, old, old))
+	packageFolder := storeFolder + "/manifests/foo"
+	util.AssertNoError(t, os.Mkdir(packageFolder+"/3", os.ModePerm))
+	util.AssertNoError(t, os.WriteFile(packageFolder+"/3/"+manifestFileName, []byte{}, os.ModePerm))
+	util.AssertNoError(t, os.Mkdir(packageFolder+"/tmp_4_old", os.ModePerm))
+	util.AssertNoError(t, os.Chtimes(packageFolder+"/tmp_4_old", old, old))
+	util.AssertNoError(t, os.Mkdir(packageFolder+"/tmp_4_new", os.ModePerm))
+	util.AssertNoError(t, writeVersionRecord(packageFolder+"/2/"+deletedFileName))
+	util.AssertNoError(t, writeVersionRecord(packageFolder+"/1/"+yankedFileName))
+
+	util.AssertNoError(t, os.WriteFile(packageFolder+"/tmp_tags", []byte{}, os.ModePerm))
+	util.AssertNoError(t, os.Chtimes(packageFolder+"/tmp_tags", old, old))
+
+	// Opening the store again only removes old temporary items
+	util.AssertNoError(t, store.Close())
+	store, err = New(storeFolder)
+	util.AssertNoError(t, err)
+	defer store.Close()
+	util.Assert(t, !util.FolderExists(packageFolder+"/tmp_4_old"))
+	util.Assert(t, !util.FileExists(packageFolder+"/tmp_tags"))
+	util.Assert(t, util.FolderExists(packageFolder+"/tmp_4_new"))
+	util.Assert(t, util.FolderExists(packageFolder+"/3"))
+	util.Assert(t, util.FileExists(packageFolder+"/2/"+manifestFileName))
+	util.Assert(t, util.FileExists(orphanedSize))
+
+	// The repair mode completes or rolls back everything else
+	util.AssertNoError(t, store.Close())
+	report, err := RepairStore(storeFolder)
+	util.AssertNoError(t, err)
+	issues := make(map[string]string)
+	for _, issue := range report.Issues {
+		issues[issue.Type] = issue.Action
+	}
+	util.Assert(t, issues[IssueMissingSize] == ActionRestored)
+	util.Assert(t, issues[IssueOrphanedSize] == ActionRemoved)
+	util.Assert(t, issues[IssueIncompleteVersion] == ActionMarkedAsDeleted)
+	util.Assert(t, issues[IssueIncompleteDeletion] == ActionRemoved)
+	util.Assert(t, reflect.DeepEqual(report.DeletedVersions, []PrunedVersion{{"foo", 3}}))
+	store, err = New(storeFolder)
+	util.AssertNoError(t, err)
+	defer store.Close()
+	found, err := store.GetObject(object.Hash)
+	util.AssertNoError(t, err)
+	util.Assert(t, found.Size == object.Size)
+	util.Assert(t, !util.FileExists(orphanedSize))
+	util.Assert(t, !util.FileExists(packageFolder+"/2/"+manifestFileName))
+	versions, err := store.GetVersions("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(versions, []uint{1}))
+	yanked, err := store.IsYanked("foo", 1)
+	util.AssertNoError(t, err)
+	util.Assert(t, yanked)
+
+	// Temporary folders and incomplete versions do not cause reused version numbers
+	manifest := bdm.Manifest{ManifestVersion: 1, PackageName: "foo", Files: []bdm.File{
+		{Path: "file3", Object: *object},
+	}}
+	manifest.Hash = bdm.HashManifest(&manifest)
+	util.AssertNoError(t, store.PublishManifest(&manifest))
+	util.Assert(t, manifest.PackageVersion == 4)
+	util.AssertNoError(t, store.Close())
+	util.AssertNoError(t, RebuildIndex(storeFolder))
+	_, err = ValidateStore(store)
+	util.AssertNoError(t, err)
+}
+
+func TestValidateStoreWithOptions(t *testing.T) {
+	const checkpointFile = "./checkpoint.json"
+	defer os.RemoveAll(storeFolder)
+	defer os.Remove(checkpointFile)
+	store, err := New(storeFolder)
+	util.AssertNoError(t, err)
+	defer store.Close()
+
+	objects := make([]*bdm.Object, 0)
+	files := make([]bdm.File, 0)
+	for i := 0; i < 10; i++ {
+		object, err := store.AddObject(bytes.NewReader([]byte{byte(i), 1, 2, 3}))
+		util.AssertNoError(t, err)
+		objects = append(objects, object)
+		files = append(files, bdm.File{Path: fmt.Sprintf("file%d", i), Object: *object})
+	}
+	manifest := bdm.Manifest{ManifestVersion: 1, PackageName: "foo", Files: files}
+	manifest.Hash = bdm.HashManifest(&manifest)
+	util.AssertNoError(t, store.PublishManifest(&manifest))
+
+	// Full validation with progress reports and a checkpoint
+	var last ValidateProgress
+	options := ValidateOptions{
+		Workers:        3,
+		CheckpointFile: checkpointFile,
+		Progress:       func(progress ValidateProgress) { last = progress },
+	}
+	stats, err := ValidateStoreWithOptions(store, options)
+	util.AssertNoError(t, err)
+	util.Assert(t, stats["objects"] == 10)
+	util.Assert(t, stats["skipped"] == 0)
+	util.Assert(t, last.Objects == 10 && last.Bytes == 40 && last.TotalBytes == 40)
+	checkpoint, err := readCheckpoint(checkpointFile)
+	util.AssertNoError(t, err)
+	util.Assert(t, checkpoint.Completed)
+	util.Assert(t, len(checkpoint.Verified) == 10)
+
+	// Recently verified objects are skipped
+	options.RecheckAfter = time.Hour
+	stats, err = ValidateStoreWithOptions(store, options)
+	util.AssertNoError(t, err)
+	util.Assert(t, stats["skipped"] == 10)
+
+	// An interrupted validation is resumed
+	checkpoint.Completed = false
+	checkpoint.Started = time.Now().Unix()
+	delete(checkpoint.Verified, objects[0].Hash)
+	delete(checkpoint.Verified, objects[1].Hash)
+	util.AssertNoError(t, writeCheckpoint(checkpointFile, checkpoint))
+	options.RecheckAfter = 0
+	stats, err = ValidateStoreWithOptions(store, options)
+	util.AssertNoError(t, err)
+	util.Assert(t, stats["skipped"] == 8)
+	util.Assert(t, last.Objects == 2)
+
+	// Corrupt objects are found and not marked as verified
+	objectPath := storeFolder + "/objects/" + getObjectPath(objects[5].Hash)
+	util.AssertNoError(t, os.WriteFile(objectPath, []byte{1, 2, 3}, os.ModePerm))
+	_, err = ValidateStoreWithOptions(store, ValidateOptions{CheckpointFile: checkpointFile})
+	util.AssertError(t, err)
+	checkpoint, err = readCheckpoint(checkpointFile)
+	util.AssertNoError(t, err)
+	util.Assert(t, !checkpoint.Completed)
+}
+
+func TestBundle(t *testing.T) {
+	defer os.RemoveAll(storeFolder)
+	source, err := New(storeFolder)
+	util.AssertNoError(t, err)
+	defer source.Close()
+
+	// Two versions sharing an object
+	object1, err := source.AddObject(bytes.NewReader([]byte{1, 2, 3}))
+	util.AssertNoError(t, err)
+	object2, err := source.AddObject(bytes.NewReader([]byte{4, 5, 6, 7}))
+	util.AssertNoError(t, err)
+	manifest1 := bdm.Manifest{ManifestVersion: 1, PackageName: "foo", Files: []bdm.File{
+		{Path: "a", Object: *object1},
+	}}
+	manifest1.Hash = bdm.HashManifest(&manifest1)
+	util.AssertNoError(t, source.PublishManifest(&manifest1))
+	manifest2 := bdm.Manifest{ManifestVersion: 1, PackageName: "foo", Files: []bdm.File{
+		{Path: "a", Object: *object1}, {Path: "b", Object: *object2},
+	}}
+	manifest2.Hash = bdm.HashManifest(&manifest2)
+	util.AssertNoError(t, source.PublishManifest(&manifest2))
+	util.AssertNoError(t, source.YankManifest("foo", 1, true))
+
+	var bundle bytes.Buffer
+	err = ExportBundle(source, []*bdm.Manifest{&manifest1, &manifest2}, &bundle)
+	util.AssertNoError(t, err)
+
+	// Objects already existing in the target are skipped
+	target := NewMemory()
+	_, err = target.AddObject(bytes.NewReader([]byte{1, 2, 3}))
+	util.AssertNoError(t, err)
+	result, err := ImportBundle(target, bytes.NewReader(bundle.Bytes()))
+	util.AssertNoError(t, err)
+	util.Assert(t, *result == ImportResult{Manifests: 2, Objects: 1, SkippedObjects: 1})
+
+	// Versions, hashes and yanked state are preserved
+	imported, err := target.GetManifest("foo", 2)
+	util.AssertNoError(t, err)
+	util.Assert(t, imported.Hash == manifest2.Hash)
+	yanked, err := target.IsYanked("foo", 1)
+	util.AssertNoError(t, err)
+	util.Assert(t, yanked)
+	_, err = ValidateStore(target)
+	util.AssertNoError(t, err)
+
+	// Importing again changes nothing
+	result, err = ImportBundle(target, bytes.NewReader(bundle.Bytes()))
+	util.AssertNoError(t, err)
+	util.Assert(t, *result == ImportResult{SkippedManifests: 2, SkippedObjects: 2})
+
+	// Versions deleted in the target are skipped and not restored
+	util.AssertNoError(t, target.DeleteManifest("foo", 2))
+	result, err = ImportBundle(target, bytes.NewReader(bundle.Bytes()))
+	util.AssertNoError(t, err)
+	util.Assert(t, *result == ImportResult{SkippedManifests: 1, DeletedManifests: 1, SkippedObjects: 2})
+	versions, err := target.GetVersions("foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(versions, []uint{1}))
+
+	// Truncated bundles are rejected without adding any manifests
+	target = NewMemory()
+	_, err = ImportBundle(target, bytes.NewReader(bundle.Bytes()[:bundle.Len()/2]))
+	util.AssertError(t, err)
+	names, err := target.GetNames()
+	util.AssertNoError(t, err)
+	util.Assert(t, len(names) == 0)
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	const policyFile = "./retention.json"
+	defer os.RemoveAll(storeFolder)
+	defer os.Remove(policyFile)
+	store, err := New(storeFolder)
+	util.AssertNoError(t, err)
+	defer store.Close()
+
+	// Five versions with unique objects and one version of another package
+	for i := 0; i < 5; i++ {
+		object, err := store.AddObject(bytes.NewReader([]byte{byte(i)}))
+		util.AssertNoError(t, err)
+		manifest := bdm.Manifest{ManifestVersion: 1, PackageName: "ci-foo", Files: []bdm.File{{Path: "a", Object: *object}}}
+		manifest.Hash = bdm.HashManifest(&manifest)
+		util.AssertNoError(t, store.PublishManifest(&manifest))
+	}
+	object, err := store.AddObject(bytes.NewReader([]byte{1, 2, 3}))
+	util.AssertNoError(t, err)
+	manifest := bdm.Manifest{ManifestVersion: 1, PackageName: "other", Files: []bdm.File{{Path: "b", Object: *object}}}
+	manifest.Hash = bdm.HashManifest(&manifest)
+	util.AssertNoError(t, store.PublishManifest(&manifest))
+
+	// Invalid policies are rejected
+	os.WriteFile(policyFile, []byte(`{"Rules":[{"Pattern":"ci-*"}]}`), os.ModePerm)
+	_, err = ReadRetentionPolicy(policyFile)
+	util.AssertError(t, err)
+	os.WriteFile(policyFile, []byte(`{"Rules":[{"Pattern":"[","KeepLast":1}]}`), os.ModePerm)
+	_, err = ReadRetentionPolicy(policyFile)
+	util.AssertError(t, err)
+
+	// Recently published versions are kept
+	policy := RetentionPolicy{Rules: []RetentionRule{{Pattern: "ci-*", KeepLast: 2, KeepDays: 1}}}
+	pruned, err := ApplyRetentionPolicy(store, &policy, false)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(pruned) == 0)
+
+	// Tagged versions are kept, removed tags do not protect their last version
+	util.AssertNoError(t, store.SetTag("ci-foo", "stable", 3, "admin"))
+	util.AssertNoError(t, store.SetTag("ci-foo", "old", 2, "admin"))
+	util.AssertNoError(t, store.SetTag("ci-foo", "old", 0, "admin"))
+
+	// Dry run does not delete anything
+	os.WriteFile(policyFile, []byte(`{"Rules":[{"Pattern":"ci-*","KeepLast":2,"KeepVersions":[1]}]}`), os.ModePerm)
+	policy2, err := ReadRetentionPolicy(policyFile)
+	util.AssertNoError(t, err)
+	pruned, err = ApplyRetentionPolicy(store, policy2, true)
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(pruned, []PrunedVersion{{"ci-foo", 2}}))
+	versions, err := store.GetVersions("ci-foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, len(versions) == 5)
+
+	// Pruned versions are deleted and their objects are collected
+	pruned, err = ApplyRetentionPolicy(store, policy2, false)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(pruned) == 1)
+	versions, err = store.GetVersions("ci-foo")
+	util.AssertNoError(t, err)
+	util.Assert(t, reflect.DeepEqual(versions, []uint{1, 3, 4, 5}))
+	versions, err = store.GetVersions("other")
+	util.AssertNoError(t, err)
+	util.Assert(t, len(versions) == 1)
+	stats, err := CollectGarbage(store, 0)
+	util.AssertNoError(t, err)
+	util.Assert(t, stats["removed"] == 1)
+}
+
+func TestStoreStats(t *testing.T) {
+	defer os.RemoveAll(storeFolder)
+	store, err := New(storeFolder)
+	util.AssertNoError(t, err)
+	defer store.Close()
+
+	stats, err := GetStoreStats(store)
+	util.AssertNoError(t, err)
+	util.Assert(t, stats.Objects == 0 && len(stats.Packages) == 0 && stats.DedupRatio == 0)
+
+	// Package foo has two versions with a shared object and bar shares one object with foo
+	shared, err := store.AddObject(bytes.NewReader(make([]byte, 1000)))
+	util.AssertNoError(t, err)
+	unique, err := store.AddObject(bytes.NewReader([]byte{1, 2, 3}))
+	util.AssertNoError(t, err)
+	other, err := store.AddObject(bytes.NewReader([]byte{4, 5}))
+	util.AssertNoError(t, err)
+	publish := func(name string, files ...bdm.File) {
+		manifest := bdm.Manifest{ManifestVersion: 1, PackageName: name, Files: files}
+		manifest.Hash = bdm.HashManifest(&manifest)
+		util.AssertNoError(t, store.PublishManifest(&manifest))
+	}
+	publish("foo", bdm.File{Path: "a", Object: *shared})
+	publish("foo", bdm.File{Path: "a", Object: *shared}, bdm.File{Path: "b", Object: *unique})
+	publish("bar", bdm.File{Path: "c", Object: *shared}, bdm.File{Path: "d", Object: *other})
+
+	stats, err = GetStoreStats(store)
+	util.AssertNoError(t, err)
+	util.Assert(t, stats.Versions == 3)
+	util.Assert(t, stats.Objects == 3)
+	util.Assert(t, stats.ObjectsSize == 1005)
+	util.Assert(t, stats.LogicalSize == 3005)
+	util.Assert(t, stats.CompressedSize > 0 && stats.CompressedSize < stats.ObjectsSize)
+	util.Assert(t, stats.RawObjects == 2)
+	util.Assert(t, stats.DedupRatio > 2.9 && stats.DedupRatio < 3)
+	util.Assert(t, reflect.DeepEqual(stats.Packages, []PackageStats{
+		{Name: "bar", Versions: 1, LogicalSize: 1002, UniqueSize: 2},
+		{Name: "foo", Versions: 2, LogicalSize: 2003, UniqueSize: 3},
+	}))
+
+	// Versions and objects removed while the statistics are calculated are skipped
+	stats, err = GetStoreStats(&racingStore{Store: store, t: t, object: other.Hash})
+	util.AssertNoError(t, err)
+	util.Assert(t, stats.Versions == 2)
+	util.Assert(t, stats.Objects == 2)
+	util.Assert(t, stats.ObjectsSize == 1003)
+}
+
+// Deletes a version and removes an object right after listing them
+type racingStore struct {
+	Store
+	t      *testing.T
+	object string
+}
+
+func (s *racingStore) GetVersions(packageName string) ([]uint, error) {
+	versions, err := s.Store.GetVersions(packageName)
+	if packageName == "foo" {
+		util.AssertNoError(s.t, s.Store.DeleteManifest(packageName, versions[0]))
+	}
+	return versions, err
+}
+
+func (s *racingStore) GetObjects() ([]*bdm.Object, error) {
+	objects, err := s.Store.GetObjects()
+	if len(s.object) > 0 {
+		removed, removeErr := s.Store.RemoveObject(s.object, time.Now().Add(time.Hour))
+		util.AssertNoError(s.t, removeErr)
+		util.Assert(s.t, removed)
+		s.object = ""
+	}
+	return objects, err
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	defer os.RemoveAll(storeFolder)
+	store, err := NewWithOptions(storeFolder, Options{Compression: util.CompressionFastest})
+	util.AssertNoError(t, err)
+	defer store.Close()
+
+	readStored := func(store Store, data []byte) *StoredObject {
+		object, err := store.AddObject(bytes.NewReader(data))
+		util.AssertNoError(t, err)
+		util.Assert(t, object.Size == int64(len(data)))
+		reader, err := store.ReadObject(object.Hash)
+		util.AssertNoError(t, err)
+		readData, err := io.ReadAll(reader)
+		reader.Close()
+		util.AssertNoError(t, err)
+		util.Assert(t, bytes.Equal(readData, data))
+		stored, err := store.ReadStoredObject(object.Hash)
+		util.AssertNoError(t, err)
+		stored.Close()
+		return stored
+	}
+
+	// Random data is bigger than the sample and not compressible
+	random := make([]byte, 3*objectFrameSize/2)
+	for i := range random {
+		random[i] = byte(rand.Intn(256))
+	}
+	stored := readStored(store, random)
+	util.Assert(t, stored.Format == FormatRaw)
+	util.Assert(t, stored.Size == int64(len(random)))
+
+	// Compressible data is split into independent frames
+	compressible := bytes.Repeat([]byte("compressible"), objectFrameSize/4)
+	stored = readStored(store, compressible)
+	util.Assert(t, stored.Format == FormatZstd)
+	util.Assert(t, stored.Size < int64(len(compressible)/10))
+	_, err = ValidateStore(store)
+	util.AssertNoError(t, err)
+
+	// ZSTD objects keep the old size files without format byte
+	object, err := store.AddObject(bytes.NewReader(make([]byte, 1000)))
+	util.AssertNoError(t, err)
+	infoPath := storeFolder + "/objects/" + getObjectPath(object.Hash) + sizeSuffix
+	infoBytes, err := os.ReadFile(infoPath)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(infoBytes) == 8)
+	_, format, err := readObjectInfo(infoPath)
+	util.AssertNoError(t, err)
+	util.Assert(t, format == FormatZstd)
+
+	// Repair restores the size file of raw objects with the right format
+	object, err = store.AddObject(bytes.NewReader([]byte{1, 2, 3}))
+	util.AssertNoError(t, err)
+	infoPath = storeFolder + "/objects/" + getObjectPath(object.Hash) + sizeSuffix
+	util.AssertNoError(t, os.Remove(infoPath))
+	util.AssertNoError(t, store.Close())
+	report, err := RepairStore(storeFolder)
+	util.AssertNoError(t, err)
+	util.Assert(t, len(report.Issues) == 1 && report.Issues[0].Type == IssueMissingSize)
+	size, format, err := readObjectInfo(infoPath)
+	util.AssertNoError(t, err)
+	util.Assert(t, size == 3 && format == FormatRaw)
+
+	// Compression can be disabled completely
+	util.AssertNoError(t, store.Close())
+	os.RemoveAll(storeFolder)
+	store, err = NewWithOptions(storeFolder, Options{Compression: util.CompressionNone})
+	util.AssertNoError(t, err)
+	defer store.Close()
+	stored = readStored(store, compressible)
+	util.Assert(t, stored.Format == FormatRaw)
+}
+
+func TestReadObjectAt(t *testing.T) {
+	defer os.RemoveAll(storeFolder)
+	store, err := New(storeFolder)
+	util.AssertNoError(t, err)
+	defer store.Close()
+
+	checkReadAt := func(hash string, data []byte, offset int64) {
+		t.Helper()
+		reader, err := store.ReadObjectAt(hash, offset)
+		util.AssertNoError(t, err)
+		defer reader.Close()
+		readData, err := io.ReadAll(reader)
+		util.AssertNoError(t, err)
+		util.Assert(t, bytes.Equal(readData, data[offset:]))
+	}
+
+	// Compressible objects consist of multiple frames with a seek table
+	compressible := make([]byte, 3*objectFrameSize+1234)
+	for i := range compressible {
+		compressible[i] = byte(i / 1000)
+	}
+	object, err := store.AddObject(bytes.NewReader(compressible))
+	util.AssertNoError(t, err)
+	for _, offset := range []int64{0, 1, objectFrameSize - 1, objectFrameSize, 2*objectFrameSize + 5, int64(len(compressible))} {
+		checkReadAt(object.Hash, compressible, offset)
+	}
+	_, err = store.ReadObjectAt(object.Hash, int64(len(compressible))+1)
+	util.AssertError(t, err)
+
+	// Older objects without seek table are decoded from the start
+	objectPath := storeFolder + "/objects/" + getObjectPath(object.Hash)
+	var oldData bytes.Buffer
+	writer, err := util.CreateCompressingWriter(&oldData)
+	util.AssertNoError(t, err)
+	writer.Write(compressible)
+	util.AssertNoError(t, writer.Close())
+	util.AssertNoError(t, os.WriteFile(objectPath, oldData.Bytes(), os.ModePerm))
+	checkReadAt(object.Hash, compressible, 2*objectFrameSize+5)
+
+	// Raw objects
+	raw := []byte{1, 2, 3, 4, 5}
+	rawObject, err := store.AddObject(bytes.NewReader(raw))
+	util.AssertNoError(t, err)
+	checkReadAt(rawObject.Hash, raw, 2)
+	checkReadAt(rawObject.Hash, raw, 5)
+
+	// Chunked files skip all chunks before the offset
+	file := bdm.File{Path: "file", Chunks: []bdm.Object{*rawObject, *object}}
+	reader := ReadFileAt(store, &file, 7)
+	readData, err := io.ReadAll(reader)
+	reader.Close()
+	util.AssertNoError(t, err)
+	util.Assert(t, bytes.Equal(readData, compressible[2:]))
+}
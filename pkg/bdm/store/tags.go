@@ -0,0 +1,109 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+)
+
+const tagsFileName = "tags.json"
+
+// MaxTagHistory is the number of changes that are kept per tag
+const MaxTagHistory = 100
+
+// Tag is a named and movable reference to a version of a package
+type Tag struct {
+	Name string
+	// Current version of the tag, zero if the tag was removed
+	Version uint
+	// Changes of the tag with the oldest change first, the last change is the current state
+	History []TagChange
+}
+
+// TagChange records that a tag was moved to a version or removed
+type TagChange struct {
+	// New version of the tag, zero if the tag was removed
+	Version uint
+	Time    int64
+	// Name of the user or ID of the token that changed the tag
+	User string `json:",omitempty"`
+}
+
+// Adds a change to the tags of a package and returns the modified tags sorted by name.
+// The target version must exist, version zero removes the tag.
+func changeTag(tags []Tag, tagName string, version uint, user string) ([]Tag, error) {
+	if !bdm.ValidateTagName(tagName) {
+		return nil, fmt.Errorf("invalid tag name %s", tagName)
+	}
+
+	var tag *Tag
+	for i := range tags {
+		if tags[i].Name == tagName {
+			tag = &tags[i]
+		}
+	}
+	if tag == nil {
+		if version == 0 {
+			return nil, fmt.Errorf("tag %s does not exist", tagName)
+		}
+		tags = append(tags, Tag{Name: tagName})
+		tag = &tags[len(tags)-1]
+	} else if version == 0 && tag.Version == 0 {
+		return nil, fmt.Errorf("tag %s was already removed", tagName)
+	}
+
+	tag.Version = version
+	tag.History = append(tag.History, TagChange{Version: version, Time: time.Now().Unix(), User: user})
+	if len(tag.History) > MaxTagHistory {
+		tag.History = tag.History[len(tag.History)-MaxTagHistory:]
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+	return tags, nil
+}
+
+// Decodes the content of a tags file, missing files have no data and no tags
+func unmarshalTags(jsonData []byte) ([]Tag, error) {
+	tags := make([]Tag, 0)
+	if len(jsonData) == 0 {
+		return tags, nil
+	}
+	err := json.Unmarshal(jsonData, &tags)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling tags JSON: %w", err)
+	}
+	return tags, nil
+}
+
+// ResolveTag returns the current version of a tag.
+// Tags that were removed or point to deleted versions cannot be resolved.
+func ResolveTag(store Store, packageName, tagName string) (uint, error) {
+	tags, err := store.GetTags(packageName)
+	if err != nil {
+		return 0, fmt.Errorf("error getting tags of package %s: %w", packageName, err)
+	}
+	for _, tag := range tags {
+		if tag.Name != tagName {
+			continue
+		}
+		if tag.Version == 0 {
+			return 0, fmt.Errorf("tag %s of package %s was removed", tagName, packageName)
+		}
+		versions, err := store.GetVersions(packageName)
+		if err != nil {
+			return 0, fmt.Errorf("error getting versions of package %s: %w", packageName, err)
+		}
+		for _, version := range versions {
+			if version == tag.Version {
+				return version, nil
+			}
+		}
+		return 0, fmt.Errorf("tag %s of package %s points to deleted version %d", tagName, packageName, tag.Version)
+	}
+	return 0, fmt.Errorf("tag %s of package %s does not exist", tagName, packageName)
+}
@@ -0,0 +1,302 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/cry-inc/bdm/pkg/bdm"
+	"github.com/cry-inc/bdm/pkg/bdm/util"
+)
+
+// ValidateOptions control how ValidateStoreWithOptions checks the objects
+type ValidateOptions struct {
+	// Number of objects checked in parallel, zero means number of CPUs
+	Workers int
+	// Optional callback for progress reports
+	Progress func(progress ValidateProgress)
+	// Interval for progress reports and checkpoint updates, zero means 10 seconds
+	ProgressInterval time.Duration
+	// Optional JSON file that records verified objects to resume an interrupted validation
+	CheckpointFile string
+	// Objects verified within this duration are not checked again, requires a checkpoint file
+	RecheckAfter time.Duration
+}
+
+// ValidateProgress describes the progress of a running validation
+type ValidateProgress struct {
+	Objects      int64
+	TotalObjects int64
+	Bytes        int64
+	TotalBytes   int64
+	Skipped      int64
+	Elapsed      time.Duration
+	// Estimated remaining time, zero if it is not yet known
+	Remaining time.Duration
+}
+
+// Persistent state of a validation run
+type validateCheckpoint struct {
+	Started   int64
+	Completed bool
+	// Maps object hashes to the Unix time of their last successful verification
+	Verified map[string]int64
+}
+
+func checkObject(store Store, object *bdm.Object) error {
+	reader, err := store.ReadObject(object.Hash)
+	if err != nil {
+		return fmt.Errorf("error reading object %s: %w", object.Hash, err)
+	}
+	defer reader.Close()
+
+	hasher := util.CreateHasher()
+	read, err := io.Copy(hasher, reader)
+	if err != nil {
+		return fmt.Errorf("error hashing object %s: %w", object.Hash, err)
+	}
+	if read != object.Size {
+		return fmt.Errorf("found size mismatch for object %s: expected %d but read %d bytes",
+			object.Hash, object.Size, read)
+	}
+
+	hash := util.GetHashString(hasher)
+	if hash != object.Hash {
+		return fmt.Errorf("found hash mismatch for object %s: expected %s but found %s",
+			object.Hash, object.Hash, hash)
+	}
+
+	return nil
+}
+
+func readCheckpoint(checkpointFile string) (*validateCheckpoint, error) {
+	checkpoint := validateCheckpoint{Verified: make(map[string]int64)}
+	if len(checkpointFile) == 0 || !util.FileExists(checkpointFile) {
+		return &checkpoint, nil
+	}
+
+	jsonData, err := os.ReadFile(checkpointFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading checkpoint file %s: %w", checkpointFile, err)
+	}
+	err = json.Unmarshal(jsonData, &checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling checkpoint JSON: %w", err)
+	}
+	if checkpoint.Verified == nil {
+		checkpoint.Verified = make(map[string]int64)
+	}
+
+	return &checkpoint, nil
+}
+
+// Writes the checkpoint into a temporary file first to never leave a broken checkpoint behind
+func writeCheckpoint(checkpointFile string, checkpoint *validateCheckpoint) error {
+	jsonData, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("error marshalling checkpoint to JSON: %w", err)
+	}
+	tempFile := checkpointFile + ".tmp"
+	err = os.WriteFile(tempFile, jsonData, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("error writing checkpoint file %s: %w", tempFile, err)
+	}
+	err = os.Rename(tempFile, checkpointFile)
+	if err != nil {
+		return fmt.Errorf("error renaming checkpoint file %s: %w", tempFile, err)
+	}
+	return nil
+}
+
+// ValidateStore validates the whole package store.
+// It will validate all manifests,
+// check that all the objects of all manifests exist and
+// check that all objects are valid and produce the correct hash.
+// It also returns a map with some simple store statistics.
+func ValidateStore(store Store) (map[string]int64, error) {
+	return ValidateStoreWithOptions(store, ValidateOptions{})
+}
+
+// ValidateStoreWithOptions is ValidateStore with parallel object checks, progress reports
+// and an optional checkpoint file. When the previous validation with the same checkpoint file
+// was interrupted, it is resumed and the objects verified by it are skipped.
+func ValidateStoreWithOptions(store Store, options ValidateOptions) (map[string]int64, error) {
+	if options.Workers <= 0 {
+		options.Workers = runtime.NumCPU()
+	}
+	if options.ProgressInterval <= 0 {
+		options.ProgressInterval = 10 * time.Second
+	}
+
+	manifests, err := getAllManifests(store)
+	if err != nil {
+		return nil, fmt.Errorf("error listing all manifests: %w", err)
+	}
+
+	// Validate all manifests
+	for _, manifest := range manifests {
+		err = bdm.ValidatePublishedManifest(manifest)
+		if err != nil {
+			return nil, fmt.Errorf("error validating published manifest %s version %d: %w",
+				manifest.PackageName, manifest.PackageVersion, err)
+		}
+	}
+
+	// Get all object metadata
+	objects, err := store.GetObjects()
+	if err != nil {
+		return nil, fmt.Errorf("error getting objects list from store: %w", err)
+	}
+
+	// Build map[hash]object for fast lookup
+	// and use the loop to also sum up overall size
+	objectsMap := make(map[string]*bdm.Object)
+	var objectsSize int64 = 0
+	for _, object := range objects {
+		objectsMap[object.Hash] = object
+		objectsSize += object.Size
+	}
+
+	// Check if all objects for all manifests exist
+	for _, manifest := range manifests {
+		for _, file := range manifest.Files {
+			for _, object := range bdm.GetFileObjects(&file) {
+				if _, ok := objectsMap[object.Hash]; !ok {
+					return nil, fmt.Errorf("unable to find object %s from package %s version %d",
+						object.Hash, manifest.PackageName, manifest.PackageVersion)
+				}
+			}
+		}
+	}
+
+	checkpoint, err := readCheckpoint(options.CheckpointFile)
+	if err != nil {
+		return nil, err
+	}
+	resumed := !checkpoint.Completed && checkpoint.Started != 0
+	if !resumed {
+		// Start a new run, the results of older runs are only used for the recheck interval
+		checkpoint.Started = time.Now().Unix()
+		checkpoint.Completed = false
+	}
+
+	// Select the objects that need to be checked
+	var recheckTime int64 = 0
+	if options.RecheckAfter > 0 {
+		recheckTime = time.Now().Add(-options.RecheckAfter).Unix()
+	}
+	pending := make([]*bdm.Object, 0)
+	progress := ValidateProgress{TotalObjects: int64(len(objects))}
+	for _, object := range objects {
+		verified, found := checkpoint.Verified[object.Hash]
+		resumeSkip := resumed && verified >= checkpoint.Started
+		recheckSkip := recheckTime > 0 && verified >= recheckTime
+		if found && (resumeSkip || recheckSkip) {
+			progress.Skipped++
+			continue
+		}
+		pending = append(pending, object)
+		progress.TotalBytes += object.Size
+	}
+	progress.TotalObjects -= progress.Skipped
+
+	// Check all object data for consistency using a pool of workers
+	var mutex sync.Mutex
+	var firstErr error
+	started := time.Now()
+	jobs := make(chan *bdm.Object)
+	var workers sync.WaitGroup
+	for i := 0; i < options.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for object := range jobs {
+				err := checkObject(store, object)
+				mutex.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("found problem while checking object: %w", err)
+				} else if err == nil {
+					checkpoint.Verified[object.Hash] = time.Now().Unix()
+					progress.Objects++
+					progress.Bytes += object.Size
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	report := func() error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		progress.Elapsed = time.Since(started)
+		if progress.Bytes > 0 {
+			remainingBytes := float64(progress.TotalBytes - progress.Bytes)
+			progress.Remaining = time.Duration(float64(progress.Elapsed) * remainingBytes / float64(progress.Bytes))
+		}
+		if options.Progress != nil {
+			options.Progress(progress)
+		}
+		if len(options.CheckpointFile) > 0 {
+			return writeCheckpoint(options.CheckpointFile, checkpoint)
+		}
+		return nil
+	}
+
+	stopReports := make(chan bool)
+	reportsStopped := make(chan error)
+	go func() {
+		ticker := time.NewTicker(options.ProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := report()
+				if err != nil {
+					reportsStopped <- err
+					return
+				}
+			case <-stopReports:
+				reportsStopped <- nil
+				return
+			}
+		}
+	}()
+
+	for _, object := range pending {
+		mutex.Lock()
+		failed := firstErr != nil
+		mutex.Unlock()
+		if failed {
+			break
+		}
+		jobs <- object
+	}
+	close(jobs)
+	workers.Wait()
+	close(stopReports)
+	reportErr := <-reportsStopped
+
+	checkpoint.Completed = firstErr == nil
+	err = report()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if reportErr != nil {
+		return nil, fmt.Errorf("error writing checkpoint: %w", reportErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error writing checkpoint: %w", err)
+	}
+
+	stats := make(map[string]int64)
+	stats["packages"] = int64(len(manifests))
+	stats["objects"] = int64(len(objects))
+	stats["size"] = objectsSize
+	stats["skipped"] = progress.Skipped
+
+	return stats, nil
+}
@@ -0,0 +1,74 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ChunkMinSize is the minimal size of content-defined chunks, only the last chunk can be smaller
+const ChunkMinSize = 256 * 1024
+
+// ChunkMaxSize is the maximal size of content-defined chunks
+const ChunkMaxSize = 4 * 1024 * 1024
+
+// Selects the upper 20 bits of the rolling hash for an average chunk size of about 1 MB
+const chunkMask = uint64(0xFFFFF) << 44
+
+// Lookup table for the gear rolling hash.
+// The values must never change since they define the chunk boundaries!
+var gearTable = createGearTable()
+
+func createGearTable() [256]uint64 {
+	var table [256]uint64
+	// Deterministic splitmix64 sequence with a fixed seed
+	state := uint64(0x6264)
+	for i := range table {
+		state += 0x9E3779B97F4A7C15
+		value := state
+		value = (value ^ (value >> 30)) * 0xBF58476D1CE4E5B9
+		value = (value ^ (value >> 27)) * 0x94D049BB133111EB
+		table[i] = value ^ (value >> 31)
+	}
+	return table
+}
+
+// Returns the length of the next chunk at the start of the data
+func findChunkBoundary(data []byte) int {
+	if len(data) <= ChunkMinSize {
+		return len(data)
+	}
+	var hash uint64 = 0
+	for i := ChunkMinSize; i < len(data); i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// SplitChunks splits the data of a reader into content-defined chunks using a gear rolling hash.
+// Identical content produces identical chunks, even if data was inserted or removed before it.
+// The callback is called for every chunk, the data slice is only valid during the call.
+func SplitChunks(reader io.Reader, callback func(data []byte) error) error {
+	buffer := make([]byte, ChunkMaxSize)
+	filled := 0
+	for {
+		read, err := io.ReadFull(reader, buffer[filled:])
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("error reading data for chunking: %w", err)
+		}
+		filled += read
+		if filled == 0 {
+			return nil
+		}
+
+		length := findChunkBoundary(buffer[:filled])
+		err = callback(buffer[:length])
+		if err != nil {
+			return err
+		}
+		filled = copy(buffer, buffer[length:filled])
+	}
+}
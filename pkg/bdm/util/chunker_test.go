@@ -0,0 +1,53 @@
+package util
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func splitTestData(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	chunks := make([][]byte, 0)
+	err := SplitChunks(bytes.NewReader(data), func(chunk []byte) error {
+		chunks = append(chunks, bytes.Clone(chunk))
+		return nil
+	})
+	AssertNoError(t, err)
+	return chunks
+}
+
+func TestSplitChunks(t *testing.T) {
+	// Empty input has no chunks
+	chunks := splitTestData(t, []byte{})
+	Assert(t, len(chunks) == 0)
+
+	// Small input is a single chunk
+	chunks = splitTestData(t, []byte{1, 2, 3})
+	Assert(t, len(chunks) == 1)
+
+	data := make([]byte, 20*1024*1024)
+	rand.New(rand.NewSource(42)).Read(data)
+	chunks = splitTestData(t, data)
+	Assert(t, len(chunks) > 5)
+	Assert(t, bytes.Equal(bytes.Join(chunks, nil), data))
+	for i, chunk := range chunks {
+		Assert(t, len(chunk) <= ChunkMaxSize)
+		Assert(t, len(chunk) >= ChunkMinSize || i == len(chunks)-1)
+	}
+
+	// Inserting data at the start must keep most of the following chunks
+	modified := append([]byte{1, 2, 3, 4, 5}, data...)
+	modifiedChunks := splitTestData(t, modified)
+	existing := make(map[string]bool)
+	for _, chunk := range chunks {
+		existing[string(chunk)] = true
+	}
+	reused := 0
+	for _, chunk := range modifiedChunks {
+		if existing[string(chunk)] {
+			reused++
+		}
+	}
+	Assert(t, reused >= len(chunks)-2)
+}
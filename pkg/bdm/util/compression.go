@@ -7,12 +7,94 @@ import (
 	"github.com/klauspost/compress/zstd"
 )
 
+// CompressionLevel selects the trade-off between speed and size for compressed objects
+type CompressionLevel int
+
+// Supported compression levels, the zero value is the default level
+const (
+	CompressionDefault CompressionLevel = iota
+	CompressionNone
+	CompressionFastest
+	CompressionBetter
+	CompressionBest
+)
+
+var compressionLevelNames = map[string]CompressionLevel{
+	"default": CompressionDefault,
+	"none":    CompressionNone,
+	"fastest": CompressionFastest,
+	"better":  CompressionBetter,
+	"best":    CompressionBest,
+}
+
+// ParseCompressionLevel returns the compression level for the names none, fastest, default, better and best
+func ParseCompressionLevel(name string) (CompressionLevel, error) {
+	level, found := compressionLevelNames[name]
+	if !found {
+		return CompressionDefault, fmt.Errorf("unknown compression level %s", name)
+	}
+	return level, nil
+}
+
+// CompressionNone has no ZSTD level, it is handled by the callers
+func getEncoderLevel(level CompressionLevel) zstd.EncoderLevel {
+	switch level {
+	case CompressionFastest:
+		return zstd.SpeedFastest
+	case CompressionBetter:
+		return zstd.SpeedBetterCompression
+	case CompressionBest:
+		return zstd.SpeedBestCompression
+	default:
+		return zstd.SpeedDefault
+	}
+}
+
 // CreateCompressingWriter returns a compressing writer
 func CreateCompressingWriter(writer io.Writer) (io.WriteCloser, error) {
-	options := zstd.WithEncoderLevel(zstd.SpeedDefault)
+	return CreateCompressingWriterWithLevel(writer, CompressionDefault)
+}
+
+// CreateCompressingWriterWithLevel returns a compressing writer with a specific compression level
+func CreateCompressingWriterWithLevel(writer io.Writer, level CompressionLevel) (io.WriteCloser, error) {
+	options := zstd.WithEncoderLevel(getEncoderLevel(level))
 	return zstd.NewWriter(writer, options)
 }
 
+// FrameEncoder compresses blocks of data into independent ZSTD frames
+type FrameEncoder struct {
+	encoder *zstd.Encoder
+}
+
+// CreateFrameEncoder returns an encoder for independent frames with a specific compression level
+func CreateFrameEncoder(level CompressionLevel) (*FrameEncoder, error) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(getEncoderLevel(level)))
+	if err != nil {
+		return nil, fmt.Errorf("error creating zstd encoder: %w", err)
+	}
+	return &FrameEncoder{encoder}, nil
+}
+
+// EncodeFrame appends a complete ZSTD frame with the compressed data to dst
+func (e *FrameEncoder) EncodeFrame(data, dst []byte) []byte {
+	return e.encoder.EncodeAll(data, dst)
+}
+
+// Close releases the resources of the encoder
+func (e *FrameEncoder) Close() error {
+	return e.encoder.Close()
+}
+
+// CompressData compresses a small block of data into a complete ZSTD frame
+func CompressData(data []byte, level CompressionLevel) ([]byte, error) {
+	encoder, err := CreateFrameEncoder(level)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+	return encoder.EncodeFrame(data, nil), nil
+}
+
 // CreateDecompressingReader returns a decompressing reader
 func CreateDecompressingReader(reader io.Reader) (io.ReadCloser, error) {
 	decoder, err := zstd.NewReader(reader)
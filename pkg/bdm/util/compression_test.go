@@ -1,6 +1,7 @@
 package util
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"testing"
@@ -38,3 +39,23 @@ func TestCompression(t *testing.T) {
 		Assert(t, readData[i] == testData[i])
 	}
 }
+
+func TestCompressionLevels(t *testing.T) {
+	level, err := ParseCompressionLevel("best")
+	AssertNoError(t, err)
+	Assert(t, level == CompressionBest)
+	_, err = ParseCompressionLevel("foo")
+	AssertError(t, err)
+
+	testData := make([]byte, 1000)
+	compressed, err := CompressData(testData, CompressionFastest)
+	AssertNoError(t, err)
+	Assert(t, len(compressed) < len(testData))
+
+	reader, err := CreateDecompressingReader(bytes.NewReader(compressed))
+	AssertNoError(t, err)
+	defer reader.Close()
+	readData, err := io.ReadAll(reader)
+	AssertNoError(t, err)
+	Assert(t, bytes.Equal(readData, testData))
+}
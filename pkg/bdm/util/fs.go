@@ -1,7 +1,10 @@
 package util
 
 import (
+	"fmt"
 	"os"
+	"path"
+	"runtime"
 )
 
 // FileExists will return true if path is a valid file
@@ -24,3 +27,54 @@ func FolderExists(path string) bool {
 	}
 	return stat.IsDir()
 }
+
+// WriteFileAtomic writes the data into a temporary file in the temp folder,
+// flushes it to disk and renames it to the final path.
+// Readers will either see the old file or the complete new file, even after a crash.
+// The temp folder must be on the same file system as the final path.
+func WriteFileAtomic(filePath, tempFolder string, data []byte) error {
+	tempFile, err := os.CreateTemp(tempFolder, "tmp_*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+	tempFileName := tempFile.Name()
+
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFileName)
+		return fmt.Errorf("error writing temporary file %s: %w", tempFileName, err)
+	}
+
+	err = os.Rename(tempFileName, filePath)
+	if err != nil {
+		os.Remove(tempFileName)
+		return fmt.Errorf("error renaming temporary file to %s: %w", filePath, err)
+	}
+
+	return SyncFolder(path.Dir(filePath))
+}
+
+// SyncFolder flushes the entries of a folder to disk to make renames and new files durable.
+// Does nothing on Windows, where folders cannot be synced.
+func SyncFolder(folder string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	handle, err := os.Open(folder)
+	if err != nil {
+		return fmt.Errorf("error opening folder %s: %w", folder, err)
+	}
+	defer handle.Close()
+	err = handle.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing folder %s: %w", folder, err)
+	}
+	return nil
+}
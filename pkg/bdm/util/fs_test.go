@@ -1,6 +1,7 @@
 package util
 
 import (
+	"os"
 	"testing"
 )
 
@@ -18,3 +19,26 @@ func TestFolderExists(t *testing.T) {
 	Assert(t, FolderExists(".."))
 	Assert(t, FolderExists("./"))
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	const folder = "atomic"
+	const file = folder + "/file"
+	AssertNoError(t, os.Mkdir(folder, os.ModePerm))
+	defer os.RemoveAll(folder)
+
+	AssertNoError(t, WriteFileAtomic(file, folder, []byte("foo")))
+	data, err := os.ReadFile(file)
+	AssertNoError(t, err)
+	AssertEqualString(t, "foo", string(data))
+
+	// Existing files are replaced and no temporary files are left behind
+	AssertNoError(t, WriteFileAtomic(file, folder, []byte("bar")))
+	data, err = os.ReadFile(file)
+	AssertNoError(t, err)
+	AssertEqualString(t, "bar", string(data))
+	items, err := os.ReadDir(folder)
+	AssertNoError(t, err)
+	Assert(t, len(items) == 1)
+
+	AssertError(t, WriteFileAtomic(file, "folderdoesnotexist", []byte("foo")))
+}